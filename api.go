@@ -0,0 +1,458 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"chatroom/hub"
+	"chatroom/models"
+	"chatroom/store"
+)
+
+// serveStats 以 JSON 形式返回消息存储的统计信息，便于运维了解存储增长情况。
+func serveStats(ms store.MessageStore, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "方法不被允许", http.StatusMethodNotAllowed)
+		return
+	}
+	stats, err := ms.Stats()
+	if err != nil {
+		log.Printf("获取消息统计失败: %v", err)
+		http.Error(w, "获取统计信息失败", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, stats)
+}
+
+// writeJSON 将 v 编码为 JSON 写入响应。
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("写入 JSON 响应失败: %v", err)
+	}
+}
+
+// defaultHistoryLimit 和 maxHistoryLimit 是 /history 的默认和最大返回条数。
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 500
+)
+
+// serveHistory 以 JSON 数组返回房间最近的历史消息。
+// 查询参数：room（为空时为默认房间）、limit、types（逗号分隔的消息类型，为空时返回所有类型）。
+func serveHistory(ms store.MessageStore, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "方法不被允许", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	room := query.Get("room")
+	if room == "" {
+		room = *defaultRoom
+	}
+	limit := defaultHistoryLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit 必须是正整数", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxHistoryLimit)
+	}
+	types := splitTypes(query.Get("types"))
+	if err := models.ValidateHistoryTypes(types); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	messages, err := ms.GetMessagesOfTypes(room, types, limit)
+	if err != nil {
+		log.Printf("获取历史消息失败: %v", err)
+		http.Error(w, "获取历史消息失败", http.StatusInternalServerError)
+		return
+	}
+	if messages == nil {
+		messages = []models.Message{} // 没有消息时返回空数组而不是 null
+	}
+	writeJSON(w, messages)
+}
+
+// serveUserHistory 以 JSON 数组返回指定用户最近发送的聊天消息（所有房间），需要管理令牌。
+// 查询参数：username（必填）、limit。普通用户通过 WebSocket 的 my_history 请求只能获取自己的消息。
+func serveUserHistory(ms store.MessageStore, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "方法不被允许", http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkAdminToken(r) {
+		http.Error(w, "未授权", http.StatusUnauthorized)
+		return
+	}
+	username := r.URL.Query().Get("username")
+	if models.UserKey(username) == "" {
+		http.Error(w, "缺少 username 参数", http.StatusBadRequest)
+		return
+	}
+	limit := defaultHistoryLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit 必须是正整数", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxHistoryLimit)
+	}
+	messages, err := ms.GetMessagesByUser(username, limit)
+	if err != nil {
+		log.Printf("获取用户 %s 的消息失败: %v", username, err)
+		http.Error(w, "获取历史消息失败", http.StatusInternalServerError)
+		return
+	}
+	if messages == nil {
+		messages = []models.Message{}
+	}
+	writeJSON(w, messages)
+}
+
+// serveUserRooms 以 JSON 数组返回用户最近活跃的房间，最近活跃的在前，需要管理令牌。
+func serveUserRooms(ms store.MessageStore, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "方法不被允许", http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkAdminToken(r) {
+		http.Error(w, "未授权", http.StatusUnauthorized)
+		return
+	}
+	username := r.URL.Query().Get("username")
+	if models.UserKey(username) == "" {
+		http.Error(w, "缺少 username 参数", http.StatusBadRequest)
+		return
+	}
+	limit := defaultHistoryLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit 必须是正整数", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, maxHistoryLimit)
+	}
+	rooms, err := ms.GetUserRooms(username, limit)
+	if err != nil {
+		log.Printf("获取用户 %s 的房间失败: %v", username, err)
+		http.Error(w, "获取用户房间失败", http.StatusInternalServerError)
+		return
+	}
+	if rooms == nil {
+		rooms = []store.UserRoom{}
+	}
+	writeJSON(w, rooms)
+}
+
+// serveOnline 以 JSON 数组返回当前在线用户列表，供面板和健康检查使用。
+func serveOnline(myHub *hub.Hub, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "方法不被允许", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, myHub.OnlineUsers())
+}
+
+// serveRooms 以 JSON 数组返回当前有人在线的房间及其在线人数。
+func serveRooms(myHub *hub.Hub, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "方法不被允许", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, myHub.Rooms())
+}
+
+// hubAliveTimeout 是就绪检查等待 Hub 主循环响应的最长时间。
+const hubAliveTimeout = time.Second
+
+// maxSaveFailStreak 是消息连续保存失败多少次后就绪检查返回 503，让运维及时发现存储故障。
+const maxSaveFailStreak = 5
+
+// serveHealthz 是存活检查：进程能处理请求即返回 200。
+func serveHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok"))
+}
+
+// serveReadyz 是就绪检查：数据库可用且 Hub 主循环在运行时返回 200，否则返回 503。
+func serveReadyz(myHub *hub.Hub, hc store.HealthChecker, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if hc != nil {
+		if err := hc.Ping(); err != nil {
+			log.Printf("就绪检查失败: %v", err)
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("database unavailable"))
+			return
+		}
+	}
+	if !myHub.Alive(hubAliveTimeout) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("hub not running"))
+		return
+	}
+	if saves := myHub.SaveStats(); saves.ConsecutiveFailures >= maxSaveFailStreak {
+		log.Printf("就绪检查失败: 消息已连续 %d 次保存失败，%d 条等待重试", saves.ConsecutiveFailures, saves.Pending)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("message store failing"))
+		return
+	}
+	w.Write([]byte("ready"))
+}
+
+// checkAdminToken 校验请求携带的管理令牌。
+// 令牌可以通过 "Authorization: Bearer <token>" 请求头或 token 查询参数提供；
+// 未配置 -admin-token 时所有请求都不通过。
+func checkAdminToken(r *http.Request) bool {
+	if *adminToken == "" {
+		return false
+	}
+	token := r.URL.Query().Get("token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(*adminToken)) == 1
+}
+
+// announceRequest 是 /api/announce 的请求体。
+type announceRequest struct {
+	Content string `json:"content"`
+}
+
+// serveAnnounce 向所有房间的在线用户广播一条系统公告，需要管理令牌。
+func serveAnnounce(myHub *hub.Hub, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "方法不被允许", http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkAdminToken(r) {
+		http.Error(w, "未授权", http.StatusUnauthorized)
+		return
+	}
+	var req announceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "请求体格式错误", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.Content) == "" {
+		http.Error(w, "公告内容不能为空", http.StatusBadRequest)
+		return
+	}
+	myHub.Announce(req.Content)
+	log.Printf("管理员发布公告: %s", req.Content)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// pinRequest 是 /api/pin 的请求体。
+type pinRequest struct {
+	MessageID int64 `json:"message_id"`
+	Pinned    bool  `json:"pinned"`
+}
+
+// servePin 置顶或取消置顶任意房间中的消息，需要管理令牌。
+func servePin(myHub *hub.Hub, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "方法不被允许", http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkAdminToken(r) {
+		http.Error(w, "未授权", http.StatusUnauthorized)
+		return
+	}
+	var req pinRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.MessageID <= 0 {
+		http.Error(w, "请求体格式错误", http.StatusBadRequest)
+		return
+	}
+	err := myHub.Pin(req.MessageID, req.Pinned)
+	if errors.Is(err, store.ErrMessageNotFound) {
+		http.Error(w, "消息不存在", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("管理员置顶消息 %d 失败: %v", req.MessageID, err)
+		http.Error(w, "置顶失败", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("管理员更新了消息 %d 的置顶状态: %v", req.MessageID, req.Pinned)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// kickAllFarewell 是清场时发送给被断开用户的告别公告。
+const kickAllFarewell = "管理员正在维护聊天室，你的连接已被断开。"
+
+// serveKickAll 断开指定房间（room 参数为空时为全部房间）的所有连接，需要管理令牌。
+func serveKickAll(myHub *hub.Hub, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "方法不被允许", http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkAdminToken(r) {
+		http.Error(w, "未授权", http.StatusUnauthorized)
+		return
+	}
+	room := r.URL.Query().Get("room")
+	kicked := myHub.KickAll(room, kickAllFarewell)
+	log.Printf("管理员清场 (房间: %q)，断开了 %d 个连接", room, kicked)
+	writeJSON(w, map[string]int{"kicked": kicked})
+}
+
+// banRequest 是 POST /api/bans 的请求体。Duration 使用 Go 的时长格式（例如 "30m"、"24h"），为空表示永久封禁。
+type banRequest struct {
+	Username string `json:"username"`
+	Duration string `json:"duration"`
+	Reason   string `json:"reason"`
+}
+
+// serveBans 列出当前生效的封禁（GET），或封禁一个用户名并断开其现有连接（POST），需要管理令牌。
+func serveBans(myHub *hub.Hub, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, "方法不被允许", http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkAdminToken(r) {
+		http.Error(w, "未授权", http.StatusUnauthorized)
+		return
+	}
+	if r.Method == "GET" {
+		bans, err := myHub.Bans()
+		if errors.Is(err, hub.ErrBansUnavailable) {
+			http.Error(w, "未启用持久化，不支持封禁", http.StatusNotImplemented)
+			return
+		}
+		if err != nil {
+			log.Printf("查询封禁名单失败: %v", err)
+			http.Error(w, "查询封禁名单失败", http.StatusInternalServerError)
+			return
+		}
+		if bans == nil {
+			bans = []store.Ban{}
+		}
+		writeJSON(w, bans)
+		return
+	}
+
+	var req banRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || models.UserKey(req.Username) == "" {
+		http.Error(w, "请求体格式错误", http.StatusBadRequest)
+		return
+	}
+	var duration time.Duration
+	if req.Duration != "" {
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil || d <= 0 {
+			http.Error(w, "duration 必须是正的时长，例如 \"30m\"", http.StatusBadRequest)
+			return
+		}
+		duration = d
+	}
+	kicked, err := myHub.Ban(req.Username, duration, req.Reason)
+	if errors.Is(err, hub.ErrBansUnavailable) {
+		http.Error(w, "未启用持久化，不支持封禁", http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		log.Printf("管理员封禁用户 %s 失败: %v", req.Username, err)
+		http.Error(w, "封禁失败", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("管理员封禁了用户 %s (期限: %q，原因: %q)，断开了 %d 个连接", req.Username, req.Duration, req.Reason, kicked)
+	writeJSON(w, map[string]int{"kicked": kicked})
+}
+
+// unbanRequest 是 /api/unban 的请求体。
+type unbanRequest struct {
+	Username string `json:"username"`
+}
+
+// serveUnban 解除用户名的封禁，需要管理令牌。
+func serveUnban(myHub *hub.Hub, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "方法不被允许", http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkAdminToken(r) {
+		http.Error(w, "未授权", http.StatusUnauthorized)
+		return
+	}
+	var req unbanRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || models.UserKey(req.Username) == "" {
+		http.Error(w, "请求体格式错误", http.StatusBadRequest)
+		return
+	}
+	err := myHub.Unban(req.Username)
+	if errors.Is(err, hub.ErrBansUnavailable) {
+		http.Error(w, "未启用持久化，不支持封禁", http.StatusNotImplemented)
+		return
+	}
+	if errors.Is(err, store.ErrNotBanned) {
+		http.Error(w, "该用户没有被封禁", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("管理员解除用户 %s 的封禁失败: %v", req.Username, err)
+		http.Error(w, "解除封禁失败", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("管理员解除了用户 %s 的封禁", req.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// queueState 描述 Hub 广播队列的状态。
+type queueState struct {
+	Length   int   `json:"length"`
+	Capacity int   `json:"capacity"`
+	Dropped  int64 `json:"dropped"`
+}
+
+// debugState 是 /debug 的响应体。
+type debugState struct {
+	Goroutines  int              `json:"goroutines"`
+	Connections int              `json:"connections"`
+	Saves       hub.SaveStats    `json:"saves"`
+	Queue       queueState       `json:"broadcast_queue"`
+	Clients     []hub.ClientInfo `json:"clients"`
+}
+
+// registerDebug 在设置了 -debug 时向 mux 注册 /debug，否则不注册，请求会得到 404。
+func registerDebug(mux *http.ServeMux, myHub *hub.Hub) {
+	if !*debug {
+		return
+	}
+	mux.HandleFunc("/debug", func(w http.ResponseWriter, r *http.Request) {
+		serveDebug(myHub, w, r)
+	})
+}
+
+// serveDebug 以 JSON 返回 Hub 的实时状态，用于排查线上问题。
+// 只有设置了 -debug 时才注册该路由，并且需要管理令牌。
+func serveDebug(myHub *hub.Hub, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "方法不被允许", http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkAdminToken(r) {
+		http.Error(w, "未授权", http.StatusUnauthorized)
+		return
+	}
+	var queue queueState
+	queue.Length, queue.Capacity, queue.Dropped = myHub.BroadcastQueueStats()
+	writeJSON(w, debugState{
+		Goroutines:  runtime.NumGoroutine(),
+		Connections: myHub.ConnectionCount(),
+		Saves:       myHub.SaveStats(),
+		Queue:       queue,
+		Clients:     myHub.ClientInfos(),
+	})
+}
@@ -0,0 +1,465 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"chatroom/hub"
+	"chatroom/models"
+	"chatroom/store"
+	"github.com/gorilla/websocket"
+)
+
+// startHub 启动一个不保存消息的 Hub，测试结束时关闭。
+func startHub(t *testing.T, cfg hub.Config) *hub.Hub {
+	t.Helper()
+	h := hub.NewHubWithConfig(store.NullMessageStore{}, cfg)
+	go h.Run()
+	t.Cleanup(func() { h.Shutdown(0) })
+	return h
+}
+
+// newStore 在临时目录中创建并初始化一个 SQLite 存储，测试结束时关闭。
+func newStore(t *testing.T) *store.SQLiteMessageStore {
+	t.Helper()
+	s, err := store.NewSQLiteMessageStore(t.TempDir() + "/chat.db")
+	if err != nil {
+		t.Fatalf("创建存储失败: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	if err := s.Init(); err != nil {
+		t.Fatalf("初始化存储失败: %v", err)
+	}
+	return s
+}
+
+// startServer 启动一个提供 /ws 和 mux 中其他接口的测试服务器。
+func startServer(t *testing.T, h *hub.Hub, mux *http.ServeMux) *httptest.Server {
+	t.Helper()
+	if mux == nil {
+		mux = http.NewServeMux()
+	}
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		serveWs(h, w, r)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// dial 以 query 中的参数连接测试服务器的 /ws。
+func dial(t *testing.T, srv *httptest.Server, query string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws?"+query, nil)
+	if err != nil {
+		t.Fatalf("连接 /ws 失败: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// getJSON 请求 url 并把 JSON 响应解码到 v，返回状态码。
+func getJSON(t *testing.T, url string, v interface{}) int {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("请求 %s 失败: %v", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK && v != nil {
+		if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+			t.Fatalf("解析 %s 的响应失败: %v", url, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+// eventually 反复执行 check，直到它返回 true 或超时。
+func eventually(t *testing.T, what string, check func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !check() {
+		if time.Now().After(deadline) {
+			t.Fatalf("等待%s超时", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServeOnlineListsConnectedUsers(t *testing.T) {
+	h := startHub(t, hub.Config{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/online", func(w http.ResponseWriter, r *http.Request) { serveOnline(h, w, r) })
+	srv := startServer(t, h, mux)
+
+	var users []string
+	if code := getJSON(t, srv.URL+"/online", &users); code != http.StatusOK || len(users) != 0 {
+		t.Fatalf("没有连接时 /online = %d %v，期望空列表", code, users)
+	}
+
+	dial(t, srv, "username=alice")
+	eventually(t, " alice 出现在 /online 中", func() bool {
+		getJSON(t, srv.URL+"/online", &users)
+		return slices.Equal(users, []string{"alice"})
+	})
+}
+
+// get 直接调用 handler 处理一个 GET 请求，返回响应。
+func get(handler http.HandlerFunc, target string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	return rec
+}
+
+func TestHealthAndReadiness(t *testing.T) {
+	s := newStore(t)
+	h := startHub(t, hub.Config{})
+	readyz := func(w http.ResponseWriter, r *http.Request) { serveReadyz(h, s, w, r) }
+
+	if rec := get(serveHealthz, "/healthz"); rec.Code != http.StatusOK {
+		t.Fatalf("/healthz = %d，期望 200", rec.Code)
+	}
+	if rec := get(readyz, "/readyz"); rec.Code != http.StatusOK || rec.Body.String() != "ready" {
+		t.Fatalf("正常时 /readyz = %d %q", rec.Code, rec.Body)
+	}
+
+	s.Close() // 模拟数据库不可用
+	if rec := get(readyz, "/readyz"); rec.Code != http.StatusServiceUnavailable || rec.Body.String() != "database unavailable" {
+		t.Fatalf("数据库不可用时 /readyz = %d %q，期望 503", rec.Code, rec.Body)
+	}
+	// 存活检查不依赖数据库
+	if rec := get(serveHealthz, "/healthz"); rec.Code != http.StatusOK {
+		t.Fatalf("数据库不可用时 /healthz = %d，期望 200", rec.Code)
+	}
+}
+
+func TestReadinessFailsWhenHubStopped(t *testing.T) {
+	h := startHub(t, hub.Config{})
+	h.Shutdown(0)
+	rec := get(func(w http.ResponseWriter, r *http.Request) { serveReadyz(h, nil, w, r) }, "/readyz")
+	if rec.Code != http.StatusServiceUnavailable || rec.Body.String() != "hub not running" {
+		t.Fatalf("Hub 停止后 /readyz = %d %q，期望 503", rec.Code, rec.Body)
+	}
+}
+
+func TestServeRoomsListsActiveRooms(t *testing.T) {
+	setFlag(t, "default-room", "lobby")
+	h := startHub(t, hub.Config{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/rooms", func(w http.ResponseWriter, r *http.Request) { serveRooms(h, w, r) })
+	srv := startServer(t, h, mux)
+
+	var rooms []hub.RoomInfo
+	if code := getJSON(t, srv.URL+"/rooms", &rooms); code != http.StatusOK || len(rooms) != 0 {
+		t.Fatalf("没有连接时 /rooms = %d %v，期望空列表", code, rooms)
+	}
+
+	dial(t, srv, "username=alice") // 未指定房间，进入默认房间
+	bob := dial(t, srv, "username=bob&room=dev")
+	carol := dial(t, srv, "username=carol&room=dev")
+	want := []hub.RoomInfo{{Name: "dev", Occupants: 2}, {Name: "lobby", Occupants: 1}}
+	eventually(t, " /rooms 列出两个房间", func() bool {
+		getJSON(t, srv.URL+"/rooms", &rooms)
+		return slices.Equal(rooms, want)
+	})
+
+	// 没有用户的房间不再列出
+	bob.Close()
+	carol.Close()
+	want = []hub.RoomInfo{{Name: "lobby", Occupants: 1}}
+	eventually(t, " dev 从 /rooms 中消失", func() bool {
+		getJSON(t, srv.URL+"/rooms", &rooms)
+		return slices.Equal(rooms, want)
+	})
+}
+
+// post 发送一个不带请求体的 POST 请求，返回状态码和响应体。
+func post(t *testing.T, url, token string) (int, string) {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodPost, url, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("请求 %s 失败: %v", url, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+// readUntilClose 读取连接上的消息直到连接被关闭，返回收到的消息和关闭错误。
+func readUntilClose(t *testing.T, conn *websocket.Conn) ([]models.Message, error) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var msgs []models.Message
+	for {
+		var msg models.Message
+		if err := conn.ReadJSON(&msg); err != nil {
+			return msgs, err
+		}
+		msgs = append(msgs, msg)
+	}
+}
+
+func TestKickAllDisconnectsRoom(t *testing.T) {
+	setFlag(t, "admin-token", "secret")
+	h := startHub(t, hub.Config{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/kick-all", func(w http.ResponseWriter, r *http.Request) { serveKickAll(h, w, r) })
+	srv := startServer(t, h, mux)
+
+	alice := dial(t, srv, "username=alice&room=dev")
+	bob := dial(t, srv, "username=bob&room=dev")
+	carol := dial(t, srv, "username=carol&room=general")
+	eventually(t, "三个用户上线", func() bool { return h.ConnectionCount() == 3 })
+
+	if code, _ := post(t, srv.URL+"/api/kick-all?room=dev", ""); code != http.StatusUnauthorized {
+		t.Fatalf("没有令牌时返回 %d，期望 401", code)
+	}
+	if code, body := post(t, srv.URL+"/api/kick-all?room=dev", "secret"); code != http.StatusOK || !strings.Contains(body, `"kicked":2`) {
+		t.Fatalf("清场 dev 返回 %d %s，期望断开 2 个连接", code, body)
+	}
+	for _, conn := range []*websocket.Conn{alice, bob} {
+		msgs, err := readUntilClose(t, conn)
+		if !websocket.IsCloseError(err, models.CloseKicked) {
+			t.Fatalf("连接应以 4003 关闭，实际 %v", err)
+		}
+		if last := msgs[len(msgs)-1]; last.Type != models.TypeAnnouncement || last.Content != kickAllFarewell {
+			t.Fatalf("关闭前的最后一条消息 = %+v，期望告别公告", last)
+		}
+	}
+	if users := h.OnlineUsers(); !slices.Equal(users, []string{"carol"}) {
+		t.Fatalf("清场 dev 后在线用户 = %v，期望 [carol]", users)
+	}
+
+	// 不指定房间时断开所有人
+	if code, body := post(t, srv.URL+"/api/kick-all", "secret"); code != http.StatusOK || !strings.Contains(body, `"kicked":1`) {
+		t.Fatalf("全部清场返回 %d %s", code, body)
+	}
+	if _, err := readUntilClose(t, carol); !websocket.IsCloseError(err, models.CloseKicked) {
+		t.Fatalf("carol 应以 4003 关闭，实际 %v", err)
+	}
+	if h.ConnectionCount() != 0 {
+		t.Fatalf("全部清场后仍有 %d 个连接", h.ConnectionCount())
+	}
+}
+
+func TestDebugEndpoint(t *testing.T) {
+	setFlag(t, "admin-token", "secret")
+	h := startHub(t, hub.Config{})
+
+	t.Run("默认关闭", func(t *testing.T) {
+		mux := http.NewServeMux()
+		registerDebug(mux, h)
+		srv := startServer(t, h, mux)
+		if code := getJSON(t, srv.URL+"/debug?token=secret", nil); code != http.StatusNotFound {
+			t.Fatalf("未设置 -debug 时 /debug 返回 %d，期望 404", code)
+		}
+	})
+
+	t.Run("开启后返回状态", func(t *testing.T) {
+		setFlag(t, "debug", "true")
+		mux := http.NewServeMux()
+		registerDebug(mux, h)
+		srv := startServer(t, h, mux)
+		dial(t, srv, "username=alice&room=dev")
+		eventually(t, " alice 上线", func() bool { return h.ConnectionCount() == 1 })
+
+		if code := getJSON(t, srv.URL+"/debug", nil); code != http.StatusUnauthorized {
+			t.Fatalf("没有令牌时返回 %d，期望 401", code)
+		}
+		var state debugState
+		if code := getJSON(t, srv.URL+"/debug?token=secret", &state); code != http.StatusOK {
+			t.Fatalf("/debug 返回 %d", code)
+		}
+		if state.Connections != 1 || state.Goroutines == 0 || len(state.Clients) != 1 {
+			t.Fatalf("调试状态 = %+v", state)
+		}
+		if cl := state.Clients[0]; cl.Username != "alice" || cl.Room != "dev" {
+			t.Fatalf("连接信息 = %+v", cl)
+		}
+		resp, err := http.Get(srv.URL + "/debug?token=secret")
+		if err != nil {
+			t.Fatalf("请求 /debug 失败: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if strings.Contains(string(body), "127.0.0.1") {
+			t.Fatalf("调试状态不应包含客户端地址: %s", body)
+		}
+	})
+}
+
+func TestServeUserHistoryRequiresAdmin(t *testing.T) {
+	setFlag(t, "admin-token", "secret")
+	s := newStore(t)
+	now := time.Now().UTC()
+	for i, msg := range []models.Message{
+		{Username: "alice", Content: "hello"},
+		{Username: "bob", Content: "hi"},
+	} {
+		msg.Type, msg.Room, msg.Timestamp = models.TypeChat, models.DefaultRoom, now.Add(time.Duration(i)*time.Second)
+		if _, err := s.SaveMessage(msg); err != nil {
+			t.Fatalf("保存消息失败: %v", err)
+		}
+	}
+	handler := func(w http.ResponseWriter, r *http.Request) { serveUserHistory(s, w, r) }
+
+	// 没有令牌时不能查询任何人，包括自己
+	if rec := get(handler, "/history/user?username=alice"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("没有令牌时返回 %d，期望 401", rec.Code)
+	}
+	if rec := get(handler, "/history/user?username=alice&token=wrong"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("错误的令牌返回 %d，期望 401", rec.Code)
+	}
+	rec := get(handler, "/history/user?username=alice&token=secret")
+	var msgs []models.Message
+	if err := json.Unmarshal(rec.Body.Bytes(), &msgs); rec.Code != http.StatusOK || err != nil || len(msgs) != 1 || msgs[0].Content != "hello" {
+		t.Fatalf("管理员查询 alice 返回 %d %s，期望只有 alice 的消息", rec.Code, rec.Body)
+	}
+	if rec := get(handler, "/history/user?token=secret"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("缺少 username 返回 %d，期望 400", rec.Code)
+	}
+}
+
+func TestServeUserRooms(t *testing.T) {
+	setFlag(t, "admin-token", "secret")
+	s := newStore(t)
+	now := time.Now().UTC()
+	for i, room := range []string{"general", "dev", "general", "random"} {
+		msg := models.Message{Type: models.TypeChat, Username: "alice", Room: room, Content: "hi", Timestamp: now.Add(time.Duration(i) * time.Second)}
+		if _, err := s.SaveMessage(msg); err != nil {
+			t.Fatalf("保存消息失败: %v", err)
+		}
+	}
+	handler := func(w http.ResponseWriter, r *http.Request) { serveUserRooms(s, w, r) }
+
+	if rec := get(handler, "/user/rooms?username=alice"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("没有令牌时返回 %d，期望 401", rec.Code)
+	}
+	rec := get(handler, "/user/rooms?username=alice&token=secret")
+	var rooms []store.UserRoom
+	if err := json.Unmarshal(rec.Body.Bytes(), &rooms); rec.Code != http.StatusOK || err != nil {
+		t.Fatalf("查询返回 %d %s (%v)", rec.Code, rec.Body, err)
+	}
+	var got []string
+	for _, room := range rooms {
+		got = append(got, room.Room)
+	}
+	if want := []string{"random", "general", "dev"}; !slices.Equal(got, want) {
+		t.Fatalf("alice 的房间 = %v，期望最近活跃的在前 %v", got, want)
+	}
+
+	if rec := get(handler, "/user/rooms?username=carol&token=secret"); rec.Code != http.StatusOK || strings.TrimSpace(rec.Body.String()) != "[]" {
+		t.Fatalf("没有消息的用户返回 %d %q，期望空数组", rec.Code, rec.Body)
+	}
+	if rec := get(handler, "/user/rooms?token=secret"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("缺少 username 返回 %d，期望 400", rec.Code)
+	}
+	if rec := get(handler, "/user/rooms?username=alice&limit=0&token=secret"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("limit=0 返回 %d，期望 400", rec.Code)
+	}
+}
+
+func TestServeHistoryFiltersTypes(t *testing.T) {
+	s := newStore(t)
+	now := time.Now().UTC()
+	for i, msg := range []models.Message{
+		{Type: models.TypeJoin, Username: "alice", Content: "join"},
+		{Type: models.TypeChat, Username: "alice", Content: "hello"},
+		{Type: models.TypeLeave, Username: "alice", Content: "leave"},
+	} {
+		msg.Room, msg.Timestamp = models.DefaultRoom, now.Add(time.Duration(i)*time.Second)
+		if _, err := s.SaveMessage(msg); err != nil {
+			t.Fatalf("保存消息失败: %v", err)
+		}
+	}
+	history := func(types string) (int, []string) {
+		rec := get(func(w http.ResponseWriter, r *http.Request) { serveHistory(s, w, r) }, "/history?types="+types)
+		var msgs []models.Message
+		json.Unmarshal(rec.Body.Bytes(), &msgs)
+		var out []string
+		for _, msg := range msgs {
+			out = append(out, msg.Content)
+		}
+		return rec.Code, out
+	}
+
+	if code, got := history("chat"); code != http.StatusOK || !slices.Equal(got, []string{"hello"}) {
+		t.Fatalf("types=chat 返回 %d %v", code, got)
+	}
+	if code, got := history("join,leave"); code != http.StatusOK || !slices.Equal(got, []string{"join", "leave"}) {
+		t.Fatalf("types=join,leave 返回 %d %v", code, got)
+	}
+	if code, got := history(""); code != http.StatusOK || len(got) != 3 {
+		t.Fatalf("不指定类型时返回 %d %v，期望所有消息", code, got)
+	}
+	if code, _ := history("chat,user_list"); code != http.StatusBadRequest {
+		t.Fatalf("不支持的类型返回 %d，期望 400", code)
+	}
+}
+
+// announce 直接调用 serveAnnounce 处理一个带 JSON 请求体的 POST 请求，返回响应。
+func announce(h *hub.Hub, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/api/announce", strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	serveAnnounce(h, rec, req)
+	return rec
+}
+
+// readAnnouncement 读取连接上的消息直到收到一条公告。
+func readAnnouncement(t *testing.T, conn *websocket.Conn) models.Message {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		var msg models.Message
+		if err := conn.ReadJSON(&msg); err != nil {
+			t.Fatalf("等待公告时读取失败: %v", err)
+		}
+		if msg.Type == models.TypeAnnouncement {
+			return msg
+		}
+	}
+}
+
+func TestServeAnnounce(t *testing.T) {
+	setFlag(t, "admin-token", "secret")
+	h := startHub(t, hub.Config{})
+
+	if rec := announce(h, "", `{"content":"维护通知"}`); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("没有令牌时返回 %d，期望 401", rec.Code)
+	}
+	if rec := announce(h, "wrong", `{"content":"维护通知"}`); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("令牌错误时返回 %d，期望 401", rec.Code)
+	}
+	for _, body := range []string{`{"content":""}`, `{"content":"  "}`, `{}`, `not json`} {
+		if rec := announce(h, "secret", body); rec.Code != http.StatusBadRequest {
+			t.Fatalf("请求体 %s 返回 %d，期望 400", body, rec.Code)
+		}
+	}
+
+	srv := startServer(t, h, nil)
+	alice := dial(t, srv, "username=alice&room=dev")
+	bob := dial(t, srv, "username=bob&room=general")
+	eventually(t, "两个用户上线", func() bool { return h.ConnectionCount() == 2 })
+
+	if rec := announce(h, "secret", `{"content":"今晚 22 点维护"}`); rec.Code != http.StatusNoContent {
+		t.Fatalf("发布公告返回 %d，期望 204", rec.Code)
+	}
+	for _, conn := range []*websocket.Conn{alice, bob} {
+		if msg := readAnnouncement(t, conn); msg.Content != "今晚 22 点维护" {
+			t.Fatalf("收到的公告内容 = %q", msg.Content)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+// Package archive 把保留期清理删除的旧消息上传到 S3 兼容的对象存储，实现 store.Archiver。
+package archive
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"chatroom/models"
+)
+
+// DefaultRegion 是未设置 Region 时签名使用的区域，MinIO 等自建服务通常接受它。
+const DefaultRegion = "us-east-1"
+
+// S3 把每批消息作为一个 JSON 数组对象上传到 S3 兼容的存储桶，使用路径风格的地址（endpoint/bucket/key）
+// 和 AWS Signature Version 4 签名，因此也适用于 MinIO、Ceph 等兼容服务。
+// 对象名由 Prefix 和这批消息的首尾 ID 组成，同一批消息重试时覆盖同一个对象。
+type S3 struct {
+	Endpoint  string // 服务地址，例如 https://s3.us-east-1.amazonaws.com 或 http://localhost:9000
+	Bucket    string
+	Region    string // 为空时使用 DefaultRegion
+	Prefix    string // 对象名前缀，例如 "chat/"
+	AccessKey string
+	SecretKey string
+
+	Client *http.Client // 为空时使用 http.DefaultClient
+}
+
+// New 检查必填的配置并返回 S3 归档器。
+func New(endpoint, bucket, region, prefix, accessKey, secretKey string) (*S3, error) {
+	if endpoint == "" || bucket == "" {
+		return nil, errors.New("必须设置服务地址和存储桶")
+	}
+	if accessKey == "" || secretKey == "" {
+		return nil, errors.New("必须设置访问密钥")
+	}
+	if region == "" {
+		region = DefaultRegion
+	}
+	return &S3{
+		Endpoint:  strings.TrimRight(endpoint, "/"),
+		Bucket:    bucket,
+		Region:    region,
+		Prefix:    prefix,
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		Client:    &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// Archive 上传一批消息，服务器返回 2xx 以外的状态码时返回错误。
+func (a *S3) Archive(batch []models.Message) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return fmt.Errorf("序列化消息失败: %w", err)
+	}
+	key := fmt.Sprintf("%smessages-%020d-%020d.json", a.Prefix, batch[0].ID, batch[len(batch)-1].ID)
+	req, err := http.NewRequest(http.MethodPut, a.Endpoint+"/"+a.Bucket+"/"+key, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("创建上传请求失败: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	a.sign(req, body, time.Now())
+
+	client := a.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("上传 %s 失败: %w", key, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("上传 %s 失败: %s %s", key, resp.Status, strings.TrimSpace(string(detail)))
+	}
+	return nil
+}
+
+// sign 按 AWS Signature Version 4 为请求添加 x-amz-date、x-amz-content-sha256 和 Authorization 头。
+// 签名 host 和调用时请求中已有的所有头（http.Client 之后自动添加的头不在其中），请求不带查询参数。
+func (a *S3) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	payloadHash := sha256Hex(body)
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		uriEncodePath(req.URL.Path),
+		"", // 查询参数
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + a.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+	signature := hex.EncodeToString(hmacSHA256(signingKey(a.SecretKey, date, a.Region, "s3"), stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		a.AccessKey, scope, signedHeaders, signature))
+}
+
+// signingKey 从密钥逐级派生出某一天、某个区域和服务的签名密钥。
+func signingKey(secret, date, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+// uriEncodePath 按 SigV4 的规则编码路径：除字母、数字、'-'、'_'、'.'、'~' 和 '/' 以外的字节都编码为 %XX。
+// 它比 url.URL.EscapedPath 严格，例如 '$' 也要编码。
+func uriEncodePath(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
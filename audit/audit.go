@@ -0,0 +1,88 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+
+	"chatroom/models"
+)
+
+// Logger 将每条消息作为一行 JSON 追加写入审计文件，与可查询、可删除的消息存储相互独立。
+// 文件以只追加方式打开，每条消息用一次 write 调用写入，进程崩溃时最多丢失正在写的那一行。
+// 写入失败只记录日志，不会影响聊天；下一次写入前会尝试重新打开文件。
+// 配合 logrotate 等外部工具轮转时，在移走文件后调用 Reopen（例如收到 SIGHUP 时）。
+type Logger struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File // 打开失败或写入出错后为 nil，下次写入时重新打开
+}
+
+// Open 以只追加方式打开（必要时创建）审计文件。
+func Open(path string) (*Logger, error) {
+	l := &Logger{path: path}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Logger) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("打开审计文件 %s 失败: %w", l.path, err)
+	}
+	l.file = f
+	return nil
+}
+
+// Record 将消息追加到审计文件。可以从任意协程调用。
+func (l *Logger) Record(msg models.Message) {
+	line, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("序列化审计记录失败: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		if err := l.open(); err != nil {
+			log.Printf("审计记录丢失: %v", err)
+			return
+		}
+	}
+	if _, err := l.file.Write(line); err != nil {
+		log.Printf("写入审计文件 %s 失败，下次写入时重新打开: %v", l.path, err)
+		l.file.Close()
+		l.file = nil
+	}
+}
+
+// Reopen 关闭当前文件并按原路径重新打开，用于日志轮转之后。
+func (l *Logger) Reopen() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+	return l.open()
+}
+
+// Close 将数据刷到磁盘并关闭审计文件。
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	l.file.Sync()
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
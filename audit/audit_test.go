@@ -0,0 +1,96 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"chatroom/models"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// readLines 按行解析审计文件，每行必须是一条完整的 JSON 消息。
+func readLines(t *testing.T, path string) []models.Message {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("打开审计文件失败: %v", err)
+	}
+	defer f.Close()
+	var msgs []models.Message
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var msg models.Message
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			t.Fatalf("第 %d 行不是合法的 JSON: %q", len(msgs)+1, scanner.Text())
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+func TestRecordAppendsJSONLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Record(models.Message{ID: 1, Type: models.TypeChat, Username: "alice", Room: "general", Content: "第一行\n第二行", Timestamp: now})
+	l.Record(models.Message{ID: 2, Type: models.TypeJoin, Username: "bob", Room: "general", Timestamp: now})
+	if err := l.Close(); err != nil {
+		t.Fatalf("关闭失败: %v", err)
+	}
+
+	// 重新打开时追加而不是覆盖
+	l, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Record(models.Message{ID: 3, Type: models.TypeChat, Username: "bob", Content: "later", Timestamp: now})
+	l.Close()
+
+	msgs := readLines(t, path)
+	if len(msgs) != 3 {
+		t.Fatalf("审计文件有 %d 行，期望 3 行", len(msgs))
+	}
+	if msgs[0].ID != 1 || msgs[0].Content != "第一行\n第二行" || msgs[1].Type != models.TypeJoin || msgs[2].Content != "later" {
+		t.Fatalf("审计记录 = %+v", msgs)
+	}
+}
+
+func TestReopenAfterRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "audit.log")
+	l, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.Record(models.Message{ID: 1, Type: models.TypeChat, Content: "old"})
+
+	rotated := filepath.Join(dir, "audit.log.1")
+	if err := os.Rename(path, rotated); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Reopen(); err != nil {
+		t.Fatalf("Reopen 失败: %v", err)
+	}
+	l.Record(models.Message{ID: 2, Type: models.TypeChat, Content: "new"})
+
+	if old := readLines(t, rotated); len(old) != 1 || old[0].Content != "old" {
+		t.Fatalf("轮转前的文件 = %+v", old)
+	}
+	if cur := readLines(t, path); len(cur) != 1 || cur[0].Content != "new" {
+		t.Fatalf("轮转后的文件 = %+v", cur)
+	}
+}
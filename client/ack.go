@@ -0,0 +1,76 @@
+package client
+
+import (
+	"slices"
+	"time"
+)
+
+const (
+	// DefaultAckTimeout 是等待客户端确认一条消息的默认时间，超时后重发一次。
+	DefaultAckTimeout = 10 * time.Second
+
+	// maxInflight 是每个连接最多跟踪的未确认消息数，超过时放弃最早的那条，防止从不确认的客户端占用过多内存。
+	maxInflight = 256
+)
+
+// inflight 是一条已发送、等待客户端确认的消息。
+type inflight struct {
+	message []byte
+	sentAt  time.Time
+	resent  bool // 已经重发过一次，再次超时就放弃
+}
+
+// SendTracked 发送一条带 ID 的消息。连接开启了确认（?ack=1）时记录为待确认，
+// 超过 AckTimeout 没有收到对应 ID 的 ack 消息就重发一次，提供至少一次的投递语义；客户端应按 ID 去重。
+// 没有开启确认或 id 为 0 时与 SendMessage 相同。
+func (c *Client) SendTracked(id int64, message []byte) {
+	c.SendMessage(message)
+	if !c.acks || id == 0 {
+		return
+	}
+	c.inflightMu.Lock()
+	defer c.inflightMu.Unlock()
+	if len(c.inflight) >= maxInflight {
+		oldest := int64(0)
+		for pending := range c.inflight {
+			if oldest == 0 || pending < oldest {
+				oldest = pending
+			}
+		}
+		delete(c.inflight, oldest)
+	}
+	c.inflight[id] = &inflight{message: message, sentAt: c.config.Clock.Now()}
+}
+
+// ack 处理客户端对消息 id 的确认。
+func (c *Client) ack(id int64) {
+	c.inflightMu.Lock()
+	defer c.inflightMu.Unlock()
+	delete(c.inflight, id)
+}
+
+// expireInflight 检查超时未确认的消息：第一次超时的返回给调用方重发，重发后仍未确认的放弃。
+// 返回的消息按 ID 升序排列，保持原来的发送顺序。
+func (c *Client) expireInflight(now time.Time) [][]byte {
+	c.inflightMu.Lock()
+	defer c.inflightMu.Unlock()
+	var ids []int64
+	for id, m := range c.inflight {
+		if now.Sub(m.sentAt) < c.config.AckTimeout {
+			continue
+		}
+		if m.resent {
+			delete(c.inflight, id)
+			continue
+		}
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	resend := make([][]byte, 0, len(ids))
+	for _, id := range ids {
+		m := c.inflight[id]
+		m.resent, m.sentAt = true, now
+		resend = append(resend, m.message)
+	}
+	return resend
+}
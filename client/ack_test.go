@@ -0,0 +1,100 @@
+package client
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"chatroom/clock"
+
+	"github.com/gorilla/websocket"
+)
+
+// trackedFrame 返回 ID 为 id 的聊天消息帧。
+func trackedFrame(id int64) []byte {
+	return []byte(`{"type":"chat","id":` + strconv.FormatInt(id, 10) + `,"content":"m` + strconv.FormatInt(id, 10) + `"}`)
+}
+
+// expectSilence 断言 d 时间内没有收到任何帧。
+func expectSilence(t *testing.T, peer *websocket.Conn, d time.Duration) {
+	t.Helper()
+	peer.SetReadDeadline(time.Now().Add(d))
+	if _, data, err := peer.ReadMessage(); err == nil {
+		t.Fatalf("不应再收到帧，收到 %s", data)
+	}
+}
+
+func TestUnackedMessageIsResentExactlyOnce(t *testing.T) {
+	const timeout = 40 * time.Millisecond
+	c, _, peer := startClient(t, ConnInfo{Acks: true}, Config{AckTimeout: timeout})
+	c.SendTracked(1, trackedFrame(1))
+
+	if msg := readMessage(t, peer); msg.ID != 1 {
+		t.Fatalf("第一帧 = %+v，期望消息 1", msg)
+	}
+	// 客户端从不确认：超时后重发一次，之后放弃
+	if msg := readMessage(t, peer); msg.ID != 1 {
+		t.Fatalf("重发的帧 = %+v，期望消息 1", msg)
+	}
+	expectSilence(t, peer, 5*timeout)
+}
+
+func TestAckedMessageIsNotResent(t *testing.T) {
+	const timeout = 40 * time.Millisecond
+	c, _, peer := startClient(t, ConnInfo{Acks: true}, Config{AckTimeout: timeout})
+	c.SendTracked(1, trackedFrame(1))
+	readMessage(t, peer)
+	send(t, peer, `{"type":"ack","message_id":1}`)
+	expectSilence(t, peer, 3*timeout)
+}
+
+func TestExpireInflight(t *testing.T) {
+	clk := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	c, _, _ := newTestClient(t, ConnInfo{Acks: true}, Config{AckTimeout: time.Second, Clock: clk, SendBufferSize: maxInflight + 8})
+	c.SendTracked(2, trackedFrame(2))
+	c.SendTracked(1, trackedFrame(1))
+	c.SendTracked(3, trackedFrame(3))
+	c.ack(3)
+
+	if got := c.expireInflight(clk.Now().Add(999 * time.Millisecond)); len(got) != 0 {
+		t.Fatalf("未超时就重发了 %d 条", len(got))
+	}
+	clk.Advance(time.Second)
+	got := c.expireInflight(clk.Now())
+	if len(got) != 2 || string(got[0]) != string(trackedFrame(1)) || string(got[1]) != string(trackedFrame(2)) {
+		t.Fatalf("第一次超时重发 %q，期望按 ID 顺序重发未确认的 1、2", got)
+	}
+	if got := c.expireInflight(clk.Now().Add(500 * time.Millisecond)); len(got) != 0 {
+		t.Fatalf("重发后的等待时间从重发时算起，提前重发了 %d 条", len(got))
+	}
+	clk.Advance(time.Second)
+	if got := c.expireInflight(clk.Now()); len(got) != 0 {
+		t.Fatalf("再次超时应放弃，又重发了 %d 条", len(got))
+	}
+	if len(c.inflight) != 0 {
+		t.Fatalf("放弃后仍在跟踪 %d 条", len(c.inflight))
+	}
+}
+
+func TestInflightIsBounded(t *testing.T) {
+	c, _, _ := newTestClient(t, ConnInfo{Acks: true}, Config{SendBufferSize: maxInflight + 8})
+	for id := int64(1); id <= maxInflight+5; id++ {
+		c.SendTracked(id, trackedFrame(id))
+	}
+	if len(c.inflight) != maxInflight {
+		t.Fatalf("跟踪了 %d 条，上限是 %d", len(c.inflight), maxInflight)
+	}
+	for id := int64(1); id <= 5; id++ {
+		if _, ok := c.inflight[id]; ok {
+			t.Fatalf("超过上限时应放弃最早的消息，消息 %d 仍在跟踪", id)
+		}
+	}
+}
+
+func TestSendTrackedWithoutAcks(t *testing.T) {
+	c, _, _ := newTestClient(t, ConnInfo{}, Config{})
+	c.SendTracked(1, trackedFrame(1))
+	if len(c.inflight) != 0 {
+		t.Fatal("没有开启确认的连接不应跟踪消息")
+	}
+}
@@ -2,34 +2,113 @@ package client
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
+	"net"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
+	"chatroom/clock"
+	"chatroom/hub"
+	"chatroom/i18n"
 	"chatroom/models"
+	"chatroom/ratelog"
 	"github.com/gorilla/websocket"
 )
 
 const (
-	writeWait      = 10 * time.Second
-	pongWait       = 60 * time.Second
-	pingPeriod     = (pongWait * 9) / 10
-	maxMessageSize = 512
+	writeWait  = 10 * time.Second
+	pongWait   = 60 * time.Second
+	pingPeriod = (pongWait * 9) / 10
+
+	// parseErrorInterval 是两次 "消息格式错误" 回复之间的最小间隔，
+	// 防止持续发送垃圾数据的客户端让服务器不停回复。
+	parseErrorInterval = time.Second
+
+	// MaxFrameSize 是底层连接的硬性读取上限，超过它 gorilla 会直接断开连接。
+	// 它远大于各类型的消息大小上限，使得超长的消息可以在解析后按类型在应用层被拒绝，而不是踢掉用户；
+	// 因此按类型配置的上限不能超过它。
+	MaxFrameSize = 64 * 1024
+
+	// presenceInterval 是转发给 Hub 的两次 "presence" 消息之间的最小间隔，
+	// 更频繁的 presence 消息直接丢弃，防止客户端借此刷屏 Hub。
+	presenceInterval = 5 * time.Second
 )
 
 // Hub 是 Client 期望的 Hub 接口，它定义了客户端如何与 Hub 交互的方法。
 // hub.Hub (具体的结构体) 将隐式地实现这个接口。
 type Hub interface {
-	Register(c *Client)
-	Unregister(c *Client)
-	Broadcast(message []byte)
+	Register(c hub.Client)
+	Unregister(c hub.Client)
+	Broadcast(sender hub.Client, msg models.Message)
 }
 
+// 确保 *Client 满足 Hub 对客户端的接口要求。
+var _ hub.Client = (*Client)(nil)
+
 // Client 代表一个连接到聊天室的用户
 type Client struct {
 	hub      Hub
 	conn     *websocket.Conn // 保持小写，私有
+	frames   frameWriter     // 写出数据帧的连接，即 conn；测试中可以换成模拟写入失败的实现
 	send     chan []byte     // 保持小写，私有
+	priority chan []byte     // 高优先级发送通道：错误、踢出通知等控制消息，writePump 总是先于 send 发送它们
+	streams  chan [][]byte   // 等待逐帧发送的分块流，见 SendStream
 	username string          // 保持小写，私有
+	userKey  string          // username 的规范化形式，用于唯一性判断
+	room     string          // 客户端所在的房间
+	config   Config          // 创建时的配置
+
+	remoteAddr string // 客户端的远端地址，用于滥用排查
+	userAgent  string // 客户端的 User-Agent
+	observer   bool   // 只读连接：只接收消息，发送的任何消息都被拒绝
+	noEcho     bool   // 不回显自己发送的聊天消息（客户端已乐观渲染）
+	lang       string // 服务器发给该连接的提示文案使用的语言（已规范化，见 i18n.Normalize）
+	version    int    // 客户端声明的协议版本（见 models.ProtocolVersion）
+	status     string // 自定义状态文字，只由 Hub 的 Run 协程读写，连接断开后随之消失
+	acks       bool   // 是否跟踪未确认的消息并超时重发（见 ack.go）
+	coalesce   bool   // 是否把排队的消息合并成一帧发送（见 coalesce.go）
+
+	// inflight 是已发送、等待客户端确认的消息，键为消息 ID。只在 acks 为 true 时使用。
+	inflightMu sync.Mutex
+	inflight   map[int64]*inflight
+
+	unregisterOnce sync.Once // 读写协程都会在退出时注销，保证只向 Hub 发送一次
+
+	closing     chan struct{} // 关闭后 writePump 发送完排队的消息再关闭连接
+	closingOnce sync.Once
+	closeCode   int    // Disconnect 指定的关闭码，在 closing 关闭前写入
+	closeReason string // Disconnect 指定的关闭原因
+
+	done chan struct{} // writePump 退出（连接已关闭）时关闭
+
+	// lastActivity 是最近一次收到客户端数据帧或 pong 的时间（UnixNano），Hub 据此断开长时间沉默的连接。
+	lastActivity atomic.Int64
+
+	// quitting 在客户端发送 quit 消息主动离开时置为 true，Hub 据此区分主动离开和连接中断。
+	quitting atomic.Bool
+
+	// ignored 是该连接屏蔽的用户名集合，由 readPump 修改，Hub 在分发消息时读取。
+	ignoredMu sync.RWMutex
+	ignored   map[string]bool
+}
+
+// ConnInfo 描述一个连接在建立时从 HTTP 请求中获得的信息。
+type ConnInfo struct {
+	Username   string // 为空时由 Hub 分配游客名称
+	Room       string // 为空时加入默认房间
+	RemoteAddr string // 客户端 IP 地址
+	UserAgent  string // 客户端 User-Agent
+	Observer   bool   // 是否为只读的观察者连接
+	NoEcho     bool   // 是否关闭自己发送的聊天消息的回显
+	Lang       string // 客户端请求的语言（?lang=），不支持时使用 i18n.Default
+	Version    int    // 客户端声明的协议版本（?v=，见 models.ParseProtocolVersion），Hub 在注册时校验
+	Acks       bool   // 客户端会用 ack 消息确认收到的聊天消息（?ack=1），未确认的消息超时后重发一次
+	Coalesce   bool   // 客户端接受一帧中包含多条用换行符分隔的消息（?coalesce=1），见 coalesce.go
 }
 
 // GetUsername 返回客户端的用户名。
@@ -38,6 +117,106 @@ func (c *Client) GetUsername() string {
 	return c.username
 }
 
+// GetUserKey 返回用户名的规范化形式（见 models.UserKey），Hub 用它判断昵称是否冲突。
+func (c *Client) GetUserKey() string {
+	return c.userKey
+}
+
+// GetLang 返回服务器发给该连接的提示文案使用的语言。
+func (c *Client) GetLang() string {
+	return c.lang
+}
+
+// GetRoom 返回客户端所在的房间。
+func (c *Client) GetRoom() string {
+	return c.room
+}
+
+// GetRemoteAddr 返回客户端的远端地址。
+func (c *Client) GetRemoteAddr() string {
+	return c.remoteAddr
+}
+
+// GetUserAgent 返回客户端的 User-Agent。
+func (c *Client) GetUserAgent() string {
+	return c.userAgent
+}
+
+// Status 返回该连接的自定义状态文字。只能在 Hub 的 Run 协程中调用。
+func (c *Client) Status() string {
+	return c.status
+}
+
+// SetStatus 设置该连接的自定义状态文字。只能在 Hub 的 Run 协程中调用。
+func (c *Client) SetStatus(status string) {
+	c.status = status
+}
+
+// ProtocolVersion 返回客户端声明的协议版本。
+func (c *Client) ProtocolVersion() int {
+	return c.version
+}
+
+// SuppressEcho 报告是否不应把该连接自己发送的聊天消息回显给它。
+func (c *Client) SuppressEcho() bool {
+	return c.noEcho
+}
+
+// IsObserver 报告客户端是否为只读的观察者连接。
+func (c *Client) IsObserver() bool {
+	return c.observer
+}
+
+// SetUsername 修改客户端的用户名。
+// 读写协程会读取用户名，因此只能在 RunPumps 之前调用（例如 Hub 在注册时分配名称）。
+func (c *Client) SetUsername(username string) {
+	c.username = username
+	c.userKey = models.UserKey(username)
+}
+
+// Ignores 报告该连接是否屏蔽了指定用户的聊天消息，用户名按规范化形式比较。可以从任意协程调用。
+func (c *Client) Ignores(username string) bool {
+	c.ignoredMu.RLock()
+	defer c.ignoredMu.RUnlock()
+	return c.ignored[models.UserKey(username)]
+}
+
+// setIgnored 屏蔽或取消屏蔽指定用户。
+func (c *Client) setIgnored(username string, ignored bool) {
+	c.ignoredMu.Lock()
+	defer c.ignoredMu.Unlock()
+	if ignored {
+		c.ignored[models.UserKey(username)] = true
+	} else {
+		delete(c.ignored, models.UserKey(username))
+	}
+}
+
+// LastActivity 返回最近一次收到客户端消息或 pong 的时间。可以从任意协程调用。
+func (c *Client) LastActivity() time.Time {
+	return time.Unix(0, c.lastActivity.Load())
+}
+
+// touch 记录一次来自客户端的活动。
+func (c *Client) touch() {
+	c.lastActivity.Store(c.config.Clock.Now().UnixNano())
+}
+
+// Quitting 报告客户端是否通过 quit 消息主动离开。可以从任意协程调用。
+func (c *Client) Quitting() bool {
+	return c.quitting.Load()
+}
+
+// QueueLen 返回发送通道中等待写出的消息数。
+func (c *Client) QueueLen() int {
+	return len(c.send)
+}
+
+// Done 返回一个在写协程退出、连接关闭后关闭的通道，用于等待 Disconnect 把排队的消息发完。
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
 // SendMessage 发送消息到客户端的发送通道。
 // 这是一个公共方法，供其他包（如 Hub）向此客户端发送消息。
 func (c *Client) SendMessage(message []byte) {
@@ -49,11 +228,63 @@ func (c *Client) SendMessage(message []byte) {
 	}
 }
 
+// SendPriority 将控制消息（错误、踢出通知等）放入高优先级通道，它们会越过 send 中积压的聊天消息先发出。
+// 高优先级通道很小且独立于 send，即使聊天消息已经塞满 send，控制消息仍然可以入队；它也满时丢弃消息。
+func (c *Client) SendPriority(message []byte) {
+	select {
+	case c.priority <- message:
+	default:
+	}
+}
+
+// SendStream 将一组必须按顺序、逐帧发送的消息（例如分块的历史消息）交给写协程。
+// 写协程每次只写出其中一帧，写完一帧才写下一帧，因此分块不会占用 send 的缓冲，发送速度受网络写入限制；
+// 流写完之前暂停发送 send 中的普通消息，保证同一流的帧之间不插入其他消息。等待发送的流太多时丢弃整个流。
+func (c *Client) SendStream(frames [][]byte) {
+	select {
+	case c.streams <- frames:
+	default:
+	}
+}
+
+// sendError 向该客户端发送一条 "error" 类型的消息，code 是 models 中定义的错误码。
+func (c *Client) sendError(code, text string) {
+	errMsg := models.Message{
+		Type:      models.TypeError,
+		Error:     text,
+		ErrorCode: code,
+	}
+	jsonErrMsg, err := json.Marshal(errMsg)
+	if err != nil {
+		log.Printf("序列化错误消息失败: %v", err)
+		return
+	}
+	c.SendPriority(jsonErrMsg)
+}
+
 // CloseConnection 提供一个公共方法让 Hub 可以关闭连接。
 func (c *Client) CloseConnection() {
 	c.conn.Close()
 }
 
+// CloseWithReason 立即发送带有关闭码和原因的关闭帧，然后关闭连接。
+// 不等待发送通道中排队的消息；需要让客户端先收到通知时使用 Disconnect。
+// 可以在读写协程运行时调用（gorilla/websocket 允许控制帧与其他写操作并发）。
+func (c *Client) CloseWithReason(code int, reason string) {
+	c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(writeWait))
+	c.conn.Close()
+}
+
+// Disconnect 让 writePump 先发送完已排队的消息，再发送带有关闭码和原因的关闭帧并关闭连接。
+// 用于踢出等需要让客户端收到最后一条通知的场景；只对已启动读写协程的客户端有效。
+// 可以安全地多次调用，只有第一次指定的关闭码生效。
+func (c *Client) Disconnect(code int, reason string) {
+	c.closingOnce.Do(func() {
+		c.closeCode, c.closeReason = code, reason
+		close(c.closing)
+	})
+}
+
 // RunPumps 是一个公共方法，用于启动客户端的读写协程。
 // Hub 包将调用此方法来启动客户端的内部逻辑。
 func (c *Client) RunPumps() {
@@ -61,96 +292,521 @@ func (c *Client) RunPumps() {
 	go c.readPump()  // 启动读取协程 (内部私有方法)
 }
 
+// unregister 将客户端从 Hub 注销，多次调用只生效一次。
+func (c *Client) unregister() {
+	c.unregisterOnce.Do(func() {
+		c.hub.Unregister(c)
+	})
+}
+
 // readPump 从 WebSocket 连接读取消息并将其发送到 Hub。
 // 这是一个内部方法（小写开头），只在 client 包内部使用。
 func (c *Client) readPump() {
 	defer func() {
-		c.hub.Unregister(c) // 在 readPump 退出时，将客户端从 Hub 注销
-		c.conn.Close()      // 关闭 WebSocket 连接
+		// 处理某条消息时发生 panic 只断开这个连接，不让整个进程崩溃
+		if r := recover(); r != nil {
+			log.Printf("客户端 %s 的读取协程发生 panic: %v\n%s", c.username, r, debug.Stack())
+		}
+		c.unregister() // 在 readPump 退出时，将客户端从 Hub 注销
+		c.conn.Close() // 关闭 WebSocket 连接
 	}()
-	c.conn.SetReadLimit(maxMessageSize)
+	c.conn.SetReadLimit(MaxFrameSize)
 	c.conn.SetReadDeadline(time.Now().Add(pongWait))
-	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+	c.conn.SetPongHandler(func(string) error {
+		c.touch()
+		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
 
+	var lastParseErrorReply time.Time // 上次回复格式错误或拒绝观察者消息的时间，用于限流
+	var lastPresence time.Time        // 上次转发 presence 消息的时间，用于限流
 	for {
 		_, message, err := c.conn.ReadMessage()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("错误: %v", err)
+				c.config.ErrorLog.Printf("读取消息错误: %v", err)
 			}
 			break // 读取出错，退出循环，触发 defer
 		}
+		c.touch()
+		// 观察者只接收消息，发来的任何消息都被拒绝（回复同样限流）
+		if c.observer {
+			if time.Since(lastParseErrorReply) >= parseErrorInterval {
+				lastParseErrorReply = time.Now()
+				c.sendError(models.ErrCodeForbidden, i18n.T(c.lang, i18n.KeyObserverReadOnly))
+			}
+			continue
+		}
+		// encoding/json 会把非法的 UTF-8 字节静默替换为 U+FFFD，因此必须在解析之前检查原始帧
+		// 与 JSON 解析错误共用限流，持续发送非法字节的客户端不会让服务器不停回复
+		if !utf8.Valid(message) {
+			if time.Since(lastParseErrorReply) >= parseErrorInterval {
+				lastParseErrorReply = time.Now()
+				c.sendError(models.ErrCodeBadFormat, i18n.T(c.lang, i18n.KeyInvalidUTF8))
+			}
+			continue
+		}
 		// 解析消息并添加用户名和时间戳
 		var msg models.Message
 		if err := json.Unmarshal(message, &msg); err != nil {
-			log.Printf("解析消息失败: %v", err)
+			c.config.ErrorLog.Printf("解析消息失败: %v", err)
+			// 告知客户端解析失败的原因，便于调试；限流期间的错误只记录日志
+			if time.Since(lastParseErrorReply) >= parseErrorInterval {
+				lastParseErrorReply = time.Now()
+				c.sendError(models.ErrCodeBadFormat, i18n.T(c.lang, i18n.KeyBadFormat, err))
+			}
 			continue
 		}
-		msg.Username = c.username // 设置客户端的用户名 (在同一包内，可以访问私有字段)
-		msg.Timestamp = time.Now()
-		msg.Type = "chat" // 默认消息类型
-
-		parsedMessage, err := json.Marshal(msg)
-		if err != nil {
-			log.Printf("序列化解析后的消息失败: %v", err)
+		if msg.Type == "" {
+			msg.Type = models.TypeChat // 未指定类型时视为聊天消息
+		}
+		// 大小上限取决于消息类型，只能在解析之后检查；超长消息只拒绝这一条，连接保持可用
+		if limit := c.messageSizeLimit(msg.Type); len(message) > limit {
+			c.sendError(models.ErrCodeMsgTooLong, i18n.T(c.lang, i18n.KeyMessageTooLarge, msg.Type, limit))
+			continue
+		}
+		if err := msg.Validate(); err != nil {
+			c.sendError(models.ErrCodeInvalidMessage, i18n.T(c.lang, i18n.KeyInvalidMessage, err))
+			continue
+		}
+		// 只由服务器产生的类型（join、user_list 等）不接受客户端发送，防止伪造系统通知
+		if !msg.Type.ClientAllowed() {
+			c.config.ErrorLog.Printf("客户端 %s (地址: %s) 试图发送 %q 类型的消息，已拒绝", c.username, c.remoteAddr, msg.Type)
+			c.sendError(models.ErrCodeForbidden, i18n.T(c.lang, i18n.KeyTypeForbidden, msg.Type))
+			continue
+		}
+		// 主动离开：标记后退出读取循环，之后与普通断开走完全相同的注销和关闭流程
+		if msg.Type == models.TypeQuit {
+			c.quitting.Store(true)
+			break
+		}
+		// 屏蔽列表只属于这个连接，直接在本地更新，不经过 Hub
+		if msg.Type == models.TypeIgnore || msg.Type == models.TypeUnignore {
+			if models.UserKey(msg.Target) == c.userKey {
+				c.sendError(models.ErrCodeInvalidTarget, i18n.T(c.lang, i18n.KeyIgnoreSelf))
+				continue
+			}
+			c.setIgnored(msg.Target, msg.Type == models.TypeIgnore)
+			continue
+		}
+		// presence 只用于告诉 Hub 用户仍在浏览，不广播也不持久化
+		if msg.Type == models.TypePresence {
+			if time.Since(lastPresence) < presenceInterval {
+				continue
+			}
+			lastPresence = time.Now()
+			c.forward(models.Message{Type: models.TypePresence})
+			continue
+		}
+		// 按类型重新获取历史消息，由 Hub 查询存储后只回复给该用户
+		if msg.Type == models.TypeHistoryRequest {
+			c.forward(models.Message{Type: msg.Type, Types: msg.Types})
+			continue
+		}
+		// 只能获取自己的消息：用户名由 forward 填为本连接的用户名
+		if msg.Type == models.TypeMyHistory {
+			c.forward(models.Message{Type: msg.Type})
+			continue
+		}
+		// 历史元信息只查询本连接所在的房间，房间由 forward 填写
+		if msg.Type == models.TypeHistoryMeta {
+			c.forward(models.Message{Type: msg.Type})
+			continue
+		}
+		// 确认先清除本连接的待确认消息，再交给 Hub 更新发送者看到的投递状态
+		if msg.Type == models.TypeAck {
+			c.ack(msg.MessageID)
+			c.forward(models.Message{Type: msg.Type, MessageID: msg.MessageID})
+			continue
+		}
+		// 已读回执交给 Hub 汇总后通知发送者
+		if msg.Type == models.TypeRead {
+			c.forward(models.Message{Type: msg.Type, MessageID: msg.MessageID})
+			continue
+		}
+		// 状态文字整理为单行后交给 Hub，长度已由 Validate 检查
+		if msg.Type == models.TypeStatus {
+			c.forward(models.Message{Type: msg.Type, Content: models.SanitizeStatus(msg.Content)})
+			continue
+		}
+		// 只能删除自己的消息：用户名和房间由 forward 填为本连接的
+		if msg.Type == models.TypeClearHistory {
+			c.forward(models.Message{Type: msg.Type})
+			continue
+		}
+		// 置顶操作交给 Hub 检查权限和被置顶的消息
+		if msg.Type == models.TypePin || msg.Type == models.TypeUnpin {
+			c.forward(models.Message{Type: msg.Type, MessageID: msg.MessageID})
+			continue
+		}
+		if limit := c.config.MaxContentRunes; limit > 0 && utf8.RuneCountInString(msg.Content) > limit {
+			if !c.config.TruncateContent {
+				c.sendError(models.ErrCodeMsgTooLong, i18n.T(c.lang, i18n.KeyContentTooLong, limit))
+				continue
+			}
+			msg.Content = string([]rune(msg.Content)[:limit])
+		}
+		// 私信交给 Hub 按收件人投递，收件人不在线时保存为离线私信
+		if msg.Type == models.TypeDirect {
+			if models.UserKey(msg.Target) == c.userKey {
+				c.sendError(models.ErrCodeInvalidTarget, i18n.T(c.lang, i18n.KeyDirectSelf))
+				continue
+			}
+			c.forward(models.Message{Type: msg.Type, Target: strings.TrimSpace(msg.Target), Content: msg.Content, Meta: msg.Meta})
 			continue
 		}
+		msg.Username = c.username                  // 设置客户端的用户名 (在同一包内，可以访问私有字段)
+		msg.Room = c.room                          // 消息只属于客户端所在的房间，忽略客户端自报的房间
+		msg.Timestamp = c.config.Clock.Now().UTC() // 统一使用 UTC，历史消息与服务器时区无关
+		msg.Type = models.TypeChat                 // 除上面的控制消息外，客户端只能发送聊天消息
 
-		c.hub.Broadcast(parsedMessage) // 将消息发送到 Hub 进行广播
+		c.hub.Broadcast(c, msg) // 将消息连同发送者一起交给 Hub 进行广播
 	}
 }
 
+// forward 为控制消息填上本连接的用户名、房间和时间，然后交给 Hub 处理。
+func (c *Client) forward(msg models.Message) {
+	msg.Username = c.username
+	msg.Room = c.room
+	msg.Timestamp = c.config.Clock.Now().UTC()
+	c.hub.Broadcast(c, msg)
+}
+
 // writePump 将从 Hub 接收到的消息写入 WebSocket 连接。
 // 这是一个内部方法（小写开头），只在 client 包内部使用。
+//
+// 暂时性的写入失败（见 retryableWriteError）在退避后重试，连续失败超过 WriteRetries 次才放弃连接；
+// 其他写入错误会被 gorilla/websocket 记在连接上，之后的写入都返回同一个错误，因此立即放弃。
+// 等待重试期间不读取新消息以保持顺序，但 select 循环不会被阻塞，ping 和断开请求照常处理。
 func (c *Client) writePump() {
 	ticker := time.NewTicker(pingPeriod) // 定时发送 ping 帧，保持连接活跃
 	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("客户端 %s 的写入协程发生 panic: %v\n%s", c.username, r, debug.Stack())
+		}
 		ticker.Stop()  // 停止定时器
 		c.conn.Close() // 关闭 WebSocket 连接
+		close(c.done)
+		c.unregister() // 写入失败时也及时从 Hub 注销，不必等待 readPump 出错
 	}()
+
+	var (
+		pending  []byte           // 暂时性写入失败、等待重试的帧
+		failures int              // 连续暂时性写入失败的次数
+		retry    <-chan time.Time // 重试定时器，没有待重试的帧时为 nil
+		stream   [][]byte         // 正在发送的流中剩余的帧
+		batch    [][]byte         // 合并模式下等待凑满或超时后一起写出的消息
+		flush    <-chan time.Time // batch 的发送定时器，batch 为空时为 nil
+	)
+	// ready 总是就绪，流中还有剩余帧时用它在 select 中排队写出下一帧，同时不耽误 ping 和断开请求
+	ready := make(chan struct{})
+	close(ready)
+
+	// 开启确认时定期检查超时未确认的消息，否则 ackCheck 为 nil，对应的 case 永远不会触发
+	var ackCheck <-chan time.Time
+	if c.acks {
+		ackTicker := time.NewTicker(c.config.AckTimeout / 2)
+		defer ackTicker.Stop()
+		ackCheck = ackTicker.C
+	}
+	// attempt 写入一帧并维护重试状态，返回 false 表示应放弃连接
+	attempt := func(frame []byte) bool {
+		err := c.writeFrame(frame) // 每次尝试都重新设置写超时
+		if err == nil {
+			failures, pending, retry = 0, nil, nil
+			return true
+		}
+		if !retryableWriteError(err) || failures >= c.config.WriteRetries {
+			c.config.ErrorLog.Printf("写入消息失败: %v", err)
+			return false
+		}
+		failures++
+		c.config.ErrorLog.Printf("写入消息暂时失败，稍后重试: %v", err)
+		pending = frame
+		retry = time.After(c.config.WriteRetryBackoff * time.Duration(failures))
+		return true
+	}
+
+	// flushBatch 把 batch 中的消息合并成一帧写出
+	flushBatch := func() bool {
+		frame := joinFrame(batch)
+		batch, flush = nil, nil
+		return attempt(frame)
+	}
+
 	for {
+		send, priority, streams, flushing := c.send, c.priority, c.streams, flush
+		var next <-chan struct{}
+		if pending != nil {
+			send, priority, streams, flushing = nil, nil, nil, nil // 有待重试的帧时暂停写出其他消息，保持消息顺序
+		} else {
+			if len(stream) == 0 && len(batch) == 0 {
+				// 流优先于普通消息开始发送，例如加入房间时的历史消息先于排队的实时消息
+				select {
+				case stream = <-c.streams:
+				default:
+				}
+			}
+			if len(stream) > 0 {
+				// 流写完之前不发送普通消息（包括凑了一半的 batch），也不开始下一个流
+				send, streams, flushing, next = nil, nil, nil, ready
+			}
+			if len(batch) > 0 {
+				streams = nil // batch 中的消息先于之后到达的流，凑满或超时写出后才开始流
+			}
+		}
+		// select 在多个通道就绪时随机选择，因此先单独检查高优先级通道，保证控制消息不排在积压的聊天消息后面
 		select {
-		case message, ok := <-c.send: // 从发送通道接收消息
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait)) // 设置写操作超时
+		case message := <-priority:
+			if !attempt(message) {
+				return
+			}
+			continue
+		default:
+		}
+		select {
+		case message := <-priority: // 控制消息单独成帧，不与聊天消息合并
+			if !attempt(message) {
+				return
+			}
+		case message, ok := <-send: // 从发送通道接收消息
 			if !ok {
 				// Hub 关闭了通道，发送一个 WebSocket 关闭消息并返回
+				c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
 			}
-
-			w, err := c.conn.NextWriter(websocket.TextMessage) // 获取 WebSocket 写入器
-			if err != nil {
-				return // 写入器获取失败，退出
+			if c.coalesce && c.config.CoalesceDelay > 0 {
+				// 等待后续消息凑成一帧，凑满时立即发送
+				batch = c.gather(append(batch, message))
+				if len(batch) >= c.config.CoalesceMax {
+					if !flushBatch() {
+						return
+					}
+				} else if flush == nil {
+					flush = time.After(c.config.CoalesceDelay)
+				}
+				continue
 			}
-			w.Write(message) // 写入消息
-
-			// 将通道中所有排队的消息也写入
-			n := len(c.send)
-			for i := 0; i < n; i++ {
-				w.Write([]byte("\n")) // 消息之间添加换行符
-				w.Write(<-c.send)
+			if !attempt(c.nextFrame(message)) {
+				return
 			}
-
-			if err := w.Close(); err != nil { // 关闭写入器
+		case <-flushing: // 合并等待超时，发送已经凑到的消息
+			if !flushBatch() {
+				return
+			}
+		case stream = <-streams: // 空闲时收到新的流，下一轮开始逐帧写出
+		case <-next: // 写出流中的下一帧
+			frame := stream[0]
+			stream = stream[1:]
+			if !attempt(frame) {
+				return
+			}
+		case <-retry: // 重试上次暂时性写入失败的帧
+			if !attempt(pending) {
 				return
 			}
+		case <-c.closing: // 被要求断开：先发完排队的消息，再发送关闭帧
+			if pending != nil {
+				if err := c.writeFrame(pending); err != nil {
+					return
+				}
+			}
+			for len(c.priority) > 0 {
+				if err := c.writeFrame(<-c.priority); err != nil {
+					return
+				}
+			}
+			if len(batch) > 0 {
+				if err := c.writeFrame(joinFrame(batch)); err != nil {
+					return
+				}
+			}
+			for len(c.send) > 0 {
+				if err := c.writeFrame(c.nextFrame(<-c.send)); err != nil {
+					return
+				}
+			}
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(c.closeCode, c.closeReason))
+			return
+		case <-ackCheck: // 重发超时未确认的消息，像普通消息一样排队
+			for _, message := range c.expireInflight(c.config.Clock.Now()) {
+				c.SendMessage(message)
+			}
 		case <-ticker.C: // 定时器触发，发送 ping 帧
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				c.config.ErrorLog.Printf("发送 ping 失败: %v", err)
 				return // ping 失败，退出
 			}
 		}
 	}
 }
 
-// NewClient 是 Client 结构体的构造函数。
+// writeFrame 在写超时限制内将一帧文本写入 WebSocket 连接。
+func (c *Client) writeFrame(frame []byte) error {
+	c.frames.SetWriteDeadline(time.Now().Add(writeWait)) // 设置写操作超时
+	return c.frames.WriteMessage(websocket.TextMessage, frame)
+}
+
+// frameWriter 是 writeFrame 用到的连接方法，由 *websocket.Conn 实现。
+type frameWriter interface {
+	SetWriteDeadline(t time.Time) error
+	WriteMessage(messageType int, data []byte) error
+}
+
+// retryableWriteError 报告写入错误是否是暂时性的、重试后连接仍可能继续使用。
+// gorilla/websocket 把写入网络时发生的错误记在连接上，之后的写入都返回同一个错误，并且会去掉这类错误的 Temporary 标记；
+// 只有还没有写出任何数据时发生的错误（例如等待写锁超时）才保留 Temporary，只有它们值得重试。
+func retryableWriteError(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Temporary()
+}
+
+// Config 保存创建客户端时可调整的参数。
+type Config struct {
+	// SendBufferSize 是发送通道的缓冲大小。
+	// 较大的缓冲能容忍突发消息，但每个连接占用更多内存，
+	// 并且慢客户端要积压更多消息才会被发现（SendMessage 在通道满时丢弃消息）。
+	// 较小的缓冲节省内存，但突发流量下更容易丢消息。
+	SendBufferSize int
+
+	// MaxMessageSize 是客户端发来的单条消息（整个 JSON 帧）允许的最大字节数，
+	// 适用于 MaxMessageSizes 中没有单独配置的类型。非正数时使用 DefaultMaxMessageSize。
+	MaxMessageSize int
+
+	// MaxMessageSizes 按消息类型覆盖 MaxMessageSize，例如允许私信比聊天消息更长。
+	// 超过 MaxFrameSize 的值没有意义，那样的帧在解析之前就会导致连接被断开。
+	MaxMessageSizes map[models.MessageType]int
+
+	// MaxContentRunes 限制消息内容的字符数（按 rune 计算，中文一个字算一个），
+	// 与帧的字节上限无关。0 表示不限制。
+	MaxContentRunes int
+
+	// TruncateContent 为 true 时，超出 MaxContentRunes 的内容会被截断后发送；
+	// 为 false 时整条消息被拒绝并回复错误。
+	TruncateContent bool
+
+	// WriteRetries 是暂时性写入失败（见 retryableWriteError）后允许的连续重试次数，超过后才认为客户端已断开。
+	// 0 表示第一次失败就断开。对端断开、写超时等连接本身的错误总是立即断开，重试没有意义。
+	WriteRetries int
+
+	// WriteRetryBackoff 是重试的基础退避时间，第 N 次重试等待 N 倍的该时间。非正数时使用 DefaultWriteRetryBackoff。
+	WriteRetryBackoff time.Duration
+
+	// CoalesceMax 是开启合并的连接一帧最多包含的消息数，非正数时使用 DefaultCoalesceMax。
+	CoalesceMax int
+
+	// CoalesceDelay 是开启合并的连接收到消息后最多等待多久再发送，以便与随后的消息合并成一帧；
+	// 0 表示不等待，只合并已经排队的消息。
+	CoalesceDelay time.Duration
+
+	// AckTimeout 是开启确认的连接等待 ack 的时间，超时后重发一次，再次超时则放弃。非正数时使用 DefaultAckTimeout。
+	AckTimeout time.Duration
+
+	// Clock 提供消息时间戳和最后活动时间，应与 Hub 使用同一个，为 nil 时使用 clock.Real。
+	// 网络读写的超时不受它影响。
+	Clock clock.Clock
+
+	// ErrorLog 用于读写协程的错误日志，会合并短时间内的重复错误。
+	// 应在所有客户端之间共享，这样大量连接同时出错时才能被合并；为 nil 时使用包内默认的记录器。
+	ErrorLog *ratelog.Logger
+}
+
+const (
+	// DefaultSendBufferSize 是未配置时使用的发送通道缓冲大小。
+	DefaultSendBufferSize = 256
+	// DefaultMaxMessageSize 是默认的单条消息字节数上限。
+	DefaultMaxMessageSize = 512
+	// DefaultMaxContentRunes 是默认的消息内容字符数上限。
+	DefaultMaxContentRunes = 280
+	// DefaultWriteRetryBackoff 是默认的写入重试基础退避时间。
+	DefaultWriteRetryBackoff = 200 * time.Millisecond
+	// prioritySendBufferSize 是高优先级发送通道的缓冲大小，控制消息很少，不需要可配置。
+	prioritySendBufferSize = 16
+	// streamBufferSize 是等待发送的分块流（例如分块的历史消息）的个数上限，每个流只在请求历史时产生。
+	streamBufferSize = 4
+)
+
+// defaultErrorLog 是未配置 ErrorLog 时所有客户端共享的错误日志记录器。
+var defaultErrorLog = ratelog.New(ratelog.DefaultWindow)
+
+// DefaultConfig 返回默认的客户端配置。
+func DefaultConfig() Config {
+	return Config{
+		SendBufferSize:    DefaultSendBufferSize,
+		MaxMessageSize:    DefaultMaxMessageSize,
+		MaxContentRunes:   DefaultMaxContentRunes,
+		WriteRetryBackoff: DefaultWriteRetryBackoff,
+	}
+}
+
+// messageSizeLimit 返回该类型消息允许的最大字节数。
+func (c *Client) messageSizeLimit(t models.MessageType) int {
+	if limit, ok := c.config.MaxMessageSizes[t]; ok && limit > 0 {
+		return limit
+	}
+	return c.config.MaxMessageSize
+}
+
+// NewClient 是 Client 结构体的构造函数，使用默认配置并加入默认房间。
 // 它只负责创建 Client 实例，不负责启动其读写协程（由 Hub 在注册成功后启动）。
 func NewClient(h Hub, conn *websocket.Conn, username string) *Client {
+	return NewClientWithConfig(h, conn, ConnInfo{Username: username}, DefaultConfig())
+}
+
+// NewClientWithConfig 使用连接信息和配置创建 Client 实例。
+// 非正数的 SendBufferSize 会回退到 DefaultSendBufferSize，空房间名会回退到默认房间。
+func NewClientWithConfig(h Hub, conn *websocket.Conn, info ConnInfo, cfg Config) *Client {
+	if cfg.SendBufferSize <= 0 {
+		cfg.SendBufferSize = DefaultSendBufferSize
+	}
+	if cfg.ErrorLog == nil {
+		cfg.ErrorLog = defaultErrorLog
+	}
+	if cfg.WriteRetryBackoff <= 0 {
+		cfg.WriteRetryBackoff = DefaultWriteRetryBackoff
+	}
+	if cfg.MaxMessageSize <= 0 {
+		cfg.MaxMessageSize = DefaultMaxMessageSize
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = clock.Real
+	}
+	if cfg.AckTimeout <= 0 {
+		cfg.AckTimeout = DefaultAckTimeout
+	}
+	if cfg.CoalesceMax <= 0 {
+		cfg.CoalesceMax = DefaultCoalesceMax
+	}
+	if info.Room == "" {
+		info.Room = models.DefaultRoom
+	}
 	c := &Client{
-		hub:      h,
-		conn:     conn,
-		send:     make(chan []byte, 256), // 缓冲通道，防止发送过快导致阻塞
-		username: username,
+		hub:        h,
+		conn:       conn,
+		frames:     conn,
+		send:       make(chan []byte, cfg.SendBufferSize), // 缓冲通道，防止发送过快导致阻塞
+		priority:   make(chan []byte, prioritySendBufferSize),
+		streams:    make(chan [][]byte, streamBufferSize),
+		username:   info.Username,
+		userKey:    models.UserKey(info.Username),
+		room:       info.Room,
+		config:     cfg,
+		remoteAddr: info.RemoteAddr,
+		userAgent:  info.UserAgent,
+		observer:   info.Observer,
+		noEcho:     info.NoEcho,
+		lang:       i18n.Normalize(info.Lang),
+		version:    info.Version,
+		acks:       info.Acks,
+		coalesce:   info.Coalesce,
+		inflight:   make(map[int64]*inflight),
+		closing:    make(chan struct{}),
+		done:       make(chan struct{}),
+		ignored:    make(map[string]bool),
 	}
+	c.touch() // 建立连接算作第一次活动
 	return c
 }
@@ -0,0 +1,669 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"chatroom/clock"
+	"chatroom/hub"
+	"chatroom/models"
+	"chatroom/store"
+	"github.com/gorilla/websocket"
+)
+
+// waitTimeout 是测试等待异步事件的上限，正常情况下事件在几毫秒内发生。
+const waitTimeout = 2 * time.Second
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// fakeHub 记录客户端交给 Hub 的消息和注销请求。
+type fakeHub struct {
+	mu         sync.Mutex
+	broadcasts []models.Message
+	senders    []hub.Client // 与 broadcasts 一一对应的发送者
+
+	received     chan models.Message // 每条 Broadcast 也放入这里，便于测试等待
+	unregistered chan hub.Client
+}
+
+func newFakeHub() *fakeHub {
+	return &fakeHub{
+		received:     make(chan models.Message, 64),
+		unregistered: make(chan hub.Client, 4),
+	}
+}
+
+func (h *fakeHub) Register(c hub.Client)   {}
+func (h *fakeHub) Unregister(c hub.Client) { h.unregistered <- c }
+
+func (h *fakeHub) Broadcast(sender hub.Client, msg models.Message) {
+	h.mu.Lock()
+	h.broadcasts = append(h.broadcasts, msg)
+	h.senders = append(h.senders, sender)
+	h.mu.Unlock()
+	h.received <- msg
+}
+
+// next 等待客户端交给 Hub 的下一条消息。
+func (h *fakeHub) next(t *testing.T) models.Message {
+	t.Helper()
+	select {
+	case msg := <-h.received:
+		return msg
+	case <-time.After(waitTimeout):
+		t.Fatal("等待 Hub 收到消息超时")
+		return models.Message{}
+	}
+}
+
+// waitUnregister 等待客户端向 Hub 注销。
+func (h *fakeHub) waitUnregister(t *testing.T) {
+	t.Helper()
+	select {
+	case <-h.unregistered:
+	case <-time.After(waitTimeout):
+		t.Fatal("等待客户端注销超时")
+	}
+}
+
+// connPair 建立一条真实的 WebSocket 连接，返回服务器端和对端（模拟浏览器）的连接。
+func connPair(t *testing.T) (server, peer *websocket.Conn) {
+	t.Helper()
+	conns := make(chan *websocket.Conn, 1)
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("升级连接失败: %v", err)
+			return
+		}
+		conns <- conn
+	}))
+	t.Cleanup(srv.Close)
+
+	peer, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("连接测试服务器失败: %v", err)
+	}
+	t.Cleanup(func() { peer.Close() })
+	select {
+	case server = <-conns:
+	case <-time.After(waitTimeout):
+		t.Fatal("等待服务器端连接超时")
+	}
+	t.Cleanup(func() { server.Close() })
+	return server, peer
+}
+
+// newTestClient 在真实连接上创建客户端，不启动读写协程，由测试按需启动。
+func newTestClient(t *testing.T, info ConnInfo, cfg Config) (*Client, *fakeHub, *websocket.Conn) {
+	t.Helper()
+	server, peer := connPair(t)
+	h := newFakeHub()
+	if info.Username == "" {
+		info.Username = "alice"
+	}
+	return NewClientWithConfig(h, server, info, cfg), h, peer
+}
+
+// readFrame 从对端读取一帧文本。
+func readFrame(t *testing.T, peer *websocket.Conn) string {
+	t.Helper()
+	peer.SetReadDeadline(time.Now().Add(waitTimeout))
+	_, data, err := peer.ReadMessage()
+	if err != nil {
+		t.Fatalf("读取帧失败: %v", err)
+	}
+	return string(data)
+}
+
+// readMessage 从对端读取一帧并解析为一条消息。
+func readMessage(t *testing.T, peer *websocket.Conn) models.Message {
+	t.Helper()
+	frame := readFrame(t, peer)
+	var msg models.Message
+	if err := json.Unmarshal([]byte(frame), &msg); err != nil {
+		t.Fatalf("解析帧 %q 失败: %v", frame, err)
+	}
+	return msg
+}
+
+// waitDone 等待写协程退出。
+func waitDone(t *testing.T, c *Client) {
+	t.Helper()
+	select {
+	case <-c.Done():
+	case <-time.After(waitTimeout):
+		t.Fatal("等待写协程退出超时")
+	}
+}
+
+func TestWriteFailureDropsClient(t *testing.T) {
+	c, h, peer := newTestClient(t, ConnInfo{}, Config{})
+	go c.writePump()
+
+	c.SendMessage([]byte(`{"type":"chat","content":"one"}`))
+	if got := readFrame(t, peer); !strings.Contains(got, `"one"`) {
+		t.Fatalf("对端收到 %q，期望第一条消息", got)
+	}
+
+	// 关闭底层连接模拟网络中断：之后的第一次写入就会失败
+	c.conn.UnderlyingConn().Close()
+	c.SendMessage([]byte(`{"type":"chat","content":"two"}`))
+
+	start := time.Now()
+	h.waitUnregister(t)
+	waitDone(t, c)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("写入失败后 %v 才断开，应立即断开", elapsed)
+	}
+}
+
+// temporaryError 模拟 gorilla/websocket 在写出数据之前返回的暂时性错误。
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "temporary write failure" }
+func (temporaryError) Timeout() bool   { return true }
+func (temporaryError) Temporary() bool { return true }
+
+// flakyWriter 让接下来的 failures 次写入以暂时性错误失败，之后正常写入真实连接，并记录每次设置的写超时。
+type flakyWriter struct {
+	*websocket.Conn
+
+	mu        sync.Mutex
+	failures  int
+	deadlines []time.Time
+}
+
+func (w *flakyWriter) SetWriteDeadline(t time.Time) error {
+	w.mu.Lock()
+	w.deadlines = append(w.deadlines, t)
+	w.mu.Unlock()
+	return w.Conn.SetWriteDeadline(t)
+}
+
+func (w *flakyWriter) WriteMessage(messageType int, data []byte) error {
+	w.mu.Lock()
+	if w.failures > 0 {
+		w.failures--
+		w.mu.Unlock()
+		return temporaryError{}
+	}
+	w.mu.Unlock()
+	return w.Conn.WriteMessage(messageType, data)
+}
+
+// expectNoUnregister 确认客户端在 d 内没有向 Hub 注销。
+func expectNoUnregister(t *testing.T, h *fakeHub, d time.Duration) {
+	t.Helper()
+	select {
+	case <-h.unregistered:
+		t.Fatal("客户端不应被断开")
+	case <-time.After(d):
+	}
+}
+
+func TestTransientWriteFailureIsRetried(t *testing.T) {
+	c, h, peer := newTestClient(t, ConnInfo{}, Config{WriteRetries: 2, WriteRetryBackoff: 10 * time.Millisecond})
+	w := &flakyWriter{Conn: c.conn, failures: 1}
+	c.frames = w
+	go c.writePump()
+
+	c.SendMessage([]byte(`{"type":"chat","content":"one"}`))
+	c.SendMessage([]byte(`{"type":"chat","content":"two"}`))
+	for _, want := range []string{`"one"`, `"two"`} {
+		if got := readFrame(t, peer); !strings.Contains(got, want) {
+			t.Fatalf("对端收到 %q，期望按顺序收到 %s", got, want)
+		}
+	}
+	expectNoUnregister(t, h, 50*time.Millisecond)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.deadlines) < 3 || !w.deadlines[1].After(w.deadlines[0]) {
+		t.Fatalf("每次尝试都应设置新的写超时，实际 %v", w.deadlines)
+	}
+}
+
+func TestWriteRetriesAreLimited(t *testing.T) {
+	c, h, _ := newTestClient(t, ConnInfo{}, Config{WriteRetries: 2, WriteRetryBackoff: time.Millisecond})
+	c.frames = &flakyWriter{Conn: c.conn, failures: 3}
+	go c.writePump()
+
+	c.SendMessage([]byte(`{"type":"chat","content":"one"}`))
+	h.waitUnregister(t)
+	waitDone(t, c)
+}
+
+func TestConnectionErrorIsNotRetried(t *testing.T) {
+	c, h, _ := newTestClient(t, ConnInfo{}, Config{WriteRetries: 5, WriteRetryBackoff: time.Second})
+	go c.writePump()
+
+	// 网络写入错误被 gorilla 记在连接上，重试没有意义，应立即断开而不是等待退避
+	c.conn.UnderlyingConn().Close()
+	c.SendMessage([]byte(`{"type":"chat","content":"one"}`))
+
+	start := time.Now()
+	h.waitUnregister(t)
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("连接出错 %v 后才断开，不应重试", elapsed)
+	}
+}
+
+// startClient 创建客户端并启动读写协程。
+func startClient(t *testing.T, info ConnInfo, cfg Config) (*Client, *fakeHub, *websocket.Conn) {
+	t.Helper()
+	c, h, peer := newTestClient(t, info, cfg)
+	c.RunPumps()
+	return c, h, peer
+}
+
+// send 从对端发送一帧文本。
+func send(t *testing.T, peer *websocket.Conn, frame string) {
+	t.Helper()
+	if err := peer.WriteMessage(websocket.TextMessage, []byte(frame)); err != nil {
+		t.Fatalf("发送帧失败: %v", err)
+	}
+}
+
+// chatFrame 返回内容为 content 的聊天消息帧，只包含 type 和 content 两个字段。
+func chatFrame(content string) string {
+	data, _ := json.Marshal(content)
+	return `{"type":"chat","content":` + string(data) + `}`
+}
+
+// expectError 读取下一帧并断言它是错误码为 code 的错误消息。
+func expectError(t *testing.T, peer *websocket.Conn, code string) models.Message {
+	t.Helper()
+	msg := readMessage(t, peer)
+	if msg.Type != models.TypeError || msg.ErrorCode != code {
+		t.Fatalf("收到 %+v，期望错误码为 %s 的错误消息", msg, code)
+	}
+	return msg
+}
+
+func TestOversizedMessageIsRejectedAndConnectionSurvives(t *testing.T) {
+	const limit = 64
+	_, h, peer := startClient(t, ConnInfo{}, Config{MaxMessageSize: limit})
+
+	content := strings.Repeat("a", limit-len(chatFrame("")))
+	exact := chatFrame(content)
+	if len(exact) != limit {
+		t.Fatalf("测试帧长度 %d，期望 %d", len(exact), limit)
+	}
+	send(t, peer, exact+" ") // 比上限多一个字节
+	expectError(t, peer, models.ErrCodeMsgTooLong)
+
+	send(t, peer, exact) // 恰好等于上限的消息仍然被接受
+	if msg := h.next(t); msg.Content != content {
+		t.Fatalf("Hub 收到 %+v", msg)
+	}
+	select {
+	case <-h.unregistered:
+		t.Fatal("超长消息不应导致连接断开")
+	default:
+	}
+}
+
+func TestPerTypeSizeLimitBoundaries(t *testing.T) {
+	cfg := Config{
+		MaxMessageSize:  64,
+		MaxMessageSizes: map[models.MessageType]int{models.TypeDirect: 128, models.TypeStatus: 40},
+	}
+	// frameOfSize 构造恰好 size 字节的帧，用 a 填充 content
+	frameOfSize := func(prefix string, size int) string {
+		const suffix = `"}`
+		return prefix + strings.Repeat("a", size-len(prefix)-len(suffix)) + suffix
+	}
+	tests := []struct {
+		typ    models.MessageType
+		prefix string
+		limit  int
+	}{
+		{models.TypeChat, `{"type":"chat","content":"`, 64}, // 没有单独配置，使用 MaxMessageSize
+		{models.TypeDirect, `{"type":"dm","target":"bob","content":"`, 128},
+		{models.TypeStatus, `{"type":"status","content":"`, 40},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.typ), func(t *testing.T) {
+			_, h, peer := startClient(t, ConnInfo{}, cfg)
+			send(t, peer, frameOfSize(tt.prefix, tt.limit+1))
+			if msg := expectError(t, peer, models.ErrCodeMsgTooLong); !strings.Contains(msg.Error, strconv.Itoa(tt.limit)) {
+				t.Fatalf("错误 %q 应说明上限 %d", msg.Error, tt.limit)
+			}
+
+			send(t, peer, frameOfSize(tt.prefix, tt.limit))
+			if msg := h.next(t); msg.Type != tt.typ {
+				t.Fatalf("恰好等于上限的 %s 消息应被接受，Hub 收到 %+v", tt.typ, msg)
+			}
+		})
+	}
+}
+
+func TestMalformedJSONGetsErrorReply(t *testing.T) {
+	_, h, peer := startClient(t, ConnInfo{}, Config{})
+
+	send(t, peer, `{"type":"chat","content":`)
+	if msg := expectError(t, peer, models.ErrCodeBadFormat); msg.Error == "" {
+		t.Fatal("错误消息应说明原因")
+	}
+
+	// 格式错误只拒绝这一条，连接仍然可用
+	send(t, peer, chatFrame("hello"))
+	if msg := h.next(t); msg.Content != "hello" {
+		t.Fatalf("Hub 收到 %+v，期望 hello", msg)
+	}
+}
+
+func TestContentRuneLimit(t *testing.T) {
+	const limit = 5
+	over := strings.Repeat("中", limit+1) // 18 个字节，远低于帧的字节上限，但超过字符数上限
+
+	t.Run("拒绝", func(t *testing.T) {
+		_, h, peer := startClient(t, ConnInfo{}, Config{MaxContentRunes: limit})
+		send(t, peer, chatFrame(over))
+		expectError(t, peer, models.ErrCodeMsgTooLong)
+
+		send(t, peer, chatFrame(strings.Repeat("中", limit))) // 恰好等于上限
+		if msg := h.next(t); msg.Content != strings.Repeat("中", limit) {
+			t.Fatalf("Hub 收到 %q", msg.Content)
+		}
+	})
+
+	t.Run("截断", func(t *testing.T) {
+		_, h, peer := startClient(t, ConnInfo{}, Config{MaxContentRunes: limit, TruncateContent: true})
+		send(t, peer, chatFrame("一二三四五六七"))
+		if msg := h.next(t); msg.Content != "一二三四五" {
+			t.Fatalf("截断后的内容 = %q，期望按字符截断为 %q", msg.Content, "一二三四五")
+		}
+	})
+}
+
+func TestPumpsUnregisterOnce(t *testing.T) {
+	c, h, _ := startClient(t, ConnInfo{}, Config{})
+
+	// 关闭底层连接后读写协程都会失败退出，但只应向 Hub 注销一次
+	c.conn.UnderlyingConn().Close()
+	c.SendMessage([]byte(chatFrame("lost")))
+	h.waitUnregister(t)
+	waitDone(t, c)
+
+	select {
+	case <-h.unregistered:
+		t.Fatal("客户端被注销了两次")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWriteFailureRemovesClientFromHub(t *testing.T) {
+	h := hub.NewHub(store.NullMessageStore{})
+	go h.Run()
+	t.Cleanup(func() { h.Shutdown(0) })
+
+	server, _ := connPair(t)
+	c := NewClientWithConfig(h, server, ConnInfo{Username: "alice", Room: "general", Version: models.ProtocolVersion}, Config{})
+	h.Register(c)
+	waitFor(t, "alice 上线", func() bool { return h.ConnectionCount() == 1 })
+
+	c.conn.UnderlyingConn().Close()
+	h.Announce("hello") // 触发一次写入
+	waitFor(t, "alice 被移除", func() bool { return h.ConnectionCount() == 0 })
+	if users := h.OnlineUsers(); len(users) != 0 {
+		t.Fatalf("在线用户 = %v，期望为空", users)
+	}
+}
+
+// waitFor 轮询 check，直到它返回 true 或超时。
+func waitFor(t *testing.T, what string, check func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(waitTimeout)
+	for !check() {
+		if time.Now().After(deadline) {
+			t.Fatalf("等待%s超时", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPresenceFloodIsRateLimited(t *testing.T) {
+	_, h, peer := startClient(t, ConnInfo{}, Config{})
+	for i := 0; i < 5; i++ {
+		send(t, peer, `{"type":"presence"}`)
+	}
+	send(t, peer, chatFrame("after"))
+
+	if msg := h.next(t); msg.Type != models.TypePresence {
+		t.Fatalf("Hub 首先收到 %+v，期望 presence", msg)
+	}
+	if msg := h.next(t); msg.Type != models.TypeChat || msg.Content != "after" {
+		t.Fatalf("Hub 收到 %+v，间隔内重复的 presence 应被丢弃", msg)
+	}
+}
+
+func TestIgnoreAndUnignore(t *testing.T) {
+	c, h, peer := startClient(t, ConnInfo{}, Config{})
+
+	send(t, peer, `{"type":"ignore","target":"Bob"}`)
+	send(t, peer, chatFrame("sync")) // 消息按顺序处理，Hub 收到它时屏蔽已经生效
+	h.next(t)
+	if !c.Ignores("bob") {
+		t.Fatal("ignore 后应屏蔽 bob")
+	}
+
+	send(t, peer, `{"type":"unignore","target":"bob"}`)
+	send(t, peer, chatFrame("sync"))
+	h.next(t)
+	if c.Ignores("bob") {
+		t.Fatal("unignore 后不应再屏蔽 bob")
+	}
+
+	send(t, peer, `{"type":"ignore","target":"alice"}`)
+	expectError(t, peer, models.ErrCodeInvalidTarget)
+}
+
+func TestQuitUnregistersThroughNormalPath(t *testing.T) {
+	c, h, peer := startClient(t, ConnInfo{}, Config{})
+	send(t, peer, `{"type":"quit"}`)
+
+	h.waitUnregister(t)
+	if !c.Quitting() {
+		t.Fatal("发送 quit 后应标记为主动离开")
+	}
+	// 与连接中断一样由 readPump 关闭连接
+	peer.SetReadDeadline(time.Now().Add(waitTimeout))
+	if _, _, err := peer.ReadMessage(); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("quit 后连接应被关闭，实际 %v", err)
+	}
+}
+
+func TestObserverMessagesAreRejected(t *testing.T) {
+	_, h, peer := startClient(t, ConnInfo{Observer: true}, Config{})
+	send(t, peer, chatFrame("hello"))
+	expectError(t, peer, models.ErrCodeForbidden)
+	send(t, peer, chatFrame("again")) // 回复限流，但消息同样被丢弃
+
+	select {
+	case msg := <-h.received:
+		t.Fatalf("观察者的消息不应交给 Hub: %+v", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestPriorityMessageJumpsFullBacklog(t *testing.T) {
+	c, _, peer := newTestClient(t, ConnInfo{}, Config{SendBufferSize: 8})
+	for i := 0; i < 9; i++ { // 第 9 条放不进已满的 send，被丢弃
+		c.SendMessage([]byte(chatFrame(strconv.Itoa(i))))
+	}
+	c.SendPriority([]byte(`{"type":"error","error":"你已被踢出","error_code":"KICKED"}`))
+	go c.writePump()
+
+	if msg := readMessage(t, peer); msg.Type != models.TypeError || msg.ErrorCode != "KICKED" {
+		t.Fatalf("第一帧 = %+v，高优先级消息应越过积压的聊天消息先发出", msg)
+	}
+	for i := 0; i < 8; i++ {
+		if msg := readMessage(t, peer); msg.Type != models.TypeChat || msg.Content != strconv.Itoa(i) {
+			t.Fatalf("第 %d 条积压消息 = %+v，聊天消息应按原顺序发出", i, msg)
+		}
+	}
+}
+
+func TestMalformedContentIsRejected(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame string
+		code  string
+	}{
+		{"非法的 UTF-8", "{\"type\":\"chat\",\"content\":\"caf\xe9\"}", models.ErrCodeBadFormat},
+		{"截断的多字节字符", "{\"type\":\"chat\",\"content\":\"\xe4\xbd\"}", models.ErrCodeBadFormat},
+		{"空字节", `{"type":"chat","content":"a\u0000b"}`, models.ErrCodeInvalidMessage},
+		{"响铃控制字符", `{"type":"chat","content":"ding\u0007"}`, models.ErrCodeInvalidMessage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, h, peer := startClient(t, ConnInfo{}, Config{})
+			send(t, peer, tt.frame)
+			expectError(t, peer, tt.code)
+			if tt.code == models.ErrCodeBadFormat {
+				// 格式错误的回复是限流的：间隔内的第二帧不再回复，下一条回复是之后被拒绝的伪造消息
+				send(t, peer, tt.frame)
+				send(t, peer, `{"type":"user_list","users":["mallory"]}`)
+				expectError(t, peer, models.ErrCodeForbidden)
+			}
+
+			// 被拒绝的消息不交给 Hub，连接保持可用
+			send(t, peer, chatFrame("ok"))
+			if msg := h.next(t); msg.Content != "ok" {
+				t.Fatalf("Hub 收到 %+v，期望之后的正常消息", msg)
+			}
+		})
+	}
+}
+
+func TestServerOnlyTypesAreRejected(t *testing.T) {
+	_, h, peer := startClient(t, ConnInfo{Username: "mallory", Room: "general"}, Config{})
+	send(t, peer, `{"type":"user_list","users":["mallory","admin"]}`)
+	expectError(t, peer, models.ErrCodeForbidden)
+
+	// 拒绝的消息不交给 Hub，之后的正常消息照常处理
+	send(t, peer, chatFrame("hi"))
+	if msg := h.next(t); msg.Type != models.TypeChat || msg.Content != "hi" {
+		t.Fatalf("Hub 收到 %+v，伪造的 user_list 不应被转发", msg)
+	}
+}
+
+func TestClientKeepsDisplayNameAndKey(t *testing.T) {
+	c, _, _ := newTestClient(t, ConnInfo{Username: "Alice"}, Config{})
+	if c.GetUsername() != "Alice" || c.GetUserKey() != "alice" {
+		t.Fatalf("显示名 = %q、键 = %q，期望 Alice、alice", c.GetUsername(), c.GetUserKey())
+	}
+	c.SetUsername("Bob")
+	if c.GetUsername() != "Bob" || c.GetUserKey() != "bob" {
+		t.Fatalf("改名后显示名 = %q、键 = %q", c.GetUsername(), c.GetUserKey())
+	}
+}
+
+func TestMessagesAreAttributedToSender(t *testing.T) {
+	c, h, peer := startClient(t, ConnInfo{Username: "alice", Room: "dev"}, Config{})
+	send(t, peer, `{"type":"chat","username":"mallory","room":"secret","content":"hi"}`)
+
+	msg := h.next(t)
+	if msg.Username != "alice" || msg.Room != "dev" || msg.Timestamp.IsZero() {
+		t.Fatalf("Hub 收到 %+v，用户名和房间应来自连接而不是客户端自报", msg)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.senders) != 1 || h.senders[0] != c {
+		t.Fatalf("发送者 = %v，期望发出消息的连接", h.senders)
+	}
+}
+
+func TestClearHistoryIsAttributedToConnection(t *testing.T) {
+	_, h, peer := startClient(t, ConnInfo{Username: "alice", Room: "dev"}, Config{})
+	send(t, peer, `{"type":"clear_history","username":"bob","room":"secret"}`)
+
+	if msg := h.next(t); msg.Type != models.TypeClearHistory || msg.Username != "alice" || msg.Room != "dev" {
+		t.Fatalf("Hub 收到 %+v，只能删除本连接用户自己的消息", msg)
+	}
+}
+
+func TestStatusIsSanitized(t *testing.T) {
+	_, h, peer := startClient(t, ConnInfo{}, Config{})
+	send(t, peer, `{"type":"status","content":"  in\n a\tmeeting  "}`)
+	if msg := h.next(t); msg.Type != models.TypeStatus || msg.Content != "in a meeting" {
+		t.Fatalf("Hub 收到 %+v，状态文字应整理为单行", msg)
+	}
+
+	send(t, peer, `{"type":"status","content":"`+strings.Repeat("忙", models.MaxStatusRunes+1)+`"}`)
+	expectError(t, peer, models.ErrCodeInvalidMessage)
+}
+
+func TestMessagesAreStampedInUTC(t *testing.T) {
+	local := time.Date(2024, 6, 1, 20, 30, 0, 0, time.FixedZone("CST", 8*3600))
+	_, h, peer := startClient(t, ConnInfo{}, Config{Clock: clock.NewFake(local)})
+	send(t, peer, chatFrame("hi"))
+
+	if got := h.next(t).Timestamp; got.Location() != time.UTC || !got.Equal(local) {
+		t.Fatalf("消息时间 = %v，期望 UTC 的 %v", got, local.UTC())
+	}
+}
+
+func TestStreamFramesAreSentContiguously(t *testing.T) {
+	c, _, peer := newTestClient(t, ConnInfo{}, Config{SendBufferSize: 3})
+	c.SendMessage([]byte(chatFrame("a")))
+	c.SendMessage([]byte(chatFrame("b")))
+	// 流不占用 send 的缓冲，帧再多也不会挤掉排队的普通消息
+	var frames [][]byte
+	for i := 1; i <= 5; i++ {
+		frames = append(frames, []byte(`{"type":"history_chunk","chunk":`+strconv.Itoa(i)+`}`))
+	}
+	frames = append(frames, []byte(`{"type":"history_end","chunk":5}`))
+	c.SendStream(frames)
+	go c.writePump()
+
+	// 流先于排队的普通消息发出，帧之间不插入其他消息
+	for i := 1; i <= 5; i++ {
+		if msg := readMessage(t, peer); msg.Type != models.TypeHistoryChunk || msg.Chunk != i {
+			t.Fatalf("第 %d 帧 = %+v，期望第 %d 个分块", i, msg, i)
+		}
+		if i == 2 {
+			c.SendMessage([]byte(chatFrame("c"))) // 流发送期间到达的实时消息排在流之后
+		}
+	}
+	if msg := readMessage(t, peer); msg.Type != models.TypeHistoryEnd {
+		t.Fatalf("分块之后 = %+v，期望 history_end", msg)
+	}
+	for _, want := range []string{"a", "b", "c"} {
+		if msg := readMessage(t, peer); msg.Type != models.TypeChat || msg.Content != want {
+			t.Fatalf("流之后的消息 = %+v，期望聊天消息 %q", msg, want)
+		}
+	}
+}
+
+func TestSendBufferSize(t *testing.T) {
+	for _, tc := range []struct {
+		configured, want int
+	}{
+		{configured: 8, want: 8},
+		{configured: 1024, want: 1024},
+		{configured: 0, want: DefaultSendBufferSize},
+		{configured: -1, want: DefaultSendBufferSize},
+	} {
+		c, _, _ := newTestClient(t, ConnInfo{}, Config{SendBufferSize: tc.configured})
+		if got := cap(c.send); got != tc.want {
+			t.Errorf("SendBufferSize=%d 时发送通道容量为 %d，期望 %d", tc.configured, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package client
+
+import "bytes"
+
+// DefaultCoalesceMax 是合并模式下一帧最多包含的消息数。
+const DefaultCoalesceMax = 32
+
+// 合并模式（?coalesce=1，见 ConnInfo.Coalesce）改变了帧的格式：一个 WebSocket 文本帧可能包含多条 JSON 消息，
+// 消息之间用换行符分隔，客户端必须先按 "\n" 拆分再逐条解析。JSON 编码会转义字符串中的换行，
+// 因此换行符只会出现在消息之间。未开启合并的连接每帧只有一条消息。
+//
+// 合并的条数不超过 Config.CoalesceMax。Config.CoalesceDelay 为 0 时只合并写出时已经排队的消息，
+// 空闲时收到的消息立即发送；大于 0 时第一条消息最多等待这么久，期间到达的消息凑进同一帧，凑满 CoalesceMax 条时提前发送。
+
+// nextFrame 返回 message 对应的帧。合并模式下把发送通道中已排队的消息一起用换行符连接成一帧，否则 message 单独成帧。
+func (c *Client) nextFrame(message []byte) []byte {
+	if !c.coalesce {
+		return message
+	}
+	return joinFrame(c.gather([][]byte{message}))
+}
+
+// gather 把发送通道中已排队的消息追加到 batch，直到通道为空或 batch 达到 CoalesceMax 条。
+// 只有 writePump 从发送通道读取，因此按 len 取出不会阻塞。
+func (c *Client) gather(batch [][]byte) [][]byte {
+	for n := len(c.send); n > 0 && len(batch) < c.config.CoalesceMax; n-- {
+		batch = append(batch, <-c.send)
+	}
+	return batch
+}
+
+// joinFrame 用换行符连接一批消息。
+func joinFrame(batch [][]byte) []byte {
+	return bytes.Join(batch, []byte{'\n'})
+}
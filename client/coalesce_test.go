@@ -0,0 +1,69 @@
+package client
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCoalesceBurstFlushesAtSizeCap(t *testing.T) {
+	c, _, peer := newTestClient(t, ConnInfo{Coalesce: true}, Config{CoalesceMax: 3, CoalesceDelay: 100 * time.Millisecond})
+	for _, m := range []string{"a", "b", "c", "d"} {
+		c.SendMessage([]byte(m))
+	}
+	start := time.Now()
+	go c.writePump()
+
+	if got := readFrame(t, peer); got != "a\nb\nc" {
+		t.Fatalf("第一帧 = %q，期望凑满 3 条 %q", got, "a\nb\nc")
+	}
+	if elapsed := time.Since(start); elapsed >= 100*time.Millisecond {
+		t.Fatalf("凑满 CoalesceMax 条后应立即发送，实际等待了 %v", elapsed)
+	}
+	if got := readFrame(t, peer); got != "d" {
+		t.Fatalf("第二帧 = %q，期望 %q", got, "d")
+	}
+}
+
+func TestCoalesceIdleFlushAfterDelay(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	c, _, peer := newTestClient(t, ConnInfo{Coalesce: true}, Config{CoalesceDelay: delay})
+	go c.writePump()
+
+	start := time.Now()
+	c.SendMessage([]byte("a"))
+	if got := readFrame(t, peer); got != "a" {
+		t.Fatalf("帧 = %q，期望 %q", got, "a")
+	}
+	if elapsed := time.Since(start); elapsed < delay {
+		t.Fatalf("空闲时的消息应等待 %v 再发送，实际 %v", delay, elapsed)
+	}
+}
+
+func TestCoalesceWithoutDelayJoinsQueuedMessages(t *testing.T) {
+	c, _, peer := newTestClient(t, ConnInfo{Coalesce: true}, Config{})
+	c.SendMessage([]byte("a"))
+	c.SendMessage([]byte("b"))
+	go c.writePump()
+
+	if got := readFrame(t, peer); got != "a\nb" {
+		t.Fatalf("帧 = %q，期望已排队的消息合并为 %q", got, "a\nb")
+	}
+}
+
+func TestCoalesceBatchPrecedesLaterStream(t *testing.T) {
+	c, _, peer := newTestClient(t, ConnInfo{Coalesce: true}, Config{CoalesceDelay: 100 * time.Millisecond})
+	go c.writePump()
+
+	c.SendMessage([]byte("a"))
+	time.Sleep(20 * time.Millisecond) // 让写协程先把 a 放进 batch
+	c.SendStream([][]byte{[]byte("s1"), []byte("s2")})
+
+	var got []string
+	for range 3 {
+		got = append(got, readFrame(t, peer))
+	}
+	if want := "a|s1|s2"; strings.Join(got, "|") != want {
+		t.Fatalf("帧的顺序 = %v，期望 %s", got, want)
+	}
+}
@@ -0,0 +1,52 @@
+// Package clock 抽象了 "当前时间"，使 Hub、存储和客户端中依赖时间的行为
+// （消息时间戳、空闲检测、封禁到期等）可以在测试中用 Fake 精确控制。
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock 提供当前时间。
+type Clock interface {
+	Now() time.Time
+}
+
+// Real 是使用系统时间的 Clock，未配置时的默认值。
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// Fake 是只有被显式设置或推进时才会变化的 Clock，用于测试。可以从多个协程并发使用。
+type Fake struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewFake 创建一个停在 t 的 Fake。
+func NewFake(t time.Time) *Fake {
+	return &Fake{now: t}
+}
+
+// Now 返回当前设置的时间。
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// Set 将时间设置为 t。
+func (f *Fake) Set(t time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = t
+}
+
+// Advance 将时间向前推进 d。
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+}
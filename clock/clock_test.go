@@ -0,0 +1,35 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFake(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	f := NewFake(start)
+	if !f.Now().Equal(start) {
+		t.Fatalf("Now = %v，期望 %v", f.Now(), start)
+	}
+	time.Sleep(time.Millisecond)
+	if !f.Now().Equal(start) {
+		t.Fatal("Fake 不应随真实时间变化")
+	}
+	f.Advance(90 * time.Second)
+	if want := start.Add(90 * time.Second); !f.Now().Equal(want) {
+		t.Fatalf("Advance 后 Now = %v，期望 %v", f.Now(), want)
+	}
+	later := start.Add(24 * time.Hour)
+	f.Set(later)
+	if !f.Now().Equal(later) {
+		t.Fatalf("Set 后 Now = %v，期望 %v", f.Now(), later)
+	}
+}
+
+func TestReal(t *testing.T) {
+	before := time.Now()
+	now := Real.Now()
+	if now.Before(before) || now.Sub(before) > time.Second {
+		t.Fatalf("Real.Now = %v，应接近系统时间 %v", now, before)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"chatroom/models"
+	"chatroom/store"
+)
+
+// exportCSVHeader 是 CSV 导出的表头，各列与 exportCSVRecord 的输出一一对应。
+var exportCSVHeader = []string{"id", "type", "username", "room", "content", "timestamp", "reply_to", "seq"}
+
+// exportCSVRecord 将一条消息转换为 CSV 的一行。
+func exportCSVRecord(msg models.Message) []string {
+	return []string{
+		strconv.FormatInt(msg.ID, 10),
+		string(msg.Type),
+		msg.Username,
+		msg.Room,
+		msg.Content,
+		msg.Timestamp.UTC().Format(time.RFC3339Nano),
+		strconv.FormatInt(msg.ReplyTo, 10),
+		strconv.FormatInt(msg.Seq, 10),
+	}
+}
+
+// serveExport 以附件形式导出房间的全部历史消息，需要管理令牌。
+// 查询参数：room（为空时为默认房间）、format（json 或 csv，默认 json）。
+// 消息从存储中逐条读取并直接写入响应，不会一次性载入内存；开始写入后出错只能中断响应并记录日志。
+func serveExport(ms store.MessageStore, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "方法不被允许", http.StatusMethodNotAllowed)
+		return
+	}
+	if !checkAdminToken(r) {
+		http.Error(w, "未授权", http.StatusUnauthorized)
+		return
+	}
+	query := r.URL.Query()
+	room := query.Get("room")
+	if room == "" {
+		room = *defaultRoom
+	}
+	format := query.Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "csv" {
+		http.Error(w, "format 必须是 json 或 csv", http.StatusBadRequest)
+		return
+	}
+
+	// 响应头在写入第一条消息时才发送，查询一开始就失败时还能返回 500
+	started := false
+	start := func() {
+		started = true
+		contentType := "application/json; charset=utf-8"
+		if format == "csv" {
+			contentType = "text/csv; charset=utf-8"
+		}
+		filename := fmt.Sprintf("chat-%s-%s.%s", room, time.Now().UTC().Format("20060102-150405"), format)
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	}
+
+	buf := bufio.NewWriter(w)
+	var (
+		err   error
+		count int
+	)
+	if format == "csv" {
+		cw := csv.NewWriter(buf) // csv.Writer 负责给包含逗号、引号和换行的字段加引号
+		err = ms.EachMessage(room, func(msg models.Message) error {
+			if !started {
+				start()
+				cw.Write(exportCSVHeader)
+			}
+			count++
+			return cw.Write(exportCSVRecord(msg))
+		})
+		if err == nil && !started {
+			start()
+			cw.Write(exportCSVHeader)
+		}
+		cw.Flush()
+		if err == nil {
+			err = cw.Error()
+		}
+	} else {
+		err = ms.EachMessage(room, func(msg models.Message) error {
+			data, err := json.Marshal(msg)
+			if err != nil {
+				return err
+			}
+			sep := ",\n"
+			if !started {
+				start()
+				sep = "[\n"
+			}
+			count++
+			buf.WriteString(sep)
+			_, err = buf.Write(data)
+			return err
+		})
+		if err == nil {
+			if !started {
+				start()
+				buf.WriteString("[")
+			}
+			buf.WriteString("\n]\n")
+		}
+	}
+	if err != nil && !started {
+		log.Printf("导出房间 %s 的历史失败: %v", room, err)
+		http.Error(w, "导出失败", http.StatusInternalServerError)
+		return
+	}
+	if flushErr := buf.Flush(); err == nil {
+		err = flushErr
+	}
+	if err != nil {
+		log.Printf("导出房间 %s 的历史时中断 (已写入 %d 条): %v", room, count, err)
+		return
+	}
+	log.Printf("管理员导出了房间 %s 的 %d 条历史消息 (格式: %s)", room, count, format)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"chatroom/models"
+	"chatroom/store"
+)
+
+// saveMessages 按顺序保存消息，时间间隔一秒。
+func saveMessages(t *testing.T, s store.MessageStore, msgs ...models.Message) {
+	t.Helper()
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, msg := range msgs {
+		if msg.Type == "" {
+			msg.Type = models.TypeChat
+		}
+		msg.Timestamp = base.Add(time.Duration(i) * time.Second)
+		if _, err := s.SaveMessage(msg); err != nil {
+			t.Fatalf("保存消息失败: %v", err)
+		}
+	}
+}
+
+// exportFilename 返回附件的文件名。
+func exportFilename(t *testing.T, rec *httptest.ResponseRecorder) string {
+	t.Helper()
+	disposition, params, err := mime.ParseMediaType(rec.Header().Get("Content-Disposition"))
+	if err != nil || disposition != "attachment" {
+		t.Fatalf("Content-Disposition = %q，期望附件", rec.Header().Get("Content-Disposition"))
+	}
+	return params["filename"]
+}
+
+func TestServeExportJSON(t *testing.T) {
+	setFlag(t, "admin-token", "secret")
+	s := newStore(t)
+	saveMessages(t, s,
+		models.Message{Username: "alice", Room: "dev", Content: "first"},
+		models.Message{Username: "bob", Room: "random", Content: "elsewhere"},
+		models.Message{Username: "bob", Room: "dev", Content: "second"},
+	)
+	handler := func(w http.ResponseWriter, r *http.Request) { serveExport(s, w, r) }
+
+	rec := get(handler, "/api/export?room=dev&token=secret")
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "application/json") {
+		t.Fatalf("导出返回 %d (%s)", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if name := exportFilename(t, rec); !strings.HasPrefix(name, "chat-dev-") || !strings.HasSuffix(name, ".json") {
+		t.Fatalf("文件名 = %q", name)
+	}
+	var msgs []models.Message
+	if err := json.Unmarshal(rec.Body.Bytes(), &msgs); err != nil {
+		t.Fatalf("导出的不是合法的 JSON 数组: %v\n%s", err, rec.Body)
+	}
+	var got []string
+	for _, msg := range msgs {
+		got = append(got, msg.Username+":"+msg.Content)
+	}
+	if want := []string{"alice:first", "bob:second"}; !slices.Equal(got, want) {
+		t.Fatalf("导出的消息 = %v，期望 %v", got, want)
+	}
+}
+
+func TestServeExportCSV(t *testing.T) {
+	setFlag(t, "admin-token", "secret")
+	s := newStore(t)
+	tricky := "a, \"quoted\"\nsecond line"
+	saveMessages(t, s,
+		models.Message{Username: "alice", Room: "dev", Content: tricky},
+		models.Message{Username: "bob", Room: "dev", Content: "=plain"},
+	)
+	handler := func(w http.ResponseWriter, r *http.Request) { serveExport(s, w, r) }
+
+	rec := get(handler, "/api/export?room=dev&format=csv&token=secret")
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/csv") {
+		t.Fatalf("导出返回 %d (%s)", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if name := exportFilename(t, rec); !strings.HasSuffix(name, ".csv") {
+		t.Fatalf("文件名 = %q", name)
+	}
+	records, err := csv.NewReader(rec.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("导出的不是合法的 CSV: %v", err)
+	}
+	if len(records) != 3 || !slices.Equal(records[0], exportCSVHeader) {
+		t.Fatalf("CSV = %q，期望表头和 2 行", records)
+	}
+	// 包含逗号、引号和换行的内容原样读回
+	if records[1][2] != "alice" || records[1][4] != tricky || records[2][4] != "=plain" {
+		t.Fatalf("CSV 行 = %q", records[1:])
+	}
+	if records[1][5] != "2024-01-01T00:00:00Z" {
+		t.Fatalf("时间列 = %q，期望 RFC 3339 的 UTC 时间", records[1][5])
+	}
+}
+
+func TestServeExportEmptyRoom(t *testing.T) {
+	setFlag(t, "admin-token", "secret")
+	s := newStore(t)
+	handler := func(w http.ResponseWriter, r *http.Request) { serveExport(s, w, r) }
+
+	rec := get(handler, "/api/export?room=empty&token=secret")
+	var msgs []models.Message
+	if err := json.Unmarshal(rec.Body.Bytes(), &msgs); rec.Code != http.StatusOK || err != nil || len(msgs) != 0 {
+		t.Fatalf("空房间的 JSON 导出 = %d %q (%v)，期望空数组", rec.Code, rec.Body, err)
+	}
+	rec = get(handler, "/api/export?room=empty&format=csv&token=secret")
+	if records, err := csv.NewReader(rec.Body).ReadAll(); rec.Code != http.StatusOK || err != nil || len(records) != 1 {
+		t.Fatalf("空房间的 CSV 导出 = %d %q (%v)，期望只有表头", rec.Code, records, err)
+	}
+}
+
+func TestServeExportRejectsBadRequests(t *testing.T) {
+	setFlag(t, "admin-token", "secret")
+	s := newStore(t)
+	handler := func(w http.ResponseWriter, r *http.Request) { serveExport(s, w, r) }
+
+	if rec := get(handler, "/api/export?room=dev"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("没有令牌时返回 %d，期望 401", rec.Code)
+	}
+	if rec := get(handler, "/api/export?room=dev&token=wrong"); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("错误的令牌返回 %d，期望 401", rec.Code)
+	}
+	if rec := get(handler, "/api/export?room=dev&format=xml&token=secret"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("不支持的格式返回 %d，期望 400", rec.Code)
+	}
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodPost, "/api/export?token=secret", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("POST 返回 %d，期望 405", rec.Code)
+	}
+}
+
+// streamingStore 在遍历到最后一条消息时记录响应已经写出的字节数。
+type streamingStore struct {
+	*store.SQLiteMessageStore
+	rec           *httptest.ResponseRecorder
+	total         int
+	writtenBefore int
+}
+
+func (s *streamingStore) EachMessage(room string, fn func(msg models.Message) error) error {
+	n := 0
+	return s.SQLiteMessageStore.EachMessage(room, func(msg models.Message) error {
+		n++
+		if n == s.total {
+			s.writtenBefore = s.rec.Body.Len()
+		}
+		return fn(msg)
+	})
+}
+
+func TestServeExportStreamsLargeHistory(t *testing.T) {
+	setFlag(t, "admin-token", "secret")
+	const total = 2000
+	s := newStore(t)
+	msgs := make([]models.Message, total)
+	for i := range msgs {
+		msgs[i] = models.Message{Username: "alice", Room: "dev", Content: "message " + strconv.Itoa(i)}
+	}
+	saveMessages(t, s, msgs...)
+
+	for _, format := range []string{"json", "csv"} {
+		t.Run(format, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			ms := &streamingStore{SQLiteMessageStore: s, rec: rec, total: total}
+			serveExport(ms, rec, httptest.NewRequest(http.MethodGet, "/api/export?room=dev&format="+format+"&token=secret", nil))
+			if rec.Code != http.StatusOK {
+				t.Fatalf("导出返回 %d", rec.Code)
+			}
+			// 读到最后一条之前，前面的消息已经写入响应，而不是全部读完才一次性输出
+			if ms.writtenBefore == 0 || ms.writtenBefore*2 < rec.Body.Len() {
+				t.Fatalf("读到最后一条时只写出了 %d/%d 字节，导出应边读边写", ms.writtenBefore, rec.Body.Len())
+			}
+
+			var got []string
+			if format == "json" {
+				var exported []models.Message
+				if err := json.Unmarshal(rec.Body.Bytes(), &exported); err != nil {
+					t.Fatalf("解析导出失败: %v", err)
+				}
+				for _, msg := range exported {
+					got = append(got, msg.Content)
+				}
+			} else {
+				records, err := csv.NewReader(rec.Body).ReadAll()
+				if err != nil {
+					t.Fatalf("解析导出失败: %v", err)
+				}
+				for _, record := range records[1:] {
+					got = append(got, record[4])
+				}
+			}
+			if len(got) != total || got[0] != "message 0" || got[total-1] != "message "+strconv.Itoa(total-1) {
+				t.Fatalf("导出了 %d 条，期望按顺序的 %d 条", len(got), total)
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package hub
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"chatroom/audit"
+	"chatroom/models"
+	"chatroom/store"
+)
+
+func TestPersistedMessagesAreAudited(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	auditor, err := audit.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ms := newTestStore(t, store.Config{PersistTypes: []models.MessageType{models.TypeChat}})
+	h := newTestHub(ms, Config{Auditor: auditor})
+	alice := newFakeClient("alice", "general")
+	join(t, h, alice)
+	chat(h, alice, "hello")
+	h.handleBroadcast(alice, models.Message{Type: models.TypePresence, Username: "alice", Room: "general"}) // 瞬时消息不审计
+	auditor.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var types []models.MessageType
+	for _, line := range bytes.Split(bytes.TrimSpace(data), []byte("\n")) {
+		var msg models.Message
+		if err := json.Unmarshal(line, &msg); err != nil {
+			t.Fatalf("审计记录不是合法的 JSON 行: %q", line)
+		}
+		if msg.Type == models.TypeChat && (msg.ID == 0 || msg.Content != "hello") {
+			t.Fatalf("聊天消息的审计记录 = %+v，应带有存储分配的 ID", msg)
+		}
+		types = append(types, msg.Type)
+	}
+	// 加入通知未配置保存到存储，但仍是需要持久化的类型，同样交给审计日志
+	if len(types) != 2 || types[0] != models.TypeJoin || types[1] != models.TypeChat {
+		t.Fatalf("审计记录的类型 = %v，期望 [join chat]", types)
+	}
+}
@@ -0,0 +1,94 @@
+package hub
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"chatroom/i18n"
+	"chatroom/models"
+	"chatroom/store"
+)
+
+// ErrBansUnavailable 表示没有配置封禁存储（例如关闭了持久化），无法封禁用户。
+var ErrBansUnavailable = errors.New("没有配置封禁存储，无法封禁用户")
+
+// activeBan 查询连接的用户名是否被封禁。查询失败时放行，不让数据库故障把所有人挡在门外。只能在 Run 协程中调用。
+func (h *Hub) activeBan(cl Client) (store.Ban, bool) {
+	if h.bans == nil {
+		return store.Ban{}, false
+	}
+	ban, err := h.bans.GetBan(cl.GetUserKey())
+	if err != nil {
+		if !errors.Is(err, store.ErrNotBanned) {
+			log.Printf("查询用户 %s 的封禁失败: %v", cl.GetUsername(), err)
+		}
+		return store.Ban{}, false
+	}
+	return ban, true
+}
+
+// rejectBanned 告诉被封禁的客户端封禁到什么时候，并关闭连接。只能在 Run 协程中调用。
+func (h *Hub) rejectBanned(cl Client, ban store.Ban) {
+	if ban.Until == nil {
+		h.rejectClient(cl, models.CloseBanned, models.ErrCodeBanned, i18n.KeyBanned)
+		return
+	}
+	h.rejectClient(cl, models.CloseBanned, models.ErrCodeBanned, i18n.KeyBannedUntil, ban.Until.Format(time.RFC3339))
+}
+
+// Ban 封禁用户名，duration 为 0 表示永久封禁；已被封禁时用新的期限覆盖。
+// 该用户当前的所有连接（包括观察者）收到 BANNED 错误后被断开，返回断开的连接数。可以从任意协程调用。
+func (h *Hub) Ban(username string, duration time.Duration, reason string) (int, error) {
+	if h.bans == nil {
+		return 0, ErrBansUnavailable
+	}
+	now := h.clock.Now().UTC()
+	ban := store.Ban{Username: models.UserKey(username), Reason: reason, CreatedAt: now}
+	if duration > 0 {
+		until := now.Add(duration)
+		ban.Until = &until
+	}
+	if err := h.bans.SaveBan(ban); err != nil {
+		return 0, err
+	}
+	log.Printf("用户 %s 被封禁，期限: %v", ban.Username, duration)
+
+	kicked := 0
+	h.call(func() {
+		h.forEachClient(func(cl Client) {
+			if cl.GetUserKey() != ban.Username {
+				return
+			}
+			errMsg := models.Message{Type: models.TypeError, ErrorCode: models.ErrCodeBanned}
+			if ban.Until == nil {
+				errMsg.Error = i18n.T(cl.GetLang(), i18n.KeyBanned)
+			} else {
+				errMsg.Error = i18n.T(cl.GetLang(), i18n.KeyBannedUntil, ban.Until.Format(time.RFC3339))
+			}
+			jsonMsg, _ := json.Marshal(errMsg)
+			cl.SendPriority(jsonMsg)
+			// 断开后照常注销，房间里的其他人会看到离开通知
+			cl.Disconnect(models.CloseBanned, models.ErrCodeBanned)
+			kicked++
+		})
+	})
+	return kicked, nil
+}
+
+// Unban 解除用户名的封禁，没有生效的封禁时返回 store.ErrNotBanned。可以从任意协程调用。
+func (h *Hub) Unban(username string) error {
+	if h.bans == nil {
+		return ErrBansUnavailable
+	}
+	return h.bans.DeleteBan(models.UserKey(username))
+}
+
+// Bans 返回当前生效的封禁列表。可以从任意协程调用。
+func (h *Hub) Bans() ([]store.Ban, error) {
+	if h.bans == nil {
+		return nil, ErrBansUnavailable
+	}
+	return h.bans.ListBans(h.clock.Now())
+}
@@ -0,0 +1,80 @@
+package hub
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"chatroom/clock"
+	"chatroom/models"
+	"chatroom/store"
+)
+
+func TestBanRejectsAndExpires(t *testing.T) {
+	clk := clock.NewFake(time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC))
+	ms := newTestStore(t, store.Config{Clock: clk})
+	h := newTestHub(ms, Config{Clock: clk, BanStore: ms})
+	runHub(t, h)
+	// Ban 经过 call 在 Run 协程中执行，注册也放到 Run 协程中，避免与之竞争
+	register := func(username string) *fakeClient {
+		cl := newFakeClient(username, "general")
+		h.call(func() { h.handleRegister(cl) })
+		return cl
+	}
+	expectBanned := func(cl *fakeClient) {
+		t.Helper()
+		if closed, code := cl.isClosed(); !closed || code != models.CloseBanned {
+			t.Fatalf("%s 应以 %d 断开，实际 closed=%v code=%d", cl.username, models.CloseBanned, closed, code)
+		}
+		if errs := cl.ofType(t, models.TypeError); len(errs) != 1 || errs[0].ErrorCode != models.ErrCodeBanned {
+			t.Fatalf("%s 应收到 %s 错误，实际 %+v", cl.username, models.ErrCodeBanned, errs)
+		}
+	}
+
+	alice, bob := register("alice"), register("bob")
+	if n, err := h.Ban("ALICE", time.Hour, "刷屏"); err != nil || n != 1 {
+		t.Fatalf("Ban = %d, %v，期望断开 alice 的 1 个连接", n, err)
+	}
+	expectBanned(alice)
+	h.call(func() { h.handleUnregister(alice) }) // 真实连接断开后由读写协程注销
+	if closed, _ := bob.isClosed(); closed {
+		t.Fatal("封禁只影响被封禁的用户")
+	}
+
+	// 封禁期间重新连接被拒绝，到期后可以连接
+	expectBanned(register("alice"))
+	clk.Advance(time.Hour + time.Second)
+	if closed, code := register("alice").isClosed(); closed {
+		t.Fatalf("封禁到期后仍被拒绝，关闭码 %d", code)
+	}
+	if bans, err := h.Bans(); err != nil || len(bans) != 0 {
+		t.Fatalf("到期后生效的封禁 = %+v (%v)", bans, err)
+	}
+}
+
+func TestPermanentBanAndUnban(t *testing.T) {
+	ms := newTestStore(t, store.Config{})
+	h := newTestHub(ms, Config{BanStore: ms})
+	runHub(t, h)
+	register := func() *fakeClient {
+		cl := newFakeClient("mallory", "general")
+		h.call(func() { h.handleRegister(cl) })
+		return cl
+	}
+
+	if _, err := h.Ban("mallory", 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	if closed, code := register().isClosed(); !closed || code != models.CloseBanned {
+		t.Fatalf("永久封禁的用户应被拒绝，实际 closed=%v code=%d", closed, code)
+	}
+	if err := h.Unban("mallory"); err != nil {
+		t.Fatalf("Unban 失败: %v", err)
+	}
+	if closed, _ := register().isClosed(); closed {
+		t.Fatal("解除封禁后应可以连接")
+	}
+	if err := h.Unban("mallory"); !errors.Is(err, store.ErrNotBanned) {
+		t.Fatalf("没有封禁时 Unban 返回 %v，期望 ErrNotBanned", err)
+	}
+}
@@ -0,0 +1,98 @@
+package hub
+
+import (
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+
+	"chatroom/models"
+)
+
+// DefaultBotName 是 BotConfig 没有设置 Name 时机器人使用的昵称。
+const DefaultBotName = "机器人"
+
+// BotConfig 配置内置的简单机器人：聊天消息的第一个词与某个触发词相同时，
+// 机器人以 Name 的名义在同一房间回复对应的内容。
+type BotConfig struct {
+	Name string `json:"name"`
+
+	// Triggers 把触发词（例如 "!help"，不区分大小写）映射到回复模板。
+	// 模板支持占位符 {username}（触发者的昵称）、{room}（房间名）和 {time}（服务器当前时间）。
+	Triggers map[string]string `json:"triggers"`
+}
+
+// bot 是 BotConfig 整理后的形式，触发词已规范化为小写。
+type bot struct {
+	name     string
+	key      string
+	triggers map[string]string
+}
+
+// newBot 整理配置，没有任何触发词时返回 nil，表示不启用机器人。
+func newBot(cfg *BotConfig) *bot {
+	if cfg == nil || len(cfg.Triggers) == 0 {
+		return nil
+	}
+	name := strings.TrimSpace(cfg.Name)
+	if name == "" {
+		name = DefaultBotName
+	}
+	b := &bot{name: name, key: models.UserKey(name), triggers: make(map[string]string, len(cfg.Triggers))}
+	for trigger, reply := range cfg.Triggers {
+		b.triggers[strings.ToLower(strings.TrimSpace(trigger))] = reply
+	}
+	return b
+}
+
+// isBotName 报告规范化的用户名 key 是否是机器人的昵称，用户不能以机器人的名义登录。
+func (h *Hub) isBotName(key string) bool {
+	return h.bot != nil && h.bot.key == key
+}
+
+// replyAsBot 检查刚广播的聊天消息是否命中触发词，命中时以机器人的名义在同一房间回复。
+// 回复直接保存并广播，不经过 handleBroadcast，因此机器人自己的消息不会再次触发它。
+func (h *Hub) replyAsBot(msg models.Message) {
+	if h.bot == nil || models.UserKey(msg.Username) == h.bot.key {
+		return
+	}
+	fields := strings.Fields(msg.Content)
+	if len(fields) == 0 {
+		return
+	}
+	template, ok := h.bot.triggers[strings.ToLower(fields[0])]
+	if !ok {
+		return
+	}
+	now := h.clock.Now()
+	content := strings.NewReplacer(
+		"{username}", msg.Username,
+		"{room}", msg.Room,
+		"{time}", now.Format(time.DateTime),
+	).Replace(template)
+	if strings.TrimSpace(content) == "" {
+		return
+	}
+
+	reply := models.Message{
+		Type:      models.TypeChat,
+		Username:  h.bot.name,
+		Room:      msg.Room,
+		Content:   content,
+		Timestamp: now.UTC(),
+		ReplyTo:   msg.ID,
+		Ephemeral: msg.Ephemeral, // 对瞬时消息的回复同样是瞬时的
+	}
+	if !reply.IsEphemeral() {
+		reply.Seq = h.nextSeq(reply.Room)
+	}
+	reply.ID = h.saveMessage(reply)
+	data, err := json.Marshal(reply)
+	if err != nil {
+		log.Printf("序列化机器人回复失败: %v", err)
+		return
+	}
+	h.fanoutTracked(h.roomTargets(reply.Room), reply.ID, data, func(cl Client) bool {
+		return !cl.Ignores(reply.Username)
+	})
+}
@@ -0,0 +1,80 @@
+package hub
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"chatroom/clock"
+	"chatroom/models"
+	"chatroom/store"
+)
+
+func newBotHub(t *testing.T, clk clock.Clock, triggers map[string]string) *Hub {
+	t.Helper()
+	ms := newTestStore(t, store.Config{PersistTypes: []models.MessageType{models.TypeChat}})
+	return newTestHub(ms, Config{Clock: clk, Bot: &BotConfig{Name: "helper", Triggers: triggers}})
+}
+
+func TestBotRepliesToTrigger(t *testing.T) {
+	clk := clock.NewFake(time.Date(2024, 5, 1, 8, 30, 0, 0, time.UTC))
+	h := newBotHub(t, clk, map[string]string{
+		"!help": "你好 {username}，这里是 {room}",
+		"!time": "现在是 {time}",
+	})
+	alice, bob := newFakeClient("alice", "general"), newFakeClient("bob", "general")
+	join(t, h, alice, bob)
+
+	chat(h, alice, "!HELP please") // 触发词不区分大小写，只看第一个词
+	chat(h, alice, "hello !help")  // 不在开头，不触发
+	chat(h, alice, "!time")
+	want := []string{"!HELP please", "你好 alice，这里是 general", "hello !help", "!time", "现在是 2024-05-01 08:30:00"}
+	if got := bob.chatContents(t); !slices.Equal(got, want) {
+		t.Fatalf("bob 收到 %v，期望 %v", got, want)
+	}
+
+	chats := bob.ofType(t, models.TypeChat)
+	reply := chats[1]
+	if reply.Username != "helper" || reply.Room != "general" || reply.ReplyTo != chats[0].ID || reply.ID == 0 {
+		t.Fatalf("机器人回复 = %+v，应以 helper 的名义保存并回复触发的消息 %d", reply, chats[0].ID)
+	}
+}
+
+func TestBotRepliesDoNotRetrigger(t *testing.T) {
+	h := newBotHub(t, clock.Real, map[string]string{
+		"!echo": "!echo",
+		"!ping": "!help pong",
+		"!help": "帮助",
+	})
+	alice := newFakeClient("alice", "general")
+	join(t, h, alice)
+
+	chat(h, alice, "!echo")
+	chat(h, alice, "!ping")
+	want := []string{"!echo", "!echo", "!ping", "!help pong"}
+	if got := alice.chatContents(t); !slices.Equal(got, want) {
+		t.Fatalf("alice 收到 %v，机器人的回复不应再次触发它", got)
+	}
+}
+
+func TestBotNameIsReserved(t *testing.T) {
+	h := newBotHub(t, clock.Real, map[string]string{"!help": "帮助"})
+	impostor := newFakeClient(" Helper", "general")
+	h.handleRegister(impostor)
+	if closed, code := impostor.isClosed(); !closed || code != models.CloseNickTaken {
+		t.Fatalf("使用机器人昵称的连接应以 %d 关闭，实际 closed=%v code=%d", models.CloseNickTaken, closed, code)
+	}
+}
+
+func TestBotDisabledWithoutTriggers(t *testing.T) {
+	if b := newBot(&BotConfig{Name: "helper"}); b != nil {
+		t.Fatalf("没有触发词时不应启用机器人，得到 %+v", b)
+	}
+	h := newTestHub(nil, Config{Bot: &BotConfig{Name: "helper"}})
+	helper := newFakeClient("helper", "general")
+	join(t, h, helper)
+	chat(h, helper, "!help")
+	if got := helper.chatContents(t); !slices.Equal(got, []string{"!help"}) {
+		t.Fatalf("收到 %v，未启用机器人时不应有回复", got)
+	}
+}
@@ -0,0 +1,42 @@
+package hub
+
+import (
+	"encoding/json"
+	"log"
+
+	"chatroom/i18n"
+	"chatroom/models"
+)
+
+// handleClearHistory 删除发送者自己保存的所有消息（默认只删除当前房间的，clearGlobal 时删除所有房间的），
+// 然后向受影响的房间广播 clear_history 通知，客户端据此从界面上移除该用户的消息。
+// 用户名来自连接本身而不是消息内容，因此用户只能删除自己的消息。只能在 Run 协程中调用。
+func (h *Hub) handleClearHistory(sender Client) {
+	room := sender.GetRoom()
+	if h.clearGlobal {
+		room = ""
+	}
+	deleted, err := h.messageStore.DeleteMessagesByUser(sender.GetUsername(), room)
+	if err != nil {
+		log.Printf("删除用户 %s 的历史消息失败: %v", sender.GetUsername(), err)
+		h.sendError(sender, models.ErrCodeClearFailed, i18n.T(sender.GetLang(), i18n.KeyClearFailed))
+		return
+	}
+	// 缓存中可能还有被删除的消息，整体丢弃，之后从存储中重新加载
+	h.resetHistoryCache()
+	log.Printf("用户 %s 删除了自己的 %d 条历史消息 (房间: %q)", sender.GetUsername(), deleted, room)
+
+	notice := models.Message{
+		Type:      models.TypeClearHistory,
+		Username:  sender.GetUsername(),
+		Room:      room,
+		Count:     int(deleted),
+		Timestamp: h.clock.Now().UTC(),
+	}
+	jsonMsg, err := json.Marshal(notice)
+	if err != nil {
+		log.Printf("序列化清除历史通知失败: %v", err)
+		return
+	}
+	h.fanout(h.roomTargets(room), jsonMsg, nil)
+}
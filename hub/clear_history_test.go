@@ -0,0 +1,85 @@
+package hub
+
+import (
+	"slices"
+	"testing"
+
+	"chatroom/models"
+	"chatroom/store"
+)
+
+// clearHistory 以 sender 的身份发送 clear_history 请求，claimed 是请求中自报的用户名。
+func clearHistory(h *Hub, sender *fakeClient, claimed string) {
+	h.handleBroadcast(sender, models.Message{Type: models.TypeClearHistory, Username: claimed, Room: sender.room})
+}
+
+// savedContents 返回存储中房间的消息内容。
+func savedContents(t *testing.T, ms store.MessageStore, room string) []string {
+	t.Helper()
+	msgs, err := ms.GetMessages(room, 100)
+	if err != nil {
+		t.Fatalf("读取 %s 的消息失败: %v", room, err)
+	}
+	var out []string
+	for _, msg := range msgs {
+		out = append(out, msg.Username+":"+msg.Content)
+	}
+	return out
+}
+
+func TestClearHistoryDeletesOnlyOwnMessages(t *testing.T) {
+	ms := newTestStore(t, store.Config{PersistTypes: []models.MessageType{models.TypeChat}})
+	seedChats(t, ms, "random", "elsewhere") // bob 在其他房间的消息
+	h := newTestHub(ms, Config{})
+	alice, bob := newFakeClient("alice", "general"), newFakeClient("bob", "general")
+	join(t, h, alice, bob)
+	chat(h, alice, "a1")
+	chat(h, bob, "b1")
+	chat(h, alice, "a2")
+	bob.reset()
+
+	// 请求中自报的用户名被忽略，alice 只能删除自己的消息
+	clearHistory(h, alice, "bob")
+	if got := savedContents(t, ms, "general"); !slices.Equal(got, []string{"bob:b1"}) {
+		t.Fatalf("general 剩下 %v，应只删除 alice 的消息", got)
+	}
+	if got := savedContents(t, ms, "random"); !slices.Equal(got, []string{"bob:elsewhere"}) {
+		t.Fatalf("random 剩下 %v，默认不影响其他房间", got)
+	}
+
+	notices := bob.ofType(t, models.TypeClearHistory)
+	if len(notices) != 1 || notices[0].Username != "alice" || notices[0].Room != "general" || notices[0].Count != 2 {
+		t.Fatalf("bob 收到的通知 = %+v，期望 alice 在 general 删除了 2 条", notices)
+	}
+
+	// 之后加入的用户看不到被删除的消息
+	carol := newFakeClient("carol", "general")
+	join(t, h, carol)
+	if got := historyContents(t, carol); !slices.Equal(got, []string{"b1"}) {
+		t.Fatalf("carol 的历史 = %v，不应包含已删除的消息", got)
+	}
+}
+
+func TestClearHistoryGlobal(t *testing.T) {
+	ms := newTestStore(t, store.Config{PersistTypes: []models.MessageType{models.TypeChat}})
+	h := newTestHub(ms, Config{ClearHistoryGlobal: true})
+	alice, bob := newFakeClient("alice", "general"), newFakeClient("bob", "random")
+	aliceRandom := newFakeClient("alice", "random")
+	join(t, h, alice, bob, aliceRandom)
+	chat(h, alice, "a1")
+	chat(h, aliceRandom, "a2")
+	chat(h, bob, "b1")
+	bob.reset()
+
+	clearHistory(h, alice, "alice")
+	if got := savedContents(t, ms, "general"); len(got) != 0 {
+		t.Fatalf("general 剩下 %v", got)
+	}
+	if got := savedContents(t, ms, "random"); !slices.Equal(got, []string{"bob:b1"}) {
+		t.Fatalf("random 剩下 %v，应删除 alice 在所有房间的消息", got)
+	}
+	notices := bob.ofType(t, models.TypeClearHistory)
+	if len(notices) != 1 || notices[0].Username != "alice" || notices[0].Room != "" || notices[0].Count != 2 {
+		t.Fatalf("其他房间的 bob 收到的通知 = %+v，期望不限房间的 2 条", notices)
+	}
+}
@@ -0,0 +1,49 @@
+package hub
+
+import (
+	"testing"
+	"time"
+
+	"chatroom/clock"
+	"chatroom/models"
+	"chatroom/store"
+)
+
+func TestServerTimestampsComeFromClock(t *testing.T) {
+	joinedAt := time.Date(2024, 5, 1, 8, 0, 0, 0, time.FixedZone("CST", 8*3600))
+	clk := clock.NewFake(joinedAt)
+	ms := newTestStore(t, store.Config{Clock: clk})
+	h := newTestHub(ms, Config{Clock: clk})
+	alice, bob := newFakeClient("alice", "general"), newFakeClient("bob", "general")
+	join(t, h, alice, bob)
+
+	clk.Advance(10 * time.Minute)
+	h.handleUnregister(alice)
+
+	joins, leaves := bob.ofType(t, models.TypeJoin), bob.ofType(t, models.TypeLeave)
+	if len(joins) != 1 || !joins[0].Timestamp.Equal(joinedAt) {
+		t.Fatalf("加入通知 = %+v，时间戳应为 %v", joins, joinedAt)
+	}
+	if len(leaves) != 1 || !leaves[0].Timestamp.Equal(joinedAt.Add(10*time.Minute)) {
+		t.Fatalf("离开通知 = %+v，时间戳应为时钟推进后的时间", leaves)
+	}
+
+	// 保存的时间同样来自时钟，并按时间顺序返回
+	saved, err := ms.GetMessages("general", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var times []time.Time
+	for _, msg := range saved {
+		times = append(times, msg.Timestamp)
+	}
+	want := []time.Time{joinedAt, joinedAt, joinedAt.Add(10 * time.Minute)} // alice、bob 加入，alice 离开
+	if len(times) != len(want) {
+		t.Fatalf("保存的消息时间 = %v，期望 %v", times, want)
+	}
+	for i := range want {
+		if !times[i].Equal(want[i]) || times[i].Location() != time.UTC {
+			t.Fatalf("保存的消息时间 = %v，期望 UTC 的 %v", times, want)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package hub
+
+import (
+	"encoding/json"
+	"log"
+	"slices"
+
+	"chatroom/models"
+)
+
+// maxTrackedDeliveries 是同时跟踪投递状态的最近聊天消息条数，超过时放弃最早的那条，
+// 之后对它的确认和已读回执被忽略。
+const maxTrackedDeliveries = 1024
+
+// delivery 是一条聊天消息的投递状态。收件人在广播时确定：同一房间内除发送者以外、没有屏蔽发送者的在线用户，
+// 按规范化的用户名计算，同一用户的任何一台设备确认或已读都算该用户的。
+type delivery struct {
+	room       string
+	sender     string            // 发送者的规范化用户名
+	recipients map[string]string // 收件人的规范化用户名 -> 展示用的用户名
+	delivered  map[string]bool
+	read       map[string]bool
+	dirty      bool // 上次汇总之后状态有变化，下次汇总时通知发送者
+}
+
+// trackDelivery 开始跟踪刚广播的聊天消息的投递状态。未开启投递状态、消息没有 ID 或没有收件人时不跟踪。
+func (h *Hub) trackDelivery(sender Client, msg models.Message) {
+	if h.deliveryInterval <= 0 || msg.ID == 0 {
+		return
+	}
+	d := &delivery{
+		room:       msg.Room,
+		sender:     sender.GetUserKey(),
+		recipients: make(map[string]string),
+		delivered:  make(map[string]bool),
+		read:       make(map[string]bool),
+	}
+	senderName := sender.GetUsername()
+	for _, cl := range h.roomTargets(msg.Room) {
+		if cl.IsObserver() || cl.GetUserKey() == d.sender || cl.Ignores(senderName) {
+			continue
+		}
+		d.recipients[cl.GetUserKey()] = cl.GetUsername()
+	}
+	if len(d.recipients) == 0 {
+		return
+	}
+	h.deliveries[msg.ID] = d
+	h.deliveryOrder = append(h.deliveryOrder, msg.ID)
+	if len(h.deliveryOrder) > maxTrackedDeliveries {
+		delete(h.deliveries, h.deliveryOrder[0])
+		h.deliveryOrder = h.deliveryOrder[1:]
+	}
+}
+
+// handleReceipt 记录收件人对消息的确认（ack）或已读回执（read），已读同时意味着已收到。
+// 不是该消息收件人的连接发来的回执被忽略，发送者不能替别人确认。
+func (h *Hub) handleReceipt(sender Client, msg models.Message) {
+	d, ok := h.deliveries[msg.MessageID]
+	if !ok {
+		return
+	}
+	key := sender.GetUserKey()
+	if _, ok := d.recipients[key]; !ok {
+		return
+	}
+	if !d.delivered[key] {
+		d.delivered[key] = true
+		d.dirty = true
+	}
+	if msg.Type == models.TypeRead && !d.read[key] {
+		d.read[key] = true
+		d.dirty = true
+	}
+}
+
+// flushDeliveries 把状态有变化的消息汇总为 "delivery_status" 消息，发给发送者在该房间的连接。
+// 所有收件人都已读的消息汇总后不再跟踪。
+func (h *Hub) flushDeliveries() {
+	kept := h.deliveryOrder[:0]
+	for _, id := range h.deliveryOrder {
+		d, ok := h.deliveries[id]
+		if !ok {
+			continue
+		}
+		if d.dirty {
+			d.dirty = false
+			h.sendDeliveryStatus(id, d)
+		}
+		if len(d.read) == len(d.recipients) {
+			delete(h.deliveries, id)
+			continue
+		}
+		kept = append(kept, id)
+	}
+	h.deliveryOrder = kept
+}
+
+// sendDeliveryStatus 向发送者在消息所在房间的连接发送一条消息的投递状态，收件人按名字排序。
+func (h *Hub) sendDeliveryStatus(id int64, d *delivery) {
+	status := models.Message{
+		Type:      models.TypeDeliveryStatus,
+		Room:      d.room,
+		MessageID: id,
+		Count:     len(d.recipients),
+		Timestamp: h.clock.Now().UTC(),
+	}
+	for key := range d.delivered {
+		status.Delivered = append(status.Delivered, d.recipients[key])
+	}
+	for key := range d.read {
+		status.ReadBy = append(status.ReadBy, d.recipients[key])
+	}
+	slices.Sort(status.Delivered)
+	slices.Sort(status.ReadBy)
+	data, err := json.Marshal(status)
+	if err != nil {
+		log.Printf("序列化投递状态失败: %v", err)
+		return
+	}
+	for _, cl := range h.clients[d.sender] {
+		if cl.GetRoom() == d.room {
+			cl.SendMessage(data)
+		}
+	}
+}
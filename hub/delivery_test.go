@@ -0,0 +1,98 @@
+package hub
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"chatroom/models"
+	"chatroom/store"
+)
+
+// receipt 以 cl 的身份发送对消息 id 的确认或已读回执。
+func receipt(h *Hub, cl *fakeClient, typ models.MessageType, id int64) {
+	h.handleBroadcast(cl, models.Message{Type: typ, Username: cl.username, Room: cl.room, MessageID: id})
+}
+
+// flushStatuses 汇总投递状态，返回这次发给 cl 的 delivery_status 消息。
+func flushStatuses(t *testing.T, h *Hub, cl *fakeClient) []models.Message {
+	t.Helper()
+	cl.reset()
+	h.flushDeliveries()
+	return cl.ofType(t, models.TypeDeliveryStatus)
+}
+
+func TestDeliveryStatusAggregatesReceipts(t *testing.T) {
+	ms := newTestStore(t, store.Config{PersistTypes: []models.MessageType{models.TypeChat}})
+	h := newTestHub(ms, Config{DeliveryStatusInterval: time.Hour}) // 测试中手动汇总
+	alice, bob, carol := newFakeClient("alice", "general"), newFakeClient("Bob", "general"), newFakeClient("carol", "general")
+	dave, erin := newFakeClient("dave", "general"), newFakeClient("erin", "random")
+	dave.ignore("alice")
+	join(t, h, alice, bob, carol, dave, erin)
+	chat(h, alice, "hello")
+	id := alice.ofType(t, models.TypeChat)[0].ID
+
+	check := func(step string, delivered, readBy []string) {
+		t.Helper()
+		statuses := flushStatuses(t, h, alice)
+		if len(statuses) != 1 {
+			t.Fatalf("%s：alice 收到 %d 条投递状态，期望 1 条", step, len(statuses))
+		}
+		s := statuses[0]
+		if s.MessageID != id || s.Count != 2 || !slices.Equal(s.Delivered, delivered) || !slices.Equal(s.ReadBy, readBy) {
+			t.Fatalf("%s：投递状态 = %+v，期望收件人 2 个、已收到 %v、已读 %v", step, s, delivered, readBy)
+		}
+	}
+
+	if got := flushStatuses(t, h, alice); len(got) != 0 {
+		t.Fatalf("还没有任何回执时不应发送状态，收到 %+v", got)
+	}
+
+	receipt(h, bob, models.TypeAck, id)
+	check("bob 确认后", []string{"Bob"}, nil)
+	if got := flushStatuses(t, h, alice); len(got) != 0 {
+		t.Fatalf("状态没有变化时不应重复发送，收到 %+v", got)
+	}
+
+	// 已读同时意味着已收到
+	receipt(h, carol, models.TypeRead, id)
+	check("carol 已读后", []string{"Bob", "carol"}, []string{"carol"})
+
+	// 不是收件人的回执被忽略：发送者自己、屏蔽了发送者的 dave、其他房间的 erin
+	receipt(h, alice, models.TypeRead, id)
+	receipt(h, dave, models.TypeRead, id)
+	receipt(h, erin, models.TypeRead, id)
+	if got := flushStatuses(t, h, alice); len(got) != 0 {
+		t.Fatalf("非收件人的回执不应改变状态，收到 %+v", got)
+	}
+
+	// 所有收件人都已读后汇总最后一次，之后不再跟踪
+	receipt(h, bob, models.TypeRead, id)
+	check("全部已读后", []string{"Bob", "carol"}, []string{"Bob", "carol"})
+	if _, ok := h.deliveries[id]; ok {
+		t.Fatal("全部已读的消息应停止跟踪")
+	}
+	if got := bob.ofType(t, models.TypeDeliveryStatus); len(got) != 0 {
+		t.Fatalf("投递状态只发给发送者，bob 收到 %+v", got)
+	}
+}
+
+func TestDeliveryTrackingIsBounded(t *testing.T) {
+	ms := newTestStore(t, store.Config{PersistTypes: []models.MessageType{models.TypeChat}})
+	h := newTestHub(ms, Config{DeliveryStatusInterval: time.Hour})
+	alice, bob := newFakeClient("alice", "general"), newFakeClient("bob", "general")
+	join(t, h, alice, bob)
+	for i := 0; i < maxTrackedDeliveries+3; i++ {
+		chat(h, alice, "m")
+	}
+	if len(h.deliveries) != maxTrackedDeliveries || len(h.deliveryOrder) != maxTrackedDeliveries {
+		t.Fatalf("跟踪了 %d 条消息，上限是 %d", len(h.deliveries), maxTrackedDeliveries)
+	}
+
+	// 最早的消息已被放弃，对它的回执被忽略
+	first := alice.ofType(t, models.TypeChat)[0].ID
+	receipt(h, bob, models.TypeAck, first)
+	if got := flushStatuses(t, h, alice); len(got) != 0 {
+		t.Fatalf("已放弃跟踪的消息不应再有状态，收到 %+v", got)
+	}
+}
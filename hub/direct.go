@@ -0,0 +1,93 @@
+package hub
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+
+	"chatroom/i18n"
+	"chatroom/models"
+	"chatroom/store"
+)
+
+// inboxLimit 是每个用户最多保存的待投递离线私信数，防止有人往别人的收件箱里灌满消息。
+const inboxLimit = 100
+
+// handleDirect 投递私信：收件人的所有连接（不限房间）都会收到，发送者的所有连接收到回显；
+// 收件人不在线时保存为离线私信，待其下次连接时由 deliverInbox 投递。只能在 Run 协程中调用。
+func (h *Hub) handleDirect(sender Client, msg models.Message) {
+	msg.Room = "" // 私信不属于任何房间
+	key := models.UserKey(msg.Target)
+	recipients := h.clients[key]
+	if len(recipients) > 0 {
+		msg.Target = recipients[0].GetUsername() // 使用收件人自己的昵称写法
+	} else {
+		if !h.queueDirect(sender, key, msg) {
+			return
+		}
+		msg.Offline = true
+	}
+
+	jsonMsg, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("序列化私信失败: %v", err)
+		return
+	}
+	// 屏蔽了发送者的收件人不会收到私信，但发送者照常看到回显，不暴露屏蔽关系
+	if len(recipients) > 0 && !h.ignoredBy(key, sender) {
+		for _, cl := range recipients {
+			cl.SendMessage(jsonMsg)
+		}
+	}
+	// 回显给发送者的所有连接，多端登录时其他设备也能看到自己发出的私信
+	for _, cl := range h.clients[sender.GetUserKey()] {
+		if cl == sender && sender.SuppressEcho() {
+			continue
+		}
+		cl.SendMessage(jsonMsg)
+	}
+}
+
+// queueDirect 为不在线的收件人（规范化的用户名）保存离线私信，无法保存时向发送者回复错误并返回 false。
+// 只为曾经连接过的用户保存，避免拼错的昵称让私信石沉大海。
+func (h *Hub) queueDirect(sender Client, key string, msg models.Message) bool {
+	if h.inbox == nil || h.lastSeen(key) == nil {
+		h.sendError(sender, models.ErrCodeUserOffline, i18n.T(sender.GetLang(), i18n.KeyUserOffline, msg.Target))
+		return false
+	}
+	if err := h.inbox.SaveUndelivered(key, msg, inboxLimit); err != nil {
+		if errors.Is(err, store.ErrInboxFull) {
+			h.sendError(sender, models.ErrCodeInboxFull, i18n.T(sender.GetLang(), i18n.KeyInboxFull, msg.Target))
+			return false
+		}
+		log.Printf("保存发给 %s 的离线私信失败: %v", key, err)
+		h.sendError(sender, models.ErrCodeUserOffline, i18n.T(sender.GetLang(), i18n.KeyUserOffline, msg.Target))
+		return false
+	}
+	log.Printf("用户 %s 不在线，已保存来自 %s 的离线私信", key, sender.GetUsername())
+	return true
+}
+
+// deliverInbox 将用户不在线期间收到的私信按发送顺序发给刚注册的（非观察者）连接，并在存储中标记为已投递。
+// 多端登录时只有用户的第一个连接会收到，之后的连接查询到的收件箱是空的。
+func (h *Hub) deliverInbox(cl Client) {
+	if h.inbox == nil {
+		return
+	}
+	messages, err := h.inbox.TakeUndelivered(cl.GetUserKey())
+	if err != nil {
+		log.Printf("读取用户 %s 的离线私信失败: %v", cl.GetUsername(), err)
+		return
+	}
+	for _, msg := range messages {
+		jsonMsg, err := json.Marshal(msg)
+		if err != nil {
+			log.Printf("序列化离线私信失败: %v", err)
+			continue
+		}
+		cl.SendMessage(jsonMsg)
+	}
+	if len(messages) > 0 {
+		log.Printf("已向 %s 投递 %d 条离线私信", cl.GetUsername(), len(messages))
+	}
+}
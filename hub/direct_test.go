@@ -0,0 +1,60 @@
+package hub
+
+import (
+	"testing"
+
+	"chatroom/models"
+	"chatroom/store"
+)
+
+// dm 以 sender 的身份给 target 发一条私信。
+func dm(h *Hub, sender *fakeClient, target, content string) {
+	h.handleBroadcast(sender, models.Message{Type: models.TypeDirect, Username: sender.username, Room: sender.room, Target: target, Content: content})
+}
+
+func TestOfflineDirectMessageIsDeliveredOnConnect(t *testing.T) {
+	ms := newTestStore(t, store.Config{})
+	h := newTestHub(ms, Config{UserStore: ms, InboxStore: ms})
+	alice, bob := newFakeClient("alice", "general"), newFakeClient("bob", "dev")
+	join(t, h, alice, bob)
+	h.handleUnregister(bob) // bob 连接过，之后下线
+
+	dm(h, alice, "Bob", "第一条")
+	dm(h, alice, "bob", "第二条")
+	echoes := alice.ofType(t, models.TypeDirect)
+	if len(echoes) != 2 || !echoes[0].Offline {
+		t.Fatalf("alice 的回显 = %+v，应标记为离线投递", echoes)
+	}
+
+	// bob 重新连接（任意房间），按发送顺序收到离线私信
+	bob = newFakeClient("bob", "random")
+	join(t, h, bob)
+	got := bob.ofType(t, models.TypeDirect)
+	if len(got) != 2 || got[0].Content != "第一条" || got[1].Content != "第二条" || got[0].Username != "alice" {
+		t.Fatalf("bob 收到的离线私信 = %+v", got)
+	}
+
+	// 已投递的私信不会重复投递
+	h.handleUnregister(bob)
+	bob = newFakeClient("bob", "random")
+	join(t, h, bob)
+	if got := bob.ofType(t, models.TypeDirect); len(got) != 0 {
+		t.Fatalf("再次连接又收到 %+v", got)
+	}
+}
+
+func TestDirectMessageToUnknownUserIsRejected(t *testing.T) {
+	ms := newTestStore(t, store.Config{})
+	h := newTestHub(ms, Config{UserStore: ms, InboxStore: ms})
+	alice := newFakeClient("alice", "general")
+	join(t, h, alice)
+
+	// 从未连接过的用户不保存离线私信，避免拼错的昵称让私信石沉大海
+	dm(h, alice, "dave", "hi")
+	if errs := alice.ofType(t, models.TypeError); len(errs) != 1 || errs[0].ErrorCode != models.ErrCodeUserOffline {
+		t.Fatalf("alice 收到 %+v，期望 %s 错误", errs, models.ErrCodeUserOffline)
+	}
+	if got := alice.ofType(t, models.TypeDirect); len(got) != 0 {
+		t.Fatalf("没有投递的私信不应回显: %+v", got)
+	}
+}
@@ -0,0 +1,45 @@
+package hub
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"chatroom/models"
+	"chatroom/store"
+)
+
+func TestEphemeralMessageIsBroadcastButNotPersisted(t *testing.T) {
+	ms := newTestStore(t, store.Config{PersistTypes: []models.MessageType{models.TypeChat}})
+	h := newTestHub(ms, Config{})
+	alice, bob := newFakeClient("alice", "general"), newFakeClient("bob", "general")
+	join(t, h, alice, bob)
+
+	h.handleBroadcast(alice, models.Message{
+		Type:      models.TypeChat,
+		Username:  "alice",
+		Room:      "general",
+		Content:   "secret",
+		Ephemeral: true,
+		Timestamp: time.Now(),
+	})
+	chat(h, alice, "kept")
+
+	if got := bob.chatContents(t); len(got) != 2 || got[0] != "secret" {
+		t.Fatalf("bob 收到的聊天消息 = %v，期望瞬时消息照常广播", got)
+	}
+	stored, err := ms.GetMessages("general", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(stored); got != 1 || stored[0].Content != "kept" {
+		t.Fatalf("数据库中的消息 = %+v，期望只有 kept", stored)
+	}
+
+	// 之后加入的用户收到的历史中没有瞬时消息
+	carol := newFakeClient("carol", "general")
+	join(t, h, carol)
+	if raw := carol.raw(); !strings.Contains(raw, "kept") || strings.Contains(raw, "secret") {
+		t.Fatalf("carol 收到的历史应包含 kept、不包含 secret: %s", raw)
+	}
+}
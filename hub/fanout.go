@@ -0,0 +1,82 @@
+package hub
+
+import "sync"
+
+// fanoutMinTargets 是启用并行扇出的最少目标连接数。
+// 每次 SendMessage 只是一次非阻塞的通道发送，目标较少时协程间协调的开销超过并行的收益。
+const fanoutMinTargets = 512
+
+// fanoutJob 是交给扇出工作协程的一段广播目标。
+type fanoutJob struct {
+	targets []Client
+	message []byte
+	id      int64                // 消息 ID，不为 0 时用 SendTracked 发送，开启确认的连接会跟踪投递
+	include func(cl Client) bool // 为 nil 表示发送给所有目标
+	wg      *sync.WaitGroup
+}
+
+// run 将消息发送给 targets 中满足 include 的连接。
+func (j fanoutJob) run() {
+	for _, cl := range j.targets {
+		if j.include != nil && !j.include(cl) {
+			continue
+		}
+		if j.id != 0 {
+			cl.SendTracked(j.id, j.message)
+		} else {
+			cl.SendMessage(j.message)
+		}
+	}
+}
+
+// fanoutWorker 处理扇出任务，直到 Run 退出时关闭 fanoutJobs。
+func (h *Hub) fanoutWorker() {
+	for job := range h.fanoutJobs {
+		job.run()
+		job.wg.Done()
+	}
+}
+
+// fanout 将消息发送给 targets 中满足 include 的连接（include 为 nil 表示全部），只能在 Run 协程中调用。
+// 配置了多个工作协程且目标足够多时，把 targets 分段交给工作协程并行发送，并等待全部发送完再返回。
+// 因为 fanout 返回前整个广播已经完成，Hub 之后发给任何连接的消息都排在这条广播之后，
+// 每个连接收到的消息顺序与单协程发送时完全相同。
+// include 会被多个工作协程并发调用，只能读取连接自身的并发安全状态（例如 Ignores），不能访问 Hub 的状态。
+func (h *Hub) fanout(targets []Client, message []byte, include func(cl Client) bool) {
+	h.fanoutTracked(targets, 0, message, include)
+}
+
+// fanoutTracked 同 fanout，但 id 不为 0 时以 SendTracked 发送，开启确认的连接会跟踪这条消息的投递。
+func (h *Hub) fanoutTracked(targets []Client, id int64, message []byte, include func(cl Client) bool) {
+	if h.fanoutWorkers <= 1 || len(targets) < fanoutMinTargets {
+		fanoutJob{targets: targets, message: message, id: id, include: include}.run()
+		return
+	}
+	chunk := (len(targets) + h.fanoutWorkers - 1) / h.fanoutWorkers
+	var wg sync.WaitGroup
+	for start := 0; start < len(targets); start += chunk {
+		wg.Add(1)
+		h.fanoutJobs <- fanoutJob{
+			targets: targets[start:min(start+chunk, len(targets))],
+			message: message,
+			id:      id,
+			include: include,
+			wg:      &wg,
+		}
+	}
+	wg.Wait()
+}
+
+// roomTargets 返回指定房间内的所有连接（包括观察者），房间为空时返回所有连接。
+// 返回的切片复用同一块内存，只在下一次调用之前有效。
+func (h *Hub) roomTargets(room string) []Client {
+	clear(h.targetBuf)
+	targets := h.targetBuf[:0]
+	h.forEachClient(func(cl Client) {
+		if room == "" || cl.GetRoom() == room {
+			targets = append(targets, cl)
+		}
+	})
+	h.targetBuf = targets
+	return targets
+}
@@ -0,0 +1,138 @@
+package hub
+
+import (
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// startFanoutWorkers 启动 h 配置的扇出工作协程（平时由 Run 启动），测试结束时关闭任务通道让它们退出。
+// jobs 不为 nil 时记录工作协程处理的任务数。
+func startFanoutWorkers(t testing.TB, h *Hub, jobs *atomic.Int64) {
+	t.Helper()
+	for i := 0; i < h.fanoutWorkers; i++ {
+		go func() {
+			for job := range h.fanoutJobs {
+				if jobs != nil {
+					jobs.Add(1)
+				}
+				job.run()
+				job.wg.Done()
+			}
+		}()
+	}
+	t.Cleanup(func() { close(h.fanoutJobs) })
+}
+
+// fanoutTargets 创建 n 个同一房间的连接。
+func fanoutTargets(n int) ([]*fakeClient, []Client) {
+	clients := make([]*fakeClient, n)
+	targets := make([]Client, n)
+	for i := range clients {
+		clients[i] = newFakeClient("user"+strconv.Itoa(i), "general")
+		targets[i] = clients[i]
+	}
+	return clients, targets
+}
+
+func TestFanoutThresholdAndChunks(t *testing.T) {
+	tests := []struct {
+		workers, targets int
+		jobs             int64 // 交给工作协程的分段数，0 表示在调用方协程中逐个发送
+	}{
+		{workers: 1, targets: 2000, jobs: 0},
+		{workers: 4, targets: fanoutMinTargets - 1, jobs: 0},
+		{workers: 4, targets: fanoutMinTargets, jobs: 4},
+		{workers: 4, targets: fanoutMinTargets + 1, jobs: 4}, // 最后一段较短
+		{workers: 3, targets: 1000, jobs: 3},
+		{workers: 8, targets: 5000, jobs: 8},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.workers)+"x"+strconv.Itoa(tt.targets), func(t *testing.T) {
+			h := newTestHub(nil, Config{FanoutWorkers: tt.workers})
+			var jobs atomic.Int64
+			startFanoutWorkers(t, h, &jobs)
+			clients, targets := fanoutTargets(tt.targets)
+
+			h.fanout(targets, []byte("hello"), nil)
+			if got := jobs.Load(); got != tt.jobs {
+				t.Errorf("分成了 %d 段，期望 %d", got, tt.jobs)
+			}
+			for _, cl := range clients {
+				if n := len(cl.sent); n != 1 {
+					t.Fatalf("%s 收到 %d 条消息，每个连接应恰好收到 1 条", cl.username, n)
+				}
+			}
+		})
+	}
+}
+
+func TestParallelFanoutPreservesPerClientOrder(t *testing.T) {
+	const messages = 50
+	h := newTestHub(nil, Config{FanoutWorkers: 4})
+	startFanoutWorkers(t, h, nil)
+	clients, targets := fanoutTargets(2000)
+	odd := make(map[Client]bool) // 工作协程只并发读取
+	for i, cl := range targets {
+		odd[cl] = i%2 == 1
+	}
+
+	// 奇数编号的消息只发给奇数编号的连接，检查过滤与分段并行同时进行时顺序也不乱
+	for i := 0; i < messages; i++ {
+		var include func(cl Client) bool
+		if i%2 == 1 {
+			include = func(cl Client) bool { return odd[cl] }
+		}
+		h.fanout(targets, []byte(strconv.Itoa(i)), include)
+	}
+	for idx, cl := range clients {
+		cl.mu.Lock()
+		var want []string
+		for i := 0; i < messages; i++ {
+			if i%2 == 0 || idx%2 == 1 {
+				want = append(want, strconv.Itoa(i))
+			}
+		}
+		if len(cl.sent) != len(want) {
+			cl.mu.Unlock()
+			t.Fatalf("%s 收到 %d 条消息，期望 %d", cl.username, len(cl.sent), len(want))
+		}
+		for i, raw := range cl.sent {
+			if string(raw) != want[i] {
+				cl.mu.Unlock()
+				t.Fatalf("%s 收到的第 %d 条消息是 %s，期望 %s：并行扇出打乱了顺序", cl.username, i, raw, want[i])
+			}
+		}
+		cl.mu.Unlock()
+	}
+}
+
+// countingClient 只统计收到的消息数，基准测试中不保存消息以免内存随 b.N 增长。
+type countingClient struct {
+	*fakeClient
+	received atomic.Int64
+}
+
+func (c *countingClient) SendMessage([]byte)        { c.received.Add(1) }
+func (c *countingClient) SendTracked(int64, []byte) { c.received.Add(1) }
+
+func BenchmarkFanout(b *testing.B) {
+	for _, clients := range []int{1000, 5000} {
+		for _, workers := range []int{1, 4, 8} {
+			b.Run(strconv.Itoa(clients)+"clients/"+strconv.Itoa(workers)+"workers", func(b *testing.B) {
+				h := newTestHub(nil, Config{FanoutWorkers: workers})
+				startFanoutWorkers(b, h, nil)
+				targets := make([]Client, clients)
+				for i := range targets {
+					targets[i] = &countingClient{fakeClient: newFakeClient("user"+strconv.Itoa(i), "general")}
+				}
+				message := []byte(`{"type":"chat","content":"hello"}`)
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					h.fanout(targets, message, nil)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package hub
+
+import "chatroom/models"
+
+// historyRing 是一个房间最近持久化的消息的环形缓冲区，内容始终是房间完整历史的一个连续后缀：
+// 每条成功保存的消息按保存顺序追加，任何可能让它与存储不一致的情况（保存失败、重试）都会清空它。
+// 只在 Run 协程中访问。
+type historyRing struct {
+	buf   []models.Message
+	start int // 最早一条消息在 buf 中的位置
+	n     int // 已保存的消息数
+}
+
+func newHistoryRing(size int) *historyRing {
+	return &historyRing{buf: make([]models.Message, size)}
+}
+
+// add 追加一条消息，缓冲区已满时覆盖最早的一条。
+func (r *historyRing) add(msg models.Message) {
+	if r.n < len(r.buf) {
+		r.buf[(r.start+r.n)%len(r.buf)] = msg
+		r.n++
+		return
+	}
+	r.buf[r.start] = msg
+	r.start = (r.start + 1) % len(r.buf)
+}
+
+// latest 按时间顺序返回最近 limit 条消息的副本。缓冲区中的消息不足 limit 条时返回 false，
+// 此时无法判断房间是否还有更早的消息，调用方应回退到存储查询。
+func (r *historyRing) latest(limit int) ([]models.Message, bool) {
+	if limit <= 0 || r.n < limit {
+		return nil, false
+	}
+	messages := make([]models.Message, limit)
+	for i := range messages {
+		messages[i] = r.buf[(r.start+r.n-limit+i)%len(r.buf)]
+	}
+	return messages, true
+}
+
+// cacheHistory 把刚保存成功的消息追加到房间的历史缓存。只缓存活跃房间，
+// 房间清理（reapRoom）后才保存的消息（例如最后一个用户的离开通知）不会让缓存重新出现。
+func (h *Hub) cacheHistory(msg models.Message) {
+	if h.historyCacheSize <= 0 {
+		return
+	}
+	room := msg.Room
+	if room == "" {
+		room = models.DefaultRoom
+	}
+	if h.roomConns[room] == 0 {
+		return
+	}
+	ring, ok := h.historyCache[room]
+	if !ok {
+		ring = newHistoryRing(h.historyCacheSize)
+		h.historyCache[room] = ring
+	}
+	ring.add(msg)
+}
+
+// cachedHistory 返回房间最近 limit 条历史消息；缓存中的消息不足时返回 false。
+func (h *Hub) cachedHistory(room string, limit int) ([]models.Message, bool) {
+	ring, ok := h.historyCache[room]
+	if !ok {
+		return nil, false
+	}
+	return ring.latest(limit)
+}
+
+// resetHistoryCache 清空所有房间的历史缓存，之后的历史查询回到存储，直到缓存重新积累足够的消息。
+func (h *Hub) resetHistoryCache() {
+	clear(h.historyCache)
+}
@@ -0,0 +1,75 @@
+package hub
+
+import (
+	"slices"
+	"strconv"
+	"testing"
+
+	"chatroom/models"
+	"chatroom/store"
+)
+
+// countingStore 统计历史查询的次数，其余操作交给内嵌的存储。
+type countingStore struct {
+	*store.SQLiteMessageStore
+	queries int
+}
+
+func (s *countingStore) GetMessages(room string, limit int) ([]models.Message, error) {
+	s.queries++
+	return s.SQLiteMessageStore.GetMessages(room, limit)
+}
+
+func TestJoinHistoryIsServedFromRingBuffer(t *testing.T) {
+	ms := &countingStore{SQLiteMessageStore: newTestStore(t, store.Config{PersistTypes: []models.MessageType{models.TypeChat}})}
+	h := newTestHub(ms, Config{HistoryLimit: 3, HistoryCacheSize: 5})
+	alice := newFakeClient("alice", "general")
+	join(t, h, alice)
+	chat(h, alice, "1")
+	chat(h, alice, "2")
+
+	// 缓存中的消息不足 HistoryLimit 条，回退到存储查询
+	bob := newFakeClient("bob", "general")
+	before := ms.queries
+	join(t, h, bob)
+	if ms.queries != before+1 {
+		t.Fatalf("缓存不足时应查询存储，查询了 %d 次", ms.queries-before)
+	}
+	if got := historyContents(t, bob); !slices.Equal(got, []string{"1", "2"}) {
+		t.Fatalf("bob 的历史 = %v", got)
+	}
+
+	for i := 3; i <= 7; i++ { // 超过缓冲区大小，最早的消息被覆盖
+		chat(h, alice, strconv.Itoa(i))
+	}
+	carol := newFakeClient("carol", "general")
+	before = ms.queries
+	join(t, h, carol)
+	if ms.queries != before {
+		t.Fatalf("缓存足够时不应查询存储，查询了 %d 次", ms.queries-before)
+	}
+	if got := historyContents(t, carol); !slices.Equal(got, []string{"5", "6", "7"}) {
+		t.Fatalf("carol 的历史 = %v，期望缓存中最近的 3 条", got)
+	}
+}
+
+func TestHistoryRingWrapsAround(t *testing.T) {
+	r := newHistoryRing(3)
+	if _, ok := r.latest(1); ok {
+		t.Fatal("空的缓冲区不应返回消息")
+	}
+	for i := 1; i <= 5; i++ {
+		r.add(models.Message{Content: strconv.Itoa(i)})
+	}
+	msgs, ok := r.latest(3)
+	var got []string
+	for _, msg := range msgs {
+		got = append(got, msg.Content)
+	}
+	if !ok || !slices.Equal(got, []string{"3", "4", "5"}) {
+		t.Fatalf("latest(3) = %v, %v，期望 [3 4 5]", got, ok)
+	}
+	if _, ok := r.latest(4); ok {
+		t.Fatal("请求的条数超过缓冲区中的消息时应返回 false")
+	}
+}
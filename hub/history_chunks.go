@@ -0,0 +1,54 @@
+package hub
+
+import (
+	"encoding/json"
+	"log"
+
+	"chatroom/models"
+)
+
+// sendHistoryMessage 将一条 history 消息发给客户端。
+// 开启分块发送（historyChunkSize > 0）时，历史消息按顺序拆成若干 history_chunk 消息，
+// 最后是携带置顶消息、总条数和分块数的 history_end 消息；它们作为一个流交给客户端的写协程逐帧发送，
+// 不占用发送缓冲，也不会被实时消息插入。带错误的 history 消息没有内容可拆，总是整体发送。
+func (h *Hub) sendHistoryMessage(cl Client, msg models.Message) {
+	if h.historyChunkSize <= 0 || msg.Error != "" {
+		jsonMsg, err := json.Marshal(msg)
+		if err != nil {
+			log.Printf("序列化历史消息失败: %v", err)
+			return
+		}
+		cl.SendMessage(jsonMsg)
+		return
+	}
+
+	frames := make([][]byte, 0, len(msg.Messages)/h.historyChunkSize+2)
+	chunks := 0
+	for start := 0; start < len(msg.Messages); start += h.historyChunkSize {
+		end := min(start+h.historyChunkSize, len(msg.Messages))
+		chunks++
+		frame, err := json.Marshal(models.Message{
+			Type:     models.TypeHistoryChunk,
+			Room:     msg.Room,
+			Messages: msg.Messages[start:end],
+			Chunk:    chunks,
+		})
+		if err != nil {
+			log.Printf("序列化历史消息分块失败: %v", err)
+			return
+		}
+		frames = append(frames, frame)
+	}
+	frame, err := json.Marshal(models.Message{
+		Type:   models.TypeHistoryEnd,
+		Room:   msg.Room,
+		Pinned: msg.Pinned,
+		Count:  len(msg.Messages),
+		Chunk:  chunks,
+	})
+	if err != nil {
+		log.Printf("序列化历史消息结束标记失败: %v", err)
+		return
+	}
+	cl.SendStream(append(frames, frame))
+}
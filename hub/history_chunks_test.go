@@ -0,0 +1,45 @@
+package hub
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	"chatroom/models"
+	"chatroom/store"
+)
+
+func TestHistoryIsStreamedInChunks(t *testing.T) {
+	ms := newTestStore(t, store.Config{PersistTypes: []models.MessageType{models.TypeChat}})
+	seedChats(t, ms, "general", "1", "2", "3", "4", "5", "6", "7")
+	h := newTestHub(ms, Config{HistoryChunkSize: 3})
+	alice := newFakeClient("alice", "general")
+	join(t, h, alice)
+
+	if got := alice.ofType(t, models.TypeHistory); len(got) != 0 {
+		t.Fatalf("开启分块后不应收到整批的 history 消息，收到 %d 条", len(got))
+	}
+	// 分块按序号依次到达，最后是结束标记，中间没有其他消息
+	var sequence []string
+	var contents []string
+	for _, msg := range alice.messages(t) {
+		switch msg.Type {
+		case models.TypeHistoryChunk:
+			sequence = append(sequence, fmt.Sprintf("chunk%d:%d", msg.Chunk, len(msg.Messages)))
+			for _, m := range msg.Messages {
+				contents = append(contents, m.Content)
+			}
+		case models.TypeHistoryEnd:
+			if msg.Count != 7 {
+				t.Errorf("history_end 的总条数 = %d，期望 7", msg.Count)
+			}
+			sequence = append(sequence, fmt.Sprintf("end:%d", msg.Chunk))
+		}
+	}
+	if want := []string{"chunk1:3", "chunk2:3", "chunk3:1", "end:3"}; !slices.Equal(sequence, want) {
+		t.Fatalf("分块顺序 = %v，期望 %v", sequence, want)
+	}
+	if want := []string{"1", "2", "3", "4", "5", "6", "7"}; !slices.Equal(contents, want) {
+		t.Fatalf("拼接后的历史 = %v，期望 %v", contents, want)
+	}
+}
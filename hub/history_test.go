@@ -0,0 +1,208 @@
+package hub
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"chatroom/models"
+	"chatroom/store"
+)
+
+func TestHistoryMetaCountsOnlySenderRoom(t *testing.T) {
+	ms := newTestStore(t, store.Config{PersistTypes: []models.MessageType{models.TypeChat}}) // 不计入加入消息
+	for _, room := range []string{"general", "general", "other"} {
+		if _, err := ms.SaveMessage(models.Message{Type: models.TypeChat, Username: "bob", Room: room, Content: "x", Timestamp: time.Now()}); err != nil {
+			t.Fatalf("保存消息失败: %v", err)
+		}
+	}
+	h := newTestHub(ms, Config{})
+	alice, carol := newFakeClient("alice", "general"), newFakeClient("carol", "empty")
+	join(t, h, alice, carol)
+
+	for cl, want := range map[*fakeClient]int{alice: 2, carol: 0} {
+		h.handleBroadcast(cl, models.Message{Type: models.TypeHistoryMeta, Username: cl.username, Room: cl.room})
+		metas := cl.ofType(t, models.TypeHistoryMeta)
+		if len(metas) != 1 {
+			t.Fatalf("%s 收到 %d 条 history_meta，期望 1", cl.username, len(metas))
+		}
+		if metas[0].Count != want || metas[0].Error != "" {
+			t.Errorf("%s 所在房间的 history_meta = %+v，期望 count=%d", cl.username, metas[0], want)
+		}
+	}
+}
+
+// seedChats 在 room 中保存 contents 对应的聊天消息，时间依次递增。
+func seedChats(t *testing.T, ms store.MessageStore, room string, contents ...string) {
+	t.Helper()
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, content := range contents {
+		msg := models.Message{Type: models.TypeChat, Username: "bob", Room: room, Content: content, Timestamp: base.Add(time.Duration(i) * time.Second)}
+		if _, err := ms.SaveMessage(msg); err != nil {
+			t.Fatalf("保存消息失败: %v", err)
+		}
+	}
+}
+
+// historyContents 返回发给该连接的唯一一条 history 消息中的消息内容。
+func historyContents(t *testing.T, cl *fakeClient) []string {
+	t.Helper()
+	batches := cl.ofType(t, models.TypeHistory)
+	if len(batches) != 1 {
+		t.Fatalf("%s 收到 %d 条 history 消息，期望整批的 1 条", cl.username, len(batches))
+	}
+	var out []string
+	for _, msg := range batches[0].Messages {
+		out = append(out, msg.Content)
+	}
+	return out
+}
+
+func TestHistoryMetaReportsOldestIDAndCount(t *testing.T) {
+	ms := newTestStore(t, store.Config{PersistTypes: []models.MessageType{models.TypeChat}})
+	var ids []int64
+	for _, content := range []string{"1", "2", "3"} {
+		id, err := ms.SaveMessage(models.Message{Type: models.TypeChat, Username: "bob", Room: "general", Content: content, Timestamp: time.Now()})
+		if err != nil {
+			t.Fatalf("保存消息失败: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	h := newTestHub(ms, Config{HistoryLimit: 1}) // 回放的历史只有最后一条，更早的需要向前翻页
+	alice, bob := newFakeClient("alice", "general"), newFakeClient("bob", "general")
+	join(t, h, alice, bob)
+
+	h.handleBroadcast(alice, models.Message{Type: models.TypeHistoryMeta, Username: "alice", Room: "general"})
+	metas := alice.ofType(t, models.TypeHistoryMeta)
+	if len(metas) != 1 || metas[0].MessageID != ids[0] || metas[0].Count != 3 {
+		t.Fatalf("history_meta = %+v，期望最早的 ID %d 和总数 3", metas, ids[0])
+	}
+	if got := bob.ofType(t, models.TypeHistoryMeta); len(got) != 0 {
+		t.Fatalf("回复只发给请求者，bob 收到 %+v", got)
+	}
+}
+
+func TestHistoryIsSentAsSingleBatch(t *testing.T) {
+	ms := newTestStore(t, store.Config{PersistTypes: []models.MessageType{models.TypeChat}})
+	seedChats(t, ms, "general", "1", "2", "3", "4", "5")
+	h := newTestHub(ms, Config{HistoryLimit: 3})
+
+	alice := newFakeClient("alice", "general")
+	join(t, h, alice)
+
+	if got := historyContents(t, alice); !slices.Equal(got, []string{"3", "4", "5"}) {
+		t.Fatalf("历史消息 = %v，期望按时间顺序的最近 3 条", got)
+	}
+	if got := alice.chatContents(t); len(got) != 0 {
+		t.Fatalf("历史消息不应逐条作为聊天消息发送: %v", got)
+	}
+}
+
+func TestHistoryLimitPerRoom(t *testing.T) {
+	ms := newTestStore(t, store.Config{PersistTypes: []models.MessageType{models.TypeChat}})
+	seedChats(t, ms, "firehose", "1", "2", "3", "4", "5")
+	seedChats(t, ms, "support", "1", "2", "3", "4", "5")
+	h := newTestHub(ms, Config{HistoryLimit: 4, RoomHistoryLimits: map[string]int{"firehose": 2}})
+
+	for room, want := range map[string]int{"firehose": 2, "support": 4, "other": 4} {
+		if got := h.historyLimitFor(room); got != want {
+			t.Errorf("historyLimitFor(%q) = %d，期望 %d", room, got, want)
+		}
+	}
+	if got := newTestHub(nil, Config{}).historyLimitFor("general"); got != DefaultHistoryLimit {
+		t.Errorf("没有任何配置时 = %d，期望 DefaultHistoryLimit", got)
+	}
+
+	alice, bob := newFakeClient("alice", "firehose"), newFakeClient("bob", "support")
+	join(t, h, alice, bob)
+	if got := historyContents(t, alice); !slices.Equal(got, []string{"4", "5"}) {
+		t.Errorf("firehose 的历史 = %v，期望按房间配置的最近 2 条", got)
+	}
+	if got := historyContents(t, bob); !slices.Equal(got, []string{"2", "3", "4", "5"}) {
+		t.Errorf("support 的历史 = %v，期望默认的最近 4 条", got)
+	}
+}
+
+func TestMyHistoryRepliesWithOwnMessagesOnly(t *testing.T) {
+	ms := newTestStore(t, store.Config{PersistTypes: []models.MessageType{models.TypeChat}})
+	h := newTestHub(ms, Config{})
+	alice, bob := newFakeClient("alice", "general"), newFakeClient("bob", "dev")
+	join(t, h, alice, bob)
+	chat(h, alice, "secret")
+	chat(h, bob, "mine")
+	alice.reset()
+
+	// 请求中自报的用户名不起作用，只查询发送连接自己的消息
+	h.handleBroadcast(bob, models.Message{Type: models.TypeMyHistory, Username: "alice", Room: "dev"})
+	replies := bob.ofType(t, models.TypeMyHistory)
+	if len(replies) != 1 || len(replies[0].Messages) != 1 || replies[0].Messages[0].Content != "mine" {
+		t.Fatalf("bob 收到 %+v，期望只有自己的消息", replies)
+	}
+	if got := alice.ofType(t, models.TypeMyHistory); len(got) != 0 {
+		t.Fatalf("回复只发给请求者，alice 收到 %+v", got)
+	}
+}
+
+// brokenHistoryStore 是读取历史消息总是失败的存储，其余操作与 NullMessageStore 相同。
+type brokenHistoryStore struct {
+	store.NullMessageStore
+}
+
+func (brokenHistoryStore) GetMessages(room string, limit int) ([]models.Message, error) {
+	return nil, errors.New("磁盘故障")
+}
+
+func TestHistoryFailureIsReportedAndChatStillWorks(t *testing.T) {
+	h := newTestHub(brokenHistoryStore{}, Config{})
+	alice, bob := newFakeClient("alice", "general"), newFakeClient("bob", "general")
+	join(t, h, alice, bob)
+
+	batches := alice.ofType(t, models.TypeHistory)
+	if len(batches) != 1 {
+		t.Fatalf("alice 收到 %d 条 history 消息，期望 1 条说明历史不可用", len(batches))
+	}
+	if got := batches[0]; got.ErrorCode != models.ErrCodeHistoryUnavailable || got.Error == "" || len(got.Messages) != 0 {
+		t.Fatalf("history 消息 = %+v，期望 %s 且不含消息", got, models.ErrCodeHistoryUnavailable)
+	}
+	if closed, _ := alice.isClosed(); closed {
+		t.Fatal("历史加载失败不应断开连接")
+	}
+
+	chat(h, bob, "still here")
+	if got := alice.chatContents(t); !slices.Equal(got, []string{"still here"}) {
+		t.Fatalf("alice 收到 %v，实时消息应照常送达", got)
+	}
+}
+
+func TestHistoryRequestFiltersTypes(t *testing.T) {
+	ms := newTestStore(t, store.Config{}) // 默认持久化聊天、加入和离开消息
+	h := newTestHub(ms, Config{})
+	alice, bob := newFakeClient("alice", "general"), newFakeClient("bob", "general")
+	join(t, h, alice, bob)
+	chat(h, bob, "hello")
+
+	request := func(types ...models.MessageType) {
+		alice.reset()
+		h.handleBroadcast(alice, models.Message{Type: models.TypeHistoryRequest, Username: "alice", Room: "general", Types: types})
+	}
+	request(models.TypeChat)
+	if got := historyContents(t, alice); !slices.Equal(got, []string{"hello"}) {
+		t.Fatalf("只请求聊天消息时返回 %v", got)
+	}
+
+	request(models.TypeChat, models.TypeJoin)
+	batch := alice.ofType(t, models.TypeHistory)[0].Messages
+	var types []models.MessageType
+	for _, msg := range batch {
+		types = append(types, msg.Type)
+	}
+	if !slices.Equal(types, []models.MessageType{models.TypeJoin, models.TypeJoin, models.TypeChat}) {
+		t.Fatalf("请求聊天和加入消息时返回的类型 = %v", types)
+	}
+
+	request(models.TypeUserList)
+	if errs := alice.ofType(t, models.TypeError); len(errs) != 1 || errs[0].ErrorCode != models.ErrCodeInvalidMessage {
+		t.Fatalf("请求不支持的类型时 alice 收到 %+v", alice.messages(t))
+	}
+}
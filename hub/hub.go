@@ -2,199 +2,1852 @@ package hub
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"regexp"
 	"sort" // 用于排序用户列表
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time" // 用于消息时间戳
 
-	"chatroom/client" // 导入 client 包，以便引用 client.Client 类型
+	"chatroom/clock"
+	"chatroom/i18n"
 	"chatroom/models" // 导入 models 包，以便引用 Message 类型
 	"chatroom/store"  // 导入 store 包，以便引用 MessageStore 接口
 )
 
+// Client 是 Hub 对一个客户端连接所需的最小接口。
+// client.Client 实现了这个接口；Hub 只依赖接口，因此不需要真实的 WebSocket 连接也能驱动，
+// 测试中可以用假客户端替代。
+type Client interface {
+	GetUsername() string
+	GetUserKey() string          // 用户名的规范化形式（models.UserKey），Hub 内部的用户状态都以它为键
+	SetUsername(username string) // 只能在 RunPumps 之前调用，例如注册时重命名
+	GetRoom() string             // 客户端所在的房间，广播、历史和用户列表都按房间隔离
+	GetRemoteAddr() string       // 客户端 IP 地址，用于日志和滥用排查
+	GetUserAgent() string        // 客户端 User-Agent
+	GetLang() string             // 发给该连接的提示文案使用的语言（见 i18n 包）
+	ProtocolVersion() int        // 客户端声明的协议版本，注册时校验，之后可用于按版本调整发给它的消息
+	SendMessage(message []byte)
+	SendPriority(message []byte)          // 发送错误、踢出通知等控制消息，它们先于已排队的普通消息发出
+	SendTracked(id int64, message []byte) // 发送带 ID 的消息，开启确认的连接在超时未确认时会重发
+	SendStream(frames [][]byte)           // 按顺序逐帧发送一组消息（分块的历史消息），写完之前不插入普通消息
+	Status() string                       // 自定义状态文字，只在 Run 协程中读写
+	SetStatus(status string)
+	CloseConnection()
+	CloseWithReason(code int, reason string) // 立即发送带关闭码的关闭帧并关闭连接
+	Disconnect(code int, reason string)      // 发送完已排队的消息后再发送关闭帧并关闭连接
+	Ignores(username string) bool            // 是否屏蔽了该用户的聊天消息，可能被其他协程并发修改
+	QueueLen() int                           // 发送通道中等待写出的消息数，用于排查慢客户端
+	Quitting() bool                          // 客户端是否主动发送 quit 消息离开（而不是连接中断）
+	IsObserver() bool                        // 只读的观察者连接：接收房间消息，但不出现在用户列表中
+	LastActivity() time.Time                 // 最近一次收到该连接的消息或 pong 的时间
+	SuppressEcho() bool                      // 是否不把该连接自己发送的聊天消息回显给它
+	Done() <-chan struct{}                   // 连接关闭（写协程退出）后关闭，用于关机时等待排队的消息发完
+	RunPumps()
+}
+
 // Hub 是聊天室的中心，负责管理客户端连接和消息广播。
 type Hub struct {
-	// clients 使用 map[string]*client.Client 存储活跃的客户端连接，键为用户名。
-	clients map[string]*client.Client
+	// clients 存储活跃的客户端连接，键为规范化的用户名（models.UserKey），值为该用户的所有连接（多端登录时不止一个）。
+	// 以下按用户记录的状态（nonces、lastActivity、away）同样以规范化的用户名为键。
+	clients map[string][]Client
+
+	// observers 存储只读的观察者连接。它们接收所在房间的消息，
+	// 但不参与昵称检查、用户列表和加入/离开通知。
+	observers map[Client]bool
+
+	// broadcast 是一个缓冲通道，用于接收来自客户端的入站消息及其发送者。
+	// 通道已满时按 overflowPolicy 处理，broadcastDropped 是因此丢弃的消息数。
+	broadcast        chan broadcastRequest
+	overflowPolicy   OverflowPolicy
+	broadcastDropped atomic.Int64
 
-	// broadcast 是一个缓冲通道，用于接收来自客户端的入站消息。
-	broadcast chan []byte
+	// fanoutWorkers 是并行扇出广播的工作协程数，不超过 1 时在 Run 协程中逐个发送（见 fanout.go）。
+	// fanoutJobs 把分段的广播目标交给工作协程，targetBuf 是收集广播目标时复用的切片。
+	fanoutWorkers int
+	fanoutJobs    chan fanoutJob
+	targetBuf     []Client
 
 	// register 是一个缓冲通道，用于接收客户端的注册请求。
-	register chan *client.Client
+	register chan Client
 
 	// unregister 是一个缓冲通道，用于接收客户端的注销请求。
-	unregister chan *client.Client
+	unregister chan Client
+
+	// quit 在 Stop 时关闭，通知 Run 退出，并让阻塞在各通道上的发送方放弃等待。
+	quit     chan struct{}
+	stopOnce sync.Once
+
+	// drainTimeout 是 Shutdown 指定的排空等待时间，在关闭 quit 之前写入；为 0 时立即关闭所有连接。
+	// stopped 在 Run 退出时关闭。
+	drainTimeout time.Duration
+	stopped      chan struct{}
+
+	// announce 用于接收系统公告，公告会发送给所有房间的在线客户端。
+	announce chan []byte
+
+	// calls 用于在 Run 协程中执行函数，使外部读取 Hub 状态时与主循环串行，避免数据竞争。
+	calls chan func()
 
 	// messageStore 是一个 MessageStore 接口的实例，用于消息的持久化存储。
 	messageStore store.MessageStore
+
+	// userStore 用于记录用户最后在线时间，可以为 nil（不记录）。
+	userStore store.UserStore
+
+	// inbox 保存发给不在线用户的私信，可以为 nil（收件人不在线时私信被拒绝）。
+	inbox store.InboxStore
+
+	// bans 保存被封禁的用户名，可以为 nil（不支持封禁）。
+	bans store.BanStore
+
+	// clock 提供消息时间戳、活动时间和连接限流使用的当前时间。
+	clock clock.Clock
+
+	// guestSeq 是游客编号计数器，为未提供昵称的客户端分配 "游客-N" 这样的唯一名称。
+	guestSeq int
+
+	// allowMultiDevice 为 true 时同一用户名可以同时建立多个连接。
+	allowMultiDevice bool
+
+	// globalNicks 为 true 时昵称在所有房间中唯一，否则只在同一房间内唯一。
+	globalNicks bool
+
+	// connectAttempts 记录每个来源 IP 最近 reconnectWindow 内的连接时间，
+	// 超过 reconnectLimit 次的来源暂时被拒绝。reconnectLimit 为 0 时不检查。
+	connectAttempts map[string][]time.Time
+	attemptsSweptAt time.Time
+	reconnectLimit  int
+	reconnectWindow time.Duration
+
+	// nonces 记录每个用户最近发送过的消息 nonce 及其时间，用于丢弃重复消息。
+	// 按用户名而不是连接记录，这样重连后重发的消息也能被识别。
+	nonces map[string]map[string]time.Time
+
+	// roomSeq 记录每个房间最近分配的聊天消息序号，首次使用时从存储中恢复。
+	roomSeq map[string]int64
+
+	// historyCache 按房间缓存最近保存的 historyCacheSize 条消息（见 history_cache.go），
+	// 加入房间时的历史回放优先从这里读取，减少繁忙房间对存储的查询。historyCacheSize 为 0 时不缓存。
+	historyCache     map[string]*historyRing
+	historyCacheSize int
+
+	// historyChunkSize 大于 0 时历史消息分块发送（见 history_chunks.go）。
+	historyChunkSize int
+
+	// clearGlobal 为 true 时 clear_history 作用于所有房间。
+	clearGlobal bool
+
+	// roomConns 记录每个活跃房间的连接数。房间的最后一个连接断开后，
+	// 该房间在 Hub 中的所有状态都会被清理，防止随意的 ?room= 参数让 map 无限增长。
+	roomConns map[string]int
+
+	// maxRooms 是同时活跃的房间数上限，0 表示不限制。
+	maxRooms int
+
+	// connCount 是当前连接数，只在 Run 协程中修改，可以从任意协程读取。
+	connCount atomic.Int64
+
+	// maxClients 是连接数硬上限，0 表示不限制。
+	maxClients int
+
+	// lastActivity 记录每个在线用户最近一次发送聊天或 presence 消息的时间。
+	lastActivity map[string]time.Time
+
+	// away 记录处于离开状态的在线用户，awayAfter 为 0 时不会有用户进入离开状态。
+	away      map[string]bool
+	awayAfter time.Duration
+
+	// idleTimeout 是连接没有任何活动（消息或 pong）多久后被断开，0 表示不断开。
+	idleTimeout time.Duration
+
+	// middlewares 是客户端消息在持久化和广播前依次经过的处理链。
+	middlewares []Middleware
+
+	// allowUserPins 为 true 时普通用户也可以置顶消息，否则只能通过管理接口置顶。
+	allowUserPins bool
+
+	// historyLimit 是默认的历史消息条数，roomHistoryLimits 按房间覆盖它。
+	historyLimit      int
+	roomHistoryLimits map[string]int
+
+	// roomRateLimit 是每个房间在 roomRateWindow 内允许的聊天消息数（所有发送者合计），roomRateLimits 按房间覆盖它；
+	// roomRates 记录各房间的消息时间（见 room_rate.go）。
+	roomRateLimit  int
+	roomRateLimits map[string]int
+	roomRateWindow time.Duration
+	roomRates      map[string]*roomRate
+
+	// welcome 是新用户加入时单独发送给他的欢迎语模板，为空时不发送。
+	welcome string
+
+	// bot 是内置的触发词机器人（见 bot.go），为 nil 时不启用。
+	bot *bot
+
+	// deliveries 按消息 ID 跟踪最近聊天消息的投递状态（见 delivery.go），deliveryOrder 按广播顺序记录这些 ID。
+	// 每隔 deliveryInterval 把有变化的状态汇总发给发送者，deliveryInterval 为 0 时不跟踪。
+	deliveries       map[int64]*delivery
+	deliveryOrder    []int64
+	deliveryInterval time.Duration
+
+	// auditor 记录每条需要持久化的消息，可以为 nil。
+	auditor Auditor
+
+	// deadLetters 暂存保存失败的消息，下次保存成功时按顺序重试；最多保留 deadLetterLimit 条。
+	deadLetters []models.Message
+
+	// saveFailures、saveFailStreak 和 pendingSaves 是消息保存失败的累计次数、连续失败次数
+	// 和待重试的消息数，只在 Run 协程中修改，可以从任意协程读取。
+	saveFailures   atomic.Int64
+	saveFailStreak atomic.Int64
+	pendingSaves   atomic.Int64
+}
+
+// Auditor 接收每条交给存储保存的消息（无论保存是否成功），用于写入独立的审计日志。
+// audit.Logger 实现了这个接口。Record 在 Run 协程中调用，不能长时间阻塞。
+type Auditor interface {
+	Record(msg models.Message)
+}
+
+// Middleware 在客户端消息持久化和广播之前处理它，例如过滤、改写或去重。
+// 返回 false 表示丢弃该消息，后续中间件不再执行；
+// 否则返回的消息（可以是修改后的消息，为 nil 时沿用原消息）交给下一个中间件。
+// 中间件在 Run 协程中执行，可以安全地访问 Hub 状态，但不能阻塞。
+type Middleware func(msg *models.Message) (bool, *models.Message)
+
+// OverflowPolicy 是广播队列已满时的处理策略。
+type OverflowPolicy string
+
+const (
+	// Block 让发送方（该连接的 readPump）等待队列有空位。不丢消息，但 Hub 跟不上时
+	// 所有发送方都会变慢，慢到一定程度会因读超时断开。
+	Block OverflowPolicy = "block"
+
+	// DropNewest 丢弃放不进队列的新消息。发送方从不等待，已排队的消息按原顺序处理；
+	// 突发期间后发的消息会丢失，而发送者不会收到通知。
+	DropNewest OverflowPolicy = "drop-newest"
+
+	// DropOldest 丢弃队列中最早的消息，为新消息腾出位置。发送方从不等待，保留最新的消息，
+	// 适合过时消息价值不大的场景；被丢弃的可能是其他用户早已发出的消息。
+	DropOldest OverflowPolicy = "drop-oldest"
+)
+
+// ParseOverflowPolicy 解析策略名称，空字符串表示 Block。
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	switch p := OverflowPolicy(name); p {
+	case "", Block:
+		return Block, nil
+	case DropNewest, DropOldest:
+		return p, nil
+	default:
+		return "", fmt.Errorf("未知的广播队列策略 %q，可选 block、drop-newest、drop-oldest", name)
+	}
+}
+
+// guestPrefix 是未提供昵称的客户端的名称前缀。
+const guestPrefix = "游客"
+
+// eventBuffer 是 register/unregister 通道的缓冲大小。
+// 缓冲让连接建立和断开在 Run 短暂忙碌时不必等待；
+// 缓冲满时发送方仍会阻塞，但 Hub 停止后会通过 quit 立即返回，不会永远卡住 readPump 或 serveWs。
+const eventBuffer = 64
+
+// DefaultHistoryLimit 是未配置时加入房间或请求历史最多返回的历史消息条数。
+const DefaultHistoryLimit = 50
+
+// deadLetterLimit 是保存失败后等待重试的消息数上限，超过时丢弃最早的消息，避免存储长时间不可用时内存无限增长。
+const deadLetterLimit = 1000
+
+// nonceTTL 是消息 nonce 的去重窗口，超过该时间的 nonce 会被清理，同一 nonce 再次出现时视为新消息。
+const nonceTTL = 5 * time.Minute
+
+// Config 保存创建 Hub 时的可选配置。
+type Config struct {
+	// HistoryChunkSize 大于 0 时，历史消息拆成每块最多这么多条的 history_chunk 消息，
+	// 最后发送一条 history_end 消息，避免一次发送巨大的帧；为 0 时整体作为一条 history 消息发送。
+	HistoryChunkSize int
+
+	// ClearHistoryGlobal 为 true 时，clear_history 删除用户在所有房间中的消息并通知所有房间；
+	// 默认只删除和通知用户当前所在的房间。
+	ClearHistoryGlobal bool
+
+	// Clock 提供当前时间，为 nil 时使用 clock.Real。测试中可以换成 clock.Fake 来精确控制
+	// 消息时间戳、离开检测和空闲断开；定时检查本身仍由真实的计时器触发。
+	Clock clock.Clock
+
+	// UserStore 用于持久化用户的最后在线时间；为 nil 时不记录。
+	UserStore store.UserStore
+
+	// InboxStore 保存发给不在线用户的私信，收件人下次连接时投递；为 nil 时发给不在线用户的私信被拒绝。
+	// 只为 UserStore 中有记录（曾经连接过）的用户保存，因此需要同时配置 UserStore。
+	InboxStore store.InboxStore
+
+	// BanStore 保存被封禁的用户名，注册时检查；为 nil 时不支持封禁。
+	BanStore store.BanStore
+
+	// AllowMultiDevice 允许同一用户名同时建立多个连接（例如手机和电脑）。
+	// 开启后同名连接不再被视为昵称冲突：消息会送达该用户的所有连接，
+	// 只有用户在某个房间的最后一个连接断开时才广播离开通知。
+	AllowMultiDevice bool
+
+	// GlobalNicknames 控制昵称唯一性的范围：为 true 时昵称在所有房间中唯一，
+	// 已在任一房间使用的昵称不能再加入其他房间；默认为 false，只要求同一房间内唯一，
+	// 不同房间可以各有一个 "Alice"。
+	// 按用户记录的状态（离开状态、最后在线时间等）以规范化的用户名为键，
+	// 在按房间唯一的模式下，不同房间的同名用户会共享这些状态。
+	GlobalNicknames bool
+
+	// ReconnectLimit 是同一来源 IP 在 ReconnectWindow 内最多允许的连接次数，
+	// 超过后新的连接会被拒绝，直到窗口内的次数回落；用于阻止客户端在断开和重连之间死循环，
+	// 反复触发加入/离开广播和历史查询。被拒绝的连接同样计数。0 表示不限制。
+	ReconnectLimit  int
+	ReconnectWindow time.Duration
+
+	// MaxClients 是连接数的硬上限，达到后新的注册请求会被拒绝；0 表示不限制。
+	MaxClients int
+
+	// MaxRooms 是同时活跃（有人在线）的房间数上限，达到后加入新房间的连接会被拒绝，
+	// 加入已有房间不受影响；0 表示不限制。
+	MaxRooms int
+
+	// AwayAfter 是用户没有任何活动（聊天或 presence 消息）多久后被标记为离开；0 表示不检测。
+	AwayAfter time.Duration
+
+	// IdleTimeout 是连接既不发送消息也不响应 ping 多久后被主动断开（包括观察者），
+	// 用于清理 NAT 后面的半开连接；0 表示不断开。
+	IdleTimeout time.Duration
+
+	// AllowUserPins 允许聊天室中的任何用户置顶或取消置顶本房间的消息；
+	// 为 false 时只能通过 Pin（管理接口）操作。
+	AllowUserPins bool
+
+	// HistoryLimit 是加入房间或请求历史时最多返回的历史消息条数，0 表示使用 DefaultHistoryLimit。
+	HistoryLimit int
+
+	// RoomHistoryLimits 按房间覆盖 HistoryLimit，例如消息很多的房间只回放最近 20 条，
+	// 客服房间回放 200 条；未列出的房间使用 HistoryLimit。
+	RoomHistoryLimits map[string]int
+
+	// RoomRateLimit 是每个房间在 RoomRateWindow 内允许的聊天消息总数（所有发送者合计），超出的消息被丢弃；0 表示不限制。
+	// RoomRateLimits 按房间覆盖它，例如给公告频道更低的上限。
+	RoomRateLimit  int
+	RoomRateLimits map[string]int
+
+	// RoomRateWindow 是统计房间消息速率的时间窗口，非正数时使用 DefaultRoomRateWindow。
+	RoomRateWindow time.Duration
+
+	// Welcome 是用户加入时只发送给该用户的欢迎语（"system" 消息），为空时不发送。
+	// 支持占位符 {username}（用户的昵称）和 {online_count}（当前在线用户数）。
+	Welcome string
+
+	// Bot 配置内置的触发词机器人，为 nil 或没有触发词时不启用。
+	Bot *BotConfig
+
+	// DeliveryStatusInterval 是向发送者汇总聊天消息投递状态（已收到、已读）的间隔，0 表示不跟踪投递状态。
+	// 收件人的确认来自开启了确认（?ack=1）的连接发来的 ack 消息，已读来自 read 消息。
+	DeliveryStatusInterval time.Duration
+
+	// HistoryCacheSize 是每个活跃房间在内存中缓存的最近消息条数，0 表示不缓存。
+	// 缓存的条数达到房间的历史回放条数（见 HistoryLimit）后，新用户加入时的历史直接从内存读取，
+	// 因此它应不小于 HistoryLimit 和 RoomHistoryLimits 中的最大值，否则缓存永远不会被使用。
+	HistoryCacheSize int
+
+	// BroadcastBuffer 是客户端消息进入 Hub 的队列容量。0 表示不缓冲：每条消息都要等 Hub 取走，
+	// 发送方与 Hub 严格同步；缓冲可以吸收突发流量，代价是队列中的消息在 Hub 处理前占用内存。
+	BroadcastBuffer int
+
+	// OverflowPolicy 决定队列已满时如何处理新消息，默认为 Block。
+	OverflowPolicy OverflowPolicy
+
+	// FanoutWorkers 是把一条广播并行发送给房间内连接的工作协程数，0 或 1 表示在 Run 协程中逐个发送。
+	// 只有目标连接足够多（数千个）的大房间才能从中受益；每个连接收到的消息顺序不受影响。
+	FanoutWorkers int
+
+	// Auditor 记录每条需要持久化的消息（聊天、加入、离开、公告），为 nil 时不记录。
+	Auditor Auditor
+
+	// Middlewares 是额外的消息处理中间件，按顺序在内置中间件（nonce 去重、回复校验）之后执行。
+	Middlewares []Middleware
 }
 
 // NewHub 创建并返回一个新的 Hub 实例。
 // 它需要一个 MessageStore 接口的实现，用于消息的持久化。
 func NewHub(ms store.MessageStore) *Hub {
-	return &Hub{
-		clients:      make(map[string]*client.Client), // 初始化客户端 map
-		broadcast:    make(chan []byte),
-		register:     make(chan *client.Client),
-		unregister:   make(chan *client.Client),
-		messageStore: ms, // 赋值消息存储实例
+	return NewHubWithConfig(ms, Config{})
+}
+
+// NewHubWithConfig 使用指定配置创建 Hub 实例。
+func NewHubWithConfig(ms store.MessageStore, cfg Config) *Hub {
+	h := &Hub{
+		clients:        make(map[string][]Client), // 初始化客户端 map
+		observers:      make(map[Client]bool),
+		broadcast:      make(chan broadcastRequest, cfg.BroadcastBuffer),
+		overflowPolicy: cfg.OverflowPolicy,
+		fanoutWorkers:  cfg.FanoutWorkers,
+		fanoutJobs:     make(chan fanoutJob, max(cfg.FanoutWorkers, 0)),
+		register:       make(chan Client, eventBuffer),
+		unregister:     make(chan Client, eventBuffer),
+		quit:           make(chan struct{}),
+		stopped:        make(chan struct{}),
+		announce:       make(chan []byte),
+		calls:          make(chan func()),
+		messageStore:   ms, // 赋值消息存储实例
+		userStore:      cfg.UserStore,
+		inbox:          cfg.InboxStore,
+		bans:           cfg.BanStore,
+		clock:          cfg.Clock,
+
+		allowMultiDevice:  cfg.AllowMultiDevice,
+		globalNicks:       cfg.GlobalNicknames,
+		connectAttempts:   make(map[string][]time.Time),
+		reconnectLimit:    cfg.ReconnectLimit,
+		reconnectWindow:   cfg.ReconnectWindow,
+		nonces:            make(map[string]map[string]time.Time),
+		roomSeq:           make(map[string]int64),
+		roomConns:         make(map[string]int),
+		historyCache:      make(map[string]*historyRing),
+		historyCacheSize:  cfg.HistoryCacheSize,
+		historyChunkSize:  cfg.HistoryChunkSize,
+		clearGlobal:       cfg.ClearHistoryGlobal,
+		maxRooms:          cfg.MaxRooms,
+		maxClients:        cfg.MaxClients,
+		lastActivity:      make(map[string]time.Time),
+		away:              make(map[string]bool),
+		awayAfter:         cfg.AwayAfter,
+		idleTimeout:       cfg.IdleTimeout,
+		allowUserPins:     cfg.AllowUserPins,
+		welcome:           cfg.Welcome,
+		bot:               newBot(cfg.Bot),
+		deliveries:        make(map[int64]*delivery),
+		deliveryInterval:  cfg.DeliveryStatusInterval,
+		auditor:           cfg.Auditor,
+		historyLimit:      cfg.HistoryLimit,
+		roomHistoryLimits: cfg.RoomHistoryLimits,
+		roomRateLimit:     cfg.RoomRateLimit,
+		roomRateLimits:    cfg.RoomRateLimits,
+		roomRateWindow:    cfg.RoomRateWindow,
+		roomRates:         make(map[string]*roomRate),
+	}
+	if h.clock == nil {
+		h.clock = clock.Real
+	}
+	if h.roomRateWindow <= 0 {
+		h.roomRateWindow = DefaultRoomRateWindow
+	}
+	h.middlewares = append([]Middleware{h.dedupNonce, h.checkReplyTo}, cfg.Middlewares...)
+	return h
+}
+
+// recordLastSeen 在用户的最后一个连接断开后记录最后在线时间，供下次加入时展示。
+// key 是规范化的用户名。用户仍有其他连接或未配置 UserStore 时什么也不做。
+func (h *Hub) recordLastSeen(key string) {
+	if h.userStore == nil || len(h.clients[key]) > 0 {
+		return
+	}
+	if err := h.userStore.UpdateLastSeen(key, h.clock.Now().UTC()); err != nil {
+		log.Printf("更新用户 %s 最后在线时间失败: %v", key, err)
+	}
+}
+
+// lastSeen 返回用户上次离开聊天室的时间，key 是规范化的用户名。没有记录或未配置 UserStore 时返回 nil。
+func (h *Hub) lastSeen(key string) *time.Time {
+	if h.userStore == nil {
+		return nil
+	}
+	t, err := h.userStore.GetLastSeen(key)
+	if err != nil {
+		if !errors.Is(err, store.ErrUserNotFound) {
+			log.Printf("获取用户 %s 最后在线时间失败: %v", key, err)
+		}
+		return nil
 	}
+	return &t
 }
 
 // Register 方法将客户端添加到注册通道。
 // client.Client 会调用此方法来向 Hub 发送注册请求。
-func (h *Hub) Register(c *client.Client) {
-	h.register <- c
+// Hub 已停止时不会阻塞，而是直接关闭该客户端的连接。
+// 先单独检查 quit：通道有缓冲，停止后发送也可能成功，而 Run 已经退出，不会再处理缓冲中的注册。
+func (h *Hub) Register(c Client) {
+	select {
+	case <-h.quit:
+		c.CloseWithReason(models.CloseGoingAway, "SERVER_SHUTDOWN")
+		return
+	default:
+	}
+	select {
+	case h.register <- c:
+	case <-h.quit:
+		c.CloseWithReason(models.CloseGoingAway, "SERVER_SHUTDOWN")
+	}
 }
 
 // Unregister 方法将客户端添加到注销通道。
 // 当客户端断开连接时，client.Client 会调用此方法。
-func (h *Hub) Unregister(c *client.Client) {
-	h.unregister <- c
+// Hub 已停止时直接返回，保证 readPump/writePump 的退出流程不会卡住。
+func (h *Hub) Unregister(c Client) {
+	select {
+	case h.unregister <- c:
+	case <-h.quit:
+	}
+}
+
+// broadcastRequest 是客户端提交给 Hub 的一条入站消息。
+// 携带发送者连接，Hub 才能把回复（错误、历史等）只发给这个连接，并据此做回显抑制等处理。
+type broadcastRequest struct {
+	sender Client         // 发送消息的连接
+	msg    models.Message // 已由客户端解析和校验，Username、Room、Timestamp 已填好
 }
 
 // Broadcast 方法将消息添加到广播通道。
-// 当客户端发送消息时，会通过此方法将消息发送到 Hub 进行广播。
-func (h *Hub) Broadcast(message []byte) {
-	h.broadcast <- message
+// 当客户端发送消息时，会通过此方法将消息连同发送者一起交给 Hub 处理。
+// 通道已满时按配置的 OverflowPolicy 处理；Hub 已停止时消息被丢弃。
+func (h *Hub) Broadcast(sender Client, msg models.Message) {
+	req := broadcastRequest{sender: sender, msg: msg}
+	switch h.overflowPolicy {
+	case DropNewest:
+		select {
+		case h.broadcast <- req:
+		case <-h.quit:
+		default:
+			h.dropBroadcast(req)
+		}
+	case DropOldest:
+		for {
+			select {
+			case h.broadcast <- req:
+				return
+			case <-h.quit:
+				return
+			default:
+			}
+			// 通道已满：取出最早的一条丢弃，为新消息腾出位置（可能与其他发送方竞争，因此循环重试）
+			select {
+			case old := <-h.broadcast:
+				h.dropBroadcast(old)
+			default:
+			}
+		}
+	default:
+		select {
+		case h.broadcast <- req:
+		case <-h.quit:
+		}
+	}
+}
+
+// dropBroadcast 记录一条因广播队列已满而被丢弃的消息。第一次和之后每 100 次记录一条日志，避免突发时刷屏。
+func (h *Hub) dropBroadcast(req broadcastRequest) {
+	if n := h.broadcastDropped.Add(1); n == 1 || n%100 == 0 {
+		log.Printf("广播队列已满 (容量 %d，策略 %s)，丢弃了来自 %s 的 %s 消息，累计丢弃 %d 条", cap(h.broadcast), h.overflowPolicy, req.msg.Username, req.msg.Type, n)
+	}
+}
+
+// BroadcastQueueStats 返回广播队列当前的长度、容量和累计丢弃的消息数。可以从任意协程调用。
+func (h *Hub) BroadcastQueueStats() (length, capacity int, dropped int64) {
+	return len(h.broadcast), cap(h.broadcast), h.broadcastDropped.Load()
+}
+
+// Stop 停止 Hub 的主循环。之后对 Register/Unregister/Broadcast 等方法的调用都会立即返回。
+// 可以安全地多次调用。
+func (h *Hub) Stop() {
+	h.stopOnce.Do(func() {
+		close(h.quit)
+	})
+}
+
+// Shutdown 优雅地停止 Hub：不再接受新的注册和消息，让每个连接在 timeout 内发完已排队的消息后
+// 再收到 1001 关闭帧，超时仍未发完的连接被直接关闭；最后再尝试保存一次之前保存失败的消息。
+// Shutdown 等待上述过程结束后返回。timeout 为 0 时与 Stop 相同，立即关闭所有连接。
+func (h *Hub) Shutdown(timeout time.Duration) {
+	h.stopOnce.Do(func() {
+		h.drainTimeout = timeout
+		close(h.quit)
+	})
+	select {
+	case <-h.stopped:
+	case <-time.After(timeout + time.Second): // Run 没有在运行时不永远等待
+	}
+}
+
+// closeAll 在 Run 退出前关闭所有连接。设置了 drainTimeout 时先等待排队的消息发完。
+func (h *Hub) closeAll() {
+	var conns []Client
+	h.forEachClient(func(cl Client) {
+		conns = append(conns, cl)
+	})
+	if h.drainTimeout > 0 {
+		for _, cl := range conns {
+			cl.Disconnect(models.CloseGoingAway, "SERVER_SHUTDOWN")
+		}
+		deadline := time.NewTimer(h.drainTimeout)
+		defer deadline.Stop()
+	wait:
+		for _, cl := range conns {
+			select {
+			case <-cl.Done():
+			case <-deadline.C:
+				log.Printf("排空连接超时 (%v)，强制关闭剩余连接", h.drainTimeout)
+				break wait
+			}
+		}
+	}
+	for _, cl := range conns {
+		select {
+		case <-cl.Done(): // 已经发完并关闭
+		default:
+			cl.CloseWithReason(models.CloseGoingAway, "SERVER_SHUTDOWN")
+		}
+	}
+	if len(h.deadLetters) > 0 {
+		h.retryDeadLetters()
+		if n := len(h.deadLetters); n > 0 {
+			log.Printf("关闭时仍有 %d 条消息保存失败，这些消息将丢失", n)
+		}
+	}
+}
+
+// Announce 构建一条不属于任何用户的 "announcement" 消息，并发送给所有房间的在线客户端。
+// 公告不会被持久化。
+func (h *Hub) Announce(content string) {
+	announcement := models.Message{
+		Type:      models.TypeAnnouncement,
+		Content:   content,
+		Timestamp: h.clock.Now().UTC(),
+	}
+	jsonMsg, err := json.Marshal(announcement)
+	if err != nil {
+		log.Printf("序列化公告失败: %v", err)
+		return
+	}
+	select {
+	case h.announce <- jsonMsg:
+	case <-h.quit:
+	}
+}
+
+// KickAll 向指定房间（room 为空时为所有房间）的所有连接发送告别公告，然后断开它们，返回断开的连接数。
+// 被踢出的连接立即从管理列表中移除，整个过程在 Hub 主循环中串行执行。
+func (h *Hub) KickAll(room, farewell string) int {
+	announcement := models.Message{
+		Type:      models.TypeAnnouncement,
+		Room:      room,
+		Content:   farewell,
+		Timestamp: h.clock.Now().UTC(),
+	}
+	jsonMsg, err := json.Marshal(announcement)
+	if err != nil {
+		log.Printf("序列化告别公告失败: %v", err)
+		return 0
+	}
+
+	kicked := 0
+	h.call(func() {
+		var targets []Client
+		h.forEachClient(func(cl Client) {
+			if room == "" || cl.GetRoom() == room {
+				targets = append(targets, cl)
+			}
+		})
+		for _, cl := range targets {
+			h.removeClient(cl)
+			if !cl.IsObserver() {
+				h.recordLastSeen(cl.GetUserKey())
+			}
+			cl.SendPriority(jsonMsg)
+			cl.Disconnect(models.CloseKicked, "KICKED")
+			kicked++
+		}
+	})
+	return kicked
+}
+
+// call 将 fn 交给 Run 协程执行并等待其完成，返回 fn 是否被执行（Hub 已停止时为 false）。
+// fn 中可以安全地访问 Hub 的内部状态；不能在 Run 协程内部调用 call，否则会死锁。
+func (h *Hub) call(fn func()) bool {
+	done := make(chan struct{})
+	select {
+	case h.calls <- func() {
+		defer close(done) // fn 发生 panic 时调用方也不会永远等待
+		fn()
+	}:
+	case <-h.quit:
+		return false
+	}
+	<-done
+	return true
+}
+
+// Alive 报告 Hub 主循环是否在运行：在 timeout 内能处理一个空事件即视为存活。
+func (h *Hub) Alive(timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	done := make(chan struct{})
+	select {
+	case h.calls <- func() { close(done) }:
+	case <-h.quit:
+		return false
+	case <-timer.C:
+		return false
+	}
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// Pin 置顶或取消置顶任意房间中的消息，并通知该房间的在线用户，供管理接口使用。
+// 消息不存在时返回 store.ErrMessageNotFound。
+func (h *Hub) Pin(id int64, pinned bool) error {
+	var err error
+	if !h.call(func() {
+		err = h.setPinned(id, pinned, "", "")
+	}) {
+		return errors.New("Hub 已停止")
+	}
+	return err
 }
 
-// SendUserListToAllClients 生成当前在线用户列表，并将其作为 "user_list" 类型的消息广播给所有在线客户端。
+// ConnectionCount 返回当前的连接数（同一用户的多个连接分别计数）。可以从任意协程调用。
+func (h *Hub) ConnectionCount() int {
+	return int(h.connCount.Load())
+}
+
+// OnlineUsers 返回所有房间当前在线用户名的有序列表，没有用户时返回空切片（不是 nil）。
+// 读取在 Hub 主循环中进行，可以从任意协程安全调用。
+func (h *Hub) OnlineUsers() []string {
+	users := make([]string, 0)
+	h.call(func() {
+		for _, conns := range h.clients {
+			users = append(users, conns[0].GetUsername())
+		}
+	})
+	sort.Strings(users)
+	return users
+}
+
+// RoomInfo 描述一个活跃房间及其在线人数。
+type RoomInfo struct {
+	Name      string `json:"name"`
+	Occupants int    `json:"occupants"` // 在线用户数（同一用户的多个连接只计一次）
+}
+
+// Rooms 返回当前有人在线的房间列表，按房间名排序。没有在线用户的房间不会出现。
+// 读取在 Hub 主循环中进行，可以从任意协程安全调用。
+func (h *Hub) Rooms() []RoomInfo {
+	rooms := make([]RoomInfo, 0)
+	h.call(func() {
+		occupants := make(map[string]int)
+		for _, conns := range h.clients {
+			counted := make(map[string]bool)
+			for _, cl := range conns {
+				if !counted[cl.GetRoom()] {
+					counted[cl.GetRoom()] = true
+					occupants[cl.GetRoom()]++
+				}
+			}
+		}
+		for name, count := range occupants {
+			rooms = append(rooms, RoomInfo{Name: name, Occupants: count})
+		}
+	})
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].Name < rooms[j].Name })
+	return rooms
+}
+
+// ClientInfo 描述一个在线连接的状态，供调试接口使用。
+// 不包含 IP 地址、User-Agent 等可能敏感的信息。
+type ClientInfo struct {
+	Username     string    `json:"username"`
+	Room         string    `json:"room"`
+	QueueLen     int       `json:"queue_len"` // 发送通道中排队的消息数
+	Observer     bool      `json:"observer"`
+	Away         bool      `json:"away"`
+	LastActivity time.Time `json:"last_activity"`
+}
+
+// ClientInfos 返回所有在线连接的状态，按用户名和房间排序。
+// 读取在 Hub 主循环中进行，可以从任意协程安全调用。
+func (h *Hub) ClientInfos() []ClientInfo {
+	infos := make([]ClientInfo, 0)
+	h.call(func() {
+		h.forEachClient(func(cl Client) {
+			info := ClientInfo{
+				Username: cl.GetUsername(),
+				Room:     cl.GetRoom(),
+				QueueLen: cl.QueueLen(),
+				Observer: cl.IsObserver(),
+			}
+			if !cl.IsObserver() {
+				info.Away = h.away[cl.GetUserKey()]
+				info.LastActivity = h.lastActivity[cl.GetUserKey()]
+			}
+			infos = append(infos, info)
+		})
+	})
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Username != infos[j].Username {
+			return infos[i].Username < infos[j].Username
+		}
+		return infos[i].Room < infos[j].Room
+	})
+	return infos
+}
+
+// SendUserListToRoom 生成指定房间的在线用户列表，并将其作为 "user_list" 类型的消息发送给该房间的所有客户端。
 // 方法名大写开头，使其在 Hub 包内部可访问，如果需要，其他包也可以访问。
-func (h *Hub) SendUserListToAllClients() {
+func (h *Hub) SendUserListToRoom(room string) {
+	if jsonUserListMsg := h.userListMessage(room); jsonUserListMsg != nil {
+		h.broadcastToRoom(room, jsonUserListMsg)
+	}
+}
+
+// SendUserListToClient 只向指定客户端发送其所在房间的在线用户列表，用于新连接的初始状态。
+// 与 SendUserListToRoom 一样只能在 Run 协程中调用。
+func (h *Hub) SendUserListToClient(cl Client) {
+	if jsonUserListMsg := h.userListMessage(cl.GetRoom()); jsonUserListMsg != nil {
+		cl.SendMessage(jsonUserListMsg)
+	}
+}
+
+// userListMessage 生成指定房间的 "user_list" 消息，序列化失败时返回 nil。
+// 观察者不会出现在列表中。
+func (h *Hub) userListMessage(room string) []byte {
 	userList := make([]string, 0, len(h.clients))
-	for username := range h.clients {
+	var awayList []string
+	var statuses map[string]string
+	for key := range h.clients {
+		conn := h.connInRoom(key, room) // 同一用户的多个连接只列出一次
+		if conn == nil {
+			continue
+		}
+		// 列表展示原始用户名；按房间唯一时同一个键在不同房间可能是不同的人，因此取本房间的连接
+		username := conn.GetUsername()
 		userList = append(userList, username)
+		if h.away[key] {
+			awayList = append(awayList, username)
+		}
+		if status := conn.Status(); status != "" {
+			if statuses == nil {
+				statuses = make(map[string]string)
+			}
+			statuses[username] = status
+		}
 	}
 	sort.Strings(userList)
-	log.Printf("DEBUG: Current user list: %v (count: %d)", userList, len(userList))
+	sort.Strings(awayList)
+	log.Printf("DEBUG: Current user list of room %s: %v (count: %d)", room, userList, len(userList))
 
 	userListMsg := models.Message{
-		Type:  "user_list",
-		Users: userList,
-		// <--- 关键修正：移除下面这三行，它们是多余的，且零值可能导致问题
-		// Username:  "",
-		// Content:   "",
-		// Timestamp: time.Time{}, // 移除此行
+		Type:     models.TypeUserList,
+		Room:     room,
+		Users:    userList,
+		Away:     awayList,
+		Statuses: statuses,
 	}
 	jsonUserListMsg, err := json.Marshal(userListMsg)
 	if err != nil {
 		log.Printf("序列化用户列表消息失败: %v", err)
+		return nil
+	}
+	return jsonUserListMsg
+}
+
+// broadcastToRoom 将消息发送给指定房间内的所有在线客户端。
+func (h *Hub) broadcastToRoom(room string, message []byte) {
+	h.fanout(h.roomTargets(room), message, nil)
+}
+
+// forEachClient 对每一个在线连接（包括观察者）调用 fn。
+func (h *Hub) forEachClient(fn func(cl Client)) {
+	for _, conns := range h.clients {
+		for _, cl := range conns {
+			fn(cl)
+		}
+	}
+	for cl := range h.observers {
+		fn(cl)
+	}
+}
+
+// userInRoom 报告用户是否有连接位于指定房间，key 是规范化的用户名。
+func (h *Hub) userInRoom(key, room string) bool {
+	return h.connInRoom(key, room) != nil
+}
+
+// connInRoom 返回用户在指定房间的任意一个连接，没有时返回 nil。key 是规范化的用户名。
+func (h *Hub) connInRoom(key, room string) Client {
+	for _, cl := range h.clients[key] {
+		if cl.GetRoom() == room {
+			return cl
+		}
+	}
+	return nil
+}
+
+// nickTaken 报告 cl 的昵称是否已被其他在线连接占用。
+// globalNicks 为 true 时在所有房间中检查，否则只检查 cl 要加入的房间。
+func (h *Hub) nickTaken(cl Client) bool {
+	if h.globalNicks {
+		return len(h.clients[cl.GetUserKey()]) > 0
+	}
+	return h.userInRoom(cl.GetUserKey(), cl.GetRoom())
+}
+
+// rejectClient 拒绝一个尚未注册的客户端：发送错误消息并关闭连接。
+// 被拒绝的客户端没有启动读写协程，错误消息只是尽力而为地放入发送通道。
+// textKey 和 args 是错误文本的文案键和参数，按客户端的语言生成。
+func (h *Hub) rejectClient(cl Client, closeCode int, code, textKey string, args ...interface{}) {
+	errMsg := models.Message{
+		Type:      models.TypeError,
+		Error:     i18n.T(cl.GetLang(), textKey, args...),
+		ErrorCode: code,
+	}
+	jsonErrMsg, _ := json.Marshal(errMsg)
+	cl.SendPriority(jsonErrMsg)
+	cl.CloseWithReason(closeCode, code) // 关闭帧带上错误码，没有启动读写协程也能让客户端知道被拒绝的原因
+}
+
+// addClient 将连接加入管理列表。新连接算作一次活动。
+func (h *Hub) addClient(cl Client) {
+	if cl.IsObserver() {
+		h.observers[cl] = true
+	} else {
+		// 多端登录的新连接沿用该用户在同一房间中已设置的状态
+		if existing := h.connInRoom(cl.GetUserKey(), cl.GetRoom()); existing != nil {
+			cl.SetStatus(existing.Status())
+		}
+		h.clients[cl.GetUserKey()] = append(h.clients[cl.GetUserKey()], cl)
+		h.touch(cl.GetUserKey())
+	}
+	h.roomConns[cl.GetRoom()]++
+	h.connCount.Add(1)
+}
+
+// removeClient 从管理列表中移除指定连接，返回该连接此前是否已注册。
+// 用户的最后一个连接移除后，删除该用户的 map 条目。
+func (h *Hub) removeClient(cl Client) bool {
+	if cl.IsObserver() {
+		if !h.observers[cl] {
+			return false
+		}
+		delete(h.observers, cl)
+		h.releaseConn(cl.GetRoom())
+		return true
+	}
+	conns := h.clients[cl.GetUserKey()]
+	for i, existing := range conns {
+		if existing == cl {
+			conns = append(conns[:i], conns[i+1:]...)
+			if len(conns) == 0 {
+				delete(h.clients, cl.GetUserKey())
+				delete(h.lastActivity, cl.GetUserKey())
+				delete(h.away, cl.GetUserKey())
+			} else {
+				h.clients[cl.GetUserKey()] = conns
+			}
+			h.releaseConn(cl.GetRoom())
+			return true
+		}
+	}
+	return false
+}
+
+// releaseConn 更新连接移除后的计数，房间没有连接时清理房间状态。
+func (h *Hub) releaseConn(room string) {
+	h.connCount.Add(-1)
+	h.roomConns[room]--
+	if h.roomConns[room] <= 0 {
+		h.reapRoom(room)
+	}
+}
+
+// touch 记录用户的一次活动，key 是规范化的用户名。
+// 用户原本处于离开状态时恢复为在线，并刷新其所在房间的用户列表。只能在 Run 协程中调用。
+func (h *Hub) touch(key string) {
+	h.lastActivity[key] = h.clock.Now()
+	if !h.away[key] {
 		return
 	}
-	log.Printf("DEBUG: Broadcasting user_list message: %s", string(jsonUserListMsg)) // <--- 添加这条日志
+	delete(h.away, key)
+	h.refreshUserRooms(key)
+}
 
-	for _, cl := range h.clients {
-		log.Printf("DEBUG: Sending user_list to client: %s", cl.GetUsername()) // <--- 添加这条日志
-		cl.SendMessage(jsonUserListMsg)
+// markIdleAway 将超过 awayAfter 没有活动的在线用户标记为离开，并刷新相关房间的用户列表。
+// 只能在 Run 协程中调用。
+func (h *Hub) markIdleAway(now time.Time) {
+	for key := range h.clients {
+		if h.away[key] || now.Sub(h.lastActivity[key]) < h.awayAfter {
+			continue
+		}
+		h.away[key] = true
+		log.Printf("用户 %s 长时间没有活动，标记为离开。", key)
+		h.refreshUserRooms(key)
+	}
+}
+
+// closeIdleConns 断开超过 idleTimeout 没有任何活动的连接。
+// 连接在 writePump 发送关闭帧后走正常的注销流程，因此会照常广播离开通知。
+// 只能在 Run 协程中调用。
+func (h *Hub) closeIdleConns(now time.Time) {
+	h.forEachClient(func(cl Client) {
+		if now.Sub(cl.LastActivity()) > h.idleTimeout {
+			log.Printf("连接 %s (房间: %s) 长时间没有活动，主动断开。", cl.GetUsername(), cl.GetRoom())
+			cl.Disconnect(models.CloseIdleTimeout, "IDLE_TIMEOUT")
+		}
+	})
+}
+
+// refreshUserRooms 向用户所在的每个房间重新发送在线用户列表，key 是规范化的用户名。
+func (h *Hub) refreshUserRooms(key string) {
+	refreshed := make(map[string]bool)
+	for _, cl := range h.clients[key] {
+		if !refreshed[cl.GetRoom()] {
+			refreshed[cl.GetRoom()] = true
+			h.SendUserListToRoom(cl.GetRoom())
+		}
+	}
+}
+
+// reapRoom 清理最后一个连接已经离开的房间在 Hub 中的状态。
+// 消息序号会在房间下次使用时从存储中恢复，因此可以安全丢弃。
+func (h *Hub) reapRoom(room string) {
+	delete(h.roomConns, room)
+	delete(h.roomSeq, room)
+	delete(h.historyCache, room)
+	delete(h.roomRates, room)
+}
+
+// pinnedMessages 返回房间当前置顶的消息，读取失败时记录日志并返回 nil，不影响历史消息的发送。
+func (h *Hub) pinnedMessages(room string) []models.Message {
+	pinned, err := h.messageStore.GetPinnedMessages(room)
+	if err != nil {
+		log.Printf("获取房间 %s 的置顶消息失败: %v", room, err)
+		return nil
+	}
+	return pinned
+}
+
+// nextSeq 返回房间的下一个消息序号。房间第一次使用时从存储中读取已持久化的最大序号，
+// 保证重启后序号继续递增。只能在 Run 协程中调用。
+func (h *Hub) nextSeq(room string) int64 {
+	seq, ok := h.roomSeq[room]
+	if !ok {
+		last, err := h.messageStore.LastSeq(room)
+		if err != nil {
+			log.Printf("读取房间 %s 的消息序号失败: %v", room, err)
+		}
+		seq = last
+	}
+	seq++
+	h.roomSeq[room] = seq
+	return seq
+}
+
+// seenNonce 报告用户在去重窗口内是否已经发送过该 nonce，并记录本次出现，key 是规范化的用户名。
+// 顺带清理该用户已过期的 nonce。只能在 Run 协程中调用。
+func (h *Hub) seenNonce(key, nonce string, now time.Time) bool {
+	seen := h.nonces[key]
+	if seen == nil {
+		seen = make(map[string]time.Time)
+		h.nonces[key] = seen
+	}
+	for n, t := range seen {
+		if now.Sub(t) > nonceTTL {
+			delete(seen, n)
+		}
+	}
+	if _, ok := seen[nonce]; ok {
+		return true
+	}
+	seen[nonce] = now
+	return false
+}
+
+// throttleConnect 记录来源 addr 的一次连接，并报告它在 reconnectWindow 内的连接次数是否已超过 reconnectLimit。
+// 每个窗口清理一次所有来源的过期记录，使只连接过一次的来源不会永远占用内存。只能在 Run 协程中调用。
+func (h *Hub) throttleConnect(addr string, now time.Time) bool {
+	if h.reconnectLimit <= 0 || h.reconnectWindow <= 0 {
+		return false
+	}
+	if now.Sub(h.attemptsSweptAt) > h.reconnectWindow {
+		for a, times := range h.connectAttempts {
+			if now.Sub(times[len(times)-1]) > h.reconnectWindow {
+				delete(h.connectAttempts, a)
+			}
+		}
+		h.attemptsSweptAt = now
+	}
+	times := h.connectAttempts[addr]
+	for len(times) > 0 && now.Sub(times[0]) > h.reconnectWindow {
+		times = times[1:]
+	}
+	times = append(times, now)
+	h.connectAttempts[addr] = times
+	return len(times) > h.reconnectLimit
+}
+
+// nextGuestName 返回下一个未被占用的游客名称，例如 "游客-1"。
+// 只能在 Run 协程中调用。
+func (h *Hub) nextGuestName() string {
+	for {
+		h.guestSeq++
+		name := fmt.Sprintf("%s-%d", guestPrefix, h.guestSeq)
+		if _, exists := h.clients[models.UserKey(name)]; !exists {
+			return name
+		}
+	}
+}
+
+// idleCheckInterval 返回空闲检查的间隔：取已开启的离开检测和空闲断开时间中较小者的一半，
+// 两者都未开启时返回 0。
+func (h *Hub) idleCheckInterval() time.Duration {
+	var shortest time.Duration
+	for _, d := range []time.Duration{h.awayAfter, h.idleTimeout} {
+		if d > 0 && (shortest == 0 || d < shortest) {
+			shortest = d
+		}
 	}
+	return shortest / 2
 }
 
 // Run 启动 Hub 的主事件循环。
 // 这个方法在一个单独的 goroutine 中运行，持续监听来自各个通道的事件。
 func (h *Hub) Run() {
+	defer close(h.stopped)
+
+	if h.fanoutWorkers > 1 {
+		for i := 0; i < h.fanoutWorkers; i++ {
+			go h.fanoutWorker()
+		}
+		defer close(h.fanoutJobs) // 只有 Run 协程发送扇出任务，Run 退出后不会再有发送
+	}
+
+	// 离开检测和空闲断开都未开启时 idleCheck 为 nil，对应的 case 永远不会触发
+	var idleCheck <-chan time.Time
+	if interval := h.idleCheckInterval(); interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		idleCheck = ticker.C
+	}
+
+	// 未开启投递状态时 deliveryFlush 为 nil
+	var deliveryFlush <-chan time.Time
+	if h.deliveryInterval > 0 {
+		ticker := time.NewTicker(h.deliveryInterval)
+		defer ticker.Stop()
+		deliveryFlush = ticker.C
+	}
+
 	for {
 		select {
+		// Hub 被停止，通知所有连接服务器正在关闭，然后退出主循环
+		case <-h.quit:
+			h.closeAll()
+			return
+
 		// 处理客户端注册请求
 		case cl := <-h.register:
-			log.Printf("DEBUG: Hub received register request for client: %s", cl.GetUsername()) // <--- 添加 DEBUG 日志
+			h.guard("register", cl, func() { h.handleRegister(cl) })
 
-			// 1. 检查昵称唯一性
-			if _, exists := h.clients[cl.GetUsername()]; exists {
-				errMsg := models.Message{
-					Type:  "error",
-					Error: "昵称已被占用，请尝试其他昵称。",
-				}
-				jsonErrMsg, _ := json.Marshal(errMsg)
-				cl.SendMessage(jsonErrMsg)
-				cl.CloseConnection() // 关闭连接
-				log.Printf("拒绝客户端 %s: 昵称已被占用。", cl.GetUsername())
-				continue // 跳过当前循环，不进行后续注册步骤
-			}
+		// 处理客户端注销请求（客户端断开连接）
+		case cl := <-h.unregister:
+			h.guard("unregister", cl, func() { h.handleUnregister(cl) })
 
-			// 昵称唯一，将客户端添加到 Hub 的管理列表
-			h.clients[cl.GetUsername()] = cl
-			log.Printf("客户端 %s 加入了聊天室。", cl.GetUsername()) // <--- 这条日志应该出现
+		// 处理系统公告，发送给所有房间的客户端
+		case message := <-h.announce:
+			h.guard("announce", nil, func() { h.fanout(h.roomTargets(""), message, nil) })
 
-			// 启动新连接客户端的读写协程。
-			// 这是客户端内部处理消息收发的核心逻辑。
-			cl.RunPumps() // <--- 修正：Hub 在成功注册后才启动泵
+		// 在主循环中执行外部提交的函数（状态读取等）
+		case fn := <-h.calls:
+			h.guard("call", nil, fn)
 
-			// --- 发送历史消息给新连接的客户端 ---
-			historyMessages, err := h.messageStore.GetMessages(50)
-			if err != nil {
-				log.Printf("获取历史消息失败: %v", err)
-			} else {
-				for _, msg := range historyMessages {
-					jsonMsg, err := json.Marshal(msg)
-					if err != nil {
-						log.Printf("序列化历史消息失败: %v", err)
-						continue
-					}
-					cl.SendMessage(jsonMsg)
+		// 处理来自客户端的广播消息
+		case req := <-h.broadcast:
+			h.guard("broadcast", req.sender, func() { h.handleBroadcast(req.sender, req.msg) })
+
+		// 定期检查长时间没有活动的用户
+		case <-idleCheck:
+			h.guard("idle check", nil, func() {
+				now := h.clock.Now()
+				if h.awayAfter > 0 {
+					h.markIdleAway(now)
 				}
-			}
+				if h.idleTimeout > 0 {
+					h.closeIdleConns(now)
+				}
+			})
 
-			// --- 广播用户加入通知 ---
-			joinMsg := models.Message{
-				Type:      "join",
-				Username:  cl.GetUsername(),
-				Content:   cl.GetUsername() + " 加入了聊天。",
-				Timestamp: time.Now(),
-			}
-			jsonMsg, _ := json.Marshal(joinMsg)
-			h.messageStore.SaveMessage(joinMsg)
+		// 定期把投递状态的变化汇总发给发送者
+		case <-deliveryFlush:
+			h.guard("delivery flush", nil, h.flushDeliveries)
+		}
+	}
+}
 
-			for _, c := range h.clients {
-				c.SendMessage(jsonMsg)
-			}
+// handleRegister 处理客户端注册：分配游客名、检查昵称、发送历史并广播加入通知。
+func (h *Hub) handleRegister(cl Client) {
+	log.Printf("DEBUG: Hub received register request for client: %s", cl.GetUsername()) // <--- 添加 DEBUG 日志
 
-			// --- 更新并广播在线用户列表 ---
-			h.SendUserListToAllClients()
+	// 未提供昵称的客户端分配唯一的游客名称，避免多个 "游客" 互相冲突
+	if cl.GetUserKey() == "" { // 只有空白字符的昵称也视为未提供
+		cl.SetUsername(h.nextGuestName())
+	}
 
-		// 处理客户端注销请求（客户端断开连接）
-		case cl := <-h.unregister:
-			// 检查客户端是否存在于 Hub 的管理列表中 (通过用户名查找)
-			if _, ok := h.clients[cl.GetUsername()]; ok {
-				// 从管理列表中删除客户端 (通过用户名删除)
-				delete(h.clients, cl.GetUsername())
-				log.Printf("客户端 %s 离开了聊天室。", cl.GetUsername())
-
-				// 构建用户离开通知消息
-				leaveMsg := models.Message{
-					Type:      "leave",
-					Username:  cl.GetUsername(),
-					Content:   cl.GetUsername() + " 离开了聊天。",
-					Timestamp: time.Now(),
-				}
-				jsonMsg, _ := json.Marshal(leaveMsg)
-				// 将用户离开消息保存到数据库
-				h.messageStore.SaveMessage(leaveMsg) // h.messageStore 必须是 MessageStore 接口的实例
+	// 协议版本不兼容时其他检查都没有意义，最先拒绝
+	if v := cl.ProtocolVersion(); !models.ProtocolSupported(v) {
+		h.rejectClient(cl, models.CloseUnsupportedVersion, models.ErrCodeUnsupportedVersion, i18n.KeyUnsupportedVersion, v, models.MinProtocolVersion, models.ProtocolVersion)
+		log.Printf("拒绝客户端 %s: 不支持的协议版本 %d。", cl.GetUsername(), v)
+		return
+	}
 
-				// 将离开通知广播给所有剩余的在线客户端
-				for _, c := range h.clients { // 遍历 map 的值
-					c.SendMessage(jsonMsg)
-				}
-				// --- 更新并广播在线用户列表 ---
-				// 调用 Hub 的公共方法 SendUserListToAllClients
-				h.SendUserListToAllClients()
-			}
+	// 0. 拒绝短时间内反复连接的来源，避免加入/离开通知刷屏
+	if h.throttleConnect(cl.GetRemoteAddr(), h.clock.Now()) {
+		h.rejectClient(cl, models.CloseThrottled, models.ErrCodeThrottled, i18n.KeyThrottled)
+		log.Printf("拒绝客户端 %s: 来源 %s 在 %v 内连接超过 %d 次。", cl.GetUsername(), cl.GetRemoteAddr(), h.reconnectWindow, h.reconnectLimit)
+		return
+	}
 
-		// 处理来自客户端的广播消息
-		case message := <-h.broadcast:
-			// 解码消息以便进行持久化（如果需要）
-			var msg models.Message
-			if err := json.Unmarshal(message, &msg); err != nil {
-				log.Printf("广播消息解码失败: %v", err)
-				continue
-			}
-			// 将聊天消息保存到数据库
-			h.messageStore.SaveMessage(msg) // h.messageStore 必须是 MessageStore 接口的实例
+	// 拒绝被封禁的用户名（包括以该名字观察的连接）
+	if ban, banned := h.activeBan(cl); banned {
+		h.rejectBanned(cl, ban)
+		log.Printf("拒绝客户端 %s: 用户名已被封禁。", cl.GetUsername())
+		return
+	}
+
+	// 1. 检查昵称唯一性（允许多端登录时，同名连接视为同一用户的另一台设备；观察者不占用昵称）
+	// 按规范化的用户名比较，"Alice" 和 "alice" 视为同一个昵称，防止通过大小写变化冒充他人
+	if !cl.IsObserver() && !h.allowMultiDevice && h.nickTaken(cl) {
+		h.rejectClient(cl, models.CloseNickTaken, models.ErrCodeNickTaken, i18n.KeyNickTaken)
+		log.Printf("拒绝客户端 %s: 昵称已被占用。", cl.GetUsername())
+		return // 不进行后续注册步骤
+	}
+	if !cl.IsObserver() && h.isBotName(cl.GetUserKey()) {
+		h.rejectClient(cl, models.CloseNickTaken, models.ErrCodeNickTaken, i18n.KeyNickTaken)
+		log.Printf("拒绝客户端 %s: 昵称与机器人相同。", cl.GetUsername())
+		return
+	}
+
+	// 2. 检查连接数硬上限
+	if h.maxClients > 0 && h.ConnectionCount() >= h.maxClients {
+		h.rejectClient(cl, models.CloseTryAgain, models.ErrCodeServerFull, i18n.KeyServerFull)
+		log.Printf("拒绝客户端 %s: 连接数已达上限 %d。", cl.GetUsername(), h.maxClients)
+		return
+	}
+
+	// 3. 检查活跃房间数上限，只限制创建新房间
+	if h.maxRooms > 0 && h.roomConns[cl.GetRoom()] == 0 && len(h.roomConns) >= h.maxRooms {
+		h.rejectClient(cl, models.CloseTooManyRooms, models.ErrCodeTooManyRooms, i18n.KeyTooManyRooms)
+		log.Printf("拒绝客户端 %s: 活跃房间数已达上限 %d，无法创建房间 %s。", cl.GetUsername(), h.maxRooms, cl.GetRoom())
+		return
+	}
+
+	// 观察者只接收历史和用户列表，不广播加入通知，也不出现在用户列表中
+	if cl.IsObserver() {
+		h.addClient(cl)
+		log.Printf("观察者 %s 进入了聊天室 %s (地址: %s, UA: %q)。", cl.GetUsername(), cl.GetRoom(), cl.GetRemoteAddr(), cl.GetUserAgent())
+		cl.RunPumps()
+		h.sendHistory(cl)
+		h.SendUserListToClient(cl)
+		return
+	}
+
+	// 该用户此前是否已在这个房间有连接（多端登录），有则不重复广播加入通知
+	alreadyInRoom := h.userInRoom(cl.GetUserKey(), cl.GetRoom())
+
+	// 将客户端添加到 Hub 的管理列表
+	h.addClient(cl)
+	log.Printf("客户端 %s 加入了聊天室 %s (地址: %s, UA: %q)。", cl.GetUsername(), cl.GetRoom(), cl.GetRemoteAddr(), cl.GetUserAgent())
+
+	// 启动新连接客户端的读写协程。
+	// 这是客户端内部处理消息收发的核心逻辑。
+	cl.RunPumps() // <--- 修正：Hub 在成功注册后才启动泵
+
+	// --- 发送历史消息、欢迎语和在线用户列表快照给新连接的客户端 ---
+	// 快照单独发送，即使之后的房间广播被跳过（例如多端登录时），新连接也一定有初始的用户列表
+	h.sendHistory(cl)
+	h.sendWelcome(cl)
+	h.SendUserListToClient(cl)
+	h.deliverInbox(cl)
+
+	// --- 广播用户加入通知 ---
+	if !alreadyInRoom {
+		joinMsg := models.Message{
+			Type:      models.TypeJoin,
+			Username:  cl.GetUsername(),
+			Room:      cl.GetRoom(),
+			Content:   i18n.T(i18n.Default, i18n.KeyJoin, cl.GetUsername()),
+			TextKey:   i18n.KeyJoin,
+			Timestamp: h.clock.Now().UTC(),
+			LastSeen:  h.lastSeen(cl.GetUserKey()),
+		}
+		joinMsg.ID = h.saveMessage(joinMsg)
+		jsonMsg, _ := json.Marshal(joinMsg)
+		h.broadcastToRoom(cl.GetRoom(), jsonMsg)
+	}
+
+	// --- 更新并广播在线用户列表 ---
+	h.SendUserListToRoom(cl.GetRoom())
+}
+
+// historyLimitFor 返回指定房间回放历史消息的条数：优先使用房间的单独配置，其次是默认配置。
+func (h *Hub) historyLimitFor(room string) int {
+	if limit, ok := h.roomHistoryLimits[room]; ok && limit > 0 {
+		return limit
+	}
+	if h.historyLimit > 0 {
+		return h.historyLimit
+	}
+	return DefaultHistoryLimit
+}
+
+// sendWelcome 向新加入的客户端单独发送欢迎语，替换其中的 {username} 和 {online_count} 占位符。
+func (h *Hub) sendWelcome(cl Client) {
+	if h.welcome == "" {
+		return
+	}
+	content := strings.NewReplacer(
+		"{username}", cl.GetUsername(),
+		"{online_count}", strconv.Itoa(len(h.clients)),
+	).Replace(h.welcome)
+	jsonMsg, err := json.Marshal(models.Message{
+		Type:      models.TypeSystem,
+		Room:      cl.GetRoom(),
+		Content:   content,
+		Timestamp: h.clock.Now().UTC(),
+	})
+	if err != nil {
+		log.Printf("序列化欢迎语失败: %v", err)
+		return
+	}
+	cl.SendMessage(jsonMsg)
+}
+
+// sendHistory 向新连接的客户端发送房间的历史消息和置顶消息。
+// 历史消息打包成一条 "history" 消息发送，只占用发送通道的一个位置，
+// 避免慢客户端的缓冲被逐条历史消息填满而丢失。
+func (h *Hub) sendHistory(cl Client) {
+	limit := h.historyLimitFor(cl.GetRoom())
+	historyMessages, ok := h.cachedHistory(cl.GetRoom(), limit)
+	var err error
+	if !ok {
+		historyMessages, err = h.messageStore.GetMessages(cl.GetRoom(), limit)
+	}
+	if err != nil {
+		// 历史加载失败不影响实时聊天，但要让客户端知道历史不可用，而不是误以为房间是空的
+		log.Printf("获取历史消息失败: %v", err)
+		historyMsg := models.Message{
+			Type:      models.TypeHistory,
+			Room:      cl.GetRoom(),
+			Error:     i18n.T(cl.GetLang(), i18n.KeyHistoryUnavailable),
+			ErrorCode: models.ErrCodeHistoryUnavailable,
+		}
+		if jsonMsg, err := json.Marshal(historyMsg); err == nil {
+			cl.SendMessage(jsonMsg)
+		}
+	} else if pinned := h.pinnedMessages(cl.GetRoom()); len(historyMessages) > 0 || len(pinned) > 0 {
+		historyMsg := models.Message{
+			Type:     models.TypeHistory,
+			Room:     cl.GetRoom(),
+			Messages: historyMessages,
+			Pinned:   pinned,
+		}
+		h.sendHistoryMessage(cl, historyMsg)
+	}
+}
+
+// handleUnregister 处理客户端注销：移除连接，在用户离开房间时广播离开通知。
+func (h *Hub) handleUnregister(cl Client) {
+	// 只移除这个连接本身：重复注销或同名的其他连接都不受影响
+	if !h.removeClient(cl) {
+		return
+	}
+	if cl.IsObserver() {
+		log.Printf("观察者 %s 的连接已断开 (房间: %s)。", cl.GetUsername(), cl.GetRoom())
+		return
+	}
+	log.Printf("客户端 %s 的连接已断开 (房间: %s)。", cl.GetUsername(), cl.GetRoom())
+
+	h.recordLastSeen(cl.GetUserKey())
+
+	// 用户在该房间还有其他连接（多端登录），不算离开
+	if h.userInRoom(cl.GetUserKey(), cl.GetRoom()) {
+		return
+	}
+	log.Printf("客户端 %s 离开了聊天室。", cl.GetUsername())
+
+	// 构建用户离开通知消息，区分主动离开和连接中断
+	textKey := i18n.KeyDisconnect
+	if cl.Quitting() {
+		textKey = i18n.KeyLeave
+	}
+	leaveMsg := models.Message{
+		Type:      models.TypeLeave,
+		Username:  cl.GetUsername(),
+		Room:      cl.GetRoom(),
+		Content:   i18n.T(i18n.Default, textKey, cl.GetUsername()),
+		TextKey:   textKey,
+		Timestamp: h.clock.Now().UTC(),
+	}
+	// 将用户离开消息保存到数据库
+	leaveMsg.ID = h.saveMessage(leaveMsg)
+	jsonMsg, _ := json.Marshal(leaveMsg)
+
+	// 将离开通知广播给同一房间内剩余的在线客户端
+	h.broadcastToRoom(cl.GetRoom(), jsonMsg)
+	// --- 更新并广播在线用户列表 ---
+	h.SendUserListToRoom(cl.GetRoom())
+}
+
+// handleBroadcast 持久化来自客户端的消息，并发送给同一房间的在线客户端。
+func (h *Hub) handleBroadcast(sender Client, msg models.Message) {
+	// ack 由客户端自动发送，不代表用户活跃，在更新活跃时间之前处理
+	if msg.Type == models.TypeAck {
+		h.handleReceipt(sender, msg)
+		return
+	}
+	// 任何来自客户端的消息都说明用户仍然活跃；presence 消息到此为止，不广播也不持久化
+	if _, online := h.clients[sender.GetUserKey()]; online {
+		h.touch(sender.GetUserKey())
+	}
+	if msg.Type == models.TypePresence {
+		return
+	}
+	if msg.Type == models.TypeRead {
+		h.handleReceipt(sender, msg)
+		return
+	}
+	if msg.Type == models.TypePin || msg.Type == models.TypeUnpin {
+		h.handlePin(sender, msg)
+		return
+	}
+	if msg.Type == models.TypeHistoryRequest {
+		h.handleHistoryRequest(sender, msg)
+		return
+	}
+	if msg.Type == models.TypeMyHistory {
+		h.handleMyHistory(sender)
+		return
+	}
+	if msg.Type == models.TypeHistoryMeta {
+		h.handleHistoryMeta(sender)
+		return
+	}
+	if msg.Type == models.TypeDirect {
+		h.handleDirect(sender, msg)
+		return
+	}
+	if msg.Type == models.TypeClearHistory {
+		h.handleClearHistory(sender)
+		return
+	}
+	if msg.Type == models.TypeStatus {
+		h.handleStatus(sender, msg.Content)
+		return
+	}
 
-			// 将原始 JSON 消息广播给所有在线客户端
-			for _, cl := range h.clients { // 遍历 map 的值
-				cl.SendMessage(message)
+	// 依次经过中间件（去重、回复校验等），任一中间件都可以丢弃或改写消息
+	processed, ok := h.applyMiddlewares(&msg)
+	if !ok {
+		return
+	}
+	msg = *processed
+
+	// 房间的消息总数超过上限时丢弃，不分配序号、不保存也不广播
+	if !h.allowRoomMessage(sender, msg.Room, h.clock.Now()) {
+		return
+	}
+
+	// 分配房间内的消息序号，客户端据此发现缺失的消息。瞬时消息不会出现在历史中，
+	// 不占用序号，否则回放历史的客户端会把它误认为缺失的消息
+	if !msg.IsEphemeral() {
+		msg.Seq = h.nextSeq(msg.Room)
+	}
+
+	// 将聊天消息保存到数据库，并带上分配的 ID 广播，客户端才能引用它进行回复。
+	// 保存失败不影响实时投递，只是这条消息暂时没有 ID
+	msg.ID = h.saveMessage(msg)
+	message, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("序列化聊天消息失败: %v", err)
+		return
+	}
+
+	// 将 JSON 消息广播给同一房间内的在线客户端，跳过屏蔽了发送者的连接
+	h.broadcastChat(msg.Room, sender, msg.ID, message)
+	h.trackDelivery(sender, msg)
+
+	// 被 @ 提到的在线用户另外收到一条只发给他们的提醒
+	h.notifyMentions(sender, msg)
+
+	// 命中触发词时由机器人在房间内回复
+	h.replyAsBot(msg)
+}
+
+// mentionPattern 匹配消息中的 @用户名：用户名由字母（包括中文）、数字和 _ . - 组成。
+// @ 前面不能是 ASCII 字母、数字、_ 或反斜杠，因此邮箱地址（a@b.com）和转义写法（\@bob）不算提及，
+// 而中文紧接 @ 的写法（"谢谢@bob"）仍然算。
+var mentionPattern = regexp.MustCompile(`(?:^|[^A-Za-z0-9_\\])@([\p{L}\p{N}_.\-]+)`)
+
+// parseMentions 返回 content 中提到的用户名（规范化形式），按出现顺序去重。
+// 用户名末尾的 . 和 - 被视为标点去掉，例如 "谢谢 @bob." 提到的是 bob。
+func parseMentions(content string) []string {
+	var keys []string
+	seen := make(map[string]bool)
+	for _, match := range mentionPattern.FindAllStringSubmatch(content, -1) {
+		key := models.UserKey(strings.TrimRight(match[1], ".-"))
+		if key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// notifyMentions 向聊天消息中 @ 提到的、在同一房间的用户发送 "mention" 提醒，提醒中引用原消息的 ID 和内容。
+// 只发给该房间中的连接：其他房间可能有同名的另一个人，也不应看到这个房间的消息。
+// 不在该房间或不存在的用户被忽略；提到自己、或者提到的用户屏蔽了发送者时不发送提醒。
+func (h *Hub) notifyMentions(sender Client, msg models.Message) {
+	var targets []string
+	for _, key := range parseMentions(msg.Content) {
+		if key == sender.GetUserKey() || h.ignoredBy(key, sender) {
+			continue
+		}
+		if h.userInRoom(key, msg.Room) {
+			targets = append(targets, key)
+		}
+	}
+	if len(targets) == 0 {
+		return
+	}
+	notice, err := json.Marshal(models.Message{
+		Type:      models.TypeMention,
+		Username:  msg.Username,
+		Room:      msg.Room,
+		Content:   msg.Content,
+		Timestamp: msg.Timestamp,
+		MessageID: msg.ID,
+	})
+	if err != nil {
+		log.Printf("序列化提及提醒失败: %v", err)
+		return
+	}
+	for _, key := range targets {
+		for _, cl := range h.clients[key] {
+			if cl.GetRoom() == msg.Room {
+				cl.SendMessage(notice)
 			}
 		}
 	}
 }
+
+// saveMessage 持久化消息并返回分配的 ID，失败时返回 0。
+// 失败不会阻止调用方继续广播：错误被记录，消息进入 deadLetters 等待重试，
+// 失败次数通过 SaveStats 暴露给就绪检查和调试接口。
+func (h *Hub) saveMessage(msg models.Message) int64 {
+	// 瞬时消息不保存、不审计，也不进入历史缓存
+	if msg.IsEphemeral() {
+		return 0
+	}
+	id, err := h.messageStore.SaveMessage(msg)
+	if h.auditor != nil {
+		audited := msg
+		audited.ID = id
+		h.auditor.Record(audited)
+	}
+	if err != nil {
+		total := h.saveFailures.Add(1)
+		h.saveFailStreak.Add(1)
+		log.Printf("保存 %s 消息失败 (用户: %q, 房间: %q, 累计失败 %d 次): %v", msg.Type, msg.Username, msg.Room, total, err)
+		h.deadLetters = append(h.deadLetters, msg)
+		if len(h.deadLetters) > deadLetterLimit {
+			dropped := h.deadLetters[0]
+			h.deadLetters = h.deadLetters[1:]
+			log.Printf("待重试的消息超过 %d 条，丢弃最早的 %s 消息 (房间: %q, 时间: %s)", deadLetterLimit, dropped.Type, dropped.Room, dropped.Timestamp.Format(time.RFC3339))
+		}
+		h.pendingSaves.Store(int64(len(h.deadLetters)))
+		// 缓存中缺了这条消息，之后重试成功时它在存储中的顺序也会与缓存不同
+		h.resetHistoryCache()
+		return 0
+	}
+	h.saveFailStreak.Store(0)
+	if len(h.deadLetters) > 0 {
+		h.retryDeadLetters()
+		h.resetHistoryCache() // 重试的消息排在刚保存的消息之后，缓存从下一条消息开始重新积累
+	} else if id != 0 {
+		msg.ID = id
+		h.cacheHistory(msg)
+	}
+	return id
+}
+
+// retryDeadLetters 在存储恢复后按原顺序重新保存之前失败的消息，遇到失败时停止，留到下次再试。
+func (h *Hub) retryDeadLetters() {
+	if len(h.deadLetters) == 0 {
+		return
+	}
+	retried := 0
+	for len(h.deadLetters) > 0 {
+		if _, err := h.messageStore.SaveMessage(h.deadLetters[0]); err != nil {
+			log.Printf("重试保存消息失败，剩余 %d 条待重试: %v", len(h.deadLetters), err)
+			break
+		}
+		h.deadLetters = h.deadLetters[1:]
+		retried++
+	}
+	if len(h.deadLetters) == 0 {
+		h.deadLetters = nil // 释放底层数组
+	}
+	h.pendingSaves.Store(int64(len(h.deadLetters)))
+	log.Printf("已重新保存 %d 条之前保存失败的消息", retried)
+}
+
+// SaveStats 是消息持久化的健康状况。
+type SaveStats struct {
+	Failures            int64 `json:"failures"`             // 累计保存失败次数
+	ConsecutiveFailures int64 `json:"consecutive_failures"` // 最近连续失败次数，保存成功后清零
+	Pending             int64 `json:"pending"`              // 等待重试的消息数
+}
+
+// SaveStats 返回消息持久化的健康状况。可以从任意协程调用。
+func (h *Hub) SaveStats() SaveStats {
+	return SaveStats{
+		Failures:            h.saveFailures.Load(),
+		ConsecutiveFailures: h.saveFailStreak.Load(),
+		Pending:             h.pendingSaves.Load(),
+	}
+}
+
+// broadcastChat 将 sender 发送的聊天消息发送给指定房间内没有屏蔽 sender 的在线客户端。
+// id 是消息持久化后的 ID（未保存时为 0），开启确认的连接据此跟踪投递。
+// 关闭了回显的发送连接本身也会被跳过（同一用户的其他设备仍会收到）。
+// 加入、离开、公告等系统消息不受屏蔽影响，应使用 broadcastToRoom。
+func (h *Hub) broadcastChat(room string, sender Client, id int64, message []byte) {
+	senderName := sender.GetUsername()
+	skipSender := sender.SuppressEcho()
+	h.fanoutTracked(h.roomTargets(room), id, message, func(cl Client) bool {
+		return !cl.Ignores(senderName) && !(skipSender && cl == sender)
+	})
+}
+
+// handleHistoryRequest 按请求的消息类型查询房间历史，并以 "history" 消息回复发出请求的连接。
+// 类型已由客户端校验过，这里再校验一次，避免绕过客户端直接调用 Broadcast 的情况。
+func (h *Hub) handleHistoryRequest(sender Client, msg models.Message) {
+	if err := models.ValidateHistoryTypes(msg.Types); err != nil {
+		h.sendError(sender, models.ErrCodeInvalidMessage, err.Error())
+		return
+	}
+	historyMsg := models.Message{Type: models.TypeHistory, Room: msg.Room}
+	messages, err := h.messageStore.GetMessagesOfTypes(msg.Room, msg.Types, h.historyLimitFor(msg.Room))
+	if err != nil {
+		log.Printf("按类型获取历史消息失败: %v", err)
+		historyMsg.Error = i18n.T(sender.GetLang(), i18n.KeyHistoryUnavailable)
+		historyMsg.ErrorCode = models.ErrCodeHistoryUnavailable
+	} else {
+		historyMsg.Messages = messages
+	}
+	h.sendHistoryMessage(sender, historyMsg)
+}
+
+// handleMyHistory 以 "my_history" 消息回复发送者自己最近发送的聊天消息（所有房间）。
+// 只查询发送连接自己的用户名，用户无法借此查看他人的消息。
+func (h *Hub) handleMyHistory(sender Client) {
+	reply := models.Message{Type: models.TypeMyHistory, Username: sender.GetUsername()}
+	messages, err := h.messageStore.GetMessagesByUser(sender.GetUsername(), h.historyLimitFor(sender.GetRoom()))
+	if err != nil {
+		log.Printf("获取用户 %s 的消息失败: %v", sender.GetUsername(), err)
+		reply.Error = i18n.T(sender.GetLang(), i18n.KeyHistoryUnavailable)
+		reply.ErrorCode = models.ErrCodeHistoryUnavailable
+	} else {
+		reply.Messages = messages
+	}
+	jsonMsg, err := json.Marshal(reply)
+	if err != nil {
+		log.Printf("序列化历史消息失败: %v", err)
+		return
+	}
+	sender.SendMessage(jsonMsg)
+}
+
+// handleHistoryMeta 以 "history_meta" 消息回复发送者所在房间保存的消息总数（count）和最早一条消息的 ID（message_id），
+// 无限滚动的客户端据此判断是否已经翻到历史的开头。
+func (h *Hub) handleHistoryMeta(sender Client) {
+	reply := models.Message{Type: models.TypeHistoryMeta, Room: sender.GetRoom()}
+	oldest, err := h.messageStore.OldestMessageID(sender.GetRoom())
+	var count int
+	if err == nil {
+		count, err = h.messageStore.CountMessages(sender.GetRoom())
+	}
+	if err != nil {
+		log.Printf("获取房间 %s 的历史元信息失败: %v", sender.GetRoom(), err)
+		reply.Error = i18n.T(sender.GetLang(), i18n.KeyHistoryUnavailable)
+		reply.ErrorCode = models.ErrCodeHistoryUnavailable
+	} else {
+		reply.MessageID = oldest
+		reply.Count = count
+	}
+	jsonMsg, err := json.Marshal(reply)
+	if err != nil {
+		log.Printf("序列化历史元信息失败: %v", err)
+		return
+	}
+	sender.SendMessage(jsonMsg)
+}
+
+// handlePin 处理用户发来的置顶和取消置顶请求，只能操作自己所在房间的消息。
+func (h *Hub) handlePin(sender Client, msg models.Message) {
+	if !h.allowUserPins {
+		h.sendError(sender, models.ErrCodeForbidden, i18n.T(sender.GetLang(), i18n.KeyPinForbidden))
+		return
+	}
+	err := h.setPinned(msg.MessageID, msg.Type == models.TypePin, msg.Username, msg.Room)
+	if errors.Is(err, store.ErrMessageNotFound) {
+		h.sendError(sender, models.ErrCodeMessageNotFound, i18n.T(sender.GetLang(), i18n.KeyPinNotFound))
+		return
+	}
+	if err != nil {
+		log.Printf("用户 %s 置顶消息 %d 失败: %v", msg.Username, msg.MessageID, err)
+	}
+}
+
+// setPinned 更新消息的置顶状态，并向消息所在房间广播 pin/unpin 事件。
+// room 不为空时消息必须属于该房间，否则视为不存在；by 是操作者，管理接口操作时为空。
+// 只能在 Run 协程中调用。
+func (h *Hub) setPinned(id int64, pinned bool, by, room string) error {
+	target, err := h.messageStore.GetMessageByID(id)
+	if err != nil {
+		return err
+	}
+	if room != "" && target.Room != room {
+		return store.ErrMessageNotFound
+	}
+	if err := h.messageStore.SetPinned(id, pinned); err != nil {
+		return err
+	}
+
+	event := models.Message{
+		Type:      models.TypeUnpin,
+		Username:  by,
+		Room:      target.Room,
+		MessageID: id,
+		Timestamp: h.clock.Now().UTC(),
+	}
+	if pinned {
+		event.Type = models.TypePin
+		event.Messages = []models.Message{target} // 客户端不必在历史中查找被置顶的消息
+	}
+	jsonMsg, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("序列化 %s 事件失败: %w", event.Type, err)
+	}
+	h.broadcastToRoom(target.Room, jsonMsg)
+	return nil
+}
+
+// applyMiddlewares 让消息依次经过所有中间件，返回最终的消息以及它是否应继续处理。
+func (h *Hub) applyMiddlewares(msg *models.Message) (*models.Message, bool) {
+	for _, mw := range h.middlewares {
+		keep, next := mw(msg)
+		if !keep {
+			return nil, false
+		}
+		if next != nil {
+			msg = next
+		}
+	}
+	return msg, true
+}
+
+// dedupNonce 是内置中间件：重复的 nonce 说明是客户端重试发送的同一条消息，不再持久化和广播。
+func (h *Hub) dedupNonce(msg *models.Message) (bool, *models.Message) {
+	if msg.Nonce != "" && h.seenNonce(models.UserKey(msg.Username), msg.Nonce, h.clock.Now()) {
+		log.Printf("丢弃用户 %s 的重复消息 (nonce: %s)", msg.Username, msg.Nonce)
+		return false, nil
+	}
+	return true, msg
+}
+
+// checkReplyTo 是内置中间件：回复的父消息必须存在且属于同一房间，否则丢弃并告知发送者。
+func (h *Hub) checkReplyTo(msg *models.Message) (bool, *models.Message) {
+	if msg.ReplyTo == 0 {
+		return true, msg
+	}
+	parent, err := h.messageStore.GetMessageByID(msg.ReplyTo)
+	if err != nil || parent.Room != msg.Room {
+		if err != nil && !errors.Is(err, store.ErrMessageNotFound) {
+			log.Printf("查询被回复的消息 %d 失败: %v", msg.ReplyTo, err)
+		}
+		h.sendErrorToUser(msg.Username, msg.Room, models.ErrCodeReplyNotFound, i18n.KeyReplyNotFound)
+		return false, nil
+	}
+	return true, msg
+}
+
+// sendError 向指定连接发送一条 "error" 消息。
+func (h *Hub) sendError(cl Client, code, text string) {
+	jsonErrMsg, err := json.Marshal(models.Message{Type: models.TypeError, Error: text, ErrorCode: code})
+	if err != nil {
+		log.Printf("序列化错误消息失败: %v", err)
+		return
+	}
+	cl.SendPriority(jsonErrMsg)
+}
+
+// sendErrorToUser 向用户在指定房间的所有连接发送一条 "error" 消息。username 可以是原始或规范化的用户名。
+// 只在不知道具体发送连接时使用（例如中间件中），否则应使用 sendError。
+// 各连接可能使用不同的语言，因此传入的是文案键，按连接分别生成错误文本。
+func (h *Hub) sendErrorToUser(username, room, code, textKey string) {
+	for _, cl := range h.clients[models.UserKey(username)] {
+		if cl.GetRoom() == room {
+			h.sendError(cl, code, i18n.T(cl.GetLang(), textKey))
+		}
+	}
+}
+
+// ignoredBy 报告用户（规范化的用户名）的任一连接是否屏蔽了 sender。
+func (h *Hub) ignoredBy(key string, sender Client) bool {
+	for _, cl := range h.clients[key] {
+		if cl.Ignores(sender.GetUsername()) {
+			return true
+		}
+	}
+	return false
+}
+
+// SendToUsers 将消息发送给指定用户（原始或规范化的用户名）的所有连接，不在线的用户被跳过，
+// 同一用户在列表中出现多次也只发送一次。只能在 Run 协程中调用。
+func (h *Hub) SendToUsers(usernames []string, message []byte) {
+	sent := make(map[string]bool, len(usernames))
+	for _, username := range usernames {
+		key := models.UserKey(username)
+		if sent[key] {
+			continue
+		}
+		sent[key] = true
+		for _, cl := range h.clients[key] {
+			cl.SendMessage(message)
+		}
+	}
+}
+
+// handleStatus 设置发送者的自定义状态文字（为空时清除），并向其所在房间广播更新后的用户列表。
+// 同一用户在该房间的所有连接（多端登录）共用一个状态；状态保存在连接上，连接断开后自然消失。
+func (h *Hub) handleStatus(sender Client, status string) {
+	if sender.Status() == status {
+		return
+	}
+	for _, cl := range h.clients[sender.GetUserKey()] {
+		if cl.GetRoom() == sender.GetRoom() {
+			cl.SetStatus(status)
+		}
+	}
+	h.SendUserListToRoom(sender.GetRoom())
+}
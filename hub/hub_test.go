@@ -0,0 +1,495 @@
+package hub
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"chatroom/i18n"
+	"chatroom/models"
+	"chatroom/store"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard) // Hub 的日志很多，测试输出只保留失败信息
+	os.Exit(m.Run())
+}
+
+// fakeClient 是测试用的 Client：记录 Hub 发给它的所有消息和关闭请求，不涉及真实的网络连接。
+type fakeClient struct {
+	username string
+	room     string
+	lang     string
+	addr     string
+	version  int
+	observer bool
+	noEcho   bool
+	quitting bool
+	status   string
+	activity time.Time
+
+	mu        sync.Mutex
+	sent      [][]byte
+	ignored   map[string]bool
+	pumps     bool
+	closed    bool
+	closeCode int
+	done      chan struct{}
+	doneOnce  sync.Once
+}
+
+func newFakeClient(username, room string) *fakeClient {
+	return &fakeClient{
+		username: username,
+		room:     room,
+		addr:     "127.0.0.1",
+		version:  models.ProtocolVersion,
+		ignored:  make(map[string]bool),
+		done:     make(chan struct{}),
+	}
+}
+
+func (c *fakeClient) GetUsername() string                { return c.username }
+func (c *fakeClient) GetUserKey() string                 { return models.UserKey(c.username) }
+func (c *fakeClient) SetUsername(username string)        { c.username = username }
+func (c *fakeClient) GetRoom() string                    { return c.room }
+func (c *fakeClient) GetRemoteAddr() string              { return c.addr }
+func (c *fakeClient) GetUserAgent() string               { return "fake" }
+func (c *fakeClient) GetLang() string                    { return c.lang }
+func (c *fakeClient) ProtocolVersion() int               { return c.version }
+func (c *fakeClient) SendMessage(message []byte)         { c.record(message) }
+func (c *fakeClient) SendPriority(message []byte)        { c.record(message) }
+func (c *fakeClient) SendTracked(_ int64, m []byte)      { c.record(m) }
+func (c *fakeClient) Status() string                     { return c.status }
+func (c *fakeClient) SetStatus(status string)            { c.status = status }
+func (c *fakeClient) CloseConnection()                   { c.close(0) }
+func (c *fakeClient) CloseWithReason(code int, _ string) { c.close(code) }
+func (c *fakeClient) Disconnect(code int, _ string)      { c.close(code) }
+func (c *fakeClient) QueueLen() int                      { return 0 }
+func (c *fakeClient) Quitting() bool                     { return c.quitting }
+func (c *fakeClient) IsObserver() bool                   { return c.observer }
+func (c *fakeClient) LastActivity() time.Time            { return c.activity }
+func (c *fakeClient) SuppressEcho() bool                 { return c.noEcho }
+func (c *fakeClient) Done() <-chan struct{}              { return c.done }
+
+func (c *fakeClient) SendStream(frames [][]byte) {
+	for _, frame := range frames {
+		c.record(frame)
+	}
+}
+
+func (c *fakeClient) Ignores(username string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ignored[models.UserKey(username)]
+}
+
+func (c *fakeClient) ignore(username string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ignored[models.UserKey(username)] = true
+}
+
+func (c *fakeClient) RunPumps() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pumps = true
+}
+
+func (c *fakeClient) record(message []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sent = append(c.sent, message)
+}
+
+func (c *fakeClient) close(code int) {
+	c.mu.Lock()
+	c.closed = true
+	if code != 0 {
+		c.closeCode = code
+	}
+	c.mu.Unlock()
+	c.doneOnce.Do(func() { close(c.done) })
+}
+
+// messages 解析发给该连接的所有消息。
+func (c *fakeClient) messages(t *testing.T) []models.Message {
+	t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	msgs := make([]models.Message, 0, len(c.sent))
+	for _, raw := range c.sent {
+		var msg models.Message
+		if err := json.Unmarshal(raw, &msg); err != nil {
+			t.Fatalf("%s 收到无法解析的消息 %q: %v", c.username, raw, err)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+// ofType 返回发给该连接的指定类型的消息。
+func (c *fakeClient) ofType(t *testing.T, typ models.MessageType) []models.Message {
+	t.Helper()
+	var out []models.Message
+	for _, msg := range c.messages(t) {
+		if msg.Type == typ {
+			out = append(out, msg)
+		}
+	}
+	return out
+}
+
+// reset 清空已记录的消息，便于只检查之后的投递。
+func (c *fakeClient) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sent = nil
+}
+
+// raw 返回发给该连接的所有帧，用于检查嵌套在历史消息中的内容。
+func (c *fakeClient) raw() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return string(bytes.Join(c.sent, []byte{'\n'}))
+}
+
+func (c *fakeClient) isClosed() (bool, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed, c.closeCode
+}
+
+// chatContents 返回发给该连接的聊天消息内容。
+func (c *fakeClient) chatContents(t *testing.T) []string {
+	t.Helper()
+	var out []string
+	for _, msg := range c.ofType(t, models.TypeChat) {
+		out = append(out, msg.Content)
+	}
+	return out
+}
+
+// newTestHub 创建使用 ms 的 Hub，不启动 Run：测试在自己的协程中直接调用各个 handle 方法，
+// 效果与 Run 协程逐个处理事件相同，而且不需要等待。
+func newTestHub(ms store.MessageStore, cfg Config) *Hub {
+	if ms == nil {
+		ms = store.NullMessageStore{}
+	}
+	return NewHubWithConfig(ms, cfg)
+}
+
+// runHub 启动 Run，测试结束时停止，用于经过 call 的公开方法（OnlineUsers、Ban 等）。
+func runHub(t *testing.T, h *Hub) {
+	t.Helper()
+	go h.Run()
+	t.Cleanup(func() {
+		h.Stop()
+		<-h.stopped
+	})
+}
+
+// newTestStore 在临时目录中创建并初始化一个 SQLite 存储。
+func newTestStore(t *testing.T, cfg store.Config) *store.SQLiteMessageStore {
+	t.Helper()
+	s, err := store.NewSQLiteMessageStoreWithConfig(t.TempDir()+"/chat.db", cfg)
+	if err != nil {
+		t.Fatalf("创建存储失败: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	if err := s.Init(); err != nil {
+		t.Fatalf("初始化存储失败: %v", err)
+	}
+	return s
+}
+
+// join 依次注册 clients，并断言它们都注册成功。
+func join(t *testing.T, h *Hub, clients ...*fakeClient) {
+	t.Helper()
+	for _, cl := range clients {
+		h.handleRegister(cl)
+		if closed, code := cl.isClosed(); closed {
+			t.Fatalf("%s 注册被拒绝 (关闭码 %d): %v", cl.username, code, cl.messages(t))
+		}
+	}
+}
+
+// chat 模拟客户端 readPump 发来一条聊天消息。
+func chat(h *Hub, sender *fakeClient, content string) {
+	h.handleBroadcast(sender, models.Message{
+		Type:      models.TypeChat,
+		Username:  sender.username,
+		Room:      sender.room,
+		Content:   content,
+		Timestamp: time.Now().UTC(),
+	})
+}
+
+// lastUserList 返回发给该连接的最后一个用户列表。
+func lastUserList(t *testing.T, cl *fakeClient) []string {
+	t.Helper()
+	lists := cl.ofType(t, models.TypeUserList)
+	if len(lists) == 0 {
+		t.Fatalf("%s 没有收到用户列表", cl.username)
+	}
+	return lists[len(lists)-1].Users
+}
+
+func TestRegisterRejectsDuplicateNickname(t *testing.T) {
+	h := newTestHub(nil, Config{})
+	first := newFakeClient("alice", "general")
+	join(t, h, first)
+
+	dup := newFakeClient("alice", "general")
+	h.handleRegister(dup)
+
+	closed, code := dup.isClosed()
+	if !closed || code != models.CloseNickTaken {
+		t.Fatalf("重名连接应以 %d 关闭，实际 closed=%v code=%d", models.CloseNickTaken, closed, code)
+	}
+	errs := dup.ofType(t, models.TypeError)
+	if len(errs) != 1 || errs[0].ErrorCode != models.ErrCodeNickTaken {
+		t.Fatalf("重名连接应收到 NICK_TAKEN 错误，实际 %+v", errs)
+	}
+	if dup.pumps {
+		t.Fatal("被拒绝的连接不应启动读写协程")
+	}
+	if got := len(h.clients["alice"]); got != 1 {
+		t.Fatalf("alice 应只有 1 个连接，实际 %d", got)
+	}
+}
+
+func TestBroadcastFansOutToRoom(t *testing.T) {
+	h := newTestHub(nil, Config{})
+	alice, bob := newFakeClient("alice", "general"), newFakeClient("bob", "general")
+	other := newFakeClient("carol", "other")
+	join(t, h, alice, bob, other)
+
+	chat(h, alice, "hello")
+
+	for _, cl := range []*fakeClient{alice, bob} {
+		if got := cl.chatContents(t); !slices.Equal(got, []string{"hello"}) {
+			t.Errorf("%s 收到的聊天消息 = %v，期望 [hello]", cl.username, got)
+		}
+	}
+	if got := other.chatContents(t); len(got) != 0 {
+		t.Errorf("其他房间的 carol 不应收到消息，实际 %v", got)
+	}
+}
+
+func TestUnregisterCleansUpAndNotifies(t *testing.T) {
+	h := newTestHub(nil, Config{})
+	alice, bob := newFakeClient("alice", "general"), newFakeClient("bob", "general")
+	join(t, h, alice, bob)
+	alice.reset()
+
+	h.handleUnregister(bob)
+
+	if _, ok := h.clients["bob"]; ok {
+		t.Fatal("bob 注销后仍在 clients 中")
+	}
+	if h.ConnectionCount() != 1 {
+		t.Fatalf("连接数 = %d，期望 1", h.ConnectionCount())
+	}
+	leaves := alice.ofType(t, models.TypeLeave)
+	if len(leaves) != 1 || leaves[0].Username != "bob" {
+		t.Fatalf("alice 应收到 bob 的离开通知，实际 %+v", leaves)
+	}
+	if got := lastUserList(t, alice); !slices.Equal(got, []string{"alice"}) {
+		t.Fatalf("用户列表 = %v，期望 [alice]", got)
+	}
+
+	// 重复注销同一个连接不会再次广播
+	alice.reset()
+	h.handleUnregister(bob)
+	if got := alice.messages(t); len(got) != 0 {
+		t.Fatalf("重复注销不应产生消息，实际 %+v", got)
+	}
+}
+
+func TestUserListIsSortedAndPerRoom(t *testing.T) {
+	h := newTestHub(nil, Config{})
+	carol, alice := newFakeClient("carol", "general"), newFakeClient("alice", "general")
+	bob := newFakeClient("bob", "other")
+	join(t, h, carol, alice, bob)
+
+	if got := lastUserList(t, carol); !slices.Equal(got, []string{"alice", "carol"}) {
+		t.Fatalf("general 的用户列表 = %v，期望 [alice carol]", got)
+	}
+	if got := lastUserList(t, bob); !slices.Equal(got, []string{"bob"}) {
+		t.Fatalf("other 的用户列表 = %v，期望 [bob]", got)
+	}
+}
+
+func TestRegisterAndUnregisterAfterStopDoNotBlock(t *testing.T) {
+	h := newTestHub(nil, Config{})
+	go h.Run()
+	h.Stop()
+	<-h.stopped
+
+	done := make(chan struct{})
+	late := newFakeClient("late", "general")
+	go func() {
+		defer close(done)
+		// 超过通道缓冲的次数，确保不是靠缓冲才没有阻塞
+		for i := 0; i < eventBuffer+1; i++ {
+			h.Unregister(newFakeClient("alice", "general"))
+		}
+		h.Register(late)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Hub 停止后 Register/Unregister 被阻塞")
+	}
+	if closed, code := late.isClosed(); !closed || code != models.CloseGoingAway {
+		t.Fatalf("停止后注册的连接应以 %d 关闭，实际 closed=%v code=%d", models.CloseGoingAway, closed, code)
+	}
+}
+
+func TestQuitLeaveDiffersFromDisconnect(t *testing.T) {
+	h := newTestHub(nil, Config{})
+	alice, bob, carol := newFakeClient("alice", "general"), newFakeClient("bob", "general"), newFakeClient("carol", "general")
+	join(t, h, alice, bob, carol)
+	alice.reset()
+
+	bob.quitting = true
+	h.handleUnregister(bob)
+	h.handleUnregister(carol)
+
+	leaves := alice.ofType(t, models.TypeLeave)
+	if len(leaves) != 2 {
+		t.Fatalf("alice 收到 %+v，期望两条离开通知", leaves)
+	}
+	if leaves[0].TextKey != i18n.KeyLeave || leaves[1].TextKey != i18n.KeyDisconnect {
+		t.Fatalf("离开通知的文案 = %q、%q，期望主动离开 %q、连接中断 %q", leaves[0].TextKey, leaves[1].TextKey, i18n.KeyLeave, i18n.KeyDisconnect)
+	}
+	if leaves[0].Content == leaves[1].Content {
+		t.Fatalf("主动离开和连接中断的通知不应相同: %q", leaves[0].Content)
+	}
+}
+
+func TestObserverReceivesButIsInvisible(t *testing.T) {
+	h := newTestHub(nil, Config{})
+	alice := newFakeClient("alice", "general")
+	join(t, h, alice)
+	alice.reset()
+
+	wall := newFakeClient("wall", "general")
+	wall.observer = true
+	join(t, h, wall)
+	if got := alice.messages(t); len(got) != 0 {
+		t.Fatalf("观察者加入不应通知其他人，alice 收到 %+v", got)
+	}
+	if got := lastUserList(t, wall); !slices.Equal(got, []string{"alice"}) {
+		t.Fatalf("观察者收到的用户列表 = %v，不应包含自己", got)
+	}
+
+	chat(h, alice, "hello")
+	if got := wall.chatContents(t); !slices.Equal(got, []string{"hello"}) {
+		t.Fatalf("观察者收到 %v，期望 [hello]", got)
+	}
+
+	join(t, h, newFakeClient("bob", "general"))
+	if got := lastUserList(t, alice); !slices.Equal(got, []string{"alice", "bob"}) {
+		t.Fatalf("用户列表 = %v，不应包含观察者", got)
+	}
+	alice.reset()
+	h.handleUnregister(wall)
+	if got := alice.messages(t); len(got) != 0 {
+		t.Fatalf("观察者离开不应通知其他人，alice 收到 %+v", got)
+	}
+}
+
+func TestSuppressEchoSkipsOnlySender(t *testing.T) {
+	h := newTestHub(nil, Config{AllowMultiDevice: true})
+	alice, bob := newFakeClient("alice", "general"), newFakeClient("bob", "general")
+	alice.noEcho = true
+	laptop := newFakeClient("alice", "general") // 同一用户的另一台设备仍需看到自己发出的消息
+	join(t, h, alice, bob, laptop)
+
+	chat(h, alice, "mine")
+	chat(h, bob, "yours")
+
+	if got := alice.chatContents(t); !slices.Equal(got, []string{"yours"}) {
+		t.Fatalf("开启回显抑制的 alice 收到 %v，不应收到自己的消息", got)
+	}
+	for _, cl := range []*fakeClient{bob, laptop} {
+		if got := cl.chatContents(t); !slices.Equal(got, []string{"mine", "yours"}) {
+			t.Fatalf("%s 收到 %v，期望 [mine yours]", cl.username, got)
+		}
+	}
+}
+
+func TestErrorRepliesGoToSendingConnection(t *testing.T) {
+	h := newTestHub(nil, Config{AllowMultiDevice: true})
+	phone, laptop := newFakeClient("alice", "general"), newFakeClient("alice", "general")
+	join(t, h, phone, laptop)
+	phone.reset()
+	laptop.reset()
+
+	h.handleBroadcast(phone, models.Message{Type: models.TypeHistoryRequest, Username: "alice", Room: "general", Types: []models.MessageType{models.TypeUserList}})
+	if errs := phone.ofType(t, models.TypeError); len(errs) != 1 {
+		t.Fatalf("发出请求的连接应收到错误，实际 %+v", phone.messages(t))
+	}
+	if got := laptop.messages(t); len(got) != 0 {
+		t.Fatalf("同一用户的其他连接不应收到错误，实际 %+v", got)
+	}
+}
+
+func TestWelcomeIsSentOnlyToJoiner(t *testing.T) {
+	ms := newTestStore(t, store.Config{PersistTypes: []models.MessageType{models.TypeChat}})
+	h := newTestHub(ms, Config{Welcome: "欢迎 {username}，当前在线 {online_count} 人"})
+	bob := newFakeClient("bob", "general")
+	join(t, h, bob)
+	chat(h, bob, "earlier") // 让 alice 有历史消息
+	bob.reset()
+
+	alice := newFakeClient("Alice", "general")
+	join(t, h, alice)
+
+	msgs := alice.messages(t)
+	historyAt := slices.IndexFunc(msgs, func(m models.Message) bool { return m.Type == models.TypeHistory })
+	welcomeAt := slices.IndexFunc(msgs, func(m models.Message) bool { return m.Type == models.TypeSystem })
+	if welcomeAt < 0 || msgs[welcomeAt].Content != "欢迎 Alice，当前在线 2 人" {
+		t.Fatalf("alice 收到 %+v，期望替换了占位符的欢迎语", msgs)
+	}
+	if historyAt < 0 || historyAt > welcomeAt {
+		t.Fatalf("欢迎语应紧随历史消息之后，历史位于 %d，欢迎语位于 %d", historyAt, welcomeAt)
+	}
+	if got := bob.ofType(t, models.TypeSystem); len(got) != 0 {
+		t.Fatalf("其他用户不应收到 alice 的欢迎语: %+v", got)
+	}
+}
+
+func TestJoinerGetsTargetedUserListSnapshot(t *testing.T) {
+	h := newTestHub(nil, Config{})
+	bob := newFakeClient("bob", "general")
+	join(t, h, bob)
+	bob.reset()
+
+	// 快照随初始状态单独发给新连接，先于房间广播的加入通知
+	alice := newFakeClient("alice", "general")
+	join(t, h, alice)
+	msgs := alice.messages(t)
+	listAt := slices.IndexFunc(msgs, func(m models.Message) bool { return m.Type == models.TypeUserList })
+	joinAt := slices.IndexFunc(msgs, func(m models.Message) bool { return m.Type == models.TypeJoin })
+	if listAt < 0 || joinAt < 0 || listAt > joinAt {
+		t.Fatalf("alice 收到 %+v，用户列表快照应先于加入通知", msgs)
+	}
+	if !slices.Equal(msgs[listAt].Users, []string{"alice", "bob"}) {
+		t.Fatalf("快照 = %v，期望 [alice bob]", msgs[listAt].Users)
+	}
+
+	bob.reset()
+	h.SendUserListToClient(alice)
+	if got := bob.messages(t); len(got) != 0 {
+		t.Fatalf("SendUserListToClient 只应发给指定连接，bob 收到 %+v", got)
+	}
+}
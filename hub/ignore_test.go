@@ -0,0 +1,31 @@
+package hub
+
+import (
+	"slices"
+	"testing"
+
+	"chatroom/models"
+)
+
+func TestIgnoredSenderChatsAreNotDelivered(t *testing.T) {
+	h := newTestHub(nil, Config{})
+	alice, bob, carol := newFakeClient("alice", "general"), newFakeClient("bob", "general"), newFakeClient("carol", "general")
+	join(t, h, alice, bob, carol)
+	alice.ignore("Bob") // 按规范化的用户名匹配
+
+	chat(h, bob, "from bob")
+	chat(h, carol, "from carol")
+	if got := alice.chatContents(t); !slices.Equal(got, []string{"from carol"}) {
+		t.Fatalf("alice 收到 %v，不应收到被屏蔽的 bob 的消息", got)
+	}
+	if got := carol.chatContents(t); !slices.Equal(got, []string{"from bob", "from carol"}) {
+		t.Fatalf("carol 收到 %v，屏蔽只影响 alice", got)
+	}
+
+	// 系统通知不受屏蔽影响
+	alice.reset()
+	h.handleUnregister(bob)
+	if leaves := alice.ofType(t, models.TypeLeave); len(leaves) != 1 || leaves[0].Username != "bob" {
+		t.Fatalf("alice 应照常收到 bob 的离开通知，实际 %+v", leaves)
+	}
+}
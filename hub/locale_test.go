@@ -0,0 +1,36 @@
+package hub
+
+import (
+	"testing"
+
+	"chatroom/i18n"
+	"chatroom/models"
+)
+
+func TestRejectionUsesConnectionLocale(t *testing.T) {
+	h := newTestHub(nil, Config{})
+	join(t, h, newFakeClient("alice", "general"))
+
+	for lang, want := range map[string]string{"en": i18n.T("en", i18n.KeyNickTaken), "zh": "昵称已被占用，请尝试其他昵称。"} {
+		dup := newFakeClient("alice", "general")
+		dup.lang = lang
+		h.handleRegister(dup)
+		errs := dup.ofType(t, models.TypeError)
+		if len(errs) != 1 || errs[0].Error != want {
+			t.Fatalf("%s 连接收到 %+v，期望文案 %q", lang, errs, want)
+		}
+	}
+}
+
+func TestJoinBroadcastCarriesTextKey(t *testing.T) {
+	h := newTestHub(nil, Config{})
+	alice := newFakeClient("alice", "general")
+	alice.lang = "en"
+	join(t, h, alice)
+
+	// 广播只有一份内容，使用默认语言；客户端可以按 text_key 用自己的语言重新渲染
+	joins := alice.ofType(t, models.TypeJoin)
+	if len(joins) != 1 || joins[0].TextKey != i18n.KeyJoin || joins[0].Content != i18n.T(i18n.Default, i18n.KeyJoin, "alice") {
+		t.Fatalf("加入通知 = %+v", joins)
+	}
+}
@@ -0,0 +1,115 @@
+package hub
+
+import (
+	"slices"
+	"testing"
+
+	"chatroom/models"
+)
+
+func TestSendToUsersDeliversOnlyToTargets(t *testing.T) {
+	h := newTestHub(nil, Config{AllowMultiDevice: true})
+	alice, bob, carol := newFakeClient("alice", "general"), newFakeClient("Bob", "general"), newFakeClient("carol", "other")
+	bobPhone := newFakeClient("Bob", "general")
+	join(t, h, alice, bob, carol, bobPhone)
+	for _, cl := range []*fakeClient{alice, bob, carol, bobPhone} {
+		cl.reset()
+	}
+
+	// 用户名不区分大小写，重复的只发一次，不在线的 dave 被跳过；目标不受房间限制
+	h.SendToUsers([]string{"bob", "CAROL", "Bob", "dave"}, []byte(`{"type":"system","content":"团队通知"}`))
+	for cl, want := range map[*fakeClient]int{alice: 0, bob: 1, bobPhone: 1, carol: 1} {
+		if got := len(cl.ofType(t, models.TypeSystem)); got != want {
+			t.Errorf("%s 的连接收到 %d 条通知，期望 %d", cl.username, got, want)
+		}
+	}
+}
+
+func TestParseMentions(t *testing.T) {
+	tests := []struct {
+		content string
+		want    []string
+	}{
+		{"@bob 你好", []string{"bob"}},
+		{"@Bob 和 @carol，还有 @BOB", []string{"bob", "carol"}},
+		{"谢谢@bob.", []string{"bob"}},
+		{"发到 alice@example.com", nil},
+		{`转义 \@bob 不算`, nil},
+		{"只有 @ 符号", nil},
+	}
+	for _, tt := range tests {
+		if got := parseMentions(tt.content); !slices.Equal(got, tt.want) {
+			t.Errorf("parseMentions(%q) = %v，期望 %v", tt.content, got, tt.want)
+		}
+	}
+}
+
+func TestMentionNotifications(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]int // 每个用户收到的提醒数
+	}{
+		{"单个提及", "@bob 看一下", map[string]int{"alice": 0, "bob": 1, "carol": 0}},
+		{"多个提及", "@bob @carol 开会了，@bob", map[string]int{"alice": 0, "bob": 1, "carol": 1}},
+		{"不存在的用户", "@dave 在吗", map[string]int{"alice": 0, "bob": 0, "carol": 0}},
+		{"提到自己", "@alice 备忘", map[string]int{"alice": 0, "bob": 0, "carol": 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHub(nil, Config{})
+			clients := map[string]*fakeClient{
+				"alice": newFakeClient("alice", "general"),
+				"bob":   newFakeClient("bob", "general"),
+				"carol": newFakeClient("carol", "general"),
+			}
+			join(t, h, clients["alice"], clients["bob"], clients["carol"])
+			for _, cl := range clients {
+				cl.reset()
+			}
+
+			chat(h, clients["alice"], tt.content)
+			for name, want := range tt.want {
+				cl := clients[name]
+				if got := len(cl.chatContents(t)); got != 1 {
+					t.Fatalf("%s 收到 %d 条聊天消息，提醒之外的正常广播不应受影响", name, got)
+				}
+				mentions := cl.ofType(t, models.TypeMention)
+				if len(mentions) != want {
+					t.Fatalf("%s 收到 %d 条提醒，期望 %d", name, len(mentions), want)
+				}
+				if want > 0 && (mentions[0].Username != "alice" || mentions[0].Content != tt.content) {
+					t.Fatalf("提醒 = %+v，应引用 alice 的原消息", mentions[0])
+				}
+			}
+		})
+	}
+}
+
+func TestMentionStaysInRoom(t *testing.T) {
+	h := newTestHub(nil, Config{AllowMultiDevice: true})
+	alice := newFakeClient("alice", "general")
+	bob := newFakeClient("bob", "general")
+	otherBob := newFakeClient("Bob", "dev")     // dev 房间中同名的另一个人
+	bobLaptop := newFakeClient("bob", "random") // 同一个 bob 在其他房间的连接
+	join(t, h, alice, bob, otherBob, bobLaptop)
+	for _, cl := range []*fakeClient{alice, bob, otherBob, bobLaptop} {
+		cl.reset()
+	}
+
+	chat(h, alice, "@bob 机密的事")
+	if got := len(bob.ofType(t, models.TypeMention)); got != 1 {
+		t.Fatalf("general 中的 bob 收到 %d 条提醒，期望 1", got)
+	}
+	for _, cl := range []*fakeClient{otherBob, bobLaptop} {
+		if got := cl.messages(t); len(got) != 0 {
+			t.Fatalf("%s 房间的 %s 不应收到 general 的任何内容，实际 %+v", cl.room, cl.username, got)
+		}
+	}
+
+	// 提到的用户不在发送者的房间时不发送提醒
+	chat(h, otherBob, "@alice 你好")
+	if got := len(alice.ofType(t, models.TypeMention)); got != 0 {
+		t.Fatalf("不在 dev 房间的 alice 收到 %d 条提醒", got)
+	}
+}
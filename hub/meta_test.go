@@ -0,0 +1,43 @@
+package hub
+
+import (
+	"reflect"
+	"testing"
+
+	"chatroom/models"
+	"chatroom/store"
+)
+
+func TestMetaSurvivesBroadcastAndHistory(t *testing.T) {
+	// 按 JSON 解码后的形式构造，数字是 float64，嵌套对象是 map[string]interface{}
+	meta := map[string]interface{}{
+		"client": "web/1.2",
+		"device": "phone",
+		"spans":  []interface{}{map[string]interface{}{"start": float64(0), "end": float64(5), "bold": true}},
+	}
+	h := newTestHub(newTestStore(t, store.Config{}), Config{})
+	alice, bob := newFakeClient("alice", "general"), newFakeClient("bob", "general")
+	join(t, h, alice, bob)
+
+	h.handleBroadcast(alice, models.Message{Type: models.TypeChat, Username: "alice", Room: "general", Content: "hello", Meta: meta})
+	chats := bob.ofType(t, models.TypeChat)
+	if len(chats) != 1 || !reflect.DeepEqual(chats[0].Meta, meta) {
+		t.Fatalf("bob 收到 %+v，meta 应原样转发为 %v", chats, meta)
+	}
+
+	carol := newFakeClient("carol", "general")
+	join(t, h, carol)
+	batches := carol.ofType(t, models.TypeHistory)
+	if len(batches) != 1 {
+		t.Fatalf("carol 收到 %d 条 history 消息，期望 1", len(batches))
+	}
+	for _, msg := range batches[0].Messages {
+		if msg.Type == models.TypeChat {
+			if !reflect.DeepEqual(msg.Meta, meta) {
+				t.Fatalf("历史中的 meta = %v，期望 %v", msg.Meta, meta)
+			}
+			return
+		}
+	}
+	t.Fatalf("历史 %+v 中没有聊天消息", batches[0].Messages)
+}
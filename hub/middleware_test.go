@@ -0,0 +1,45 @@
+package hub
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"chatroom/models"
+	"chatroom/store"
+)
+
+func TestMiddlewareDropsAndTransforms(t *testing.T) {
+	ms := newTestStore(t, store.Config{PersistTypes: []models.MessageType{models.TypeChat}})
+	var seen []string // 第二个中间件看到的消息
+	h := newTestHub(ms, Config{Middlewares: []Middleware{
+		func(msg *models.Message) (bool, *models.Message) {
+			return !strings.Contains(msg.Content, "spam"), nil
+		},
+		func(msg *models.Message) (bool, *models.Message) {
+			seen = append(seen, msg.Content)
+			out := *msg
+			out.Content = strings.ToUpper(msg.Content)
+			return true, &out
+		},
+	}})
+	alice, bob := newFakeClient("alice", "general"), newFakeClient("bob", "general")
+	join(t, h, alice, bob)
+
+	chat(h, alice, "buy spam")
+	chat(h, alice, "hello")
+
+	if !slices.Equal(seen, []string{"hello"}) {
+		t.Fatalf("被丢弃的消息不应交给后续中间件，第二个中间件看到 %v", seen)
+	}
+	if got := bob.chatContents(t); !slices.Equal(got, []string{"HELLO"}) {
+		t.Fatalf("bob 收到 %v，期望只有改写后的 HELLO", got)
+	}
+	saved, err := ms.GetMessages("general", 10)
+	if err != nil {
+		t.Fatalf("获取消息失败: %v", err)
+	}
+	if len(saved) != 1 || saved[0].Content != "HELLO" {
+		t.Fatalf("保存的消息 = %+v，期望只保存改写后的 HELLO", saved)
+	}
+}
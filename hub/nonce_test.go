@@ -0,0 +1,40 @@
+package hub
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"chatroom/clock"
+	"chatroom/models"
+	"chatroom/store"
+)
+
+func TestDuplicateNonceIsDropped(t *testing.T) {
+	ms := newTestStore(t, store.Config{PersistTypes: []models.MessageType{models.TypeChat}})
+	clk := clock.NewFake(time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC))
+	h := newTestHub(ms, Config{Clock: clk})
+	alice, bob := newFakeClient("alice", "general"), newFakeClient("bob", "general")
+	join(t, h, alice, bob)
+
+	send := func(sender *fakeClient, content, nonce string) {
+		h.handleBroadcast(sender, models.Message{Type: models.TypeChat, Username: sender.username, Room: sender.room, Content: content, Nonce: nonce, Timestamp: clk.Now()})
+	}
+	send(alice, "hello", "n-1")
+	send(alice, "hello", "n-1")    // 重连后重发的同一条消息
+	send(bob, "same nonce", "n-1") // nonce 按用户区分
+
+	if got := bob.chatContents(t); !slices.Equal(got, []string{"hello", "same nonce"}) {
+		t.Fatalf("bob 收到 %v，重复的消息应只广播一次", got)
+	}
+	if n, _ := ms.CountMessages("general"); n != 2 {
+		t.Fatalf("保存了 %d 条消息，重复的消息应只保存一次", n)
+	}
+
+	// 超过去重窗口后同一 nonce 视为新消息
+	clk.Advance(nonceTTL + time.Second)
+	send(alice, "hello again", "n-1")
+	if n, _ := ms.CountMessages("general"); n != 3 {
+		t.Fatalf("去重窗口过后应保存新消息，共 %d 条", n)
+	}
+}
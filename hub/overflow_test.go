@@ -0,0 +1,88 @@
+package hub
+
+import (
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"chatroom/models"
+)
+
+// queuedContents 取出广播队列中的所有消息，返回它们的内容。Hub 没有运行，队列不会被消费。
+func queuedContents(h *Hub) []string {
+	var out []string
+	for len(h.broadcast) > 0 {
+		out = append(out, (<-h.broadcast).msg.Content)
+	}
+	return out
+}
+
+func TestBroadcastOverflowPolicies(t *testing.T) {
+	tests := []struct {
+		policy OverflowPolicy
+		want   []string
+	}{
+		{DropNewest, []string{"1", "2", "3"}},
+		{DropOldest, []string{"3", "4", "5"}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			h := newTestHub(nil, Config{BroadcastBuffer: 3, OverflowPolicy: tt.policy})
+			alice := newFakeClient("alice", "general")
+			for i := 1; i <= 5; i++ {
+				h.Broadcast(alice, models.Message{Type: models.TypeChat, Content: strconv.Itoa(i)})
+			}
+			length, capacity, dropped := h.BroadcastQueueStats()
+			if length != 3 || capacity != 3 || dropped != 2 {
+				t.Fatalf("队列统计 = (%d, %d, %d)，期望 (3, 3, 2)", length, capacity, dropped)
+			}
+			if got := queuedContents(h); !slices.Equal(got, tt.want) {
+				t.Fatalf("队列中的消息 = %v，期望 %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBroadcastBlockPolicyWaitsForRoom(t *testing.T) {
+	h := newTestHub(nil, Config{BroadcastBuffer: 1, OverflowPolicy: Block})
+	alice := newFakeClient("alice", "general")
+	h.Broadcast(alice, models.Message{Type: models.TypeChat, Content: "1"})
+
+	done := make(chan struct{})
+	go func() {
+		h.Broadcast(alice, models.Message{Type: models.TypeChat, Content: "2"})
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("队列已满时 Block 策略应让发送方等待")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if got := (<-h.broadcast).msg.Content; got != "1" {
+		t.Fatalf("取出 %q，期望 1", got)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("队列有空位后发送方应继续")
+	}
+	if got := queuedContents(h); !slices.Equal(got, []string{"2"}) {
+		t.Fatalf("队列中的消息 = %v，期望 [2]", got)
+	}
+	if _, _, dropped := h.BroadcastQueueStats(); dropped != 0 {
+		t.Fatalf("Block 策略不应丢弃消息，丢弃了 %d 条", dropped)
+	}
+}
+
+func TestParseOverflowPolicy(t *testing.T) {
+	for name, want := range map[string]OverflowPolicy{"": Block, "block": Block, "drop-newest": DropNewest, "drop-oldest": DropOldest} {
+		if got, err := ParseOverflowPolicy(name); err != nil || got != want {
+			t.Errorf("ParseOverflowPolicy(%q) = %q, %v，期望 %q", name, got, err, want)
+		}
+	}
+	if _, err := ParseOverflowPolicy("drop-all"); err == nil {
+		t.Error("未知的策略应返回错误")
+	}
+}
@@ -0,0 +1,79 @@
+package hub
+
+import (
+	"testing"
+
+	"chatroom/models"
+	"chatroom/store"
+)
+
+// pin 模拟客户端发来一条 pin 或 unpin 消息。
+func pin(h *Hub, sender *fakeClient, typ models.MessageType, id int64) {
+	h.handleBroadcast(sender, models.Message{Type: typ, Username: sender.username, Room: sender.room, MessageID: id})
+}
+
+func TestPinUnpinAndHistory(t *testing.T) {
+	ms := newTestStore(t, store.Config{PersistTypes: []models.MessageType{models.TypeChat}})
+	h := newTestHub(ms, Config{AllowUserPins: true})
+	alice, bob := newFakeClient("alice", "general"), newFakeClient("bob", "general")
+	join(t, h, alice, bob)
+	chat(h, alice, "important")
+	id := bob.ofType(t, models.TypeChat)[0].ID
+
+	pin(h, bob, models.TypePin, id)
+	events := alice.ofType(t, models.TypePin)
+	if len(events) != 1 || events[0].MessageID != id || events[0].Username != "bob" ||
+		len(events[0].Messages) != 1 || events[0].Messages[0].Content != "important" {
+		t.Fatalf("alice 收到的 pin 事件 = %+v", events)
+	}
+
+	// 新加入的用户随历史消息收到置顶消息
+	carol := newFakeClient("carol", "general")
+	join(t, h, carol)
+	if history := carol.ofType(t, models.TypeHistory); len(history) != 1 || len(history[0].Pinned) != 1 || history[0].Pinned[0].ID != id {
+		t.Fatalf("carol 收到的历史 = %+v，期望带有置顶消息 %d", history, id)
+	}
+
+	pin(h, bob, models.TypeUnpin, id)
+	if events := alice.ofType(t, models.TypeUnpin); len(events) != 1 || events[0].MessageID != id {
+		t.Fatalf("alice 收到的 unpin 事件 = %+v", events)
+	}
+	dave := newFakeClient("dave", "general")
+	join(t, h, dave)
+	if history := dave.ofType(t, models.TypeHistory); len(history) != 1 || len(history[0].Pinned) != 0 {
+		t.Fatalf("取消置顶后加入的 dave 收到 %+v，不应再有置顶消息", history)
+	}
+
+	t.Run("消息不存在", func(t *testing.T) {
+		bob.reset()
+		pin(h, bob, models.TypePin, id+100)
+		if errs := bob.ofType(t, models.TypeError); len(errs) != 1 || errs[0].ErrorCode != models.ErrCodeMessageNotFound {
+			t.Fatalf("bob 收到 %+v，期望 %s", bob.messages(t), models.ErrCodeMessageNotFound)
+		}
+	})
+
+	t.Run("其他房间的消息", func(t *testing.T) {
+		eve := newFakeClient("eve", "other")
+		join(t, h, eve)
+		pin(h, eve, models.TypePin, id)
+		if errs := eve.ofType(t, models.TypeError); len(errs) != 1 || errs[0].ErrorCode != models.ErrCodeMessageNotFound {
+			t.Fatalf("eve 收到 %+v，期望 %s", eve.messages(t), models.ErrCodeMessageNotFound)
+		}
+	})
+}
+
+func TestPinForbiddenByDefault(t *testing.T) {
+	ms := newTestStore(t, store.Config{PersistTypes: []models.MessageType{models.TypeChat}})
+	h := newTestHub(ms, Config{})
+	alice := newFakeClient("alice", "general")
+	join(t, h, alice)
+	chat(h, alice, "important")
+
+	pin(h, alice, models.TypePin, alice.ofType(t, models.TypeChat)[0].ID)
+	if errs := alice.ofType(t, models.TypeError); len(errs) != 1 || errs[0].ErrorCode != models.ErrCodeForbidden {
+		t.Fatalf("alice 收到 %+v，期望 %s", alice.messages(t), models.ErrCodeForbidden)
+	}
+	if pinned, _ := ms.GetPinnedMessages("general"); len(pinned) != 0 {
+		t.Fatalf("未允许用户置顶时不应置顶消息: %+v", pinned)
+	}
+}
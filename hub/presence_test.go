@@ -0,0 +1,104 @@
+package hub
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"chatroom/clock"
+	"chatroom/models"
+	"chatroom/store"
+)
+
+func TestJoinCarriesLastSeen(t *testing.T) {
+	clk := clock.NewFake(time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC))
+	ms := newTestStore(t, store.Config{Clock: clk})
+	h := newTestHub(ms, Config{Clock: clk, UserStore: ms})
+
+	observer := newFakeClient("bob", "general")
+	alice := newFakeClient("Alice", "general")
+	join(t, h, observer, alice)
+	if joins := observer.ofType(t, models.TypeJoin); joins[len(joins)-1].LastSeen != nil {
+		t.Fatalf("第一次加入不应带有最后在线时间: %+v", joins[len(joins)-1])
+	}
+
+	left := clk.Now()
+	h.handleUnregister(alice)
+	clk.Advance(time.Hour)
+	observer.reset()
+	join(t, h, newFakeClient("alice", "general"))
+
+	joins := observer.ofType(t, models.TypeJoin)
+	if len(joins) != 1 || joins[0].LastSeen == nil || !joins[0].LastSeen.Equal(left) {
+		t.Fatalf("再次加入的 join 消息应带有上次离开的时间 %v: %+v", left, joins)
+	}
+}
+
+// lastAway 返回发给该连接的最后一个用户列表中处于离开状态的用户。
+func lastAway(t *testing.T, cl *fakeClient) []string {
+	t.Helper()
+	lists := cl.ofType(t, models.TypeUserList)
+	if len(lists) == 0 {
+		t.Fatalf("%s 没有收到用户列表", cl.username)
+	}
+	return lists[len(lists)-1].Away
+}
+
+func TestPresenceResetsAwayWithoutBroadcast(t *testing.T) {
+	clk := clock.NewFake(time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC))
+	ms := newTestStore(t, store.Config{Clock: clk})
+	h := newTestHub(ms, Config{Clock: clk, AwayAfter: time.Minute})
+	alice, bob := newFakeClient("alice", "general"), newFakeClient("bob", "general")
+	join(t, h, alice, bob)
+	before, _ := ms.CountMessages("general")
+
+	clk.Advance(2 * time.Minute)
+	h.handleBroadcast(bob, models.Message{Type: models.TypePresence})
+	h.markIdleAway(clk.Now())
+	if got := lastAway(t, bob); !slices.Equal(got, []string{"alice"}) {
+		t.Fatalf("离开的用户 = %v，期望只有没有活动的 alice", got)
+	}
+
+	bob.reset()
+	h.handleBroadcast(alice, models.Message{Type: models.TypePresence})
+	if got := lastAway(t, bob); len(got) != 0 {
+		t.Fatalf("presence 后 alice 应恢复在线，离开的用户 = %v", got)
+	}
+	for _, msg := range bob.messages(t) {
+		if msg.Type != models.TypeUserList {
+			t.Fatalf("presence 不应广播，bob 收到 %+v", msg)
+		}
+	}
+	if after, _ := ms.CountMessages("general"); after != before {
+		t.Fatalf("presence 不应持久化，消息数 %d -> %d", before, after)
+	}
+}
+
+func TestIdleConnectionsAreDisconnected(t *testing.T) {
+	clk := clock.NewFake(time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC))
+	h := newTestHub(nil, Config{Clock: clk, IdleTimeout: time.Minute})
+	silent, active := newFakeClient("alice", "general"), newFakeClient("bob", "general")
+	wall := newFakeClient("wall", "general")
+	wall.observer = true
+	for _, cl := range []*fakeClient{silent, active, wall} {
+		cl.activity = clk.Now()
+	}
+	join(t, h, silent, active, wall)
+
+	clk.Advance(90 * time.Second)
+	active.activity = clk.Now()
+	clk.Advance(30 * time.Second)
+	h.closeIdleConns(clk.Now())
+
+	for _, cl := range []*fakeClient{silent, wall} {
+		if closed, code := cl.isClosed(); !closed || code != models.CloseIdleTimeout {
+			t.Errorf("%s 空闲 2 分钟，应以 %d 断开，实际 closed=%v code=%d", cl.username, models.CloseIdleTimeout, closed, code)
+		}
+	}
+	if closed, _ := active.isClosed(); closed {
+		t.Error("bob 30 秒前还有活动，不应断开")
+	}
+	if interval := newTestHub(nil, Config{}).idleCheckInterval(); interval != 0 {
+		t.Errorf("IdleTimeout 为 0 时不应检查空闲连接，检查间隔 = %v", interval)
+	}
+}
@@ -0,0 +1,26 @@
+package hub
+
+import (
+	"log"
+	"runtime/debug"
+)
+
+// guard 在 Run 协程中执行一个事件的处理函数 fn，并拦截其中的 panic，
+// 使一个事件（例如某条异常消息）的处理错误不会让整个聊天室停止运行。
+// cl 是与事件相关的连接，可以为 nil；发生 panic 时它的状态可能只更新了一半，因此将其移除并断开，让客户端重连。
+func (h *Hub) guard(event string, cl Client, fn func()) {
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		if cl == nil {
+			log.Printf("处理 %s 事件时发生 panic: %v\n%s", event, r, debug.Stack())
+			return
+		}
+		log.Printf("处理客户端 %s 的 %s 事件时发生 panic，断开该连接: %v\n%s", cl.GetUsername(), event, r, debug.Stack())
+		h.removeClient(cl)
+		cl.CloseConnection()
+	}()
+	fn()
+}
@@ -0,0 +1,63 @@
+package hub
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"chatroom/models"
+	"chatroom/store"
+)
+
+// panicStore 保存内容为 "boom" 的消息时 panic，模拟处理某条异常消息时的程序错误。
+type panicStore struct {
+	*store.SQLiteMessageStore
+}
+
+func (s panicStore) SaveMessage(msg models.Message) (int64, error) {
+	if msg.Content == "boom" {
+		var m map[string]int
+		m["boom"]++ // 写入 nil map
+	}
+	return s.SQLiteMessageStore.SaveMessage(msg)
+}
+
+func TestHandlerPanicDoesNotKillHub(t *testing.T) {
+	ms := panicStore{newTestStore(t, store.Config{PersistTypes: []models.MessageType{models.TypeChat}})}
+	h := newTestHub(ms, Config{})
+	runHub(t, h)
+	alice, bob := newFakeClient("alice", "general"), newFakeClient("bob", "general")
+	h.call(func() {
+		h.handleRegister(alice)
+		h.handleRegister(bob)
+	})
+
+	h.Broadcast(alice, models.Message{Type: models.TypeChat, Username: "alice", Room: "general", Content: "boom", Timestamp: time.Now().UTC()})
+	select {
+	case <-alice.Done():
+	case <-time.After(time.Second):
+		t.Fatal("处理消息时发生 panic 后应断开发送者")
+	}
+	if !h.Alive(time.Second) {
+		t.Fatal("一个事件发生 panic 后 Hub 主循环应继续运行")
+	}
+
+	// 发送者已被移除，其他连接照常聊天
+	h.call(func() { chat(h, bob, "still here") })
+	if got := bob.chatContents(t); !slices.Equal(got, []string{"still here"}) {
+		t.Fatalf("bob 收到的聊天消息 = %v", got)
+	}
+	h.call(func() {
+		if h.userInRoom(alice.GetUserKey(), "general") {
+			t.Error("发生 panic 的连接应从房间中移除")
+		}
+	})
+
+	// 没有关联连接的事件发生 panic 时同样只记录日志
+	if !h.call(func() { panic("boom") }) {
+		t.Fatal("call 应在 fn panic 后返回")
+	}
+	if !h.Alive(time.Second) {
+		t.Fatal("call 中发生 panic 后 Hub 主循环应继续运行")
+	}
+}
@@ -0,0 +1,213 @@
+package hub
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"chatroom/models"
+)
+
+func TestNamelessClientsGetDistinctGuestNames(t *testing.T) {
+	h := newTestHub(nil, Config{})
+	taken := newFakeClient("游客-2", "general") // 已有用户恰好使用了下一个游客名
+	join(t, h, taken)
+
+	seen := map[string]bool{taken.username: true}
+	for _, name := range []string{"", "", " ", ""} {
+		cl := newFakeClient(name, "general")
+		join(t, h, cl)
+		if !strings.HasPrefix(cl.username, guestPrefix+"-") {
+			t.Fatalf("未提供昵称的客户端被命名为 %q", cl.username)
+		}
+		if seen[cl.username] {
+			t.Fatalf("游客名 %q 重复", cl.username)
+		}
+		seen[cl.username] = true
+	}
+	if got := len(h.clients); got != 5 {
+		t.Fatalf("在线用户数 = %d，期望 5", got)
+	}
+}
+
+func TestMultiDeviceJoinAndLeave(t *testing.T) {
+	h := newTestHub(nil, Config{AllowMultiDevice: true})
+	bob := newFakeClient("bob", "general")
+	phone, laptop := newFakeClient("alice", "general"), newFakeClient("alice", "general")
+	join(t, h, bob, phone)
+	bob.reset()
+
+	join(t, h, laptop)
+	if joins := bob.ofType(t, models.TypeJoin); len(joins) != 0 {
+		t.Fatalf("第二台设备不应再次广播加入通知，bob 收到 %+v", joins)
+	}
+	if got := lastUserList(t, laptop); !slices.Equal(got, []string{"alice", "bob"}) {
+		t.Fatalf("用户列表 = %v，同一用户应只出现一次", got)
+	}
+	if got := h.ConnectionCount(); got != 3 {
+		t.Fatalf("连接数 = %d，期望 3", got)
+	}
+
+	chat(h, bob, "hi")
+	for _, cl := range []*fakeClient{phone, laptop} {
+		if got := cl.chatContents(t); !slices.Equal(got, []string{"hi"}) {
+			t.Errorf("alice 的每个连接都应收到聊天消息，实际 %v", got)
+		}
+	}
+	h.handleBroadcast(bob, models.Message{Type: models.TypeDirect, Username: "bob", Target: "alice", Content: "psst", Timestamp: time.Now().UTC()})
+	for _, cl := range []*fakeClient{phone, laptop} {
+		if dms := cl.ofType(t, models.TypeDirect); len(dms) != 1 || dms[0].Content != "psst" {
+			t.Errorf("alice 的每个连接都应收到私信，实际 %+v", dms)
+		}
+	}
+
+	bob.reset()
+	h.handleUnregister(phone)
+	if leaves := bob.ofType(t, models.TypeLeave); len(leaves) != 0 {
+		t.Fatalf("alice 还有一个连接，不应广播离开通知，bob 收到 %+v", leaves)
+	}
+	h.handleUnregister(laptop)
+	if leaves := bob.ofType(t, models.TypeLeave); len(leaves) != 1 || leaves[0].Username != "alice" {
+		t.Fatalf("最后一个连接断开时应广播一次离开通知，bob 收到 %+v", leaves)
+	}
+	if got := lastUserList(t, bob); !slices.Equal(got, []string{"bob"}) {
+		t.Fatalf("用户列表 = %v，期望 [bob]", got)
+	}
+}
+
+func TestRegisterRejectionErrorCodes(t *testing.T) {
+	tests := []struct {
+		name      string
+		cfg       Config
+		existing  []*fakeClient
+		client    func() *fakeClient
+		errCode   string
+		closeCode int
+	}{
+		{
+			name:      "昵称已被占用",
+			existing:  []*fakeClient{newFakeClient("alice", "general")},
+			client:    func() *fakeClient { return newFakeClient("ALICE", "general") },
+			errCode:   models.ErrCodeNickTaken,
+			closeCode: models.CloseNickTaken,
+		},
+		{
+			name:      "连接数已满",
+			cfg:       Config{MaxClients: 1},
+			existing:  []*fakeClient{newFakeClient("alice", "general")},
+			client:    func() *fakeClient { return newFakeClient("bob", "general") },
+			errCode:   models.ErrCodeServerFull,
+			closeCode: models.CloseTryAgain,
+		},
+		{
+			name:      "活跃房间数已满",
+			cfg:       Config{MaxRooms: 1},
+			existing:  []*fakeClient{newFakeClient("alice", "general")},
+			client:    func() *fakeClient { return newFakeClient("bob", "other") },
+			errCode:   models.ErrCodeTooManyRooms,
+			closeCode: models.CloseTooManyRooms,
+		},
+		{
+			name: "协议版本不受支持",
+			client: func() *fakeClient {
+				cl := newFakeClient("bob", "general")
+				cl.version = models.ProtocolVersion + 1
+				return cl
+			},
+			errCode:   models.ErrCodeUnsupportedVersion,
+			closeCode: models.CloseUnsupportedVersion,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHub(nil, tt.cfg)
+			join(t, h, tt.existing...)
+			cl := tt.client()
+			h.handleRegister(cl)
+
+			if closed, code := cl.isClosed(); !closed || code != tt.closeCode {
+				t.Fatalf("连接应以 %d 关闭，实际 closed=%v code=%d", tt.closeCode, closed, code)
+			}
+			errs := cl.ofType(t, models.TypeError)
+			if len(errs) != 1 || errs[0].ErrorCode != tt.errCode || errs[0].Error == "" {
+				t.Fatalf("应收到带说明的 %s 错误，实际 %+v", tt.errCode, errs)
+			}
+		})
+	}
+}
+
+func TestLastLeaveReapsRoom(t *testing.T) {
+	h := newTestHub(nil, Config{MaxRooms: 1})
+	alice, bob := newFakeClient("alice", "dev"), newFakeClient("bob", "dev")
+	join(t, h, alice, bob)
+	chat(h, alice, "hi") // 让房间有序号等状态
+
+	h.handleUnregister(alice)
+	if h.roomConns["dev"] != 1 {
+		t.Fatalf("dev 还有 bob，连接数 = %d", h.roomConns["dev"])
+	}
+	h.handleUnregister(bob)
+	if _, ok := h.roomConns["dev"]; ok {
+		t.Fatal("最后一个连接离开后房间应被清理")
+	}
+	if _, ok := h.roomSeq["dev"]; ok {
+		t.Fatal("最后一个连接离开后房间的序号状态应被清理")
+	}
+
+	// 清理后的房间不再占用名额，可以创建新房间
+	join(t, h, newFakeClient("carol", "other"))
+}
+
+func TestNicknameCaseCollidesButDisplayKeepsCase(t *testing.T) {
+	h := newTestHub(nil, Config{})
+	alice, bob := newFakeClient("Alice", "general"), newFakeClient("bob", "general")
+	join(t, h, alice, bob)
+
+	impostor := newFakeClient("alice ", "general")
+	h.handleRegister(impostor)
+	if closed, code := impostor.isClosed(); !closed || code != models.CloseNickTaken {
+		t.Fatalf("只有大小写和空白不同的昵称应视为重名，实际 closed=%v code=%d", closed, code)
+	}
+
+	if _, ok := h.clients["alice"]; !ok {
+		t.Fatal("clients 应以规范化的用户名为键")
+	}
+	if got := lastUserList(t, bob); !slices.Equal(got, []string{"Alice", "bob"}) {
+		t.Fatalf("用户列表 = %v，应保留原始大小写", got)
+	}
+	chat(h, alice, "hi")
+	if chats := bob.ofType(t, models.TypeChat); len(chats) != 1 || chats[0].Username != "Alice" {
+		t.Fatalf("bob 收到 %+v，发送者应显示为 Alice", chats)
+	}
+}
+
+func TestNicknameScope(t *testing.T) {
+	tests := []struct {
+		name    string
+		global  bool
+		allowed bool
+	}{
+		{"按房间唯一（默认）", false, true},
+		{"全局唯一", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newTestHub(nil, Config{GlobalNicknames: tt.global})
+			join(t, h, newFakeClient("alice", "general"))
+
+			other := newFakeClient("Alice", "dev")
+			h.handleRegister(other)
+			if closed, code := other.isClosed(); closed == tt.allowed {
+				t.Fatalf("同名用户进入另一个房间: closed=%v code=%d，期望允许=%v", closed, code, tt.allowed)
+			}
+
+			// 两种模式下同一房间内都不能重名
+			same := newFakeClient("ALICE", "general")
+			h.handleRegister(same)
+			if closed, code := same.isClosed(); !closed || code != models.CloseNickTaken {
+				t.Fatalf("同一房间内的重名连接应被拒绝，实际 closed=%v code=%d", closed, code)
+			}
+		})
+	}
+}
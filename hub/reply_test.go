@@ -0,0 +1,51 @@
+package hub
+
+import (
+	"testing"
+	"time"
+
+	"chatroom/models"
+	"chatroom/store"
+)
+
+func TestReplyIsBroadcastWithParent(t *testing.T) {
+	ms := newTestStore(t, store.Config{PersistTypes: []models.MessageType{models.TypeChat}})
+	h := newTestHub(ms, Config{})
+	alice, bob := newFakeClient("alice", "general"), newFakeClient("bob", "general")
+	carol := newFakeClient("carol", "other")
+	join(t, h, alice, bob, carol)
+
+	chat(h, alice, "question")
+	chats := bob.ofType(t, models.TypeChat)
+	if len(chats) != 1 || chats[0].ID == 0 {
+		t.Fatalf("bob 收到 %+v，期望一条带 ID 的消息", chats)
+	}
+	parent := chats[0].ID
+
+	reply := func(sender *fakeClient, parent int64) {
+		h.handleBroadcast(sender, models.Message{Type: models.TypeChat, Username: sender.username, Room: sender.room, Content: "answer", ReplyTo: parent, Timestamp: time.Now().UTC()})
+	}
+	reply(bob, parent)
+	if chats := alice.ofType(t, models.TypeChat); len(chats) != 2 || chats[1].ReplyTo != parent {
+		t.Fatalf("alice 收到 %+v，回复应携带 reply_to=%d", chats, parent)
+	}
+
+	t.Run("回复不存在的消息", func(t *testing.T) {
+		alice.reset()
+		bob.reset()
+		reply(bob, parent+100)
+		if errs := bob.ofType(t, models.TypeError); len(errs) != 1 || errs[0].ErrorCode != models.ErrCodeReplyNotFound {
+			t.Fatalf("bob 收到 %+v，期望 %s", bob.messages(t), models.ErrCodeReplyNotFound)
+		}
+		if got := alice.chatContents(t); len(got) != 0 {
+			t.Fatalf("被拒绝的回复不应广播，alice 收到 %v", got)
+		}
+	})
+
+	t.Run("回复其他房间的消息", func(t *testing.T) {
+		reply(carol, parent)
+		if errs := carol.ofType(t, models.TypeError); len(errs) != 1 || errs[0].ErrorCode != models.ErrCodeReplyNotFound {
+			t.Fatalf("carol 收到 %+v，期望 %s", carol.messages(t), models.ErrCodeReplyNotFound)
+		}
+	})
+}
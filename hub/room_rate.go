@@ -0,0 +1,67 @@
+package hub
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"chatroom/i18n"
+	"chatroom/models"
+)
+
+// DefaultRoomRateWindow 是未配置 RoomRateWindow 时统计房间消息速率的时间窗口。
+const DefaultRoomRateWindow = time.Second
+
+// roomRate 记录一个房间在当前窗口内广播的聊天消息时间，以及上次通知房间已限流的时间。
+type roomRate struct {
+	times      []time.Time
+	notifiedAt time.Time
+}
+
+// roomRateLimitFor 返回房间在一个窗口内允许的聊天消息数，0 表示不限制。
+func (h *Hub) roomRateLimitFor(room string) int {
+	if limit, ok := h.roomRateLimits[room]; ok && limit > 0 {
+		return limit
+	}
+	return h.roomRateLimit
+}
+
+// allowRoomMessage 报告房间在 roomRateWindow 内的聊天消息数是否还没有达到上限，允许时记录这条消息。
+// 这是所有发送者合计的上限，防止许多各自发得不快的连接一起刷屏一个房间，拖垮扇出和数据库。
+// 超过上限的消息被丢弃，发送者收到 ROOM_RATE_LIMITED 错误；每个窗口最多向整个房间发送一次系统提示。
+// 只能在 Run 协程中调用。
+func (h *Hub) allowRoomMessage(sender Client, room string, now time.Time) bool {
+	limit := h.roomRateLimitFor(room)
+	if limit <= 0 {
+		return true
+	}
+	rate := h.roomRates[room]
+	if rate == nil {
+		rate = &roomRate{}
+		h.roomRates[room] = rate
+	}
+	for len(rate.times) > 0 && now.Sub(rate.times[0]) >= h.roomRateWindow {
+		rate.times = rate.times[1:]
+	}
+	if len(rate.times) < limit {
+		rate.times = append(rate.times, now)
+		return true
+	}
+
+	h.sendError(sender, models.ErrCodeRoomRateLimited, i18n.T(sender.GetLang(), i18n.KeyRoomRateLimited))
+	if now.Sub(rate.notifiedAt) >= h.roomRateWindow {
+		rate.notifiedAt = now
+		log.Printf("房间 %s 的消息超过每 %v %d 条，开始丢弃消息", room, h.roomRateWindow, limit)
+		notice := models.Message{
+			Type:      models.TypeSystem,
+			Room:      room,
+			Content:   i18n.T(i18n.Default, i18n.KeyRoomBusy),
+			TextKey:   i18n.KeyRoomBusy,
+			Timestamp: now.UTC(),
+		}
+		if jsonMsg, err := json.Marshal(notice); err == nil {
+			h.broadcastToRoom(room, jsonMsg)
+		}
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+package hub
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"chatroom/clock"
+	"chatroom/i18n"
+	"chatroom/models"
+)
+
+// roomBusyNotices 返回发给该连接的房间限流提示数。
+func roomBusyNotices(t *testing.T, cl *fakeClient) int {
+	t.Helper()
+	n := 0
+	for _, msg := range cl.ofType(t, models.TypeSystem) {
+		if msg.TextKey == i18n.KeyRoomBusy {
+			n++
+		}
+	}
+	return n
+}
+
+func TestRoomRateLimitAcrossClients(t *testing.T) {
+	clk := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	h := newTestHub(nil, Config{Clock: clk, RoomRateLimit: 5, RoomRateWindow: time.Second})
+	var senders []*fakeClient
+	for i := 0; i < 10; i++ {
+		senders = append(senders, newFakeClient("user"+strconv.Itoa(i), "general"))
+	}
+	listener := newFakeClient("listener", "general")
+	elsewhere := newFakeClient("elsewhere", "random")
+	join(t, h, append(senders, listener, elsewhere)...)
+	listener.reset()
+
+	// 每个连接只发一条，远低于各自的上限，但房间合计超过了 5 条
+	for i, sender := range senders {
+		chat(h, sender, strconv.Itoa(i))
+	}
+	if got := listener.chatContents(t); len(got) != 5 {
+		t.Fatalf("listener 收到 %d 条聊天消息 %v，房间上限是 5", len(got), got)
+	}
+	for i, sender := range senders {
+		errs := sender.ofType(t, models.TypeError)
+		limited := len(errs) == 1 && errs[0].ErrorCode == models.ErrCodeRoomRateLimited
+		if limited != (i >= 5) {
+			t.Fatalf("第 %d 个发送者收到的错误 = %+v", i, errs)
+		}
+	}
+	if n := roomBusyNotices(t, listener); n != 1 {
+		t.Fatalf("一个窗口内应只向房间提示一次，收到 %d 次", n)
+	}
+
+	// 其他房间不受影响
+	chat(h, elsewhere, "hi")
+	if got := elsewhere.chatContents(t); len(got) != 1 {
+		t.Fatalf("其他房间的消息 = %v，不应被限流", got)
+	}
+
+	// 窗口过去后恢复
+	clk.Advance(time.Second)
+	listener.reset()
+	chat(h, senders[9], "again")
+	if got := listener.chatContents(t); len(got) != 1 || got[0] != "again" {
+		t.Fatalf("窗口过去后收到 %v，期望恢复发送", got)
+	}
+}
+
+func TestRoomRateLimitOverride(t *testing.T) {
+	clk := clock.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	h := newTestHub(nil, Config{Clock: clk, RoomRateLimit: 100, RoomRateLimits: map[string]int{"announcements": 2}})
+	alice, bob := newFakeClient("alice", "announcements"), newFakeClient("bob", "announcements")
+	join(t, h, alice, bob)
+	for i := 0; i < 4; i++ {
+		chat(h, alice, strconv.Itoa(i))
+	}
+	if got := bob.chatContents(t); len(got) != 2 {
+		t.Fatalf("bob 收到 %v，announcements 的上限覆盖为 2", got)
+	}
+}
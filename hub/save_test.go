@@ -0,0 +1,64 @@
+package hub
+
+import (
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+
+	"chatroom/models"
+	"chatroom/store"
+)
+
+// flakyStore 在 failing 为 true 时保存失败，否则记录保存的聊天消息内容。
+type flakyStore struct {
+	store.NullMessageStore
+	mu      sync.Mutex
+	failing bool
+	saved   []string
+}
+
+func (s *flakyStore) SaveMessage(msg models.Message) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.failing {
+		return 0, errors.New("磁盘已满")
+	}
+	if msg.Type == models.TypeChat {
+		s.saved = append(s.saved, msg.Content)
+	}
+	return int64(len(s.saved)), nil
+}
+
+func (s *flakyStore) setFailing(failing bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failing = failing
+}
+
+func TestSaveFailureStillBroadcastsAndIsRetried(t *testing.T) {
+	ms := &flakyStore{}
+	h := newTestHub(ms, Config{})
+	alice, bob := newFakeClient("alice", "general"), newFakeClient("bob", "general")
+	join(t, h, alice, bob)
+
+	ms.setFailing(true)
+	chat(h, alice, "a")
+	chat(h, alice, "b")
+	if got := bob.chatContents(t); !slices.Equal(got, []string{"a", "b"}) {
+		t.Fatalf("保存失败时 bob 收到 %v，消息仍应实时送达", got)
+	}
+	if stats := h.SaveStats(); stats != (SaveStats{Failures: 2, ConsecutiveFailures: 2, Pending: 2}) {
+		t.Fatalf("保存统计 = %+v，期望记录两次失败和两条待重试消息", stats)
+	}
+
+	// 存储恢复后，下一次保存成功时按原顺序补存之前失败的消息
+	ms.setFailing(false)
+	chat(h, alice, "c")
+	if !slices.Equal(ms.saved, []string{"c", "a", "b"}) {
+		t.Fatalf("保存的消息 = %v，期望补存 a、b", ms.saved)
+	}
+	if stats := h.SaveStats(); stats != (SaveStats{Failures: 2}) {
+		t.Fatalf("恢复后的保存统计 = %+v，期望只保留累计失败次数", stats)
+	}
+}
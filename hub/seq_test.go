@@ -0,0 +1,52 @@
+package hub
+
+import (
+	"slices"
+	"testing"
+
+	"chatroom/models"
+	"chatroom/store"
+)
+
+// seqs 返回发给该连接的聊天消息的序号。
+func seqs(t *testing.T, cl *fakeClient) []int64 {
+	t.Helper()
+	var out []int64
+	for _, msg := range cl.ofType(t, models.TypeChat) {
+		out = append(out, msg.Seq)
+	}
+	return out
+}
+
+func TestSeqIsMonotonicPerRoom(t *testing.T) {
+	ms := newTestStore(t, store.Config{PersistTypes: []models.MessageType{models.TypeChat}})
+	h := newTestHub(ms, Config{})
+	alice, bob := newFakeClient("alice", "general"), newFakeClient("bob", "dev")
+	join(t, h, alice, bob)
+
+	chat(h, alice, "a1")
+	chat(h, bob, "b1")
+	chat(h, alice, "a2")
+	chat(h, alice, "a3")
+	chat(h, bob, "b2")
+
+	if got := seqs(t, alice); !slices.Equal(got, []int64{1, 2, 3}) {
+		t.Fatalf("general 的序号 = %v，期望 [1 2 3]", got)
+	}
+	if got := seqs(t, bob); !slices.Equal(got, []int64{1, 2}) {
+		t.Fatalf("dev 的序号 = %v，期望独立编号 [1 2]", got)
+	}
+
+	// 序号随消息持久化，重启后的 Hub 从已保存的最大序号继续
+	saved, err := ms.GetMessages("general", 10)
+	if err != nil || len(saved) != 3 || saved[2].Seq != 3 {
+		t.Fatalf("保存的消息 = %+v (%v)，期望最后一条序号为 3", saved, err)
+	}
+	restarted := newTestHub(ms, Config{})
+	carol := newFakeClient("carol", "general")
+	join(t, restarted, carol)
+	chat(restarted, carol, "a4")
+	if got := seqs(t, carol); !slices.Equal(got, []int64{4}) {
+		t.Fatalf("重启后的序号 = %v，期望 [4]", got)
+	}
+}
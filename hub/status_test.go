@@ -0,0 +1,71 @@
+package hub
+
+import (
+	"maps"
+	"testing"
+
+	"chatroom/models"
+)
+
+// lastStatuses 返回发给该连接的最后一个用户列表中的自定义状态。
+func lastStatuses(t *testing.T, cl *fakeClient) map[string]string {
+	t.Helper()
+	lists := cl.ofType(t, models.TypeUserList)
+	if len(lists) == 0 {
+		t.Fatalf("%s 没有收到用户列表", cl.username)
+	}
+	return lists[len(lists)-1].Statuses
+}
+
+func setStatus(h *Hub, sender *fakeClient, status string) {
+	h.handleBroadcast(sender, models.Message{Type: models.TypeStatus, Username: sender.username, Room: sender.room, Content: status})
+}
+
+func TestStatusAppearsInUserListUntilLeave(t *testing.T) {
+	h := newTestHub(nil, Config{})
+	alice, bob := newFakeClient("alice", "general"), newFakeClient("bob", "general")
+	other := newFakeClient("carol", "random")
+	join(t, h, alice, bob, other)
+	bob.reset()
+	other.reset()
+
+	setStatus(h, alice, "开会中")
+	if got := lastStatuses(t, bob); !maps.Equal(got, map[string]string{"alice": "开会中"}) {
+		t.Fatalf("bob 收到的状态 = %v，期望 alice 的状态", got)
+	}
+	if got := other.ofType(t, models.TypeUserList); len(got) != 0 {
+		t.Fatalf("其他房间不应收到用户列表，收到 %d 个", len(got))
+	}
+
+	// 状态不变时不重复广播
+	bob.reset()
+	setStatus(h, alice, "开会中")
+	if got := bob.ofType(t, models.TypeUserList); len(got) != 0 {
+		t.Fatalf("相同的状态不应再次广播，收到 %d 个用户列表", len(got))
+	}
+
+	// 离开后状态随连接消失，重新加入时没有状态
+	h.handleUnregister(alice)
+	if got := lastStatuses(t, bob); len(got) != 0 {
+		t.Fatalf("alice 离开后的状态 = %v，期望为空", got)
+	}
+	again := newFakeClient("alice", "general")
+	join(t, h, again)
+	if got := lastStatuses(t, bob); len(got) != 0 {
+		t.Fatalf("alice 重新加入后的状态 = %v，期望为空", got)
+	}
+}
+
+func TestEmptyStatusClearsIt(t *testing.T) {
+	h := newTestHub(nil, Config{})
+	alice, bob := newFakeClient("alice", "general"), newFakeClient("bob", "general")
+	join(t, h, alice, bob)
+	setStatus(h, alice, "午饭")
+	setStatus(h, alice, "")
+	if got := lastStatuses(t, bob); len(got) != 0 {
+		t.Fatalf("清除后的状态 = %v，期望为空", got)
+	}
+	if got := lastUserList(t, bob); len(got) != 2 {
+		t.Fatalf("清除状态后的用户列表 = %v，用户本身不受影响", got)
+	}
+}
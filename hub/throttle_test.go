@@ -0,0 +1,46 @@
+package hub
+
+import (
+	"testing"
+	"time"
+
+	"chatroom/clock"
+	"chatroom/models"
+)
+
+func TestRapidReconnectsAreThrottled(t *testing.T) {
+	clk := clock.NewFake(time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC))
+	h := newTestHub(nil, Config{Clock: clk, ReconnectLimit: 3, ReconnectWindow: time.Minute})
+
+	reconnect := func(addr string) *fakeClient {
+		cl := newFakeClient("alice", "general")
+		cl.addr = addr
+		h.handleRegister(cl)
+		h.handleUnregister(cl)
+		clk.Advance(time.Second)
+		return cl
+	}
+	for i := 0; i < 3; i++ {
+		if closed, code := reconnect("10.0.0.1").isClosed(); closed {
+			t.Fatalf("第 %d 次连接不应被拒绝，关闭码 %d", i+1, code)
+		}
+	}
+	cl := reconnect("10.0.0.1")
+	if closed, code := cl.isClosed(); !closed || code != models.CloseThrottled {
+		t.Fatalf("窗口内第 4 次连接应以 %d 关闭，实际 closed=%v code=%d", models.CloseThrottled, closed, code)
+	}
+	if errs := cl.ofType(t, models.TypeError); len(errs) != 1 || errs[0].ErrorCode != models.ErrCodeThrottled {
+		t.Fatalf("应收到 %s 错误，实际 %+v", models.ErrCodeThrottled, errs)
+	}
+
+	// 限流按来源统计，其他 IP 不受影响
+	if closed, _ := reconnect("10.0.0.2").isClosed(); closed {
+		t.Fatal("其他来源不应被限流")
+	}
+
+	// 窗口过去后同一来源可以再次连接
+	clk.Advance(time.Minute)
+	if closed, code := reconnect("10.0.0.1").isClosed(); closed {
+		t.Fatalf("窗口过去后连接不应被拒绝，关闭码 %d", code)
+	}
+}
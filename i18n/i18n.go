@@ -0,0 +1,141 @@
+// Package i18n 提供服务器生成文案（加入/离开通知、错误提示等）的多语言消息目录。
+//
+// 客户端通过 ?lang= 选择语言。发给单个连接的消息（错误提示、拒绝原因）直接按连接的语言生成；
+// 广播和持久化的消息（加入、离开）只能有一份内容，使用默认语言，同时带上 text_key，
+// 客户端可以据此用自己的语言重新渲染。
+package i18n
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Default 是未指定或不支持客户端请求的语言时使用的语言。
+const Default = "zh"
+
+// 文案键。广播消息的 text_key 字段使用 KeyJoin、KeyLeave 和 KeyDisconnect，
+// 客户端可以把它们与 username 字段组合成自己语言的文案。
+const (
+	KeyJoin       = "join"       // 参数：用户名
+	KeyLeave      = "leave"      // 参数：用户名
+	KeyDisconnect = "disconnect" // 参数：用户名
+
+	KeyThrottled          = "throttled"
+	KeyBanned             = "banned"
+	KeyBannedUntil        = "banned_until"        // 参数：封禁到期时间
+	KeyUnsupportedVersion = "unsupported_version" // 参数：客户端声明的版本、最低版本、最高版本
+	KeyNickTaken          = "nick_taken"
+	KeyServerFull         = "server_full"
+	KeyTooManyRooms       = "too_many_rooms"
+	KeyHistoryUnavailable = "history_unavailable"
+	KeyPinForbidden       = "pin_forbidden"
+	KeyPinNotFound        = "pin_not_found"
+	KeyReplyNotFound      = "reply_not_found"
+	KeyObserverReadOnly   = "observer_read_only"
+	KeyMessageTooLarge    = "message_too_large" // 参数：消息类型、最大字节数
+	KeyBadFormat          = "bad_format"        // 参数：解析错误
+	KeyInvalidUTF8        = "invalid_utf8"
+	KeyInvalidMessage     = "invalid_message" // 参数：校验错误
+	KeyTypeForbidden      = "type_forbidden"  // 参数：消息类型
+	KeyIgnoreSelf         = "ignore_self"
+	KeyDirectSelf         = "dm_self"
+	KeyUserOffline        = "user_offline"     // 参数：收件人
+	KeyInboxFull          = "inbox_full"       // 参数：收件人
+	KeyContentTooLong     = "content_too_long" // 参数：最大字符数
+	KeyClearFailed        = "clear_failed"
+	KeyRoomRateLimited    = "room_rate_limited"
+	KeyRoomBusy           = "room_busy"
+)
+
+// catalogs 按语言保存文案模板（fmt 格式）。每种语言都应包含默认语言的所有键，缺失的键回退到默认语言。
+var catalogs = map[string]map[string]string{
+	"zh": {
+		KeyJoin:               "%s 加入了聊天。",
+		KeyLeave:              "%s 离开了聊天。",
+		KeyDisconnect:         "%s 的连接已断开。",
+		KeyThrottled:          "连接过于频繁，请稍后再试。",
+		KeyBanned:             "你已被封禁。",
+		KeyBannedUntil:        "你已被封禁，到期时间: %s。",
+		KeyUnsupportedVersion: "不支持的协议版本 %d，服务器支持版本 %d 到 %d，请升级客户端。",
+		KeyNickTaken:          "昵称已被占用，请尝试其他昵称。",
+		KeyServerFull:         "服务器连接数已满，请稍后再试。",
+		KeyTooManyRooms:       "活跃房间数已达上限，请加入已有的房间。",
+		KeyHistoryUnavailable: "历史消息暂时不可用",
+		KeyPinForbidden:       "没有置顶消息的权限",
+		KeyPinNotFound:        "要置顶的消息不存在",
+		KeyReplyNotFound:      "被回复的消息不存在",
+		KeyObserverReadOnly:   "观察者连接不能发送消息",
+		KeyMessageTooLarge:    "%s 消息过长，最多 %d 个字节",
+		KeyBadFormat:          "消息格式错误: %v",
+		KeyInvalidUTF8:        "消息不是合法的 UTF-8 文本",
+		KeyInvalidMessage:     "无效的消息: %v",
+		KeyTypeForbidden:      "客户端不能发送 %s 消息",
+		KeyIgnoreSelf:         "不能屏蔽自己",
+		KeyDirectSelf:         "不能给自己发私信",
+		KeyUserOffline:        "%s 不在线，私信未发送",
+		KeyInboxFull:          "%s 的离线私信已满，请等对方上线后再发送",
+		KeyContentTooLong:     "消息内容过长，最多 %d 个字符",
+		KeyClearFailed:        "删除历史消息失败，请稍后再试",
+		KeyRoomRateLimited:    "房间内消息过多，你的消息未发送，请稍后再试",
+		KeyRoomBusy:           "房间内消息过多，部分消息已被丢弃。",
+	},
+	"en": {
+		KeyJoin:               "%s joined the chat.",
+		KeyLeave:              "%s left the chat.",
+		KeyDisconnect:         "%s disconnected.",
+		KeyThrottled:          "Too many connection attempts, please try again later.",
+		KeyBanned:             "You have been banned.",
+		KeyBannedUntil:        "You have been banned until %s.",
+		KeyUnsupportedVersion: "Unsupported protocol version %d; the server supports versions %d to %d, please upgrade your client.",
+		KeyNickTaken:          "That nickname is already taken, please choose another.",
+		KeyServerFull:         "The server is full, please try again later.",
+		KeyTooManyRooms:       "Too many active rooms, please join an existing room.",
+		KeyHistoryUnavailable: "History is temporarily unavailable",
+		KeyPinForbidden:       "You are not allowed to pin messages",
+		KeyPinNotFound:        "The message to pin does not exist",
+		KeyReplyNotFound:      "The message being replied to does not exist",
+		KeyObserverReadOnly:   "Observer connections cannot send messages",
+		KeyMessageTooLarge:    "%s message too large, at most %d bytes",
+		KeyBadFormat:          "Malformed message: %v",
+		KeyInvalidUTF8:        "Message is not valid UTF-8 text",
+		KeyInvalidMessage:     "Invalid message: %v",
+		KeyTypeForbidden:      "Clients cannot send %s messages",
+		KeyIgnoreSelf:         "You cannot ignore yourself",
+		KeyDirectSelf:         "You cannot send a direct message to yourself",
+		KeyUserOffline:        "%s is offline; the message was not sent",
+		KeyInboxFull:          "%s has too many pending offline messages; try again once they are online",
+		KeyContentTooLong:     "Message content is too long, at most %d characters",
+		KeyClearFailed:        "Failed to delete your message history, please try again later",
+		KeyRoomRateLimited:    "This room is receiving too many messages; yours was not sent, please try again shortly",
+		KeyRoomBusy:           "This room is receiving too many messages; some were dropped.",
+	},
+}
+
+// Normalize 将客户端请求的语言（例如 "en"、"en-US"、"zh_CN"）映射为支持的语言，不支持时返回 Default。
+func Normalize(lang string) string {
+	lang = strings.ToLower(strings.TrimSpace(lang))
+	if _, ok := catalogs[lang]; ok {
+		return lang
+	}
+	base, _, _ := strings.Cut(strings.ReplaceAll(lang, "_", "-"), "-")
+	if _, ok := catalogs[base]; ok {
+		return base
+	}
+	return Default
+}
+
+// T 返回 key 在指定语言中的文案，用 args 填充模板。
+// 语言不支持或缺少该键时回退到默认语言，默认语言也没有时返回 key 本身，方便发现遗漏。
+func T(lang, key string, args ...interface{}) string {
+	format, ok := catalogs[Normalize(lang)][key]
+	if !ok {
+		format, ok = catalogs[Default][key]
+	}
+	if !ok {
+		return key
+	}
+	if len(args) == 0 {
+		return format
+	}
+	return fmt.Sprintf(format, args...)
+}
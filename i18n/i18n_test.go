@@ -0,0 +1,41 @@
+package i18n
+
+import "testing"
+
+func TestTranslateInTwoLocales(t *testing.T) {
+	tests := []struct {
+		lang, key string
+		args      []interface{}
+		want      string
+	}{
+		{"zh", KeyJoin, []interface{}{"alice"}, "alice 加入了聊天。"},
+		{"en", KeyJoin, []interface{}{"alice"}, "alice joined the chat."},
+		{"en-US", KeyNickTaken, nil, T("en", KeyNickTaken)},
+		{"fr", KeyNickTaken, nil, "昵称已被占用，请尝试其他昵称。"}, // 不支持的语言回退到默认语言
+		{"", KeyLeave, []interface{}{"bob"}, "bob 离开了聊天。"},
+		{"en", "no_such_key", nil, "no_such_key"},
+	}
+	for _, tt := range tests {
+		if got := T(tt.lang, tt.key, tt.args...); got != tt.want {
+			t.Errorf("T(%q, %q) = %q，期望 %q", tt.lang, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	for lang, want := range map[string]string{"en": "en", "EN-gb": "en", "zh_CN": "zh", "ja": Default, "": Default} {
+		if got := Normalize(lang); got != want {
+			t.Errorf("Normalize(%q) = %q，期望 %q", lang, got, want)
+		}
+	}
+}
+
+func TestCatalogsCoverDefaultKeys(t *testing.T) {
+	for lang, catalog := range catalogs {
+		for key := range catalogs[Default] {
+			if _, ok := catalog[key]; !ok {
+				t.Errorf("%s 缺少文案 %q", lang, key)
+			}
+		}
+	}
+}
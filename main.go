@@ -1,29 +1,197 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"os"        // 用于处理信号
 	"os/signal" // 用于处理信号
-	"syscall"   // 用于处理信号
+	"strconv"
+	"strings"
+	"syscall" // 用于处理信号
 	"text/template"
+	"time"
 
+	"chatroom/archive"
+	"chatroom/audit"
 	"chatroom/client"
 	"chatroom/hub"
+	"chatroom/models"
+	"chatroom/ratelog"
 	"chatroom/store"
 	"github.com/gorilla/websocket"
 )
 
 var addr = flag.String("addr", ":8080", "http 服务地址")
 var dbPath = flag.String("db", "./chat.db", "SQLite 数据库文件路径") // 数据库路径参数
+var retention = flag.Duration("retention", 0, "删除早于该时长的消息（置顶的除外），0 表示永久保留")
+var retentionInterval = flag.Duration("retention-interval", time.Hour, "执行保留期清理的间隔")
+var archiveEndpoint = flag.String("archive-endpoint", "", "保留期清理删除消息前，把消息归档到该 S3 兼容服务（例如 https://s3.amazonaws.com），为空时不归档；访问密钥从环境变量 AWS_ACCESS_KEY_ID 和 AWS_SECRET_ACCESS_KEY 读取")
+var archiveBucket = flag.String("archive-bucket", "", "归档使用的存储桶")
+var archiveRegion = flag.String("archive-region", archive.DefaultRegion, "归档存储桶所在的区域")
+var archivePrefix = flag.String("archive-prefix", "", "归档对象名的前缀，例如 chat/")
+var compactInterval = flag.Duration("compact-interval", 0, "定期对 SQLite 数据库执行 VACUUM 以回收删除消息后的空间的间隔，0 表示不整理")
+var broadcastBuffer = flag.Int("broadcast-buffer", 256, "客户端消息进入 Hub 的队列容量，0 表示不缓冲")
+var broadcastPolicy = flag.String("broadcast-policy", string(hub.Block), "广播队列已满时的策略：block（发送方等待）、drop-newest（丢弃新消息）、drop-oldest（丢弃最早的消息）")
+var fanoutWorkers = flag.Int("fanout-workers", 0, "并行发送广播的工作协程数，只对数千人的大房间有帮助，0 表示在 Hub 主循环中逐个发送")
+var noPersist = flag.Bool("no-persist", false, "不保存任何聊天记录，也不创建数据库文件；加入的用户看不到历史消息")
+var auditLog = flag.String("audit-log", "", "审计日志文件路径，每条持久化的消息以一行 JSON 追加写入；收到 SIGHUP 时重新打开以配合日志轮转，为空时不记录")
+var sendBuffer = flag.Int("send-buffer", client.DefaultSendBufferSize, "每个客户端发送通道的缓冲大小（越大越能容忍突发，但占用更多内存）")
+var maxMessageSize = flag.Int("max-message-size", client.DefaultMaxMessageSize, "客户端发来的单条消息（整个 JSON 帧）的最大字节数")
+var maxMessageSizes = flag.String("max-message-sizes", "", "按消息类型覆盖 -max-message-size，格式为 类型=字节数，逗号分隔，例如 dm=2048；不能超过 64KB")
+var maxContentRunes = flag.Int("max-content", client.DefaultMaxContentRunes, "消息内容最大字符数，0 表示不限制")
+var truncateContent = flag.Bool("truncate-content", false, "消息内容超长时截断而不是拒绝")
+var adminToken = flag.String("admin-token", "", "管理接口（/api/*）使用的令牌，为空时禁用管理接口")
+var persistTypes = flag.String("persist-types", joinTypes(store.DefaultPersistTypes), "需要持久化的消息类型，逗号分隔，只能从 "+joinTypes(models.HistoryTypes)+" 中选择")
+var multiDevice = flag.Bool("multi-device", false, "允许同一昵称同时从多个设备连接")
+var allowedOrigins = flag.String("allowed-origins", "", "允许的跨域来源，逗号分隔；同时用于 WebSocket 来源校验和 REST 接口的 CORS，为空时允许所有来源")
+var trustedProxiesFlag = flag.String("trusted-proxies", "", "可信反向代理的 IP 或 CIDR，逗号分隔；只有来自它们的请求才使用 X-Forwarded-For/X-Real-IP 中的客户端 IP，为空时总是使用连接的来源地址")
+var reconnectLimit = flag.Int("reconnect-limit", 0, "同一 IP 在 -reconnect-window 内最多允许的连接次数，超过后暂时拒绝，0 表示不限制（默认）")
+var reconnectWindow = flag.Duration("reconnect-window", time.Minute, "统计重连次数的时间窗口")
+var globalNicks = flag.Bool("global-nicks", false, "昵称在所有房间中唯一；默认只要求同一房间内唯一")
+var defaultRoom = flag.String("default-room", models.DefaultRoom, "连接时未指定 ?room= 的用户进入的房间")
+var logSuppressWindow = flag.Duration("log-suppress-window", ratelog.DefaultWindow, "合并重复错误日志的时间窗口，0 表示不合并")
+var coalesceMax = flag.Int("coalesce-max", client.DefaultCoalesceMax, "开启合并（?coalesce=1）的连接一帧最多包含的消息数，消息之间用换行符分隔")
+var coalesceDelay = flag.Duration("coalesce-delay", 0, "开启合并的连接收到消息后最多等待多久再发送，以便与随后的消息合并；0 表示只合并已经排队的消息")
+var ackTimeout = flag.Duration("ack-timeout", client.DefaultAckTimeout, "开启确认（?ack=1）的连接等待 ack 的时间，超时后重发一次，再次超时则放弃")
+var maxClients = flag.Int("max-clients", 0, "连接数硬上限，达到后拒绝新的注册，0 表示不限制")
+var softMaxClients = flag.Int("soft-max-clients", 0, "连接数软上限，达到后新的 WebSocket 请求直接返回 503，已有连接不受影响，0 表示不限制")
+var maxRooms = flag.Int("max-rooms", 1000, "同时活跃的房间数上限，达到后拒绝创建新房间，0 表示不限制")
+var awayAfter = flag.Duration("away-after", 5*time.Minute, "用户没有任何活动多久后在用户列表中显示为离开，0 表示不检测")
+var sqliteJournalMode = flag.String("sqlite-journal-mode", "WAL", "SQLite 日志模式（PRAGMA journal_mode），为空时使用 SQLite 默认值")
+var sqliteSynchronous = flag.String("sqlite-synchronous", "NORMAL", "SQLite 同步级别（PRAGMA synchronous）：NORMAL 更快但掉电时可能丢失最近的消息，FULL 更安全")
+var sqliteBusyTimeout = flag.Duration("sqlite-busy-timeout", 5*time.Second, "SQLite 数据库被锁时的等待时间（PRAGMA busy_timeout）")
+var sqliteRetries = flag.Int("sqlite-retries", store.DefaultRetries, "数据库被锁、磁盘已满等暂时性错误的重试次数，-1 表示不重试")
+var sqliteRetryBackoff = flag.Duration("sqlite-retry-backoff", store.DefaultRetryBackoff, "第一次重试前的等待时间，之后每次翻倍")
+var idleTimeout = flag.Duration("idle-timeout", 0, "连接既不发送消息也不响应 ping 多久后被主动断开，应明显大于 ping 间隔（54 秒），0 表示不断开")
+var userPins = flag.Bool("user-pins", true, "允许聊天室中的任何用户置顶消息；关闭后只能通过 /api/pin 置顶")
+var debug = flag.Bool("debug", false, "启用 /debug 调试接口（需要管理令牌），用于查看 Hub 的实时状态")
+var historyLimit = flag.Int("history-limit", hub.DefaultHistoryLimit, "加入房间或请求历史时回放的历史消息条数")
+var historyCache = flag.Int("history-cache", 0, "每个活跃房间在内存中缓存的最近消息条数，不小于 -history-limit 时加入房间的历史直接从内存读取，0 表示不缓存")
+var historyChunkSize = flag.Int("history-chunk-size", 0, "大于 0 时历史消息拆成每块最多这么多条的 history_chunk 消息逐帧发送，以 history_end 结束；0 表示整体作为一条 history 消息发送")
+var roomRateLimit = flag.Int("room-rate-limit", 0, "每个房间在 -room-rate-window 内允许的聊天消息总数（所有人合计），超出的被丢弃，0 表示不限制")
+var roomRateLimits = flag.String("room-rate-limits", "", "按房间覆盖 -room-rate-limit，格式为 房间=条数，逗号分隔，例如 lobby=50")
+var roomRateWindow = flag.Duration("room-rate-window", hub.DefaultRoomRateWindow, "统计房间消息速率的时间窗口")
+var clearHistoryGlobal = flag.Bool("clear-history-global", false, "用户的 clear_history 请求删除其在所有房间中的消息；默认只删除当前房间中的")
+var roomHistoryLimits = flag.String("room-history-limits", "", "按房间覆盖 -history-limit，格式为 房间=条数，逗号分隔，例如 firehose=20,support=200")
+var welcome = flag.String("welcome", "", "用户加入时单独发送给他的欢迎语，支持 {username} 和 {online_count} 占位符")
+var welcomeFile = flag.String("welcome-file", "", "从文件读取欢迎语（格式同 -welcome），不能与 -welcome 同时设置")
+var botFile = flag.String("bot-file", "", "内置机器人的 JSON 配置文件，格式为 {\"name\": 昵称, \"triggers\": {触发词: 回复}}，回复支持 {username}、{room} 和 {time} 占位符")
+var homeFile = flag.String("home-file", "home.html", "首页模板文件路径，相对路径相对于当前工作目录；找不到时使用内置的简易页面")
+var deliveryStatusInterval = flag.Duration("delivery-status-interval", 0, "向发送者汇总聊天消息投递状态（已收到、已读）的间隔，0 表示不跟踪")
+var shutdownTimeout = flag.Duration("shutdown-timeout", 5*time.Second, "关闭时等待连接发完已排队消息的最长时间，0 表示立即断开")
+var writeRetries = flag.Int("write-retries", 0, "暂时性写入失败后断开客户端前的重试次数")
+var writeRetryBackoff = flag.Duration("write-retry-backoff", client.DefaultWriteRetryBackoff, "写入重试的基础退避时间，第 N 次重试等待 N 倍")
+var tlsCert = flag.String("tls-cert", "", "TLS 证书文件路径，与 -tls-key 同时设置时启用 HTTPS/WSS")
+var tlsKey = flag.String("tls-key", "", "TLS 私钥文件路径，与 -tls-cert 同时设置时启用 HTTPS/WSS")
+
+// pumpErrorLog 是所有客户端读写协程共享的错误日志记录器，在 main 中根据参数创建。
+var pumpErrorLog *ratelog.Logger
+
+// typeSizes 是按消息类型配置的消息大小上限，在 main 中由 -max-message-sizes 解析得到。
+var typeSizes map[models.MessageType]int
 
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
 	CheckOrigin: func(r *http.Request) bool {
-		return true // 允许所有来源，方便开发
+		return originAllowed(r) // 未配置 -allowed-origins 时允许所有来源，方便开发
 	},
+	Error: upgradeError,
+}
+
+// upgradeError 在 WebSocket 升级失败时返回说明原因的 HTTP 错误，代替 gorilla 默认的简短错误文本。
+// 请求头不符合要求（例如直接用浏览器或 curl 访问 /ws）属于客户端错误，只在调试时有用，不记录日志；
+// 其他失败（例如来源被拒绝、连接劫持失败）记录日志。
+func upgradeError(w http.ResponseWriter, r *http.Request, status int, reason error) {
+	w.Header().Set("Sec-Websocket-Version", "13")
+	switch {
+	case !websocket.IsWebSocketUpgrade(r):
+		// 普通 HTTP 请求：提示这是 WebSocket 接口，并告诉客户端需要升级协议
+		w.Header().Set("Upgrade", "websocket")
+		http.Error(w, "/ws 是 WebSocket 接口，请使用 WebSocket 客户端连接（例如 new WebSocket(\"ws://host/ws?username=...\")），而不是普通的 HTTP 请求。", http.StatusUpgradeRequired)
+	case status == http.StatusForbidden:
+		log.Printf("拒绝来自 %s 的 WebSocket 连接: %v (Origin: %q)", remoteIP(r), reason, r.Header.Get("Origin"))
+		http.Error(w, "WebSocket 连接被拒绝: 来源 "+r.Header.Get("Origin")+" 不在允许列表中", status)
+	case status >= http.StatusInternalServerError:
+		log.Printf("WebSocket 升级失败 (来自 %s): %v", remoteIP(r), reason)
+		http.Error(w, "WebSocket 升级失败，请稍后重试", status)
+	default:
+		// 是升级请求但握手头不完整或版本不支持
+		http.Error(w, "WebSocket 握手请求无效: "+reason.Error(), status)
+	}
+}
+
+// splitList 将逗号分隔的参数值拆分为去除空白后的非空字符串切片。
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseRoomLimits 解析 "房间=条数" 形式、逗号分隔的按房间配置，条数必须是正整数。
+func parseRoomLimits(value string) (map[string]int, error) {
+	limits := make(map[string]int)
+	for _, item := range splitList(value) {
+		room, n, ok := strings.Cut(item, "=")
+		room = strings.TrimSpace(room)
+		if !ok || room == "" {
+			return nil, fmt.Errorf("%q 应为 房间=条数", item)
+		}
+		limit, err := strconv.Atoi(strings.TrimSpace(n))
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("房间 %s 的条数 %q 必须是正整数", room, n)
+		}
+		limits[room] = limit
+	}
+	return limits, nil
+}
+
+// parseTypeSizes 解析 "类型=字节数" 形式、逗号分隔的按消息类型配置的大小上限，
+// 字节数必须是不超过 client.MaxFrameSize 的正整数。
+func parseTypeSizes(value string) (map[models.MessageType]int, error) {
+	sizes := make(map[models.MessageType]int)
+	for _, item := range splitList(value) {
+		t, n, ok := strings.Cut(item, "=")
+		t = strings.TrimSpace(t)
+		if !ok || t == "" {
+			return nil, fmt.Errorf("%q 应为 类型=字节数", item)
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(n))
+		if err != nil || size <= 0 || size > client.MaxFrameSize {
+			return nil, fmt.Errorf("类型 %s 的字节数 %q 必须是 1 到 %d 之间的整数", t, n, client.MaxFrameSize)
+		}
+		sizes[models.MessageType(t)] = size
+	}
+	return sizes, nil
+}
+
+// splitTypes 将逗号分隔的消息类型列表拆分为 MessageType 切片。
+func splitTypes(value string) []models.MessageType {
+	var types []models.MessageType
+	for _, item := range splitList(value) {
+		types = append(types, models.MessageType(item))
+	}
+	return types
+}
+
+// joinTypes 将消息类型列表拼接为逗号分隔的字符串，是 splitTypes 的逆操作。
+func joinTypes(types []models.MessageType) string {
+	items := make([]string, len(types))
+	for i, t := range types {
+		items[i] = string(t)
+	}
+	return strings.Join(items, ",")
 }
 
 // serveHome 处理根路径 "/" 的 HTTP 请求，通常用于提供 HTML 页面。
@@ -37,23 +205,55 @@ func serveHome(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "方法不被允许", http.StatusMethodNotAllowed)
 		return
 	}
-	homeTemplate.Execute(w, r.Host) // 渲染 HTML 模板
+	// 先渲染到缓冲区，渲染失败时返回 500，而不是带着 200 状态码发出半截页面
+	var buf bytes.Buffer
+	if err := homeTemplate.Execute(&buf, r.Host); err != nil {
+		log.Printf("渲染首页模板失败: %v", err)
+		http.Error(w, "服务器内部错误", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if _, err := buf.WriteTo(w); err != nil {
+		log.Printf("发送首页失败: %v", err)
+	}
+}
+
+// shedRetryAfterSeconds 是负载过高拒绝连接时建议客户端等待的秒数。
+const shedRetryAfterSeconds = 30
+
+// clientConfig 根据命令行参数构造每个连接的客户端配置。
+func clientConfig() client.Config {
+	return client.Config{
+		SendBufferSize:    *sendBuffer,
+		MaxMessageSize:    *maxMessageSize,
+		MaxMessageSizes:   typeSizes,
+		MaxContentRunes:   *maxContentRunes,
+		TruncateContent:   *truncateContent,
+		ErrorLog:          pumpErrorLog,
+		AckTimeout:        *ackTimeout,
+		CoalesceMax:       *coalesceMax,
+		CoalesceDelay:     *coalesceDelay,
+		WriteRetries:      *writeRetries,
+		WriteRetryBackoff: *writeRetryBackoff,
+	}
 }
 
 // serveWs 处理 WebSocket 连接升级请求。
 func serveWs(myHub *hub.Hub, w http.ResponseWriter, r *http.Request) {
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Println(err)
+	// 负载过高时在升级之前拒绝新连接，保护已有用户的聊天体验
+	if *softMaxClients > 0 && myHub.ConnectionCount() >= *softMaxClients {
+		w.Header().Set("Retry-After", strconv.Itoa(shedRetryAfterSeconds))
+		http.Error(w, "服务器繁忙，请稍后再试", http.StatusServiceUnavailable)
+		log.Printf("连接数已达软上限 %d，拒绝来自 %s 的新连接", *softMaxClients, remoteIP(r))
 		return
 	}
 
-	username := r.URL.Query().Get("username")
-	if username == "" {
-		username = "游客"
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return // upgradeError 已经返回了 HTTP 错误并按需记录日志
 	}
 
-	cl := client.NewClient(myHub, conn, username)
+	cl := client.NewClientWithConfig(myHub, conn, connInfo(r), clientConfig())
 	// <--- 关键修正：将客户端实例发送到 Hub 的注册通道
 	myHub.Register(cl) // 调用 Hub 的 Register 方法
 
@@ -61,24 +261,211 @@ func serveWs(myHub *hub.Hub, w http.ResponseWriter, r *http.Request) {
 	// 这解决了循环依赖问题，也确保了只有成功注册的客户端才启动泵。
 }
 
+// connInfo 从 WebSocket 升级请求中读取连接信息：查询参数中的昵称、房间和各项选项，以及客户端的地址和 User-Agent。
+func connInfo(r *http.Request) client.ConnInfo {
+	info := client.ConnInfo{
+		Username:   r.URL.Query().Get("username"), // 为空时由 Hub 在注册时分配唯一的游客名称
+		Room:       r.URL.Query().Get("room"),
+		RemoteAddr: remoteIP(r),
+		UserAgent:  r.UserAgent(),
+		Observer:   r.URL.Query().Get("mode") == "observer", // 只读连接，例如大屏展示
+		NoEcho:     r.URL.Query().Get("echo") == "false",    // 客户端自行渲染自己发送的消息
+		Lang:       r.URL.Query().Get("lang"),               // 服务器提示文案的语言，例如 en
+		Version:    models.ParseProtocolVersion(r.URL.Query().Get("v")),
+		Acks:       r.URL.Query().Get("ack") == "1",      // 客户端会确认收到的聊天消息，未确认的超时重发
+		Coalesce:   r.URL.Query().Get("coalesce") == "1", // 客户端会按换行符拆分一帧中的多条消息
+	}
+	if info.Room == "" {
+		info.Room = *defaultRoom // 未指定房间时进入配置的默认房间
+	}
+	return info
+}
+
 func main() {
 	flag.Parse() // 解析命令行参数
 
-	// --- 初始化数据库存储 ---
-	// 创建 SQLiteMessageStore 实例
-	messageStore, err := store.NewSQLiteMessageStore(*dbPath)
+	// --- 加载首页模板 ---
+	// 模板缺失通常是部署时漏了文件或工作目录不对，只影响首页，不应阻止聊天服务启动
+	if tmpl, err := loadHomeTemplate(*homeFile); err != nil {
+		log.Printf("%v，改用内置的简易首页", err)
+		homeTemplate = fallbackHomeTemplate
+	} else {
+		homeTemplate = tmpl
+	}
+
+	// --- 校验 TLS 配置 ---
+	// 在打开数据库等资源之前加载证书，配置错误时尽早给出明确提示
+	tlsConfig, err := loadTLSConfig(*tlsCert, *tlsKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// --- 加载欢迎语 ---
+	welcomeText := *welcome
+	if *welcomeFile != "" {
+		if welcomeText != "" {
+			log.Fatalf("-welcome 和 -welcome-file 不能同时设置")
+		}
+		data, err := os.ReadFile(*welcomeFile)
+		if err != nil {
+			log.Fatalf("读取欢迎语文件 %s 失败: %v", *welcomeFile, err)
+		}
+		welcomeText = strings.TrimSpace(string(data))
+	}
+
+	// --- 加载机器人配置 ---
+	var botConfig *hub.BotConfig
+	if *botFile != "" {
+		data, err := os.ReadFile(*botFile)
+		if err != nil {
+			log.Fatalf("读取机器人配置文件 %s 失败: %v", *botFile, err)
+		}
+		botConfig = &hub.BotConfig{}
+		if err := json.Unmarshal(data, botConfig); err != nil {
+			log.Fatalf("机器人配置文件 %s 格式错误: %v", *botFile, err)
+		}
+	}
+
+	overflowPolicy, err := hub.ParseOverflowPolicy(*broadcastPolicy)
+	if err != nil {
+		log.Fatalf("-broadcast-policy 无效: %v", err)
+	}
+	roomLimits, err := parseRoomLimits(*roomHistoryLimits)
 	if err != nil {
-		log.Fatalf("创建消息存储失败: %v", err)
+		log.Fatalf("-room-history-limits 格式错误: %v", err)
+	}
+	if *maxMessageSize <= 0 || *maxMessageSize > client.MaxFrameSize {
+		log.Fatalf("-max-message-size 必须在 1 到 %d 之间", client.MaxFrameSize)
+	}
+	if typeSizes, err = parseTypeSizes(*maxMessageSizes); err != nil {
+		log.Fatalf("-max-message-sizes 格式错误: %v", err)
+	}
+	if trustedProxies, err = parseTrustedProxies(*trustedProxiesFlag); err != nil {
+		log.Fatalf("-trusted-proxies 格式错误: %v", err)
+	}
+	roomRates, err := parseRoomLimits(*roomRateLimits)
+	if err != nil {
+		log.Fatalf("-room-rate-limits 格式错误: %v", err)
+	}
+
+	// --- 初始化消息存储 ---
+	// -no-persist 时使用不保存任何内容的存储，不创建也不打开数据库文件
+	var (
+		messageStore store.MessageStore
+		userStore    store.UserStore
+		inboxStore   store.InboxStore
+		banStore     store.BanStore
+		healthCheck  store.HealthChecker
+	)
+	if *noPersist {
+		messageStore = store.NullMessageStore{}
+		log.Println("已禁用消息持久化，不会保存任何聊天记录。")
+	} else {
+		// 创建 SQLiteMessageStore 实例
+		sqliteStore, err := store.NewSQLiteMessageStoreWithConfig(*dbPath, store.Config{
+			PersistTypes: splitTypes(*persistTypes),
+			JournalMode:  *sqliteJournalMode,
+			Synchronous:  *sqliteSynchronous,
+			BusyTimeout:  *sqliteBusyTimeout,
+			Retries:      *sqliteRetries,
+			RetryBackoff: *sqliteRetryBackoff,
+			DefaultRoom:  *defaultRoom,
+		})
+		if err != nil {
+			log.Fatalf("创建消息存储失败: %v", err)
+		}
+		defer sqliteStore.Close() // 确保在程序退出时关闭数据库连接
+
+		// 初始化数据库表
+		if err := sqliteStore.Init(); err != nil {
+			log.Fatalf("初始化消息存储失败: %v", err)
+		}
+		// SQLite 存储同时实现了 UserStore、InboxStore、BanStore 和 HealthChecker
+		messageStore, userStore, inboxStore, banStore, healthCheck = sqliteStore, sqliteStore, sqliteStore, sqliteStore, sqliteStore
+
+		if *compactInterval > 0 {
+			stopCompaction := make(chan struct{})
+			defer close(stopCompaction) // 先于 sqliteStore.Close 执行
+			go sqliteStore.RunCompaction(*compactInterval, stopCompaction)
+		}
+
+		if *retention > 0 {
+			// 接口值只在配置了归档时赋值，避免传入包着 nil 指针的非 nil 接口
+			var archiver store.Archiver
+			if *archiveEndpoint != "" {
+				s3, err := archive.New(*archiveEndpoint, *archiveBucket, *archiveRegion, *archivePrefix,
+					os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"))
+				if err != nil {
+					log.Fatalf("配置消息归档失败: %v", err)
+				}
+				archiver = s3
+			}
+			stopRetention := make(chan struct{})
+			defer close(stopRetention) // 先于 sqliteStore.Close 执行
+			go sqliteStore.RunRetention(*retention, *retentionInterval, archiver, stopRetention)
+		} else if *archiveEndpoint != "" {
+			log.Printf("未设置 -retention，不会删除消息，-archive-endpoint 不起作用")
+		}
 	}
-	defer messageStore.Close() // 确保在程序退出时关闭数据库连接
 
-	// 初始化数据库表
-	if err := messageStore.Init(); err != nil {
-		log.Fatalf("初始化消息存储失败: %v", err)
+	// --- 初始化审计日志 ---
+	// 接口值只在真正打开文件时赋值，避免 Hub 拿到包着 nil 指针的非 nil 接口
+	var auditor hub.Auditor
+	if *auditLog != "" {
+		auditLogger, err := audit.Open(*auditLog)
+		if err != nil {
+			log.Fatalf("打开审计日志失败: %v", err)
+		}
+		defer auditLogger.Close() // 在 Hub 停止后执行，此时不会再有写入
+		auditor = auditLogger
+
+		reopen := make(chan os.Signal, 1)
+		signal.Notify(reopen, syscall.SIGHUP)
+		go func() {
+			for range reopen {
+				if err := auditLogger.Reopen(); err != nil {
+					log.Printf("重新打开审计日志失败，将在下次写入时重试: %v", err)
+				} else {
+					log.Printf("已重新打开审计日志 %s", *auditLog)
+				}
+			}
+		}()
+		log.Printf("审计日志写入 %s", *auditLog)
 	}
 
 	// 创建聊天室的 Hub 实例，并将消息存储传递给它
-	myHub := hub.NewHub(messageStore)
+	// 所有客户端共享同一个错误日志记录器，才能合并大量连接同时产生的相同错误
+	pumpErrorLog = ratelog.New(*logSuppressWindow)
+
+	myHub := hub.NewHubWithConfig(messageStore, hub.Config{
+		UserStore:              userStore,
+		InboxStore:             inboxStore,
+		BanStore:               banStore,
+		AllowMultiDevice:       *multiDevice,
+		GlobalNicknames:        *globalNicks,
+		ReconnectLimit:         *reconnectLimit,
+		ReconnectWindow:        *reconnectWindow,
+		MaxClients:             *maxClients,
+		MaxRooms:               *maxRooms,
+		AwayAfter:              *awayAfter,
+		IdleTimeout:            *idleTimeout,
+		AllowUserPins:          *userPins,
+		Welcome:                welcomeText,
+		Bot:                    botConfig,
+		DeliveryStatusInterval: *deliveryStatusInterval,
+		HistoryLimit:           *historyLimit,
+		RoomHistoryLimits:      roomLimits,
+		HistoryChunkSize:       *historyChunkSize,
+		ClearHistoryGlobal:     *clearHistoryGlobal,
+		RoomRateLimit:          *roomRateLimit,
+		RoomRateLimits:         roomRates,
+		RoomRateWindow:         *roomRateWindow,
+		HistoryCacheSize:       *historyCache,
+		BroadcastBuffer:        *broadcastBuffer,
+		OverflowPolicy:         overflowPolicy,
+		FanoutWorkers:          *fanoutWorkers,
+		Auditor:                auditor,
+	})
 	go myHub.Run() // 启动 Hub 的主循环协程，处理注册、注销和广播消息
 
 	// 注册 HTTP 路由处理器
@@ -86,6 +473,47 @@ func main() {
 	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
 		serveWs(myHub, w, r) // 将 Hub 实例传递给 WebSocket 处理器
 	})
+	http.HandleFunc("/stats", withCORS(withGzip(func(w http.ResponseWriter, r *http.Request) {
+		serveStats(messageStore, w, r)
+	})))
+	http.HandleFunc("/history", withCORS(withGzip(func(w http.ResponseWriter, r *http.Request) {
+		serveHistory(messageStore, w, r)
+	})))
+	http.HandleFunc("/history/user", withCORS(withGzip(func(w http.ResponseWriter, r *http.Request) {
+		serveUserHistory(messageStore, w, r)
+	})))
+	http.HandleFunc("/user/rooms", withCORS(withGzip(func(w http.ResponseWriter, r *http.Request) {
+		serveUserRooms(messageStore, w, r)
+	})))
+	http.HandleFunc("/healthz", serveHealthz)
+	http.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		serveReadyz(myHub, healthCheck, w, r)
+	})
+	http.HandleFunc("/online", withCORS(withGzip(func(w http.ResponseWriter, r *http.Request) {
+		serveOnline(myHub, w, r)
+	})))
+	http.HandleFunc("/rooms", withCORS(withGzip(func(w http.ResponseWriter, r *http.Request) {
+		serveRooms(myHub, w, r)
+	})))
+	http.HandleFunc("/api/announce", withCORS(func(w http.ResponseWriter, r *http.Request) {
+		serveAnnounce(myHub, w, r)
+	}))
+	http.HandleFunc("/api/pin", withCORS(func(w http.ResponseWriter, r *http.Request) {
+		servePin(myHub, w, r)
+	}))
+	http.HandleFunc("/api/kick-all", withCORS(func(w http.ResponseWriter, r *http.Request) {
+		serveKickAll(myHub, w, r)
+	}))
+	http.HandleFunc("/api/export", withCORS(withGzip(func(w http.ResponseWriter, r *http.Request) {
+		serveExport(messageStore, w, r)
+	})))
+	http.HandleFunc("/api/bans", withCORS(func(w http.ResponseWriter, r *http.Request) {
+		serveBans(myHub, w, r)
+	}))
+	http.HandleFunc("/api/unban", withCORS(func(w http.ResponseWriter, r *http.Request) {
+		serveUnban(myHub, w, r)
+	}))
+	registerDebug(http.DefaultServeMux, myHub)
 
 	// --- 优雅关闭服务器 ---
 	// 创建一个通道用于接收操作系统信号
@@ -94,19 +522,74 @@ func main() {
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 
 	// 在一个单独的协程中启动 HTTP 服务器
+	srv := &http.Server{Addr: *addr, TLSConfig: tlsConfig}
 	go func() {
-		if err := http.ListenAndServe(*addr, nil); err != nil && err != http.ErrServerClosed {
+		var err error
+		if tlsConfig != nil {
+			err = srv.ListenAndServeTLS("", "") // 证书已在 TLSConfig 中加载
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			log.Fatalf("ListenAndServe 失败: %v", err)
 		}
 	}()
-	log.Printf("服务器已在 %s 启动", *addr)
+	if tlsConfig != nil {
+		log.Printf("服务器已在 %s 启动 (TLS)", *addr)
+	} else {
+		log.Printf("服务器已在 %s 启动", *addr)
+	}
 
 	<-quit // 阻塞主协程，直到接收到终止信号
 	log.Println("收到终止信号，正在关闭服务器...")
-	// 在这里可以添加清理资源的代码，例如关闭所有 WebSocket 连接。
-	// 对于这个简单的应用，defer messageStore.Close() 已经处理了数据库关闭。
+	// 先停止接受新的 HTTP 请求和 WebSocket 升级，再让 Hub 排空已有连接的发送队列
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("关闭 HTTP 服务器失败: %v", err)
+	}
+	cancel()
+	myHub.Shutdown(*shutdownTimeout) // 停止 Hub 主循环，之后客户端的注销调用不会再阻塞
+	// defer sqliteStore.Close() 会在返回时关闭数据库连接。
 	log.Println("服务器已优雅关闭。")
 }
 
-// home.html 模板（与 main.go 在同一目录或调整路径）
-var homeTemplate = template.Must(template.ParseFiles("home.html"))
+// homeTemplate 是首页模板，在 main 中由 loadHomeTemplate 加载；加载失败时使用 fallbackHomeTemplate。
+var homeTemplate *template.Template
+
+// fallbackHomeTemplate 是找不到首页模板文件时使用的内置简易页面，
+// 页面本身只提示部署问题，WebSocket 服务和各接口照常可用。
+var fallbackHomeTemplate = template.Must(template.New("fallback").Parse(`<!DOCTYPE html>
+<html lang="zh">
+<head><meta charset="utf-8"><title>聊天室</title></head>
+<body>
+<h1>聊天室</h1>
+<p>服务器没有找到首页模板文件，无法显示聊天界面，请检查部署。</p>
+<p>WebSocket 服务仍然可用：ws://{{.}}/ws?username=昵称</p>
+</body>
+</html>
+`))
+
+// loadTLSConfig 加载证书和私钥。两者都未设置时返回 nil（不启用 TLS），
+// 只设置了其中一个或证书与私钥无法加载、不匹配时返回带有文件路径的错误。
+func loadTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("启用 TLS 需要同时设置 -tls-cert 和 -tls-key")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("加载 TLS 证书失败 (证书: %s, 私钥: %s): %w", certFile, keyFile, err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+// loadHomeTemplate 解析 path 处的首页模板，失败时返回带有文件路径的错误。
+func loadHomeTemplate(path string) (*template.Template, error) {
+	tmpl, err := template.ParseFiles(path)
+	if err != nil {
+		return nil, fmt.Errorf("加载首页模板 %s 失败: %w", path, err)
+	}
+	return tmpl, nil
+}
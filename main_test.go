@@ -0,0 +1,440 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"io"
+	"io/fs"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+
+	"chatroom/client"
+	"chatroom/hub"
+	"chatroom/models"
+	"github.com/gorilla/websocket"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// setFlag 在测试期间修改命令行参数的值，测试结束后恢复原值。
+func setFlag(t *testing.T, name, value string) {
+	t.Helper()
+	f := flag.Lookup(name)
+	if f == nil {
+		t.Fatalf("没有参数 -%s", name)
+	}
+	old := f.Value.String()
+	if err := flag.Set(name, value); err != nil {
+		t.Fatalf("设置 -%s=%s 失败: %v", name, value, err)
+	}
+	t.Cleanup(func() { flag.Set(name, old) })
+}
+
+func TestConnInfoFromRequest(t *testing.T) {
+	r := httptest.NewRequest("GET", "/ws?username=alice&room=dev&lang=en&mode=observer&echo=false&v=1&ack=1&coalesce=1", nil)
+	r.RemoteAddr = "203.0.113.7:51234"
+	r.Header.Set("User-Agent", "test-agent/1.0")
+
+	info := connInfo(r)
+	if info.Username != "alice" || info.Room != "dev" || info.Lang != "en" {
+		t.Errorf("昵称、房间或语言没有从查询参数读取: %+v", info)
+	}
+	if info.RemoteAddr != "203.0.113.7" {
+		t.Errorf("RemoteAddr = %q，期望去掉端口的 203.0.113.7", info.RemoteAddr)
+	}
+	if info.UserAgent != "test-agent/1.0" {
+		t.Errorf("UserAgent = %q，期望 test-agent/1.0", info.UserAgent)
+	}
+	if !info.Observer || !info.NoEcho || !info.Acks || !info.Coalesce || info.Version != 1 {
+		t.Errorf("连接选项没有从查询参数读取: %+v", info)
+	}
+}
+
+func TestConnInfoDefaults(t *testing.T) {
+	setFlag(t, "default-room", "lobby")
+	r := httptest.NewRequest("GET", "/ws", nil)
+
+	info := connInfo(r)
+	if info.Room != "lobby" {
+		t.Errorf("未指定房间时应进入 -default-room，实际 %q", info.Room)
+	}
+	if info.Username != "" || info.Observer || info.NoEcho || info.Acks || info.Coalesce {
+		t.Errorf("未指定的选项应为零值: %+v", info)
+	}
+	if info.Version != models.ParseProtocolVersion("") {
+		t.Errorf("未声明协议版本时 Version = %d", info.Version)
+	}
+}
+
+func TestSendBufferFlag(t *testing.T) {
+	if got := clientConfig().SendBufferSize; got != client.DefaultSendBufferSize {
+		t.Errorf("默认的 -send-buffer = %d，期望 client.DefaultSendBufferSize", got)
+	}
+	setFlag(t, "send-buffer", "32")
+	if got := clientConfig().SendBufferSize; got != 32 {
+		t.Errorf("-send-buffer=32 时 SendBufferSize = %d", got)
+	}
+}
+
+func TestSoftMaxClientsShedsNewConnections(t *testing.T) {
+	setFlag(t, "soft-max-clients", "2")
+	h := startHub(t, hub.Config{})
+	srv := startServer(t, h, nil)
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws?username="
+
+	dial(t, srv, "username=alice")
+	eventually(t, " alice 上线", func() bool { return h.ConnectionCount() == 1 })
+	bob := dial(t, srv, "username=bob") // 第 2 个连接仍在软上限之内
+	eventually(t, " bob 上线", func() bool { return h.ConnectionCount() == 2 })
+
+	_, resp, err := websocket.DefaultDialer.Dial(url+"carol", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("达到软上限后的连接应返回 503，实际 %v %v", resp, err)
+	}
+	if got := resp.Header.Get("Retry-After"); got != strconv.Itoa(shedRetryAfterSeconds) {
+		t.Fatalf("Retry-After = %q", got)
+	}
+	if got := h.ConnectionCount(); got != 2 {
+		t.Fatalf("已有连接不应受影响，连接数 = %d", got)
+	}
+
+	// 连接数回到软上限以下后重新接受新连接
+	bob.Close()
+	eventually(t, " bob 离开", func() bool { return h.ConnectionCount() == 1 })
+	dial(t, srv, "username=carol")
+	eventually(t, " carol 上线", func() bool { return h.ConnectionCount() == 2 })
+}
+
+// expectClose 读取连接上的消息直到关闭，断言关闭码为 code。
+func expectClose(t *testing.T, conn *websocket.Conn, code int) {
+	t.Helper()
+	if _, err := readUntilClose(t, conn); !websocket.IsCloseError(err, code) {
+		t.Fatalf("连接应以 %d 关闭，实际 %v", code, err)
+	}
+}
+
+func TestCloseCodes(t *testing.T) {
+	h := startHub(t, hub.Config{})
+	srv := startServer(t, h, nil)
+
+	t.Run("昵称已被占用", func(t *testing.T) {
+		dial(t, srv, "username=alice")
+		eventually(t, " alice 上线", func() bool { return h.ConnectionCount() == 1 })
+		expectClose(t, dial(t, srv, "username=Alice"), models.CloseNickTaken)
+	})
+
+	t.Run("协议版本不受支持", func(t *testing.T) {
+		expectClose(t, dial(t, srv, "username=bob&v=99"), models.CloseUnsupportedVersion)
+	})
+
+	t.Run("服务器关闭", func(t *testing.T) {
+		carol := dial(t, srv, "username=carol")
+		eventually(t, " carol 上线", func() bool { return slices.Contains(h.OnlineUsers(), "carol") })
+		h.Shutdown(time.Second)
+		expectClose(t, carol, websocket.CloseGoingAway)
+	})
+}
+
+func TestIdleTimeoutClosesConnection(t *testing.T) {
+	h := startHub(t, hub.Config{IdleTimeout: 100 * time.Millisecond})
+	srv := startServer(t, h, nil)
+	expectClose(t, dial(t, srv, "username=alice"), models.CloseIdleTimeout)
+}
+
+func TestShutdownDrainsQueuedMessages(t *testing.T) {
+	h := startHub(t, hub.Config{})
+	srv := startServer(t, h, nil)
+	alice := dial(t, srv, "username=alice")
+	eventually(t, " alice 上线", func() bool { return h.ConnectionCount() == 1 })
+
+	// 公告在 Announce 返回时已经进入 alice 的发送队列，随后立即关机
+	const queued = 200
+	padding := strings.Repeat("x", 4096)
+	for i := 0; i < queued; i++ {
+		h.Announce(strconv.Itoa(i) + padding)
+	}
+	h.Shutdown(2 * time.Second)
+
+	msgs, err := readUntilClose(t, alice)
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatalf("连接应以 1001 关闭，实际 %v", err)
+	}
+	var got int
+	for _, msg := range msgs {
+		if msg.Type == models.TypeAnnouncement {
+			if want := strconv.Itoa(got) + padding; msg.Content != want {
+				t.Fatalf("第 %d 条公告内容不对或乱序", got)
+			}
+			got++
+		}
+	}
+	if got != queued {
+		t.Fatalf("关闭前只收到 %d 条公告，期望排队的 %d 条全部送达", got, queued)
+	}
+}
+
+func TestNullStoreKeepsNoHistory(t *testing.T) {
+	// 在空的临时目录中运行，结束时检查没有创建任何文件
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	h := startHub(t, hub.Config{HistoryCacheSize: 10}) // 使用 NullMessageStore
+	srv := startServer(t, h, nil)
+	alice := dial(t, srv, "username=alice")
+	eventually(t, " alice 上线", func() bool { return h.ConnectionCount() == 1 })
+	for _, content := range []string{"one", "two"} {
+		if err := alice.WriteJSON(models.Message{Type: models.TypeChat, Content: content}); err != nil {
+			t.Fatalf("发送消息失败: %v", err)
+		}
+	}
+	// 等 alice 收到自己第二条消息的回显，确认两条消息都已在 bob 加入前处理完
+	alice.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		var msg models.Message
+		if err := alice.ReadJSON(&msg); err != nil {
+			t.Fatalf("等待回显失败: %v", err)
+		}
+		if msg.Type == models.TypeChat && msg.Content == "two" {
+			break
+		}
+	}
+
+	bob := dial(t, srv, "username=bob")
+	eventually(t, " bob 上线", func() bool { return h.ConnectionCount() == 2 })
+	h.Shutdown(time.Second)
+	msgs, _ := readUntilClose(t, bob)
+	for _, msg := range msgs {
+		if msg.Type == models.TypeHistory || msg.Type == models.TypeChat {
+			t.Fatalf("不保存消息时 bob 不应收到历史，实际收到 %+v", msg)
+		}
+	}
+	if entries, err := os.ReadDir(dir); err != nil || len(entries) != 0 {
+		t.Fatalf("不应写入任何文件，目录中有 %v (%v)", entries, err)
+	}
+}
+
+func TestUpgradeFailuresExplainTheError(t *testing.T) {
+	setFlag(t, "allowed-origins", "https://chat.example.com")
+	h := startHub(t, hub.Config{})
+	srv := startServer(t, h, nil)
+
+	upgrade := http.Header{
+		"Connection":            {"Upgrade"},
+		"Upgrade":               {"websocket"},
+		"Sec-Websocket-Version": {"13"},
+		"Sec-Websocket-Key":     {"dGhlIHNhbXBsZSBub25jZQ=="},
+	}
+	tests := []struct {
+		name   string
+		header http.Header
+		status int
+		want   string
+	}{
+		{"普通的 GET 请求", nil, http.StatusUpgradeRequired, "WebSocket 接口"},
+		{"不支持的版本", http.Header{"Sec-Websocket-Version": {"8"}}, http.StatusBadRequest, "握手请求无效"},
+		{"来源不在允许列表中", http.Header{"Origin": {"https://evil.example.com"}}, http.StatusForbidden, "不在允许列表中"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, srv.URL+"/ws?username=alice", nil)
+			if tt.header != nil {
+				for k, v := range upgrade {
+					req.Header[k] = v
+				}
+				for k, v := range tt.header {
+					req.Header[k] = v
+				}
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("请求失败: %v", err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tt.status || !strings.Contains(string(body), tt.want) {
+				t.Fatalf("返回 %d %q，期望 %d 并包含 %q", resp.StatusCode, body, tt.status, tt.want)
+			}
+		})
+	}
+	if h.ConnectionCount() != 0 {
+		t.Fatalf("升级失败的请求不应注册到 Hub")
+	}
+}
+
+func TestProtocolVersionHandshake(t *testing.T) {
+	h := startHub(t, hub.Config{})
+	srv := startServer(t, h, nil)
+
+	for _, query := range []string{"username=alice&v=" + strconv.Itoa(models.ProtocolVersion), "username=bob"} {
+		conn := dial(t, srv, query)
+		var msg models.Message
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if err := conn.ReadJSON(&msg); err != nil || msg.Type == models.TypeError {
+			t.Fatalf("%s 应被接受，实际收到 %+v (%v)", query, msg, err)
+		}
+	}
+
+	for _, v := range []string{strconv.Itoa(models.ProtocolVersion + 1), "abc"} {
+		// 被拒绝的连接不会启动读写协程，错误码通过关闭帧的原因告知客户端
+		_, err := readUntilClose(t, dial(t, srv, "username=carol&v="+v))
+		var closeErr *websocket.CloseError
+		if !errors.As(err, &closeErr) || closeErr.Code != models.CloseUnsupportedVersion || closeErr.Text != models.ErrCodeUnsupportedVersion {
+			t.Fatalf("v=%s 应以 %d %s 关闭，实际 %v", v, models.CloseUnsupportedVersion, models.ErrCodeUnsupportedVersion, err)
+		}
+	}
+	if users := h.OnlineUsers(); !slices.Equal(users, []string{"alice", "bob"}) {
+		t.Fatalf("在线用户 = %v，不支持的版本不应注册", users)
+	}
+}
+
+// useHomeTemplate 在测试期间替换首页模板。
+func useHomeTemplate(t *testing.T, text string) {
+	t.Helper()
+	old := homeTemplate
+	homeTemplate = template.Must(template.New("home").Parse(text))
+	t.Cleanup(func() { homeTemplate = old })
+}
+
+func TestServeHomeTemplateError(t *testing.T) {
+	// 出错之前已经渲染了一段内容，不应以 200 发出这半截页面
+	useHomeTemplate(t, `<html><body>已经渲染的部分 {{.NoSuchField}}</body></html>`)
+	rec := get(serveHome, "/")
+	if rec.Code != http.StatusInternalServerError || strings.Contains(rec.Body.String(), "已经渲染的部分") {
+		t.Fatalf("模板出错时返回 %d %q，期望不含半截页面的 500", rec.Code, rec.Body)
+	}
+
+	useHomeTemplate(t, `<html><body>ws://{{.}}/ws</body></html>`)
+	rec = get(serveHome, "http://chat.example.com/")
+	if rec.Code != http.StatusOK || rec.Body.String() != "<html><body>ws://chat.example.com/ws</body></html>" {
+		t.Fatalf("正常渲染返回 %d %q", rec.Code, rec.Body)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+}
+
+func TestLoadHomeTemplate(t *testing.T) {
+	dir := t.TempDir()
+
+	missing := filepath.Join(dir, "missing.html")
+	if _, err := loadHomeTemplate(missing); err == nil || !errors.Is(err, fs.ErrNotExist) || !strings.Contains(err.Error(), missing) {
+		t.Fatalf("缺少文件时的错误 = %v，应说明找不到 %s", err, missing)
+	}
+
+	broken := filepath.Join(dir, "broken.html")
+	if err := os.WriteFile(broken, []byte(`<p>{{.</p>`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadHomeTemplate(broken); err == nil || !strings.Contains(err.Error(), broken) {
+		t.Fatalf("模板语法错误时的错误 = %v，应带有文件路径", err)
+	}
+
+	// 仓库自带的首页模板可以正常加载
+	if _, err := loadHomeTemplate("home.html"); err != nil {
+		t.Fatalf("加载 home.html 失败: %v", err)
+	}
+}
+
+func TestFallbackHomePage(t *testing.T) {
+	old := homeTemplate
+	homeTemplate = fallbackHomeTemplate
+	t.Cleanup(func() { homeTemplate = old })
+
+	rec := get(serveHome, "http://chat.example.com/")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "ws://chat.example.com/ws") {
+		t.Fatalf("内置首页返回 %d %q，应提示 WebSocket 地址", rec.Code, rec.Body)
+	}
+}
+
+// writeKeyPair 在 dir 中生成一对自签名证书和私钥文件，返回它们的路径。
+func writeKeyPair(t *testing.T, dir, name string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("生成私钥失败: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("生成证书失败: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("编码私钥失败: %v", err)
+	}
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestLoadTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	certA, keyA := writeKeyPair(t, dir, "a")
+	certB, keyB := writeKeyPair(t, dir, "b")
+
+	if cfg, err := loadTLSConfig("", ""); cfg != nil || err != nil {
+		t.Fatalf("未设置证书时应不启用 TLS，实际 %v, %v", cfg, err)
+	}
+	if cfg, err := loadTLSConfig(certA, keyA); err != nil || cfg == nil || len(cfg.Certificates) != 1 {
+		t.Fatalf("加载匹配的证书和私钥失败: %v", err)
+	}
+
+	for _, tc := range []struct {
+		name, cert, key string
+		want            []string // 错误信息应包含的片段
+	}{
+		{"只设置证书", certA, "", []string{"-tls-cert", "-tls-key"}},
+		{"只设置私钥", "", keyA, []string{"-tls-cert", "-tls-key"}},
+		{"证书与私钥不匹配", certA, keyB, []string{certA, keyB}},
+		{"私钥文件不存在", certB, filepath.Join(dir, "missing.key"), []string{certB, "missing.key"}},
+		{"证书不是 PEM", keyA, keyA, []string{keyA}},
+	} {
+		cfg, err := loadTLSConfig(tc.cert, tc.key)
+		if err == nil || cfg != nil {
+			t.Errorf("%s: 应返回错误，实际 %v, %v", tc.name, cfg, err)
+			continue
+		}
+		for _, want := range tc.want {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("%s: 错误 %q 应包含 %q", tc.name, err, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"compress/gzip"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// originAllowed 判断请求的 Origin 是否被允许。
+// 没有 Origin 头（非浏览器客户端）或同源请求总是允许；
+// 未配置 -allowed-origins 时允许所有来源（方便开发），列表中的 "*" 也表示允许所有来源。
+func originAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && u.Host == r.Host {
+		return true
+	}
+	origins := splitList(*allowedOrigins)
+	if len(origins) == 0 {
+		return true
+	}
+	for _, allowed := range origins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// withCORS 为数据接口添加 CORS 响应头，并处理 OPTIONS 预检请求。
+// 只用于 REST 接口，WebSocket 升级由 upgrader.CheckOrigin 校验来源。
+func withCORS(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
+		origin := r.Header.Get("Origin")
+		if origin != "" && originAllowed(r) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+
+		// 预检请求直接返回，不进入实际处理器
+		if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+			if origin == "" || !originAllowed(r) {
+				http.Error(w, "来源不被允许", http.StatusForbidden)
+				return
+			}
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// acceptsGzip 报告请求的 Accept-Encoding 是否接受 gzip（忽略 q=0 的声明）。
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if strings.TrimSpace(coding) != "gzip" {
+			continue
+		}
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if q, err := strconv.ParseFloat(value, 64); err == nil && q == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// gzipResponseWriter 将响应体写入 gzip 压缩流。
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz *gzip.Writer
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	return w.gz.Write(b)
+}
+
+// withGzip 在客户端声明接受 gzip 时压缩响应体，减少历史、在线列表等大响应的流量。
+// 只用于 REST 数据接口，不能用于 WebSocket 升级（压缩包装会破坏连接劫持）。
+func withGzip(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) {
+			next(w, r)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Del("Content-Length") // 压缩后的长度与原始长度不同
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		next(&gzipResponseWriter{ResponseWriter: w, gz: gz}, r)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORS(t *testing.T) {
+	setFlag(t, "allowed-origins", "https://app.example")
+	var called int
+	handler := withCORS(func(w http.ResponseWriter, r *http.Request) {
+		called++
+		w.Write([]byte("data"))
+	})
+	request := func(method, origin string, preflight bool) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "http://chat.example/history", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		if preflight {
+			r.Header.Set("Access-Control-Request-Method", "GET")
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, r)
+		return rec
+	}
+
+	t.Run("允许的来源预检", func(t *testing.T) {
+		called = 0
+		rec := request(http.MethodOptions, "https://app.example", true)
+		if rec.Code != http.StatusNoContent || called != 0 {
+			t.Fatalf("预检返回 %d、调用处理器 %d 次，期望 204 且不调用", rec.Code, called)
+		}
+		if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "https://app.example" {
+			t.Fatalf("Access-Control-Allow-Origin = %q", got)
+		}
+		if rec.Header().Get("Access-Control-Allow-Methods") == "" || rec.Header().Get("Access-Control-Allow-Headers") == "" {
+			t.Fatalf("预检响应缺少允许的方法或头: %v", rec.Header())
+		}
+	})
+
+	t.Run("不允许的来源预检", func(t *testing.T) {
+		called = 0
+		rec := request(http.MethodOptions, "https://evil.example", true)
+		if rec.Code != http.StatusForbidden || called != 0 {
+			t.Fatalf("预检返回 %d、调用处理器 %d 次，期望 403 且不调用", rec.Code, called)
+		}
+		if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "" {
+			t.Fatalf("不允许的来源不应得到 Access-Control-Allow-Origin，实际 %q", got)
+		}
+	})
+
+	t.Run("允许的来源实际请求", func(t *testing.T) {
+		called = 0
+		rec := request(http.MethodGet, "https://app.example", false)
+		if rec.Code != http.StatusOK || called != 1 || rec.Body.String() != "data" {
+			t.Fatalf("实际请求返回 %d %q、调用处理器 %d 次", rec.Code, rec.Body, called)
+		}
+		if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "https://app.example" {
+			t.Fatalf("Access-Control-Allow-Origin = %q", got)
+		}
+		if got := rec.Header().Get("Vary"); got != "Origin" {
+			t.Fatalf("Vary = %q，期望 Origin", got)
+		}
+	})
+
+	t.Run("不允许的来源实际请求", func(t *testing.T) {
+		// 由浏览器拒绝读取响应，服务器照常处理但不返回允许头
+		rec := request(http.MethodGet, "https://evil.example", false)
+		if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "" {
+			t.Fatalf("不允许的来源不应得到 Access-Control-Allow-Origin，实际 %q", got)
+		}
+	})
+
+	t.Run("同源和非浏览器请求", func(t *testing.T) {
+		for _, origin := range []string{"", "http://chat.example"} {
+			if rec := request(http.MethodGet, origin, false); rec.Code != http.StatusOK {
+				t.Fatalf("来源 %q 的请求返回 %d", origin, rec.Code)
+			}
+		}
+	})
+}
+
+func TestGzip(t *testing.T) {
+	const payload = `{"users":["alice","bob"]}`
+	handler := withGzip(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(payload))
+	})
+	request := func(acceptEncoding string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/online", nil)
+		if acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, r)
+		return rec
+	}
+
+	rec := request("br, gzip")
+	if got := rec.Header().Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("Content-Encoding = %q，期望 gzip", got)
+	}
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatalf("响应不是合法的 gzip: %v", err)
+	}
+	body, err := io.ReadAll(zr)
+	if err != nil || string(body) != payload {
+		t.Fatalf("解压后的响应 = %q (%v)，期望 %q", body, err, payload)
+	}
+
+	for _, accept := range []string{"", "gzip;q=0"} {
+		rec := request(accept)
+		if got := rec.Header().Get("Content-Encoding"); got != "" {
+			t.Fatalf("Accept-Encoding %q 时不应压缩，Content-Encoding = %q", accept, got)
+		}
+		if rec.Body.String() != payload {
+			t.Fatalf("Accept-Encoding %q 时响应 = %q", accept, rec.Body)
+		}
+		if got := rec.Header().Get("Vary"); got != "Accept-Encoding" {
+			t.Fatalf("Vary = %q，期望 Accept-Encoding", got)
+		}
+	}
+}
@@ -0,0 +1,16 @@
+package models
+
+// WebSocket 关闭码。服务器主动断开连接时在关闭帧中携带这些代码，关闭原因为对应的错误码（如 "NICK_TAKEN"），
+// 客户端据此区分可以自动重连的情况（例如服务器重启）和不应重连的永久拒绝（例如昵称被占用）。
+// 4000-4999 是 WebSocket 协议留给应用自定义的范围。
+const (
+	CloseGoingAway          = 1001 // 服务器正在关闭，稍后可以重连
+	CloseTryAgain           = 1013 // 服务器暂时过载（连接数已满），稍后可以重连
+	CloseNickTaken          = 4001 // 昵称已被占用，换一个昵称才能重连
+	CloseTooManyRooms       = 4002 // 活跃房间数已达上限，加入已有房间才能重连
+	CloseKicked             = 4003 // 被管理员断开
+	CloseIdleTimeout        = 4004 // 长时间没有任何活动，可以重连
+	CloseThrottled          = 4005 // 短时间内连接次数过多，等待一段时间后才能重连
+	CloseUnsupportedVersion = 4006 // 客户端声明的协议版本不受支持，升级客户端才能重连
+	CloseBanned             = 4007 // 用户名被管理员封禁，封禁解除或到期前不应重连
+)
@@ -0,0 +1,25 @@
+package models
+
+// 错误码随 "error" 消息（以及携带 Error 的 history 消息）一起发送，
+// 供客户端按类型处理错误；Error 字段中的文字只用于展示，可能随版本调整。
+// 已发布的错误码保持稳定，不会改变含义。
+const (
+	ErrCodeNickTaken          = "NICK_TAKEN"          // 昵称已被占用，连接会被关闭
+	ErrCodeServerFull         = "SERVER_FULL"         // 服务器连接数已达上限，连接会被关闭
+	ErrCodeTooManyRooms       = "TOO_MANY_ROOMS"      // 活跃房间数已达上限，无法创建新房间，连接会被关闭
+	ErrCodeMsgTooLong         = "MSG_TOO_LONG"        // 消息或消息内容超过长度限制
+	ErrCodeBadFormat          = "BAD_FORMAT"          // 消息不是合法的 JSON
+	ErrCodeInvalidMessage     = "INVALID_MESSAGE"     // 消息字段组合不合法（Validate 失败）
+	ErrCodeInvalidTarget      = "INVALID_TARGET"      // 操作的目标用户不合法，例如屏蔽自己
+	ErrCodeReplyNotFound      = "REPLY_NOT_FOUND"     // 被回复的消息不存在或不在同一房间
+	ErrCodeMessageNotFound    = "MESSAGE_NOT_FOUND"   // 操作（例如置顶）引用的消息不存在或不在同一房间
+	ErrCodeForbidden          = "FORBIDDEN"           // 没有执行该操作的权限
+	ErrCodeHistoryUnavailable = "HISTORY_UNAVAILABLE" // 历史消息加载失败，实时聊天不受影响
+	ErrCodeThrottled          = "THROTTLED"           // 同一来源短时间内连接次数过多，连接会被关闭
+	ErrCodeUnsupportedVersion = "UNSUPPORTED_VERSION" // 客户端声明的协议版本（?v=）不受支持，连接会被关闭
+	ErrCodeUserOffline        = "USER_OFFLINE"        // 私信的收件人不在线，且服务器无法为其保存离线私信（未开启持久化或从未见过该用户）
+	ErrCodeInboxFull          = "INBOX_FULL"          // 私信的收件人不在线，且待投递的离线私信已达上限
+	ErrCodeBanned             = "BANNED"              // 用户名被管理员封禁，连接会被关闭
+	ErrCodeClearFailed        = "CLEAR_FAILED"        // 删除自己的历史消息失败，可以稍后重试
+	ErrCodeRoomRateLimited    = "ROOM_RATE_LIMITED"   // 房间内所有人合计发送的消息过多，这条消息被丢弃
+)
@@ -1,13 +1,239 @@
 package models
 
-import "time"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// DefaultRoom 是未指定房间时使用的房间名。
+const DefaultRoom = "general"
 
 type Message struct {
-	Type      string    `json:"type"` // 例如 "chat", "join", "leave"
-	Username  string    `json:"username"`
-	Content   string    `json:"content"`
-	Timestamp time.Time `json:"timestamp"`
+	ID        int64       `json:"id,omitempty"` // 持久化后由存储层分配的消息 ID
+	Type      MessageType `json:"type"`         // 消息类型，见 TypeChat 等常量
+	Username  string      `json:"username"`
+	Room      string      `json:"room,omitempty"` // 消息所属的房间
+	Content   string      `json:"content"`
+	Timestamp time.Time   `json:"timestamp"`
+
+	Users     []string          `json:"users,omitempty"`
+	Away      []string          `json:"away,omitempty"`     // user_list 消息中处于离开状态的用户，是 Users 的子集
+	Statuses  map[string]string `json:"statuses,omitempty"` // user_list 消息中设置了自定义状态的用户及其状态文字
+	Error     string            `json:"error,omitempty"`
+	ErrorCode string            `json:"error_code,omitempty"` // 稳定的错误码（ErrCode* 常量），与 Error 一起出现
+	LastSeen  *time.Time        `json:"last_seen,omitempty"`  // join 消息中携带该用户上次离开的时间
+
+	Messages []Message `json:"messages,omitempty"` // history 消息中批量携带的历史消息；pin 消息中携带被置顶的消息
+	Pinned   []Message `json:"pinned,omitempty"`   // history 消息中携带房间当前置顶的消息
+
+	ReplyTo int64  `json:"reply_to,omitempty"` // 回复的父消息 ID，0 表示不是回复
+	Target  string `json:"target,omitempty"`   // ignore/unignore 消息要屏蔽或取消屏蔽的用户名；dm 消息的收件人
+	Offline bool   `json:"offline,omitempty"`  // 发回给发送者的 dm 回显中表示收件人不在线，私信已保存，待其下次连接时投递
+
+	MessageID int64 `json:"message_id,omitempty"` // pin/unpin 消息要置顶或取消置顶的消息 ID；ack 消息确认收到的消息 ID；mention 消息中提到用户的聊天消息 ID；history_meta 回复中房间最早的消息 ID
+	Count     int   `json:"count,omitempty"`      // history_meta 回复中房间保存的消息总数；history_end 消息中本次发送的历史消息总数；clear_history 通知中删除的消息数；delivery_status 消息中的收件人总数
+	Chunk     int   `json:"chunk,omitempty"`      // history_chunk 消息的序号（从 1 开始）；history_end 消息中的分块总数
+
+	Delivered []string `json:"delivered,omitempty"` // delivery_status 消息中已收到该消息的收件人
+	ReadBy    []string `json:"read_by,omitempty"`   // delivery_status 消息中已读该消息的收件人，是 Delivered 的子集
+
+	Types []MessageType `json:"types,omitempty"` // history_request 消息要获取的消息类型，为空表示所有类型
+	Seq   int64         `json:"seq,omitempty"`   // 房间内单调递增的聊天消息序号，客户端据此发现缺失的消息
+
+	// TextKey 是服务器生成的 content 对应的文案键（见 i18n 包），例如 join 消息的 "join"。
+	// content 使用服务器默认语言，客户端可以根据 text_key 和 username 用自己的语言重新渲染。
+	TextKey string `json:"text_key,omitempty"`
+
+	// Nonce 是客户端为聊天消息生成的可选唯一标识（例如 UUID），
+	// 服务器据此丢弃断线重连时重复发送的同一条消息。
+	Nonce string `json:"nonce,omitempty"`
+
+	// Meta 是客户端附加的自定义元数据（例如客户端版本、设备类型、富文本标记），
+	// 服务器不解释其内容，只限制大小，随消息原样广播并保存在 payload 中。
+	Meta map[string]interface{} `json:"meta,omitempty"`
+
+	// Ephemeral 为 true 时消息只广播给在线连接，不保存、不分配序号，也不会出现在历史中。
+	// 客户端可以用它发送一次性的聊天消息；瞬时类型的消息无论是否设置都按瞬时处理（见 IsEphemeral）。
+	Ephemeral bool `json:"ephemeral,omitempty"`
+}
+
+// IsEphemeral 报告消息是否只投递给在线连接而不保存：显式设置了 Ephemeral，或者类型本身是瞬时的。
+func (m Message) IsEphemeral() bool {
+	return m.Ephemeral || m.Type.Ephemeral()
+}
+
+// UserKey 返回用户名的规范化形式（去掉首尾空白并转为小写），用于判断两个用户名是否属于同一用户。
+// 原始用户名仍用于展示，"Alice" 和 "alice" 的键相同，因此不能同时被不同的人使用。
+func UserKey(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+// HistoryTypes 是可以出现在历史消息中、允许按类型筛选的消息类型。
+var HistoryTypes = []MessageType{TypeChat, TypeJoin, TypeLeave, TypeAnnouncement}
+
+// ValidateHistoryTypes 检查历史筛选条件中的类型是否都在 HistoryTypes 中。
+func ValidateHistoryTypes(types []MessageType) error {
+	for _, t := range types {
+		if !slices.Contains(HistoryTypes, t) {
+			return fmt.Errorf("不支持按类型 %q 筛选历史消息", t)
+		}
+	}
+	return nil
+}
+
+// MaxStatusRunes 是自定义状态文字允许的最大字符数。
+const MaxStatusRunes = 64
+
+// SanitizeStatus 将状态文字整理为单行：去掉首尾空白，并把换行、制表符等连续空白合并为一个空格。
+func SanitizeStatus(status string) string {
+	return strings.Join(strings.Fields(status), " ")
+}
+
+// maxNonceLength 是 Nonce 允许的最大长度，足以容纳 UUID 等常见格式。
+const maxNonceLength = 64
+
+// maxMetaSize 是 Meta 序列化为 JSON 后允许的最大字节数。
+const maxMetaSize = 256
+
+// checkContent 检查内容中是否有会破坏显示的控制字符（包括空字节）。
+// 允许制表符和换行（\t、\n、\r），多行消息需要它们；其他 C0/C1 控制字符和 DEL 一律拒绝。
+// 内容本身是否是合法的 UTF-8 由调用方在解析 JSON 之前检查，解析时非法字节已经被替换为 U+FFFD。
+func checkContent(content string) error {
+	for i, r := range content {
+		if r == '\t' || r == '\n' || r == '\r' {
+			continue
+		}
+		if unicode.IsControl(r) {
+			return fmt.Errorf("内容在第 %d 个字节处包含不允许的控制字符 %U", i, r)
+		}
+	}
+	return nil
+}
 
-	Users []string `json:"users,omitempty"`
-	Error string   `json:"error,omitempty"`
+// Validate 按消息类型检查字段组合是否合理，例如聊天消息必须有内容、
+// 聊天消息不能携带用户列表等。返回的错误可以直接展示给客户端。
+func (m Message) Validate() error {
+	if err := checkContent(m.Content); err != nil {
+		return err
+	}
+	if len(m.Nonce) > maxNonceLength {
+		return fmt.Errorf("nonce 不能超过 %d 个字节", maxNonceLength)
+	}
+	if len(m.Meta) > 0 {
+		encoded, err := json.Marshal(m.Meta)
+		if err != nil {
+			return fmt.Errorf("meta 无法序列化: %v", err)
+		}
+		if len(encoded) > maxMetaSize {
+			return fmt.Errorf("meta 不能超过 %d 个字节", maxMetaSize)
+		}
+	}
+	switch m.Type {
+	case TypeChat:
+		if strings.TrimSpace(m.Content) == "" {
+			return errors.New("聊天消息内容不能为空")
+		}
+		if len(m.Users) > 0 || m.Error != "" {
+			return errors.New("聊天消息不能包含 users 或 error 字段")
+		}
+	case TypeJoin, TypeLeave:
+		if m.Username == "" {
+			return fmt.Errorf("%s 消息必须包含用户名", m.Type)
+		}
+		if len(m.Users) > 0 || m.Error != "" {
+			return fmt.Errorf("%s 消息不能包含 users 或 error 字段", m.Type)
+		}
+	case TypeDirect:
+		if m.Target == "" {
+			return errors.New("dm 消息必须包含 target 字段")
+		}
+		if strings.TrimSpace(m.Content) == "" {
+			return errors.New("私信内容不能为空")
+		}
+		if len(m.Users) > 0 || m.Error != "" {
+			return errors.New("dm 消息不能包含 users 或 error 字段")
+		}
+	case TypeAnnouncement:
+		if strings.TrimSpace(m.Content) == "" {
+			return errors.New("公告内容不能为空")
+		}
+		if m.Username != "" {
+			return errors.New("公告不能归属于用户")
+		}
+	case TypeSystem:
+		if strings.TrimSpace(m.Content) == "" {
+			return errors.New("系统消息内容不能为空")
+		}
+		if m.Username != "" {
+			return errors.New("系统消息不能归属于用户")
+		}
+	case TypeStatus:
+		if utf8.RuneCountInString(m.Content) > MaxStatusRunes {
+			return fmt.Errorf("状态文字不能超过 %d 个字符", MaxStatusRunes)
+		}
+		if len(m.Users) > 0 || m.Error != "" {
+			return errors.New("status 消息不能包含 users 或 error 字段")
+		}
+	case TypePresence, TypeQuit:
+		if m.Content != "" || len(m.Users) > 0 {
+			return fmt.Errorf("%s 消息不能包含 content 或 users 字段", m.Type)
+		}
+	case TypeIgnore, TypeUnignore:
+		if m.Target == "" {
+			return fmt.Errorf("%s 消息必须包含 target 字段", m.Type)
+		}
+		if m.Content != "" || len(m.Users) > 0 {
+			return fmt.Errorf("%s 消息不能包含 content 或 users 字段", m.Type)
+		}
+	case TypePin, TypeUnpin, TypeAck, TypeRead:
+		if m.MessageID <= 0 {
+			return fmt.Errorf("%s 消息必须包含 message_id 字段", m.Type)
+		}
+		if m.Content != "" || len(m.Users) > 0 {
+			return fmt.Errorf("%s 消息不能包含 content 或 users 字段", m.Type)
+		}
+	case TypeHistoryRequest:
+		if m.Content != "" || len(m.Users) > 0 {
+			return errors.New("history_request 消息不能包含 content 或 users 字段")
+		}
+		if err := ValidateHistoryTypes(m.Types); err != nil {
+			return err
+		}
+	case TypeMyHistory, TypeHistoryMeta, TypeClearHistory:
+		if m.Content != "" || len(m.Users) > 0 {
+			return fmt.Errorf("%s 消息不能包含 content 或 users 字段", m.Type)
+		}
+	case TypeHistory, TypeHistoryChunk, TypeHistoryEnd:
+		if m.Content != "" || len(m.Users) > 0 {
+			return fmt.Errorf("%s 消息不能包含 content 或 users 字段", m.Type)
+		}
+	case TypeDeliveryStatus:
+		if m.MessageID <= 0 {
+			return errors.New("delivery_status 消息必须包含 message_id 字段")
+		}
+	case TypeMention:
+		if m.MessageID <= 0 || m.Username == "" {
+			return errors.New("mention 消息必须包含 message_id 和 username 字段")
+		}
+	case TypeUserList:
+		if m.Content != "" || m.Error != "" {
+			return errors.New("user_list 消息不能包含 content 或 error 字段")
+		}
+	case TypeError:
+		if m.Error == "" {
+			return errors.New("error 消息必须包含 error 字段")
+		}
+		if len(m.Users) > 0 {
+			return errors.New("error 消息不能包含 users 字段")
+		}
+	default:
+		return fmt.Errorf("未知的消息类型: %q", m.Type)
+	}
+	return nil
 }
@@ -0,0 +1,85 @@
+package models
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  Message
+		ok   bool
+	}{
+		{"聊天消息", Message{Type: TypeChat, Content: "hi"}, true},
+		{"空白的聊天消息", Message{Type: TypeChat, Content: "  "}, false},
+		{"带用户列表的聊天消息", Message{Type: TypeChat, Content: "hi", Users: []string{"a"}}, false},
+		{"带错误的聊天消息", Message{Type: TypeChat, Content: "hi", Error: "x"}, false},
+		{"多行聊天消息", Message{Type: TypeChat, Content: "a\nb\tc"}, true},
+
+		{"加入", Message{Type: TypeJoin, Username: "alice"}, true},
+		{"没有用户名的加入", Message{Type: TypeJoin}, false},
+		{"带用户列表的离开", Message{Type: TypeLeave, Username: "alice", Users: []string{"a"}}, false},
+
+		{"私信", Message{Type: TypeDirect, Target: "bob", Content: "hi"}, true},
+		{"没有收件人的私信", Message{Type: TypeDirect, Content: "hi"}, false},
+		{"空的私信", Message{Type: TypeDirect, Target: "bob"}, false},
+
+		{"公告", Message{Type: TypeAnnouncement, Content: "维护"}, true},
+		{"归属于用户的公告", Message{Type: TypeAnnouncement, Content: "维护", Username: "alice"}, false},
+		{"空的系统消息", Message{Type: TypeSystem}, false},
+
+		{"状态", Message{Type: TypeStatus, Content: "开会中"}, true},
+		{"清除状态", Message{Type: TypeStatus}, true},
+		{"过长的状态", Message{Type: TypeStatus, Content: strings.Repeat("忙", MaxStatusRunes+1)}, false},
+
+		{"presence", Message{Type: TypePresence}, true},
+		{"带内容的 presence", Message{Type: TypePresence, Content: "x"}, false},
+		{"quit", Message{Type: TypeQuit}, true},
+
+		{"屏蔽", Message{Type: TypeIgnore, Target: "bob"}, true},
+		{"没有目标的取消屏蔽", Message{Type: TypeUnignore}, false},
+
+		{"置顶", Message{Type: TypePin, MessageID: 1}, true},
+		{"没有消息 ID 的取消置顶", Message{Type: TypeUnpin}, false},
+		{"确认", Message{Type: TypeAck, MessageID: 1}, true},
+		{"负数 ID 的已读", Message{Type: TypeRead, MessageID: -1}, false},
+
+		{"按类型请求历史", Message{Type: TypeHistoryRequest, Types: []MessageType{TypeChat, TypeJoin}}, true},
+		{"按瞬时类型请求历史", Message{Type: TypeHistoryRequest, Types: []MessageType{TypePresence}}, false},
+		{"我的历史", Message{Type: TypeMyHistory}, true},
+		{"带内容的历史元信息请求", Message{Type: TypeHistoryMeta, Content: "x"}, false},
+		{"清除历史", Message{Type: TypeClearHistory}, true},
+
+		{"用户列表", Message{Type: TypeUserList, Users: []string{"a"}}, true},
+		{"带内容的用户列表", Message{Type: TypeUserList, Content: "x"}, false},
+		{"错误", Message{Type: TypeError, Error: "x"}, true},
+		{"没有原因的错误", Message{Type: TypeError}, false},
+		{"提醒", Message{Type: TypeMention, MessageID: 1, Username: "alice"}, true},
+		{"没有用户名的提醒", Message{Type: TypeMention, MessageID: 1}, false},
+		{"投递状态", Message{Type: TypeDeliveryStatus, MessageID: 1}, true},
+
+		{"未知类型", Message{Type: "bogus"}, false},
+		{"包含空字节的内容", Message{Type: TypeChat, Content: "a\x00b"}, false},
+		{"包含 DEL 的内容", Message{Type: TypeChat, Content: "a\x7fb"}, false},
+		{"过长的 nonce", Message{Type: TypeChat, Content: "hi", Nonce: strings.Repeat("n", maxNonceLength+1)}, false},
+		{"过大的 meta", Message{Type: TypeChat, Content: "hi", Meta: map[string]interface{}{"k": strings.Repeat("v", maxMetaSize)}}, false},
+		{"普通的 meta", Message{Type: TypeChat, Content: "hi", Meta: map[string]interface{}{"client": "web"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.msg.Validate()
+			if (err == nil) != tt.ok {
+				t.Fatalf("Validate(%+v) = %v，期望通过: %v", tt.msg, err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestUserKey(t *testing.T) {
+	for _, name := range []string{"alice", "Alice", "  ALICE ", "alice\t"} {
+		if got := UserKey(name); got != "alice" {
+			t.Errorf("UserKey(%q) = %q，期望 alice", name, got)
+		}
+	}
+}
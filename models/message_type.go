@@ -0,0 +1,67 @@
+package models
+
+import "slices"
+
+// MessageType 是消息的类型。底层是字符串，JSON 中直接使用下面各常量的值，与旧版本的协议完全兼容。
+type MessageType string
+
+// 协议中的所有消息类型。
+const (
+	TypeChat           MessageType = "chat"            // 用户发送的聊天消息
+	TypeJoin           MessageType = "join"            // 用户加入房间的通知
+	TypeLeave          MessageType = "leave"           // 用户离开房间的通知
+	TypeAnnouncement   MessageType = "announcement"    // 管理员发布的系统公告
+	TypeSystem         MessageType = "system"          // 只发给单个用户的系统提示，例如欢迎语
+	TypePresence       MessageType = "presence"        // 客户端告诉服务器用户仍在浏览
+	TypeQuit           MessageType = "quit"            // 客户端主动离开
+	TypeIgnore         MessageType = "ignore"          // 屏蔽某个用户的消息
+	TypeUnignore       MessageType = "unignore"        // 取消屏蔽
+	TypePin            MessageType = "pin"             // 置顶消息的请求或通知
+	TypeUnpin          MessageType = "unpin"           // 取消置顶的请求或通知
+	TypeHistoryRequest MessageType = "history_request" // 按类型重新获取历史消息的请求
+	TypeHistory        MessageType = "history"         // 批量发送的历史消息
+	TypeHistoryChunk   MessageType = "history_chunk"   // 开启分块发送时，历史消息按顺序拆成的一块
+	TypeHistoryEnd     MessageType = "history_end"     // 分块发送的历史消息结束，携带置顶消息和总条数
+	TypeUserList       MessageType = "user_list"       // 房间的在线用户列表
+	TypeError          MessageType = "error"           // 错误回复
+	TypeMention        MessageType = "mention"         // 只发给被 @ 提到的用户的提醒
+	TypeMyHistory      MessageType = "my_history"      // 获取自己最近发送的消息的请求，回复也使用该类型
+	TypeHistoryMeta    MessageType = "history_meta"    // 获取房间历史的总条数和最早消息 ID 的请求，回复也使用该类型
+	TypeDirect         MessageType = "dm"              // 发给指定用户（target）的私信，不属于任何房间
+	TypeClearHistory   MessageType = "clear_history"   // 删除自己保存的所有消息的请求；广播的通知也使用该类型，客户端据此移除该用户的消息
+	TypeStatus         MessageType = "status"          // 设置自定义状态文字（content），为空表示清除；结果体现在 user_list 的 statuses 中
+	TypeAck            MessageType = "ack"             // 开启确认的客户端确认收到了 message_id 对应的聊天消息
+	TypeRead           MessageType = "read"            // 已读回执：用户已经看到了 message_id 对应的聊天消息
+	TypeDeliveryStatus MessageType = "delivery_status" // 发给发送者的投递状态汇总：哪些收件人已收到、已读 message_id 对应的消息
+)
+
+// clientTypes 是客户端允许发送的消息类型。其余类型（加入、离开、用户列表、公告等）只能由服务器产生，
+// 客户端发来时一律拒绝，防止伪造系统通知。
+var clientTypes = map[MessageType]bool{
+	TypeChat:           true,
+	TypePresence:       true,
+	TypeQuit:           true,
+	TypeIgnore:         true,
+	TypeUnignore:       true,
+	TypePin:            true,
+	TypeUnpin:          true,
+	TypeHistoryRequest: true,
+	TypeMyHistory:      true,
+	TypeHistoryMeta:    true,
+	TypeDirect:         true,
+	TypeClearHistory:   true,
+	TypeStatus:         true,
+	TypeAck:            true,
+	TypeRead:           true,
+}
+
+// ClientAllowed 报告客户端是否可以发送该类型的消息。
+func (t MessageType) ClientAllowed() bool {
+	return clientTypes[t]
+}
+
+// Ephemeral 报告该类型的消息是否天然是瞬时的：只有可以出现在历史中的类型（见 HistoryTypes）才会被保存，
+// 其余类型（在线状态、用户列表、错误、提醒等）只发给在线连接。新增瞬时类型时无需修改保存逻辑。
+func (t MessageType) Ephemeral() bool {
+	return !slices.Contains(HistoryTypes, t)
+}
@@ -0,0 +1,64 @@
+package models
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// 线上的类型字符串是协议的一部分，这里逐个写死，防止改名悄悄破坏旧客户端。
+var wireTypes = map[MessageType]string{
+	TypeChat:           "chat",
+	TypeJoin:           "join",
+	TypeLeave:          "leave",
+	TypeAnnouncement:   "announcement",
+	TypeSystem:         "system",
+	TypePresence:       "presence",
+	TypeQuit:           "quit",
+	TypeIgnore:         "ignore",
+	TypeUnignore:       "unignore",
+	TypePin:            "pin",
+	TypeUnpin:          "unpin",
+	TypeHistoryRequest: "history_request",
+	TypeHistory:        "history",
+	TypeHistoryChunk:   "history_chunk",
+	TypeHistoryEnd:     "history_end",
+	TypeUserList:       "user_list",
+	TypeError:          "error",
+	TypeMention:        "mention",
+	TypeMyHistory:      "my_history",
+	TypeHistoryMeta:    "history_meta",
+	TypeDirect:         "dm",
+	TypeClearHistory:   "clear_history",
+	TypeStatus:         "status",
+	TypeAck:            "ack",
+	TypeRead:           "read",
+	TypeDeliveryStatus: "delivery_status",
+}
+
+func TestMessageTypeWireValues(t *testing.T) {
+	for typ, wire := range wireTypes {
+		t.Run(wire, func(t *testing.T) {
+			data, err := json.Marshal(Message{Type: typ})
+			if err != nil {
+				t.Fatalf("序列化失败: %v", err)
+			}
+			var raw struct {
+				Type string `json:"type"`
+			}
+			if err := json.Unmarshal(data, &raw); err != nil {
+				t.Fatalf("解析 %s 失败: %v", data, err)
+			}
+			if raw.Type != wire {
+				t.Fatalf("%s 序列化为 type=%q，期望 %q", data, raw.Type, wire)
+			}
+
+			var msg Message
+			if err := json.Unmarshal([]byte(`{"type":"`+wire+`"}`), &msg); err != nil {
+				t.Fatalf("反序列化失败: %v", err)
+			}
+			if msg.Type != typ {
+				t.Fatalf("%q 反序列化为 %q，期望 %q", wire, msg.Type, typ)
+			}
+		})
+	}
+}
@@ -0,0 +1,29 @@
+package models
+
+import "strconv"
+
+// 消息协议版本。客户端连接时通过 ?v= 声明自己使用的版本，
+// 服务器接受 MinProtocolVersion 到 ProtocolVersion 之间的版本，并可以按连接的版本调整发给它的消息；
+// 协议发生不兼容的变化时递增 ProtocolVersion，不再兼容的旧版本通过提高 MinProtocolVersion 淘汰。
+const (
+	ProtocolVersion    = 1 // 服务器实现的最新版本
+	MinProtocolVersion = 1 // 服务器仍然支持的最旧版本
+)
+
+// ParseProtocolVersion 解析客户端声明的协议版本。没有声明时视为版本 1（在引入版本握手之前的客户端）；
+// 无法解析时返回 0，它不在任何支持的范围内，注册时会被拒绝。
+func ParseProtocolVersion(s string) int {
+	if s == "" {
+		return 1
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < 0 {
+		return 0
+	}
+	return v
+}
+
+// ProtocolSupported 报告服务器是否支持该协议版本。
+func ProtocolSupported(v int) bool {
+	return v >= MinProtocolVersion && v <= ProtocolVersion
+}
@@ -0,0 +1,27 @@
+package models
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestParseProtocolVersion(t *testing.T) {
+	tests := []struct {
+		in        string
+		want      int
+		supported bool
+	}{
+		{"", 1, true}, // 引入握手之前的客户端
+		{strconv.Itoa(ProtocolVersion), ProtocolVersion, true},
+		{strconv.Itoa(ProtocolVersion + 1), ProtocolVersion + 1, false},
+		{"0", 0, false},
+		{"-1", 0, false},
+		{"v2", 0, false},
+	}
+	for _, tt := range tests {
+		v := ParseProtocolVersion(tt.in)
+		if v != tt.want || ProtocolSupported(v) != tt.supported {
+			t.Errorf("ParseProtocolVersion(%q) = %d (支持: %v)，期望 %d (支持: %v)", tt.in, v, ProtocolSupported(v), tt.want, tt.supported)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// trustedProxies 是 -trusted-proxies 解析得到的可信代理网段，在 main 中设置。
+// 只有直接来源属于这些网段时，才相信 X-Forwarded-For 和 X-Real-IP 请求头。
+var trustedProxies []netip.Prefix
+
+// parseTrustedProxies 解析逗号分隔的 CIDR 列表，单个 IP 视为只包含它自己的网段。
+func parseTrustedProxies(value string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, item := range splitList(value) {
+		if strings.Contains(item, "/") {
+			prefix, err := netip.ParsePrefix(item)
+			if err != nil {
+				return nil, fmt.Errorf("%q 不是合法的 CIDR: %w", item, err)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(item)
+		if err != nil {
+			return nil, fmt.Errorf("%q 不是合法的 IP 或 CIDR: %w", item, err)
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// isTrustedProxy 报告 addr 是否属于可信代理网段。
+func isTrustedProxy(addr netip.Addr) bool {
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseForwardedAddr 解析转发头中的一个地址，允许带端口（"1.2.3.4:5678"、"[::1]:80"）。
+func parseForwardedAddr(value string) (netip.Addr, bool) {
+	value = strings.TrimSpace(value)
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		value = host
+	}
+	addr, err := netip.ParseAddr(strings.Trim(value, "[]"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap(), true
+}
+
+// remoteIP 返回请求的真实来源 IP（去掉端口），用于限流和日志。
+// 直接来源是可信代理时，从右向左检查 X-Forwarded-For，跳过可信代理，第一个不可信的地址就是客户端；
+// 遇到格式错误的条目时停止，使用它右侧最后一个可信的地址，不再相信更左边可能被伪造的部分。
+// 没有 X-Forwarded-For 时使用 X-Real-IP。直接来源不可信时完全忽略这些请求头，防止客户端伪造 IP 绕过限流。
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer, err := netip.ParseAddr(host)
+	if err != nil || !isTrustedProxy(peer.Unmap()) {
+		return host
+	}
+
+	clientIP := peer.Unmap()
+	if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+		hops := strings.Split(strings.Join(forwarded, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			addr, ok := parseForwardedAddr(hops[i])
+			if !ok {
+				break
+			}
+			clientIP = addr
+			if !isTrustedProxy(addr) {
+				break
+			}
+		}
+		return clientIP.String()
+	}
+	if addr, ok := parseForwardedAddr(r.Header.Get("X-Real-IP")); ok {
+		return addr.String()
+	}
+	return clientIP.String()
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+// useTrustedProxies 在测试期间设置可信代理网段。
+func useTrustedProxies(t *testing.T, value string) {
+	t.Helper()
+	prefixes, err := parseTrustedProxies(value)
+	if err != nil {
+		t.Fatalf("解析可信代理 %q 失败: %v", value, err)
+	}
+	old := trustedProxies
+	trustedProxies = prefixes
+	t.Cleanup(func() { trustedProxies = old })
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	prefixes, err := parseTrustedProxies("10.0.0.0/8, 192.168.1.1, 2001:db8::/32, 10.1.2.3/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, prefix := range prefixes {
+		got = append(got, prefix.String())
+	}
+	want := []string{"10.0.0.0/8", "192.168.1.1/32", "2001:db8::/32", "10.1.0.0/16"}
+	if !slices.Equal(got, want) {
+		t.Fatalf("网段 = %v，期望 %v", got, want)
+	}
+
+	for _, bad := range []string{"10.0.0.0/33", "proxy.internal", "10.0.0"} {
+		if _, err := parseTrustedProxies(bad); err == nil {
+			t.Errorf("%q 应解析失败", bad)
+		}
+	}
+}
+
+func TestRemoteIP(t *testing.T) {
+	useTrustedProxies(t, "10.0.0.0/8")
+	tests := []struct {
+		name   string
+		peer   string
+		xff    []string
+		realIP string
+		want   string
+	}{
+		{"不可信来源忽略 X-Forwarded-For", "203.0.113.5:1234", []string{"1.2.3.4"}, "", "203.0.113.5"},
+		{"不可信来源忽略 X-Real-IP", "203.0.113.5:1234", nil, "1.2.3.4", "203.0.113.5"},
+		{"可信代理转发的客户端", "10.0.0.1:1234", []string{"1.2.3.4"}, "", "1.2.3.4"},
+		{"跳过多层可信代理", "10.0.0.1:1234", []string{"1.2.3.4, 10.0.0.2"}, "", "1.2.3.4"},
+		{"不相信不可信地址左侧伪造的部分", "10.0.0.1:1234", []string{"6.6.6.6, 1.2.3.4, 10.0.0.2"}, "", "1.2.3.4"},
+		{"多个请求头按顺序拼接", "10.0.0.1:1234", []string{"6.6.6.6", "1.2.3.4, 10.0.0.2"}, "", "1.2.3.4"},
+		{"全部是可信代理时取最左边", "10.0.0.1:1234", []string{"10.0.0.3, 10.0.0.2"}, "", "10.0.0.3"},
+		{"格式错误的条目之前停止", "10.0.0.1:1234", []string{"6.6.6.6, garbage, 10.0.0.2"}, "", "10.0.0.2"},
+		{"空条目视为格式错误", "10.0.0.1:1234", []string{"6.6.6.6,,10.0.0.2"}, "", "10.0.0.2"},
+		{"只有格式错误的条目时使用直接来源", "10.0.0.1:1234", []string{"garbage"}, "", "10.0.0.1"},
+		{"条目带端口", "10.0.0.1:1234", []string{"1.2.3.4:5678"}, "", "1.2.3.4"},
+		{"IPv6 条目带端口", "10.0.0.1:1234", []string{"[2001:db8::1]:80"}, "", "2001:db8::1"},
+		{"X-Forwarded-For 优先于 X-Real-IP", "10.0.0.1:1234", []string{"1.2.3.4"}, "5.6.7.8", "1.2.3.4"},
+		{"没有 X-Forwarded-For 时使用 X-Real-IP", "10.0.0.1:1234", nil, "5.6.7.8", "5.6.7.8"},
+		{"格式错误的 X-Real-IP 被忽略", "10.0.0.1:1234", nil, "not-an-ip", "10.0.0.1"},
+		{"IPv4 映射的可信来源", "[::ffff:10.0.0.1]:1234", []string{"1.2.3.4"}, "", "1.2.3.4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/ws", nil)
+			r.RemoteAddr = tt.peer
+			for _, value := range tt.xff {
+				r.Header.Add("X-Forwarded-For", value)
+			}
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+			if got := remoteIP(r); got != tt.want {
+				t.Fatalf("remoteIP = %q，期望 %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRemoteIPWithoutTrustedProxies(t *testing.T) {
+	useTrustedProxies(t, "")
+	r := httptest.NewRequest("GET", "/ws", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "1.2.3.4")
+	r.Header.Set("X-Real-IP", "1.2.3.4")
+	if got := remoteIP(r); got != "10.0.0.1" {
+		t.Fatalf("未配置可信代理时 remoteIP = %q，应使用直接来源", got)
+	}
+}
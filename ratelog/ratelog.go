@@ -0,0 +1,64 @@
+package ratelog
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// DefaultWindow 是默认的重复日志合并窗口。
+const DefaultWindow = 5 * time.Second
+
+// Logger 是一个会合并重复日志的日志记录器。
+// 同一条日志（格式化后的完整内容）在窗口内第一次出现时立即输出，
+// 之后的重复只计数，窗口结束时输出一行带次数的汇总。内容不同的日志互不影响。
+// 适合在大量连接同时断开等场景下防止相同的错误刷屏。
+type Logger struct {
+	window  time.Duration
+	mu      sync.Mutex
+	entries map[string]*entry
+}
+
+// entry 记录一条日志在当前窗口内被抑制的情况。
+type entry struct {
+	suppressed int // 被抑制的次数
+}
+
+// New 创建一个以 window 为合并窗口的 Logger，window 小于等于 0 时不做任何合并。
+func New(window time.Duration) *Logger {
+	return &Logger{
+		window:  window,
+		entries: make(map[string]*entry),
+	}
+}
+
+// Printf 按 log.Printf 的方式输出日志，并合并窗口内内容相同的重复日志。
+func (l *Logger) Printf(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if l == nil || l.window <= 0 {
+		log.Print(msg)
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if e, ok := l.entries[msg]; ok {
+		e.suppressed++
+		return
+	}
+	e := &entry{}
+	l.entries[msg] = e
+	log.Print(msg)
+	time.AfterFunc(l.window, func() { l.flush(msg, e) })
+}
+
+// flush 在窗口结束时输出被抑制日志的汇总，并开始新的窗口。
+func (l *Logger) flush(msg string, e *entry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.entries, msg)
+	if e.suppressed > 0 {
+		log.Printf("%s（%v 内另有 %d 条相同日志被合并）", msg, l.window, e.suppressed)
+	}
+}
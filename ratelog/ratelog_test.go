@@ -0,0 +1,116 @@
+package ratelog
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// captureLog 把标准日志重定向到一个并发安全的缓冲区，测试结束时恢复。
+func captureLog(t *testing.T) *lockedBuffer {
+	t.Helper()
+	buf := &lockedBuffer{}
+	out, flags := log.Writer(), log.Flags()
+	log.SetOutput(buf)
+	log.SetFlags(0)
+	t.Cleanup(func() {
+		log.SetOutput(out)
+		log.SetFlags(flags)
+	})
+	return buf
+}
+
+// lockedBuffer 是可以被汇总协程写入、同时被测试读取的缓冲区。
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) lines() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return strings.Split(strings.TrimSpace(b.buf.String()), "\n")
+}
+
+// waitLines 等待缓冲区中至少有 n 行日志。
+func waitLines(t *testing.T, b *lockedBuffer, n int) []string {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		lines := b.lines()
+		if len(lines) >= n && lines[0] != "" {
+			return lines
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("等待 %d 行日志超时，实际 %q", n, lines)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRepeatsAreSuppressedAndSummarized(t *testing.T) {
+	buf := captureLog(t)
+	l := New(50 * time.Millisecond)
+	for i := 0; i < 4; i++ {
+		l.Printf("写入失败: %s", "broken pipe")
+	}
+	if lines := buf.lines(); len(lines) != 1 || lines[0] != "写入失败: broken pipe" {
+		t.Fatalf("窗口内只应输出第一条日志，实际 %q", lines)
+	}
+
+	lines := waitLines(t, buf, 2)
+	if len(lines) != 2 {
+		t.Fatalf("窗口结束时应输出一行汇总，实际 %q", lines)
+	}
+	if summary := lines[1]; !strings.HasPrefix(summary, "写入失败: broken pipe") || !strings.Contains(summary, "另有 3 条") {
+		t.Fatalf("汇总行 = %q，期望包含原日志和被合并的 3 条", summary)
+	}
+
+	// 窗口结束后重新开始计数，下一条日志立即输出
+	l.Printf("写入失败: %s", "broken pipe")
+	if lines := buf.lines(); len(lines) != 3 || lines[2] != "写入失败: broken pipe" {
+		t.Fatalf("新窗口的第一条日志应立即输出，实际 %q", lines)
+	}
+}
+
+func TestDifferentMessagesAreNotMerged(t *testing.T) {
+	buf := captureLog(t)
+	l := New(time.Hour)
+	l.Printf("连接 %s 写入失败", "203.0.113.1")
+	l.Printf("连接 %s 写入失败", "203.0.113.2")
+	l.Printf("连接 %s 写入失败", "203.0.113.1")
+
+	want := []string{"连接 203.0.113.1 写入失败", "连接 203.0.113.2 写入失败"}
+	if lines := buf.lines(); strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("格式相同、内容不同的日志应分别输出，实际 %q，期望 %q", lines, want)
+	}
+}
+
+func TestNoSummaryWithoutRepeats(t *testing.T) {
+	buf := captureLog(t)
+	l := New(10 * time.Millisecond)
+	l.Printf("只出现一次")
+	time.Sleep(50 * time.Millisecond)
+	if lines := buf.lines(); len(lines) != 1 {
+		t.Fatalf("没有重复时不应输出汇总，实际 %q", lines)
+	}
+}
+
+func TestZeroWindowDisablesSuppression(t *testing.T) {
+	buf := captureLog(t)
+	l := New(0)
+	l.Printf("重复")
+	l.Printf("重复")
+	if lines := buf.lines(); len(lines) != 2 {
+		t.Fatalf("窗口为 0 时每条日志都应输出，实际 %q", lines)
+	}
+}
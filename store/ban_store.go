@@ -0,0 +1,30 @@
+package store
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrNotBanned 表示用户当前没有生效的封禁。
+var ErrNotBanned = errors.New("用户没有被封禁")
+
+// Ban 是一条封禁记录。Until 为 nil 表示永久封禁。
+type Ban struct {
+	Username  string     `json:"username"` // 规范化的用户名（models.UserKey）
+	Reason    string     `json:"reason,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	Until     *time.Time `json:"until,omitempty"`
+}
+
+// Active 报告封禁在 now 时是否仍然生效。
+func (b Ban) Active(now time.Time) bool {
+	return b.Until == nil || now.Before(*b.Until)
+}
+
+// BanStore 定义了封禁名单的存储接口。username 都是规范化的用户名。
+type BanStore interface {
+	SaveBan(ban Ban) error                 // 封禁用户，已有封禁时覆盖（例如把临时封禁改为永久）
+	DeleteBan(username string) error       // 解除封禁，没有生效的封禁时返回 ErrNotBanned
+	GetBan(username string) (Ban, error)   // 获取生效中的封禁，没有或已过期时返回 ErrNotBanned
+	ListBans(now time.Time) ([]Ban, error) // 列出 now 时仍然生效的封禁，按封禁时间排序
+}
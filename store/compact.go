@@ -0,0 +1,64 @@
+package store
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// compactQuietPeriod 是开始整理前要求没有任何写入的时间。
+// VACUUM 需要独占数据库，期间的写入只能等待 busy_timeout，因此只在写入空闲时整理。
+const compactQuietPeriod = 10 * time.Second
+
+// Compact 执行 VACUUM，把删除消息后留下的空闲页还给文件系统，使数据库文件缩小。
+// VACUUM 会重写整个数据库并在期间阻塞写入，数据库较大时可能耗时较长，不应在请求处理路径上调用。
+func (s *SQLiteMessageStore) Compact() error {
+	before, err := s.fileSize()
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	if _, err := s.db.Exec(`VACUUM`); err != nil {
+		return fmt.Errorf("整理数据库失败: %w", err)
+	}
+	after, err := s.fileSize()
+	if err != nil {
+		return err
+	}
+	log.Printf("数据库整理完成，耗时 %v，大小 %d -> %d 字节", time.Since(start).Round(time.Millisecond), before, after)
+	return nil
+}
+
+// fileSize 返回数据库的页数乘以页大小，即数据库文件（不含 WAL）的大小。
+func (s *SQLiteMessageStore) fileSize() (int64, error) {
+	var pages, pageSize int64
+	if err := s.db.QueryRow(`PRAGMA page_count`).Scan(&pages); err != nil {
+		return 0, fmt.Errorf("读取 page_count 失败: %w", err)
+	}
+	if err := s.db.QueryRow(`PRAGMA page_size`).Scan(&pageSize); err != nil {
+		return 0, fmt.Errorf("读取 page_size 失败: %w", err)
+	}
+	return pages * pageSize, nil
+}
+
+// RunCompaction 每隔 interval 调用一次 Compact，直到 stop 被关闭。
+// 最近 compactQuietPeriod 内有写入时跳过这一轮，留到下一次再试，避免在写入繁忙时阻塞聊天消息的保存。
+// 应在单独的协程中运行。
+func (s *SQLiteMessageStore) RunCompaction(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if since := s.clock.Now().Sub(time.Unix(0, s.lastWrite.Load())); since < compactQuietPeriod {
+				log.Printf("最近 %v 内有消息写入，跳过本次数据库整理", since.Round(time.Second))
+				continue
+			}
+			if err := s.Compact(); err != nil {
+				log.Printf("定期整理数据库失败: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package store
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"chatroom/models"
+)
+
+func TestCompactShrinksPopulatedDatabase(t *testing.T) {
+	s := newTestStore(t, Config{})
+	padding := strings.Repeat("x", 2000)
+	for i := 0; i < 300; i++ {
+		save(t, s, models.Message{Username: "bob", Room: "general", Content: padding})
+	}
+	keep := saveChat(t, s, "general", "keep", 1)
+	if _, err := s.DeleteMessagesByUser("bob", "general"); err != nil {
+		t.Fatalf("删除消息失败: %v", err)
+	}
+
+	before, err := s.fileSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Compact(); err != nil {
+		t.Fatalf("Compact 失败: %v", err)
+	}
+	after, err := s.fileSize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after >= before {
+		t.Fatalf("删除大量消息后整理，数据库大小 %d -> %d，应当变小", before, after)
+	}
+
+	msgs, err := s.GetMessages("general", 10)
+	if err != nil || !slices.Equal(contents(msgs), []string{"keep"}) || msgs[0].ID != keep {
+		t.Fatalf("整理后剩余消息 = %+v (%v)，期望只有 keep", msgs, err)
+	}
+	if err := s.Compact(); err != nil {
+		t.Fatalf("再次 Compact 失败: %v", err)
+	}
+}
@@ -0,0 +1,17 @@
+package store
+
+import (
+	"errors"
+
+	"chatroom/models"
+)
+
+// ErrInboxFull 表示收件人待投递的离线私信已达上限。
+var ErrInboxFull = errors.New("收件人的离线私信已满")
+
+// InboxStore 定义了离线私信的存储接口：收件人不在线时私信先保存下来，收件人下次连接时投递。
+// recipient 是规范化的用户名（models.UserKey）。
+type InboxStore interface {
+	SaveUndelivered(recipient string, msg models.Message, limit int) error // 保存一条待投递的私信，收件人已有 limit 条待投递时返回 ErrInboxFull
+	TakeUndelivered(recipient string) ([]models.Message, error)            // 取出收件人所有待投递的私信（按发送顺序）并标记为已投递
+}
@@ -1,12 +1,53 @@
 package store
 
 import (
+	"errors"
+	"time"
+
 	"chatroom/models"
 )
 
+// ErrMessageNotFound 表示按 ID 查找或删除的消息不存在。
+var ErrMessageNotFound = errors.New("消息不存在")
+
 // MessageStore 定义了消息存储的接口
 type MessageStore interface {
-	Init() error // 初始化存储（例如创建表）
-	SaveMessage(msg models.Message) error
-	GetMessages(limit int) ([]models.Message, error) // 获取最近的 N 条消息
+	Init() error                                                                                     // 初始化存储（例如创建表）
+	SaveMessage(msg models.Message) (int64, error)                                                   // 保存消息并返回分配的 ID，不需要持久化的类型返回 0
+	GetMessages(room string, limit int) ([]models.Message, error)                                    // 获取指定房间最近的 N 条消息，空房间名表示默认房间
+	GetMessagesOfTypes(room string, types []models.MessageType, limit int) ([]models.Message, error) // 同 GetMessages，但只返回指定类型的消息，types 为空时不过滤
+	GetMessagesByUser(username string, limit int) ([]models.Message, error)                          // 获取用户在所有房间中最近发送的 N 条聊天消息，用户名按规范化形式比较
+	GetUserRooms(username string, limit int) ([]UserRoom, error)                                     // 获取用户有消息的房间（最多 N 个），按用户在房间中最近一次活动倒序排列，用户名按规范化形式比较
+	GetMessageByID(id int64) (models.Message, error)                                                 // 按 ID 获取单条消息，不存在时返回 ErrMessageNotFound
+	EachMessage(room string, fn func(msg models.Message) error) error                                // 按 ID 升序逐条读取房间的全部消息并交给 fn，不一次性载入内存；fn 返回错误时停止并返回该错误
+	DeleteMessage(id int64) error                                                                    // 按 ID 删除消息，不存在时返回 ErrMessageNotFound
+	DeleteMessagesByUser(username, room string) (int64, error)                                       // 删除用户在指定房间（空房间名表示所有房间）的所有消息，返回删除的条数，用户名按规范化形式比较
+	LastSeq(room string) (int64, error)                                                              // 获取房间内已持久化的最大消息序号，没有消息时为 0
+	SetPinned(id int64, pinned bool) error                                                           // 置顶或取消置顶消息，不存在时返回 ErrMessageNotFound
+	GetPinnedMessages(room string) ([]models.Message, error)                                         // 获取房间内当前置顶的消息，按 ID 升序
+	OldestMessageID(room string) (int64, error)                                                      // 获取房间内最早一条消息的 ID，没有消息时为 0
+	CountMessages(room string) (int, error)                                                          // 获取房间内保存的消息总数，空房间名表示默认房间
+	Stats() (Stats, error)                                                                           // 获取消息存储的统计信息
+}
+
+// HealthChecker 由可以报告自身健康状态的存储实现，供就绪检查使用
+type HealthChecker interface {
+	Ping() error // 存储可用时返回 nil
+}
+
+// Stats 描述消息存储的规模，用于了解存储增长情况。
+// 没有任何消息时，计数为零，时间戳为 nil。
+type Stats struct {
+	Total  int            `json:"total"`   // 消息总数
+	ByType map[string]int `json:"by_type"` // 各类型的消息数
+	ByRoom map[string]int `json:"by_room"` // 各房间的消息数
+	Oldest *time.Time     `json:"oldest"`  // 最早一条消息的时间
+	Newest *time.Time     `json:"newest"`  // 最新一条消息的时间
+}
+
+// UserRoom 是用户参与过的一个房间。聊天、加入和离开等保存的消息都算作用户在房间中的活动。
+type UserRoom struct {
+	Room       string     `json:"room"`
+	Count      int        `json:"count"`       // 用户在该房间保存的消息数
+	LastActive *time.Time `json:"last_active"` // 用户在该房间最近一条消息的时间
 }
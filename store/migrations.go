@@ -0,0 +1,257 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// migration 是一次表结构升级。version 从 1 开始连续递增，已发布的迁移不能再修改，
+// 表结构的变化只能通过追加新的迁移完成。
+type migration struct {
+	version     int
+	description string
+	apply       func(tx *sql.Tx, env migrationEnv) error
+}
+
+// migrationEnv 是迁移可能用到的存储配置。
+type migrationEnv struct {
+	defaultRoom string // 没有房间的旧消息归入的房间（Config.DefaultRoom）
+}
+
+// migrations 是按版本排列的所有迁移。
+// 引入版本号之前的数据库可能已经有部分列，因此早期迁移都写成幂等的（IF NOT EXISTS、ensureColumn）。
+var migrations = []migration{
+	{1, "创建 messages 表", func(tx *sql.Tx, _ migrationEnv) error {
+		return execAll(tx, `CREATE TABLE IF NOT EXISTS messages (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			type TEXT NOT NULL,
+			username TEXT,
+			content TEXT,
+			timestamp DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`)
+	}},
+	{2, "messages 表增加 room 列", func(tx *sql.Tx, env migrationEnv) error {
+		// 已有消息都归入配置的默认房间。列定义中的默认值只用于回填，不能随配置变化，
+		// 因此列是新加的时候再把回填的消息改到配置的默认房间。
+		// 在这个迁移之后才修改 -default-room 的数据库不受影响，旧消息需要手动迁移，例如：
+		//   UPDATE messages SET room = 'lobby' WHERE room = 'general';
+		columns, err := tableColumns(tx, "messages")
+		if err != nil {
+			return err
+		}
+		if columns["room"] {
+			return nil
+		}
+		if err := ensureColumn(tx, "messages", "room", "TEXT NOT NULL DEFAULT 'general'"); err != nil {
+			return err
+		}
+		if env.defaultRoom == "general" {
+			return nil
+		}
+		_, err = tx.Exec(`UPDATE messages SET room = ?`, env.defaultRoom)
+		return err
+	}},
+	{3, "messages 表增加 reply_to 列", func(tx *sql.Tx, _ migrationEnv) error {
+		return ensureColumn(tx, "messages", "reply_to", "INTEGER")
+	}},
+	{4, "messages 表增加 seq 列", func(tx *sql.Tx, _ migrationEnv) error {
+		return ensureColumn(tx, "messages", "seq", "INTEGER")
+	}},
+	{5, "messages 表增加 payload 列", func(tx *sql.Tx, _ migrationEnv) error {
+		// 旧消息没有 payload，读取时只能从各列还原
+		return ensureColumn(tx, "messages", "payload", "TEXT")
+	}},
+	{6, "messages 表增加 pinned 列", func(tx *sql.Tx, _ migrationEnv) error {
+		return ensureColumn(tx, "messages", "pinned", "INTEGER NOT NULL DEFAULT 0")
+	}},
+	{7, "创建 messages 房间索引", func(tx *sql.Tx, _ migrationEnv) error {
+		return execAll(tx, `CREATE INDEX IF NOT EXISTS idx_messages_room_timestamp ON messages(room, timestamp)`)
+	}},
+	{8, "创建 users 表", func(tx *sql.Tx, _ migrationEnv) error {
+		return execAll(tx, `CREATE TABLE IF NOT EXISTS users (
+			username TEXT PRIMARY KEY,
+			last_seen TEXT NOT NULL
+		)`)
+	}},
+	{9, "创建 inbox 表", func(tx *sql.Tx, _ migrationEnv) error {
+		// 离线私信，delivered_at 为 NULL 表示尚未投递；已投递的记录保留，便于排查
+		return execAll(tx, `CREATE TABLE IF NOT EXISTS inbox (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			recipient TEXT NOT NULL,
+			payload TEXT NOT NULL,
+			created_at TEXT NOT NULL,
+			delivered_at TEXT
+		)`, `CREATE INDEX IF NOT EXISTS idx_inbox_recipient ON inbox(recipient, delivered_at)`)
+	}},
+	{10, "创建 bans 表", func(tx *sql.Tx, _ migrationEnv) error {
+		// expires_at 为 NULL 表示永久封禁；过期的记录不会自动删除，再次封禁时覆盖
+		return execAll(tx, `CREATE TABLE IF NOT EXISTS bans (
+			username TEXT PRIMARY KEY,
+			reason TEXT NOT NULL DEFAULT '',
+			created_at TEXT NOT NULL,
+			expires_at TEXT
+		)`)
+	}},
+}
+
+// migrate 创建 schema_migrations 表，并在各自的事务中依次执行版本高于当前版本的迁移。
+// 某个迁移失败时它的修改会被回滚，已成功的迁移保留，下次启动时从失败的迁移继续。
+func (s *SQLiteMessageStore) migrate() error {
+	createSQL := `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		applied_at TEXT NOT NULL
+	)`
+	if _, err := s.db.Exec(createSQL); err != nil {
+		return fmt.Errorf("创建 schema_migrations 表失败: %w", err)
+	}
+	current, err := s.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := s.applyMigration(m); err != nil {
+			return err
+		}
+		log.Printf("已应用数据库迁移 %d: %s", m.version, m.description)
+	}
+	return nil
+}
+
+// applyMigration 在一个事务中执行迁移并记录它的版本号。
+func (s *SQLiteMessageStore) applyMigration(m migration) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("开始迁移 %d 的事务失败: %w", m.version, err)
+	}
+	defer tx.Rollback() // 提交成功后 Rollback 不做任何事
+
+	if err := m.apply(tx, migrationEnv{defaultRoom: s.defaultRoom}); err != nil {
+		return fmt.Errorf("数据库迁移 %d (%s) 失败: %w", m.version, m.description, err)
+	}
+	if _, err := tx.Exec(`INSERT INTO schema_migrations(version, applied_at) VALUES(?, ?)`, m.version, s.clock.Now().UTC().Format(time.RFC3339Nano)); err != nil {
+		return fmt.Errorf("记录迁移 %d 失败: %w", m.version, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("提交迁移 %d 失败: %w", m.version, err)
+	}
+	return nil
+}
+
+// SchemaVersion 返回数据库当前的表结构版本，即已应用的最大迁移版本号；尚未应用任何迁移时返回 0。
+func (s *SQLiteMessageStore) SchemaVersion() (int, error) {
+	var version int
+	if err := s.db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&version); err != nil {
+		return 0, fmt.Errorf("读取表结构版本失败: %w", err)
+	}
+	return version, nil
+}
+
+// execAll 在事务中依次执行多条语句。
+func execAll(tx *sql.Tx, statements ...string) error {
+	for _, stmt := range statements {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// querier 是 *sql.DB 和 *sql.Tx 共有的查询方法，使读取表结构的代码在事务内外都能使用。
+type querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// tableColumns 通过 PRAGMA table_info 返回表的所有列名；表不存在时返回空集合。
+func tableColumns(q querier, table string) (map[string]bool, error) {
+	rows, err := q.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return nil, fmt.Errorf("读取 %s 表结构失败: %w", table, err)
+	}
+	defer rows.Close()
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var (
+			cid        int
+			name, typ  string
+			notNull    int
+			defaultVal sql.NullString
+			pk         int
+		)
+		if err := rows.Scan(&cid, &name, &typ, &notNull, &defaultVal, &pk); err != nil {
+			return nil, fmt.Errorf("扫描 %s 表结构失败: %w", table, err)
+		}
+		columns[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("行迭代错误: %w", err)
+	}
+	return columns, nil
+}
+
+// ensureColumn 在表缺少指定列时通过 ALTER TABLE 添加它
+func ensureColumn(tx *sql.Tx, table, column, definition string) error {
+	columns, err := tableColumns(tx, table)
+	if err != nil {
+		return err
+	}
+	if columns[column] {
+		return nil
+	}
+	if _, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+		return fmt.Errorf("为 %s 表添加 %s 列失败: %w", table, column, err)
+	}
+	log.Printf("已为 %s 表添加 %s 列。", table, column)
+	return nil
+}
+
+// baseColumns 是迁移 1 创建的 messages 表的列。已存在的 messages 表至少要有这些列，后续迁移才能在它上面进行。
+var baseColumns = []string{"id", "type", "username", "content", "timestamp"}
+
+// expectedColumns 是最新表结构中各表必须有的列，与 migrations 保持一致。
+var expectedColumns = map[string][]string{
+	"messages": {"id", "type", "username", "content", "timestamp", "room", "reply_to", "seq", "payload", "pinned"},
+	"users":    {"username", "last_seen"},
+	"inbox":    {"id", "recipient", "payload", "created_at", "delivered_at"},
+	"bans":     {"username", "reason", "created_at", "expires_at"},
+}
+
+// verifySchema 检查各表是否具备代码依赖的所有列。
+// 迁移只添加缺失的列，无法修复被手工改动或来自其他程序的同名表，这种情况下尽早返回明确的错误，
+// 而不是等到迁移或 SaveMessage 时才出现难以理解的 SQL 错误。
+// 迁移之前调用时（beforeMigrate 为 true）只检查已存在的 messages 表是否具备 baseColumns。
+func (s *SQLiteMessageStore) verifySchema(beforeMigrate bool) error {
+	expected := expectedColumns
+	if beforeMigrate {
+		expected = map[string][]string{"messages": baseColumns}
+	}
+	for _, table := range []string{"messages", "users", "inbox", "bans"} {
+		required, ok := expected[table]
+		if !ok {
+			continue
+		}
+		columns, err := tableColumns(s.db, table)
+		if err != nil {
+			return err
+		}
+		if beforeMigrate && len(columns) == 0 {
+			continue // 表还不存在，由迁移创建
+		}
+		var missing []string
+		for _, column := range required {
+			if !columns[column] {
+				missing = append(missing, column)
+			}
+		}
+		if len(missing) > 0 {
+			return fmt.Errorf("%s 表结构不兼容：缺少列 %s。该表可能不是由本程序创建的，或被手工修改过，无法自动迁移；请检查数据库文件，必要时迁移数据后使用新的数据库",
+				table, strings.Join(missing, ", "))
+		}
+	}
+	return nil
+}
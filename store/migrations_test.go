@@ -0,0 +1,151 @@
+package store
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// openUninitialized 在临时目录中创建存储但不初始化，先执行 setup 构造已有的表结构。
+func openUninitialized(t *testing.T, setup ...string) *SQLiteMessageStore {
+	t.Helper()
+	s, err := NewSQLiteMessageStore(filepath.Join(t.TempDir(), "chat.db"))
+	if err != nil {
+		t.Fatalf("创建存储失败: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	for _, stmt := range setup {
+		if _, err := s.db.Exec(stmt); err != nil {
+			t.Fatalf("构造旧表结构失败: %v", err)
+		}
+	}
+	return s
+}
+
+func TestMigrateOldSchemaForward(t *testing.T) {
+	// 引入版本号之前的数据库：只有最初的几列，没有 schema_migrations 表
+	s := openUninitialized(t,
+		`CREATE TABLE messages (id INTEGER PRIMARY KEY AUTOINCREMENT, type TEXT NOT NULL, username TEXT, content TEXT, timestamp DATETIME DEFAULT CURRENT_TIMESTAMP)`,
+		`INSERT INTO messages(type, username, content, timestamp) VALUES('chat', 'alice', 'old message', '2023-01-01T00:00:00Z')`,
+	)
+	if err := s.Init(); err != nil {
+		t.Fatalf("迁移旧数据库失败: %v", err)
+	}
+
+	if version, err := s.SchemaVersion(); err != nil || version != len(migrations) {
+		t.Fatalf("表结构版本 = %d (%v)，期望 %d", version, err, len(migrations))
+	}
+	for table, want := range expectedColumns {
+		columns, err := tableColumns(s.db, table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, column := range want {
+			if !columns[column] {
+				t.Errorf("迁移后 %s 表缺少 %s 列", table, column)
+			}
+		}
+	}
+
+	// 旧消息保留下来，新列取默认值
+	msgs, err := s.GetMessages("", 10)
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("获取旧消息 = %+v (%v)", msgs, err)
+	}
+	if got := msgs[0]; got.Content != "old message" || got.Room != "general" || got.ReplyTo != 0 || got.Seq != 0 {
+		t.Fatalf("迁移后的旧消息 = %+v", got)
+	}
+	var pinned int
+	if err := s.db.QueryRow(`SELECT pinned FROM messages`).Scan(&pinned); err != nil || pinned != 0 {
+		t.Fatalf("pinned 列 = %d (%v)，期望默认值 0", pinned, err)
+	}
+
+	// 再次初始化不会重复执行迁移
+	if err := s.Init(); err != nil {
+		t.Fatalf("再次初始化失败: %v", err)
+	}
+	var applied int
+	s.db.QueryRow(`SELECT COUNT(*) FROM schema_migrations`).Scan(&applied)
+	if applied != len(migrations) {
+		t.Fatalf("schema_migrations 有 %d 条记录，期望 %d", applied, len(migrations))
+	}
+}
+
+func TestMigrateBackfillsConfiguredDefaultRoom(t *testing.T) {
+	s, err := NewSQLiteMessageStoreWithConfig(filepath.Join(t.TempDir(), "chat.db"), Config{DefaultRoom: "lobby"})
+	if err != nil {
+		t.Fatalf("创建存储失败: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	for _, stmt := range []string{
+		`CREATE TABLE messages (id INTEGER PRIMARY KEY AUTOINCREMENT, type TEXT NOT NULL, username TEXT, content TEXT, timestamp DATETIME DEFAULT CURRENT_TIMESTAMP)`,
+		`INSERT INTO messages(type, username, content, timestamp) VALUES('chat', 'alice', 'old message', '2023-01-01T00:00:00Z')`,
+	} {
+		if _, err := s.db.Exec(stmt); err != nil {
+			t.Fatalf("构造旧表结构失败: %v", err)
+		}
+	}
+	if err := s.Init(); err != nil {
+		t.Fatalf("迁移旧数据库失败: %v", err)
+	}
+
+	var room string
+	if err := s.db.QueryRow(`SELECT room FROM messages`).Scan(&room); err != nil || room != "lobby" {
+		t.Fatalf("旧消息的房间 = %q (%v)，期望配置的默认房间 lobby", room, err)
+	}
+}
+
+func TestMigrateResumesFromRecordedVersion(t *testing.T) {
+	s := openUninitialized(t)
+	if err := s.migrate(); err != nil {
+		t.Fatal(err)
+	}
+	// 模拟较早版本的程序创建的数据库：只应用了前两个迁移
+	if _, err := s.db.Exec(`DELETE FROM schema_migrations WHERE version > 2`); err != nil {
+		t.Fatal(err)
+	}
+	if version, _ := s.SchemaVersion(); version != 2 {
+		t.Fatalf("表结构版本 = %d，期望 2", version)
+	}
+	// 之后的迁移都是幂等的，重新执行不会失败
+	if err := s.Init(); err != nil {
+		t.Fatalf("从版本 2 继续迁移失败: %v", err)
+	}
+	if version, _ := s.SchemaVersion(); version != len(migrations) {
+		t.Fatalf("表结构版本 = %d，期望 %d", version, len(migrations))
+	}
+}
+
+func TestInitRejectsIncompatibleSchema(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   string
+		table   string
+		missing string
+	}{
+		{"messages 缺少时间列", `CREATE TABLE messages (id INTEGER PRIMARY KEY, type TEXT, username TEXT, content TEXT)`, "messages", "timestamp"},
+		{"同名的 users 表", `CREATE TABLE users (name TEXT PRIMARY KEY)`, "users", "username, last_seen"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := openUninitialized(t, tt.setup).Init()
+			if err == nil {
+				t.Fatal("表结构不兼容时 Init 应返回错误")
+			}
+			for _, want := range []string{tt.table + " 表结构不兼容", "缺少列 " + tt.missing} {
+				if !strings.Contains(err.Error(), want) {
+					t.Fatalf("错误 %q 应包含 %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestInitIsIdempotent(t *testing.T) {
+	s := openUninitialized(t)
+	for i := 0; i < 2; i++ {
+		if err := s.Init(); err != nil {
+			t.Fatalf("第 %d 次 Init 失败: %v", i+1, err)
+		}
+	}
+}
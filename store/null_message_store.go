@@ -0,0 +1,69 @@
+package store
+
+import "chatroom/models"
+
+// NullMessageStore 是不保存任何消息的 MessageStore，用于不保留聊天记录的部署。
+// 保存操作直接丢弃消息，查询总是返回空结果，按 ID 访问的操作返回 ErrMessageNotFound。
+type NullMessageStore struct{}
+
+// Init 什么也不做
+func (NullMessageStore) Init() error { return nil }
+
+// SaveMessage 丢弃消息，返回的 ID 总是 0
+func (NullMessageStore) SaveMessage(msg models.Message) (int64, error) { return 0, nil }
+
+// GetMessages 总是返回空结果
+func (NullMessageStore) GetMessages(room string, limit int) ([]models.Message, error) {
+	return nil, nil
+}
+
+// GetMessagesOfTypes 总是返回空结果
+func (NullMessageStore) GetMessagesOfTypes(room string, types []models.MessageType, limit int) ([]models.Message, error) {
+	return nil, nil
+}
+
+// GetMessagesByUser 总是返回空结果
+func (NullMessageStore) GetMessagesByUser(username string, limit int) ([]models.Message, error) {
+	return nil, nil
+}
+
+// GetUserRooms 总是返回空结果
+func (NullMessageStore) GetUserRooms(username string, limit int) ([]UserRoom, error) {
+	return nil, nil
+}
+
+// GetMessageByID 总是返回 ErrMessageNotFound
+func (NullMessageStore) GetMessageByID(id int64) (models.Message, error) {
+	return models.Message{}, ErrMessageNotFound
+}
+
+// EachMessage 没有任何消息，不调用 fn
+func (NullMessageStore) EachMessage(room string, fn func(msg models.Message) error) error { return nil }
+
+// DeleteMessage 总是返回 ErrMessageNotFound
+func (NullMessageStore) DeleteMessage(id int64) error { return ErrMessageNotFound }
+
+// DeleteMessagesByUser 没有可删除的消息，总是返回 0
+func (NullMessageStore) DeleteMessagesByUser(username, room string) (int64, error) { return 0, nil }
+
+// LastSeq 总是返回 0，房间序号在每次启动后从 1 开始
+func (NullMessageStore) LastSeq(room string) (int64, error) { return 0, nil }
+
+// SetPinned 总是返回 ErrMessageNotFound
+func (NullMessageStore) SetPinned(id int64, pinned bool) error { return ErrMessageNotFound }
+
+// GetPinnedMessages 总是返回空结果
+func (NullMessageStore) GetPinnedMessages(room string) ([]models.Message, error) {
+	return nil, nil
+}
+
+// OldestMessageID 总是返回 0
+func (NullMessageStore) OldestMessageID(room string) (int64, error) { return 0, nil }
+
+// CountMessages 没有保存任何消息，总是返回 0
+func (NullMessageStore) CountMessages(room string) (int, error) { return 0, nil }
+
+// Stats 返回空的统计信息
+func (NullMessageStore) Stats() (Stats, error) {
+	return Stats{ByType: map[string]int{}, ByRoom: map[string]int{}}, nil
+}
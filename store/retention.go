@@ -0,0 +1,130 @@
+package store
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"chatroom/models"
+)
+
+// DefaultPruneBatchSize 是保留期清理每批读取、归档和删除的消息条数。
+const DefaultPruneBatchSize = 500
+
+// Archiver 在保留期清理删除旧消息之前把它们保存到别处，例如 S3 兼容的对象存储（见 archive 包）。
+// Archive 返回 nil 表示这批消息已经安全保存，之后才会从数据库删除；同一批消息可能因为重试被归档多次。
+type Archiver interface {
+	Archive(batch []models.Message) error
+}
+
+// Prune 删除 before 之前的消息（置顶的消息除外），返回删除的条数。
+// 消息按 ID 升序每次处理 batchSize 条（非正数时使用 DefaultPruneBatchSize），遇到第一条不早于 before 的消息即停止。
+// archiver 不为 nil 时每批先归档，归档成功后才删除；归档失败时停止，这一批和之后的消息都保留到下次清理。
+func (s *SQLiteMessageStore) Prune(before time.Time, archiver Archiver, batchSize int) (int64, error) {
+	if batchSize <= 0 {
+		batchSize = DefaultPruneBatchSize
+	}
+	var total int64
+	for {
+		batch, full, err := s.expiredBatch(before, batchSize)
+		if err != nil {
+			return total, err
+		}
+		if len(batch) == 0 {
+			return total, nil
+		}
+		first, last := batch[0].ID, batch[len(batch)-1].ID
+		if archiver != nil {
+			if err := archiver.Archive(batch); err != nil {
+				return total, fmt.Errorf("归档消息 %d-%d 失败，这批消息没有删除: %w", first, last, err)
+			}
+		}
+		ids := make([]int64, len(batch))
+		for i, msg := range batch {
+			ids[i] = msg.ID
+		}
+		deleted, err := s.deleteExpired(ids)
+		total += deleted
+		if err != nil {
+			return total, err
+		}
+		if !full {
+			return total, nil
+		}
+	}
+}
+
+// expiredBatch 按 ID 升序读取最多 limit 条未置顶的消息，在第一条不早于 before 的消息处截断。
+// full 为 true 表示这一批没有被截断，之后可能还有过期的消息。
+func (s *SQLiteMessageStore) expiredBatch(before time.Time, limit int) (batch []models.Message, full bool, err error) {
+	var rows *sql.Rows
+	err = s.withRetry("读取过期消息", func() (err error) {
+		rows, err = s.db.Query(`SELECT `+messageColumns+` FROM messages WHERE pinned = 0 ORDER BY id LIMIT ?`, limit)
+		return err
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("查询过期消息失败: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return nil, false, fmt.Errorf("读取消息失败: %w", err)
+		}
+		if !msg.Timestamp.Before(before) {
+			return batch, false, nil
+		}
+		batch = append(batch, msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, fmt.Errorf("遍历过期消息失败: %w", err)
+	}
+	return batch, len(batch) == limit, nil
+}
+
+// deleteExpired 按 ID 删除 expiredBatch 刚读出（并已归档）的那一批中仍未置顶的消息。
+// 按确切的 ID 而不是 ID 范围删除：读取之后才取消置顶的消息不在这一批中，没有归档，不能删除，留到下次清理。
+func (s *SQLiteMessageStore) deleteExpired(ids []int64) (int64, error) {
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	query := `DELETE FROM messages WHERE pinned = 0 AND id IN (?` + strings.Repeat(`, ?`, len(ids)-1) + `)`
+	var result sql.Result
+	err := s.withWriteRetry("删除过期消息", func() (err error) {
+		result, err = s.db.Exec(query, args...)
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("删除消息 %d-%d 失败: %w", ids[0], ids[len(ids)-1], err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("获取删除结果失败: %w", err)
+	}
+	return affected, nil
+}
+
+// RunRetention 每隔 interval 删除一次早于 maxAge 的消息，删除前交给 archiver 归档（可以为 nil），直到 stop 被关闭。
+// 应在单独的协程中运行。
+func (s *SQLiteMessageStore) RunRetention(maxAge, interval time.Duration, archiver Archiver, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			deleted, err := s.Prune(s.clock.Now().Add(-maxAge), archiver, DefaultPruneBatchSize)
+			if err != nil {
+				log.Printf("清理过期消息失败 (已删除 %d 条): %v", deleted, err)
+				continue
+			}
+			if deleted > 0 {
+				log.Printf("已清理 %d 条超过 %v 的消息", deleted, maxAge)
+			}
+		}
+	}
+}
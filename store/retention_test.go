@@ -0,0 +1,195 @@
+package store
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"chatroom/clock"
+	"chatroom/models"
+)
+
+// fakeArchiver 记录收到的批次。Archive 被调用时检查这批消息仍在数据库中，即先归档后删除。
+type fakeArchiver struct {
+	t       *testing.T
+	s       *SQLiteMessageStore
+	err     error  // 不为 nil 时 Archive 返回它
+	during  func() // 在 Archive 中执行，模拟归档期间发生的并发修改
+	batches [][]int64
+}
+
+func (a *fakeArchiver) Archive(batch []models.Message) error {
+	var ids []int64
+	for _, msg := range batch {
+		if _, err := a.s.GetMessageByID(msg.ID); err != nil {
+			a.t.Errorf("归档消息 %d 时它已经不在数据库中: %v", msg.ID, err)
+		}
+		ids = append(ids, msg.ID)
+	}
+	a.batches = append(a.batches, ids)
+	if a.during != nil {
+		a.during()
+	}
+	return a.err
+}
+
+// remainingIDs 返回房间内剩下的消息 ID。
+func remainingIDs(t *testing.T, s *SQLiteMessageStore, room string) []int64 {
+	t.Helper()
+	msgs, err := s.GetMessages(room, 100)
+	if err != nil {
+		t.Fatalf("读取消息失败: %v", err)
+	}
+	ids := make([]int64, len(msgs))
+	for i, msg := range msgs {
+		ids[i] = msg.ID
+	}
+	slices.Sort(ids)
+	return ids
+}
+
+func TestPruneArchivesBeforeDeleting(t *testing.T) {
+	s := newTestStore(t, Config{})
+	var ids []int64
+	for i := range 5 {
+		ids = append(ids, saveChat(t, s, "general", "m", i))
+	}
+	archiver := &fakeArchiver{t: t, s: s}
+
+	// 早于第 3 分钟的消息过期，每批 2 条
+	deleted, err := s.Prune(testEpoch.Add(3*time.Minute), archiver, 2)
+	if err != nil {
+		t.Fatalf("Prune 失败: %v", err)
+	}
+	if deleted != 3 {
+		t.Fatalf("删除了 %d 条，期望 3", deleted)
+	}
+	want := [][]int64{{ids[0], ids[1]}, {ids[2]}}
+	if !slices.EqualFunc(archiver.batches, want, slices.Equal) {
+		t.Fatalf("归档批次 = %v，期望 %v", archiver.batches, want)
+	}
+	if got := remainingIDs(t, s, "general"); !slices.Equal(got, ids[3:]) {
+		t.Fatalf("剩下的消息 = %v，期望 %v", got, ids[3:])
+	}
+}
+
+func TestPruneKeepsBatchWhenArchiveFails(t *testing.T) {
+	s := newTestStore(t, Config{})
+	var ids []int64
+	for i := range 3 {
+		ids = append(ids, saveChat(t, s, "general", "m", i))
+	}
+	archiver := &fakeArchiver{t: t, s: s, err: errors.New("存储桶不可用")}
+
+	deleted, err := s.Prune(testEpoch.Add(time.Hour), archiver, 10)
+	if err == nil {
+		t.Fatal("归档失败时 Prune 应返回错误")
+	}
+	if deleted != 0 {
+		t.Fatalf("归档失败时删除了 %d 条", deleted)
+	}
+	if got := remainingIDs(t, s, "general"); !slices.Equal(got, ids) {
+		t.Fatalf("剩下的消息 = %v，期望全部保留 %v", got, ids)
+	}
+}
+
+func TestPruneKeepsPinnedMessages(t *testing.T) {
+	s := newTestStore(t, Config{})
+	old := saveChat(t, s, "general", "old", 0)
+	pinned := saveChat(t, s, "general", "pinned", 1)
+	if err := s.SetPinned(pinned, true); err != nil {
+		t.Fatalf("置顶失败: %v", err)
+	}
+	archiver := &fakeArchiver{t: t, s: s}
+
+	if _, err := s.Prune(testEpoch.Add(time.Hour), archiver, 10); err != nil {
+		t.Fatalf("Prune 失败: %v", err)
+	}
+	if want := [][]int64{{old}}; !slices.EqualFunc(archiver.batches, want, slices.Equal) {
+		t.Fatalf("归档批次 = %v，期望只有未置顶的 %v", archiver.batches, want)
+	}
+	if got := remainingIDs(t, s, "general"); !slices.Equal(got, []int64{pinned}) {
+		t.Fatalf("剩下的消息 = %v，期望只剩置顶的 %d", got, pinned)
+	}
+}
+
+func TestPruneKeepsMessageUnpinnedDuringArchive(t *testing.T) {
+	s := newTestStore(t, Config{})
+	first := saveChat(t, s, "general", "a", 0)
+	pinned := saveChat(t, s, "general", "b", 1)
+	last := saveChat(t, s, "general", "c", 2)
+	if err := s.SetPinned(pinned, true); err != nil {
+		t.Fatalf("置顶失败: %v", err)
+	}
+	// 第一次归档时取消置顶：这条消息不在已归档的批次中，这一轮不能删除它
+	unpinned := false
+	archiver := &fakeArchiver{t: t, s: s}
+	archiver.during = func() {
+		if !unpinned {
+			unpinned = true
+			if err := s.SetPinned(pinned, false); err != nil {
+				t.Errorf("取消置顶失败: %v", err)
+			}
+		}
+	}
+
+	if _, err := s.Prune(testEpoch.Add(time.Hour), archiver, 10); err != nil {
+		t.Fatalf("Prune 失败: %v", err)
+	}
+	if want := []int64{first, last}; !slices.Equal(archiver.batches[0], want) {
+		t.Fatalf("第一批归档 = %v，期望 %v", archiver.batches[0], want)
+	}
+	if got := remainingIDs(t, s, "general"); !slices.Equal(got, []int64{pinned}) {
+		t.Fatalf("剩下的消息 = %v，未归档的 %d 不应被删除", got, pinned)
+	}
+
+	// 下次清理时它会先被归档再删除
+	if _, err := s.Prune(testEpoch.Add(time.Hour), archiver, 10); err != nil {
+		t.Fatalf("第二次 Prune 失败: %v", err)
+	}
+	if got := archiver.batches[len(archiver.batches)-1]; !slices.Equal(got, []int64{pinned}) {
+		t.Fatalf("第二次归档 = %v，期望 [%d]", got, pinned)
+	}
+	if got := remainingIDs(t, s, "general"); len(got) != 0 {
+		t.Fatalf("第二次清理后仍剩 %v", got)
+	}
+}
+
+func TestRunRetentionUsesStoreClock(t *testing.T) {
+	clk := clock.NewFake(testEpoch.Add(30 * time.Minute))
+	s := newTestStore(t, Config{Clock: clk})
+	saveChat(t, s, "general", "old", 0)
+	recent := saveChat(t, s, "general", "recent", 50)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		s.RunRetention(time.Hour, 5*time.Millisecond, nil, stop)
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	// 按时钟的当前时间，两条消息都没有超过一小时
+	time.Sleep(30 * time.Millisecond)
+	if got := remainingIDs(t, s, "general"); len(got) != 2 {
+		t.Fatalf("时钟推进前剩下 %v，不应删除任何消息", got)
+	}
+
+	// 推进到 old 超过一小时而 recent 没有
+	clk.Advance(45 * time.Minute)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		got := remainingIDs(t, s, "general")
+		if slices.Equal(got, []int64{recent}) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("时钟推进后剩下 %v，期望只剩 %d", got, recent)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -0,0 +1,92 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// 数据库操作失败时的默认重试设置。重试在调用方的协程中同步进行（SaveMessage 在 Hub 主循环中），
+// 因此默认值保持较小：最坏情况下一次保存额外等待约 150ms，再加上每次尝试的 busy_timeout。
+const (
+	DefaultRetries      = 2
+	DefaultRetryBackoff = 50 * time.Millisecond
+)
+
+// transient 报告错误是否可能在稍后自行消失，值得重试：数据库被锁、磁盘已满、I/O 错误或暂时无法打开文件。
+// 约束冲突、SQL 错误等重试也不会成功的错误直接返回。
+func transient(err error) bool {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	switch sqliteErr.Code {
+	case sqlite3.ErrBusy, sqlite3.ErrLocked, sqlite3.ErrFull, sqlite3.ErrIoErr, sqlite3.ErrCantOpen:
+		return true
+	}
+	return false
+}
+
+// health 记录最近一次写操作（重试之后）的结果，供就绪检查判断存储是否可用。
+type health struct {
+	mu      sync.Mutex
+	lastErr error     // 最近一次写操作最终失败的错误，成功后清空
+	since   time.Time // 开始持续失败的时间
+}
+
+func (h *health) record(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err == nil {
+		if h.lastErr != nil {
+			log.Printf("数据库已恢复，此前自 %s 起持续失败", h.since.Format(time.RFC3339))
+		}
+		h.lastErr = nil
+		return
+	}
+	if h.lastErr == nil {
+		h.since = time.Now()
+	}
+	h.lastErr = err
+}
+
+// err 返回存储当前的故障，健康时返回 nil。
+func (h *health) err() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.lastErr == nil {
+		return nil
+	}
+	return fmt.Errorf("数据库写入自 %s 起持续失败: %w", h.since.Format(time.RFC3339), h.lastErr)
+}
+
+// withRetry 执行一次数据库操作，遇到暂时性错误时按指数退避重试，最多重试 Config.Retries 次。
+// fn 必须可以安全地重复执行（失败的语句不会留下部分结果，SQLite 的单条语句满足这一点）。
+func (s *SQLiteMessageStore) withRetry(op string, fn func() error) error {
+	backoff := s.retryBackoff
+	err := fn()
+	for attempt := 1; attempt <= s.retries && err != nil && transient(err); attempt++ {
+		log.Printf("%s失败，%v 后第 %d 次重试: %v", op, backoff, attempt, err)
+		time.Sleep(backoff)
+		backoff *= 2
+		err = fn()
+	}
+	return err
+}
+
+// withWriteRetry 与 withRetry 相同，并把最终结果记录到健康状态：写入持续失败时 Ping 返回错误，
+// 让就绪检查把实例摘掉，而不是悄悄丢数据。只有写操作计入健康状态，因为数据库被锁或磁盘已满时读取往往仍能成功。
+func (s *SQLiteMessageStore) withWriteRetry(op string, fn func() error) error {
+	err := s.withRetry(op, fn)
+	if err == nil || transient(err) {
+		s.health.record(err)
+	} else {
+		// 非暂时性错误（例如约束冲突）说明数据库本身是可写的
+		s.health.record(nil)
+	}
+	return err
+}
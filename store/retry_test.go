@@ -0,0 +1,95 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"chatroom/models"
+	"github.com/mattn/go-sqlite3"
+)
+
+func TestSaveMessageRetriesWhileDatabaseIsLocked(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chat.db")
+	s, err := NewSQLiteMessageStoreWithConfig(path, Config{BusyTimeout: time.Millisecond, Retries: 3, RetryBackoff: 40 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	// 另一个连接持有排他锁一小段时间，模拟其他进程正在写入
+	other, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	other.SetMaxOpenConns(1)
+	if _, err := other.Exec(`BEGIN EXCLUSIVE`); err != nil {
+		t.Fatalf("加锁失败: %v", err)
+	}
+	go func() {
+		time.Sleep(60 * time.Millisecond)
+		other.Exec(`COMMIT`)
+	}()
+
+	id, err := s.SaveMessage(models.Message{Type: models.TypeChat, Username: "alice", Content: "hi", Timestamp: testEpoch})
+	if err != nil || id == 0 {
+		t.Fatalf("锁释放后重试应成功，实际 id=%d err=%v", id, err)
+	}
+	if err := s.Ping(); err != nil {
+		t.Fatalf("重试成功后存储应是健康的: %v", err)
+	}
+}
+
+func TestWithRetry(t *testing.T) {
+	busy := sqlite3.Error{Code: sqlite3.ErrBusy}
+	tests := []struct {
+		name      string
+		errs      []error // 依次返回的错误，用完后返回 nil
+		wantCalls int
+		wantErr   bool
+	}{
+		{"暂时性错误后成功", []error{busy, busy}, 3, false},
+		{"重试次数用完", []error{busy, busy, busy, busy}, 3, true},
+		{"非暂时性错误不重试", []error{sqlite3.Error{Code: sqlite3.ErrConstraint}}, 1, true},
+		{"普通错误不重试", []error{errors.New("boom")}, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &SQLiteMessageStore{retries: 2, retryBackoff: time.Millisecond}
+			calls := 0
+			err := s.withRetry("测试操作", func() error {
+				calls++
+				if calls <= len(tt.errs) {
+					return tt.errs[calls-1]
+				}
+				return nil
+			})
+			if calls != tt.wantCalls || (err != nil) != tt.wantErr {
+				t.Fatalf("调用 %d 次，错误 %v；期望调用 %d 次，出错 %v", calls, err, tt.wantCalls, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPersistentWriteFailureIsReportedByPing(t *testing.T) {
+	s := newTestStore(t, Config{Retries: 3, RetryBackoff: 40 * time.Millisecond})
+	busy := sqlite3.Error{Code: sqlite3.ErrFull}
+	if err := s.withWriteRetry("保存消息", func() error { return busy }); err == nil {
+		t.Fatal("写入应失败")
+	}
+	if err := s.Ping(); err == nil {
+		t.Fatal("写入持续失败时 Ping 应返回错误")
+	}
+	if err := s.withWriteRetry("保存消息", func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Ping(); err != nil {
+		t.Fatalf("写入恢复后 Ping 应成功: %v", err)
+	}
+}
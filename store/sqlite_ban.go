@@ -0,0 +1,111 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// SaveBan 封禁用户，已有记录（包括已过期的）时覆盖。
+func (s *SQLiteMessageStore) SaveBan(ban Ban) error {
+	upsertSQL := `INSERT INTO bans(username, reason, created_at, expires_at) VALUES(?, ?, ?, ?)
+		ON CONFLICT(username) DO UPDATE SET reason = excluded.reason, created_at = excluded.created_at, expires_at = excluded.expires_at`
+	var expires sql.NullString
+	if ban.Until != nil {
+		expires = sql.NullString{String: ban.Until.UTC().Format(time.RFC3339Nano), Valid: true}
+	}
+	err := s.withWriteRetry("保存封禁", func() error {
+		_, err := s.db.Exec(upsertSQL, ban.Username, ban.Reason, ban.CreatedAt.UTC().Format(time.RFC3339Nano), expires)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("封禁用户 %s 失败: %w", ban.Username, err)
+	}
+	return nil
+}
+
+// DeleteBan 解除封禁。已过期的记录也会被删除，但仍返回 ErrNotBanned。
+func (s *SQLiteMessageStore) DeleteBan(username string) error {
+	active := true
+	if _, err := s.GetBan(username); errors.Is(err, ErrNotBanned) {
+		active = false
+	} else if err != nil {
+		return err
+	}
+	err := s.withWriteRetry("解除封禁", func() error {
+		_, err := s.db.Exec(`DELETE FROM bans WHERE username = ?`, username)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("解除用户 %s 的封禁失败: %w", username, err)
+	}
+	if !active {
+		return ErrNotBanned
+	}
+	return nil
+}
+
+// GetBan 获取用户生效中的封禁。
+func (s *SQLiteMessageStore) GetBan(username string) (Ban, error) {
+	var ban Ban
+	err := s.withRetry("查询封禁", func() error {
+		var err error
+		ban, err = scanBan(s.db.QueryRow(`SELECT username, reason, created_at, expires_at FROM bans WHERE username = ?`, username))
+		return err
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return Ban{}, ErrNotBanned
+	}
+	if err != nil {
+		return Ban{}, fmt.Errorf("查询用户 %s 的封禁失败: %w", username, err)
+	}
+	if !ban.Active(s.clock.Now()) {
+		return Ban{}, ErrNotBanned
+	}
+	return ban, nil
+}
+
+// ListBans 列出 now 时仍然生效的封禁。
+func (s *SQLiteMessageStore) ListBans(now time.Time) ([]Ban, error) {
+	var bans []Ban
+	err := s.withRetry("查询封禁名单", func() error {
+		rows, err := s.db.Query(`SELECT username, reason, created_at, expires_at FROM bans ORDER BY created_at`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		bans = nil
+		for rows.Next() {
+			ban, err := scanBan(rows)
+			if err != nil {
+				return err
+			}
+			if ban.Active(now) {
+				bans = append(bans, ban)
+			}
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("查询封禁名单失败: %w", err)
+	}
+	return bans, nil
+}
+
+// scanBan 从一行 bans 记录中读取封禁。
+func scanBan(row rowScanner) (Ban, error) {
+	var ban Ban
+	var createdAt string
+	var expires sql.NullString
+	if err := row.Scan(&ban.Username, &ban.Reason, &createdAt, &expires); err != nil {
+		return Ban{}, err
+	}
+	t, err := time.Parse(time.RFC3339Nano, createdAt)
+	if err != nil {
+		return Ban{}, fmt.Errorf("解析封禁时间 '%s' 失败: %w", createdAt, err)
+	}
+	ban.CreatedAt = t.UTC()
+	ban.Until = parseNullTimestamp(expires)
+	return ban, nil
+}
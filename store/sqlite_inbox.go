@@ -0,0 +1,89 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"chatroom/models"
+)
+
+// SaveUndelivered 将私信保存到 inbox 表等待投递。计数和插入在同一条语句中完成，并发保存也不会超过 limit。
+func (s *SQLiteMessageStore) SaveUndelivered(recipient string, msg models.Message, limit int) error {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("序列化私信失败: %w", err)
+	}
+	insertSQL := `INSERT INTO inbox(recipient, payload, created_at)
+		SELECT ?, ?, ? WHERE (SELECT COUNT(*) FROM inbox WHERE recipient = ? AND delivered_at IS NULL) < ?`
+	var result sql.Result
+	err = s.withWriteRetry("保存离线私信", func() (err error) {
+		result, err = s.db.Exec(insertSQL, recipient, string(payload), s.clock.Now().UTC().Format(time.RFC3339Nano), recipient, limit)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("保存离线私信失败: %w", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("获取保存结果失败: %w", err)
+	}
+	if affected == 0 {
+		return ErrInboxFull
+	}
+	return nil
+}
+
+// TakeUndelivered 在一个事务中读取收件人所有待投递的私信并标记为已投递，同一条私信不会被投递两次。
+func (s *SQLiteMessageStore) TakeUndelivered(recipient string) ([]models.Message, error) {
+	var messages []models.Message
+	err := s.withWriteRetry("取出离线私信", func() error {
+		var err error
+		messages, err = s.takeUndelivered(recipient)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("取出离线私信失败: %w", err)
+	}
+	return messages, nil
+}
+
+func (s *SQLiteMessageStore) takeUndelivered(recipient string) ([]models.Message, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback() // 提交后调用不会产生影响
+
+	rows, err := tx.Query(`SELECT payload FROM inbox WHERE recipient = ? AND delivered_at IS NULL ORDER BY id`, recipient)
+	if err != nil {
+		return nil, err
+	}
+	var messages []models.Message
+	for rows.Next() {
+		var payload string
+		if err := rows.Scan(&payload); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		var msg models.Message
+		if err := json.Unmarshal([]byte(payload), &msg); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("解析私信失败: %w", err)
+		}
+		messages = append(messages, msg)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(messages) == 0 {
+		return nil, nil
+	}
+	now := s.clock.Now().UTC().Format(time.RFC3339Nano)
+	if _, err := tx.Exec(`UPDATE inbox SET delivered_at = ? WHERE recipient = ? AND delivered_at IS NULL`, now, recipient); err != nil {
+		return nil, err
+	}
+	return messages, tx.Commit()
+}
@@ -0,0 +1,35 @@
+package store
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"chatroom/models"
+)
+
+func TestInboxSaveAndTake(t *testing.T) {
+	s := newTestStore(t, Config{})
+	for _, content := range []string{"1", "2"} {
+		if err := s.SaveUndelivered("bob", models.Message{Type: models.TypeDirect, Username: "alice", Target: "bob", Content: content}, 2); err != nil {
+			t.Fatalf("保存离线私信失败: %v", err)
+		}
+	}
+	if err := s.SaveUndelivered("bob", models.Message{Type: models.TypeDirect, Content: "3"}, 2); !errors.Is(err, ErrInboxFull) {
+		t.Fatalf("收件箱已满时返回 %v，期望 ErrInboxFull", err)
+	}
+	if err := s.SaveUndelivered("carol", models.Message{Type: models.TypeDirect, Content: "c"}, 2); err != nil {
+		t.Fatalf("收件箱按收件人计数，carol 不受影响: %v", err)
+	}
+
+	msgs, err := s.TakeUndelivered("bob")
+	if err != nil || !slices.Equal(contents(msgs), []string{"1", "2"}) {
+		t.Fatalf("取出 bob 的离线私信 = %v (%v)，期望按发送顺序的 [1 2]", contents(msgs), err)
+	}
+	if msgs, err := s.TakeUndelivered("bob"); err != nil || len(msgs) != 0 {
+		t.Fatalf("已投递的私信又被取出: %v (%v)", contents(msgs), err)
+	}
+	if err := s.SaveUndelivered("bob", models.Message{Type: models.TypeDirect, Content: "4"}, 2); err != nil {
+		t.Fatalf("投递后收件箱应有空位: %v", err)
+	}
+}
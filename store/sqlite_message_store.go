@@ -2,21 +2,127 @@ package store
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"chatroom/clock"
 	"chatroom/models"
 	_ "github.com/mattn/go-sqlite3" // SQLite 驱动
 )
 
 type SQLiteMessageStore struct {
 	db *sql.DB
+
+	// persistTypes 是需要持久化的消息类型集合，其他类型的 SaveMessage 调用直接忽略
+	persistTypes map[models.MessageType]bool
+
+	// lastWrite 是最近一次写入消息的时间（UnixNano），后台整理据此避开写入繁忙的时段
+	lastWrite atomic.Int64
+
+	// retries 和 retryBackoff 控制暂时性数据库错误的重试（见 withRetry）
+	retries      int
+	retryBackoff time.Duration
+
+	// health 记录最近一次数据库操作的结果，Ping 据此报告持续失败
+	health health
+
+	// clock 提供写入记录的时间和判断封禁是否到期的当前时间
+	clock clock.Clock
+
+	// defaultRoom 是配置的默认房间（见 Config.DefaultRoom）
+	defaultRoom string
 }
 
-// NewSQLiteMessageStore 创建并返回一个新的 SQLiteMessageStore 实例
+// DefaultPersistTypes 是默认持久化的消息类型
+var DefaultPersistTypes = []models.MessageType{models.TypeChat, models.TypeJoin, models.TypeLeave}
+
+// Config 保存创建 SQLiteMessageStore 时的配置
+type Config struct {
+	// PersistTypes 是需要持久化的消息类型，为空时使用 DefaultPersistTypes。
+	// 只能包含 models.HistoryTypes 中的类型：其他类型是瞬时的（见 models.MessageType.Ephemeral），永远不会被保存，
+	// 包含它们的配置会被 NewSQLiteMessageStoreWithConfig 拒绝，而不是被静默忽略。
+	PersistTypes []models.MessageType
+
+	// JournalMode 设置 PRAGMA journal_mode，为空时使用 SQLite 默认值（DELETE）。
+	// WAL 让读写互不阻塞，并发写入吞吐量高得多；代价是数据库旁多出 -wal/-shm 文件，
+	// 且数据库文件不能放在网络文件系统上。
+	JournalMode string
+
+	// Synchronous 设置 PRAGMA synchronous，为空时使用 SQLite 默认值（FULL）。
+	// NORMAL 在 WAL 模式下仍能保证数据库不损坏，但掉电或系统崩溃时可能丢失最近提交的事务；
+	// FULL 每次提交都等待落盘，最安全也最慢；OFF 最快，但系统崩溃可能损坏数据库。
+	Synchronous string
+
+	// BusyTimeout 设置 PRAGMA busy_timeout：数据库被锁时等待多久才返回 "database is locked"。
+	// 0 表示使用 go-sqlite3 的默认值（5 秒）。更长的等待减少写入失败，但锁竞争严重时调用方会被阻塞更久。
+	BusyTimeout time.Duration
+
+	// Retries 是遇到暂时性错误（数据库被锁、磁盘已满、I/O 错误）时的重试次数，
+	// 0 表示使用 DefaultRetries，负数表示不重试。
+	Retries int
+
+	// RetryBackoff 是第一次重试前的等待时间，之后每次翻倍；0 表示使用 DefaultRetryBackoff。
+	RetryBackoff time.Duration
+
+	// Clock 提供当前时间，为 nil 时使用 clock.Real。测试中可以换成 clock.Fake。
+	Clock clock.Clock
+
+	// DefaultRoom 是默认房间，应与服务器的 -default-room 一致，为空时使用 models.DefaultRoom。
+	// 保存和查询时空房间名都指这个房间，升级表结构时没有房间的旧消息也归入它。
+	DefaultRoom string
+}
+
+// dsnWithPragmas 将配置中的 pragma 作为 go-sqlite3 的连接参数追加到数据源名称上。
+// 通过连接参数设置可以保证连接池中的每个连接都生效，而不只是执行 PRAGMA 的那一个连接。
+func dsnWithPragmas(dataSourceName string, cfg Config) string {
+	params := url.Values{}
+	if cfg.JournalMode != "" {
+		params.Set("_journal_mode", cfg.JournalMode)
+	}
+	if cfg.Synchronous != "" {
+		params.Set("_synchronous", cfg.Synchronous)
+	}
+	if cfg.BusyTimeout > 0 {
+		params.Set("_busy_timeout", strconv.FormatInt(cfg.BusyTimeout.Milliseconds(), 10))
+	}
+	if len(params) == 0 {
+		return dataSourceName
+	}
+	sep := "?"
+	if strings.Contains(dataSourceName, "?") {
+		sep = "&"
+	}
+	return dataSourceName + sep + params.Encode()
+}
+
+// NewSQLiteMessageStore 使用默认配置创建并返回一个新的 SQLiteMessageStore 实例
 func NewSQLiteMessageStore(dataSourceName string) (*SQLiteMessageStore, error) {
-	db, err := sql.Open("sqlite3", dataSourceName)
+	return NewSQLiteMessageStoreWithConfig(dataSourceName, Config{})
+}
+
+// NewSQLiteMessageStoreWithConfig 使用指定配置创建并返回一个新的 SQLiteMessageStore 实例，
+// PersistTypes 中包含瞬时类型时返回错误
+func NewSQLiteMessageStoreWithConfig(dataSourceName string, cfg Config) (*SQLiteMessageStore, error) {
+	types := cfg.PersistTypes
+	if len(types) == 0 {
+		types = DefaultPersistTypes
+	}
+	persistTypes := make(map[models.MessageType]bool, len(types))
+	for _, t := range types {
+		if t.Ephemeral() {
+			return nil, fmt.Errorf("消息类型 %q 是瞬时的，不能持久化（可以持久化的类型: %v）", t, models.HistoryTypes)
+		}
+		persistTypes[t] = true
+	}
+
+	db, err := sql.Open("sqlite3", dsnWithPragmas(dataSourceName, cfg))
 	if err != nil {
 		return nil, fmt.Errorf("打开数据库失败: %w", err)
 	}
@@ -24,47 +130,221 @@ func NewSQLiteMessageStore(dataSourceName string) (*SQLiteMessageStore, error) {
 	if err = db.Ping(); err != nil {
 		return nil, fmt.Errorf("连接数据库失败: %w", err)
 	}
-	return &SQLiteMessageStore{db: db}, nil
+	// 某些情况下 SQLite 会忽略请求的日志模式（例如内存数据库不支持 WAL），记录实际生效的模式
+	if cfg.JournalMode != "" {
+		var mode string
+		if err := db.QueryRow("PRAGMA journal_mode").Scan(&mode); err != nil {
+			return nil, fmt.Errorf("读取 journal_mode 失败: %w", err)
+		}
+		if !strings.EqualFold(mode, cfg.JournalMode) {
+			log.Printf("请求的 journal_mode 为 %s，实际生效的是 %s", cfg.JournalMode, mode)
+		}
+	}
+
+	retries := cfg.Retries
+	if retries == 0 {
+		retries = DefaultRetries
+	}
+	backoff := cfg.RetryBackoff
+	if backoff <= 0 {
+		backoff = DefaultRetryBackoff
+	}
+	clk := cfg.Clock
+	if clk == nil {
+		clk = clock.Real
+	}
+	defaultRoom := cfg.DefaultRoom
+	if defaultRoom == "" {
+		defaultRoom = models.DefaultRoom
+	}
+	return &SQLiteMessageStore{db: db, persistTypes: persistTypes, retries: retries, retryBackoff: backoff, clock: clk, defaultRoom: defaultRoom}, nil
 }
 
-// Init 初始化数据库，创建 messages 表
+// ShouldPersist 报告指定类型的消息是否会被持久化
+func (s *SQLiteMessageStore) ShouldPersist(msgType models.MessageType) bool {
+	return s.persistTypes[msgType]
+}
+
+// Init 初始化数据库：按顺序执行尚未应用的迁移（见 migrations.go），
+// 新数据库和旧版本的数据库都会被升级到最新的表结构；最后校验表结构，不兼容时返回说明原因的错误。
 func (s *SQLiteMessageStore) Init() error {
-	createTableSQL := `
-	CREATE TABLE IF NOT EXISTS messages (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		type TEXT NOT NULL,
-		username TEXT,
-		content TEXT,
-		timestamp DATETIME DEFAULT CURRENT_TIMESTAMP
-	);`
-	_, err := s.db.Exec(createTableSQL)
-	if err != nil {
-		return fmt.Errorf("创建 messages 表失败: %w", err)
+	if err := s.verifySchema(true); err != nil {
+		return err
+	}
+	if err := s.migrate(); err != nil {
+		return err
+	}
+	if err := s.verifySchema(false); err != nil {
+		return err
 	}
 	log.Println("SQLite 数据库表初始化成功。")
 	return nil
 }
 
-func (s *SQLiteMessageStore) SaveMessage(msg models.Message) error {
-	if msg.Type != "chat" && msg.Type != "join" && msg.Type != "leave" {
-		return nil
+// roomOrDefault 将空房间名视为配置的默认房间（见 Config.DefaultRoom）
+func (s *SQLiteMessageStore) roomOrDefault(room string) string {
+	if room == "" {
+		return s.defaultRoom
+	}
+	return room
+}
+
+// SaveMessage 保存消息并返回分配的消息 ID；不需要持久化的类型直接返回 0
+func (s *SQLiteMessageStore) SaveMessage(msg models.Message) (int64, error) {
+	// 瞬时消息（见 models.Message.IsEphemeral）和不在持久化集合中的类型直接忽略，不访问数据库
+	if msg.IsEphemeral() || !s.ShouldPersist(msg.Type) {
+		return 0, nil
 	}
 
 	// 将 time.Time 格式化为数据库能接受的字符串格式，通常推荐 ISO 8601 或 RFC3339
 	// SQLite 的 CURRENT_TIMESTAMP 默认是 "YYYY-MM-DD HH:MM:SS" 或 "YYYY-MM-DD HH:MM:SS.SSS"
 	// 为了兼容，我们存入数据库时使用 time.RFC3339Nano 格式，这是最完整的格式
-	insertSQL := `INSERT INTO messages(type, username, content, timestamp) VALUES(?, ?, ?, ?)`
-	_, err := s.db.Exec(insertSQL, msg.Type, msg.Username, msg.Content, msg.Timestamp.Format(time.RFC3339Nano)) // <--- 关键修正：存储时格式化
+	// 时间戳统一以 UTC 保存，历史消息的时间与服务器所在时区无关
+	msg.Timestamp = msg.Timestamp.UTC()
+	// payload 保存完整的消息 JSON，使各列之外的字段（例如 Users、Error）也能在读取时还原
+	payload, err := json.Marshal(msg)
 	if err != nil {
-		return fmt.Errorf("保存消息失败: %w", err)
+		return 0, fmt.Errorf("序列化消息失败: %w", err)
 	}
-	return nil
+	insertSQL := `INSERT INTO messages(type, username, content, timestamp, room, reply_to, seq, payload) VALUES(?, ?, ?, ?, ?, ?, ?, ?)`
+	var result sql.Result
+	err = s.withWriteRetry("保存消息", func() (err error) {
+		result, err = s.db.Exec(insertSQL, string(msg.Type), msg.Username, msg.Content, msg.Timestamp.Format(time.RFC3339Nano), s.roomOrDefault(msg.Room), nullInt64(msg.ReplyTo), nullInt64(msg.Seq), string(payload)) // <--- 关键修正：存储时格式化
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("保存消息失败: %w", err)
+	}
+	s.lastWrite.Store(s.clock.Now().UnixNano())
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("获取消息 ID 失败: %w", err)
+	}
+	return id, nil
+}
+
+// nullInt64 将 0 视为 NULL，用于可选的整数列
+func nullInt64(v int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: v, Valid: v != 0}
 }
 
-// GetMessages 获取最近的 N 条消息
-func (s *SQLiteMessageStore) GetMessages(limit int) ([]models.Message, error) {
-	query := `SELECT type, username, content, timestamp FROM messages ORDER BY timestamp DESC LIMIT ?`
-	rows, err := s.db.Query(query, limit)
+// messageColumns 是查询消息时选取的列，顺序与 scanMessage 一致
+const messageColumns = `id, type, username, content, timestamp, room, reply_to, seq, payload`
+
+// rowScanner 是 *sql.Row 和 *sql.Rows 共有的 Scan 方法
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanMessage 按 messageColumns 的顺序读取一行消息。
+// 有 payload 时先从中还原完整的消息，再用各列的值覆盖，列是查询和修改的依据。
+func scanMessage(row rowScanner) (models.Message, error) {
+	var msg models.Message
+	var timestampStr string
+	var replyTo, seq sql.NullInt64
+	var payload sql.NullString
+	var id int64
+	var msgType, username, content, room string
+	if err := row.Scan(&id, &msgType, &username, &content, &timestampStr, &room, &replyTo, &seq, &payload); err != nil {
+		return models.Message{}, err
+	}
+	if payload.Valid && payload.String != "" {
+		if err := json.Unmarshal([]byte(payload.String), &msg); err != nil {
+			log.Printf("警告: 解析消息 %d 的 payload 失败: %v", id, err)
+			msg = models.Message{}
+		}
+	}
+	msg.ID, msg.Type, msg.Username, msg.Content, msg.Room = id, models.MessageType(msgType), username, content, room
+	// <--- 关键修正：读取时使用 time.RFC3339Nano 解析
+	parsedTime, err := time.Parse(time.RFC3339Nano, timestampStr)
+	if err != nil {
+		log.Printf("警告: 解析时间戳 '%s' 失败: %v", timestampStr, err)
+		parsedTime = time.Now() // 回退到当前时间
+	}
+	msg.Timestamp = parsedTime.UTC() // 旧数据可能带有服务器本地时区的偏移，读取时统一转换为 UTC
+	msg.ReplyTo = replyTo.Int64
+	msg.Seq = seq.Int64
+	return msg, nil
+}
+
+// GetMessages 获取指定房间最近的 N 条消息，空房间名表示默认房间
+func (s *SQLiteMessageStore) GetMessages(room string, limit int) ([]models.Message, error) {
+	return s.GetMessagesOfTypes(room, nil, limit)
+}
+
+// GetMessagesOfTypes 获取指定房间最近的 N 条指定类型的消息，types 为空时不按类型过滤
+func (s *SQLiteMessageStore) GetMessagesOfTypes(room string, types []models.MessageType, limit int) ([]models.Message, error) {
+	query := `SELECT ` + messageColumns + ` FROM messages WHERE room = ?`
+	args := []interface{}{s.roomOrDefault(room)}
+	if len(types) > 0 {
+		// 类型数量可变，占位符按数量生成，值仍然通过参数传递
+		query += ` AND type IN (?` + strings.Repeat(`, ?`, len(types)-1) + `)`
+		for _, t := range types {
+			args = append(args, string(t))
+		}
+	}
+	query += ` ORDER BY timestamp DESC LIMIT ?`
+	args = append(args, limit)
+	return s.queryLatest(query, args...)
+}
+
+// GetMessagesByUser 获取用户在所有房间中最近发送的 N 条聊天消息，按时间顺序返回。
+// 用户名按规范化形式（models.UserKey）比较；SQLite 的 lower 只转换 ASCII 字母，非 ASCII 的大小写变体不会匹配。
+func (s *SQLiteMessageStore) GetMessagesByUser(username string, limit int) ([]models.Message, error) {
+	query := `SELECT ` + messageColumns + ` FROM messages WHERE lower(trim(username)) = ? AND type = ? ORDER BY id DESC LIMIT ?`
+	return s.queryLatest(query, models.UserKey(username), string(models.TypeChat), limit)
+}
+
+// GetUserRooms 按房间分组统计用户的消息，以每个房间中最新一条消息的 ID 判断先后，最近活跃的房间在前
+func (s *SQLiteMessageStore) GetUserRooms(username string, limit int) ([]UserRoom, error) {
+	query := `SELECT m.room, r.total, m.timestamp FROM messages m
+		JOIN (SELECT room, MAX(id) AS last_id, COUNT(*) AS total FROM messages WHERE lower(trim(username)) = ? GROUP BY room) r
+		ON m.id = r.last_id
+		ORDER BY m.id DESC LIMIT ?`
+	var rooms []UserRoom
+	err := s.withRetry("查询用户房间", func() error {
+		rooms = nil
+		rows, err := s.db.Query(query, models.UserKey(username), limit)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var room UserRoom
+			var last sql.NullString
+			if err := rows.Scan(&room.Room, &room.Count, &last); err != nil {
+				return err
+			}
+			room.LastActive = parseNullTimestamp(last)
+			rooms = append(rooms, room)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return nil, fmt.Errorf("查询用户 %s 的房间失败: %w", username, err)
+	}
+	return rooms, nil
+}
+
+// queryLatest 执行按时间倒序取最近 N 条的查询，并把结果翻转为时间顺序返回。
+func (s *SQLiteMessageStore) queryLatest(query string, args ...interface{}) ([]models.Message, error) {
+	var messages []models.Message
+	err := s.withRetry("查询消息", func() (err error) {
+		messages, err = s.queryMessages(query, args...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
+// queryMessages 执行返回 messageColumns 各列的查询，按查询结果的顺序返回消息。
+func (s *SQLiteMessageStore) queryMessages(query string, args ...interface{}) ([]models.Message, error) {
+	rows, err := s.db.Query(query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("查询消息失败: %w", err)
 	}
@@ -72,32 +352,295 @@ func (s *SQLiteMessageStore) GetMessages(limit int) ([]models.Message, error) {
 
 	var messages []models.Message
 	for rows.Next() {
-		var msg models.Message
-		var timestampStr string
-		if err := rows.Scan(&msg.Type, &msg.Username, &msg.Content, &timestampStr); err != nil {
-			return nil, fmt.Errorf("扫描消息行失败: %w", err)
-		}
-		// <--- 关键修正：读取时使用 time.RFC3339Nano 解析
-		parsedTime, err := time.Parse(time.RFC3339Nano, timestampStr)
+		msg, err := scanMessage(rows)
 		if err != nil {
-			log.Printf("警告: 解析时间戳 '%s' 失败: %v", timestampStr, err)
-			parsedTime = time.Now() // 回退到当前时间
+			return nil, fmt.Errorf("扫描消息行失败: %w", err)
 		}
-		msg.Timestamp = parsedTime
 		messages = append(messages, msg)
 	}
 
 	if err := rows.Err(); err != nil {
 		return nil, fmt.Errorf("行迭代错误: %w", err)
 	}
+	return messages, nil
+}
 
-	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
-		messages[i], messages[j] = messages[j], messages[i]
+// GetMessageByID 按 ID 获取单条消息，消息不存在时返回 ErrMessageNotFound
+func (s *SQLiteMessageStore) GetMessageByID(id int64) (models.Message, error) {
+	query := `SELECT ` + messageColumns + ` FROM messages WHERE id = ?`
+	var msg models.Message
+	err := s.withRetry("查询消息", func() (err error) {
+		msg, err = scanMessage(s.db.QueryRow(query, id))
+		return err
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return models.Message{}, ErrMessageNotFound
+	}
+	if err != nil {
+		return models.Message{}, fmt.Errorf("查询消息 %d 失败: %w", id, err)
 	}
+	return msg, nil
+}
 
+// EachMessage 按 ID 升序逐行读取房间的全部消息，用于导出等需要遍历整个历史的场景。
+// 只有打开查询时会重试暂时性错误；开始遍历后出错直接返回，因为 fn 可能已经处理了一部分消息。
+func (s *SQLiteMessageStore) EachMessage(room string, fn func(msg models.Message) error) error {
+	var rows *sql.Rows
+	err := s.withRetry("遍历消息", func() (err error) {
+		rows, err = s.db.Query(`SELECT `+messageColumns+` FROM messages WHERE room = ? ORDER BY id`, s.roomOrDefault(room))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("查询房间 %s 的消息失败: %w", room, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		msg, err := scanMessage(rows)
+		if err != nil {
+			return fmt.Errorf("读取消息失败: %w", err)
+		}
+		if err := fn(msg); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("遍历房间 %s 的消息失败: %w", room, err)
+	}
+	return nil
+}
+
+// DeleteMessage 按 ID 删除消息，消息不存在时返回 ErrMessageNotFound
+func (s *SQLiteMessageStore) DeleteMessage(id int64) error {
+	var result sql.Result
+	err := s.withWriteRetry("删除消息", func() (err error) {
+		result, err = s.db.Exec(`DELETE FROM messages WHERE id = ?`, id)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("删除消息 %d 失败: %w", id, err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("获取删除结果失败: %w", err)
+	}
+	if affected == 0 {
+		return ErrMessageNotFound
+	}
+	return nil
+}
+
+// DeleteMessagesByUser 删除用户在指定房间的所有消息（包括加入、离开记录），room 为空时删除所有房间中的，返回删除的条数
+func (s *SQLiteMessageStore) DeleteMessagesByUser(username, room string) (int64, error) {
+	query := `DELETE FROM messages WHERE lower(trim(username)) = ?`
+	args := []interface{}{models.UserKey(username)}
+	if room != "" {
+		query += ` AND room = ?`
+		args = append(args, room)
+	}
+	var result sql.Result
+	err := s.withWriteRetry("删除用户消息", func() (err error) {
+		result, err = s.db.Exec(query, args...)
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("删除用户 %s 的消息失败: %w", username, err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("获取删除结果失败: %w", err)
+	}
+	return affected, nil
+}
+
+// SetPinned 置顶或取消置顶消息，消息不存在时返回 ErrMessageNotFound
+func (s *SQLiteMessageStore) SetPinned(id int64, pinned bool) error {
+	var result sql.Result
+	err := s.withWriteRetry("更新置顶状态", func() (err error) {
+		result, err = s.db.Exec(`UPDATE messages SET pinned = ? WHERE id = ?`, pinned, id)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("更新消息 %d 的置顶状态失败: %w", id, err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("获取更新结果失败: %w", err)
+	}
+	if affected == 0 {
+		return ErrMessageNotFound
+	}
+	return nil
+}
+
+// GetPinnedMessages 获取房间内当前置顶的消息，按 ID 升序，空房间名表示默认房间
+func (s *SQLiteMessageStore) GetPinnedMessages(room string) ([]models.Message, error) {
+	query := `SELECT ` + messageColumns + ` FROM messages WHERE room = ? AND pinned = 1 ORDER BY id`
+	var messages []models.Message
+	err := s.withRetry("查询置顶消息", func() (err error) {
+		messages, err = s.queryMessages(query, s.roomOrDefault(room))
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("查询置顶消息失败: %w", err)
+	}
 	return messages, nil
 }
 
+// LastSeq 获取房间内已持久化的最大消息序号，没有消息时返回 0
+func (s *SQLiteMessageStore) LastSeq(room string) (int64, error) {
+	var seq sql.NullInt64
+	err := s.withRetry("查询消息序号", func() error {
+		return s.db.QueryRow(`SELECT MAX(seq) FROM messages WHERE room = ?`, s.roomOrDefault(room)).Scan(&seq)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("查询房间 %s 的消息序号失败: %w", room, err)
+	}
+	return seq.Int64, nil
+}
+
+// OldestMessageID 获取房间内最早一条消息的 ID，没有消息时返回 0。
+// 消息 ID 按插入顺序递增，客户端向前翻页到这条消息时就知道已经到了历史的开头。
+func (s *SQLiteMessageStore) OldestMessageID(room string) (int64, error) {
+	var id sql.NullInt64
+	err := s.withRetry("查询最早的消息", func() error {
+		return s.db.QueryRow(`SELECT MIN(id) FROM messages WHERE room = ?`, s.roomOrDefault(room)).Scan(&id)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("查询房间 %s 最早的消息失败: %w", room, err)
+	}
+	return id.Int64, nil
+}
+
+// CountMessages 获取房间内保存的消息总数，空房间名表示默认房间（与 OldestMessageID 一致）。
+// 客户端分页加载历史时据此显示滚动条和"加载更多"。
+func (s *SQLiteMessageStore) CountMessages(room string) (int, error) {
+	var count int
+	err := s.withRetry("统计消息数", func() error {
+		return s.db.QueryRow(`SELECT COUNT(*) FROM messages WHERE room = ?`, s.roomOrDefault(room)).Scan(&count)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("统计房间 %q 的消息数失败: %w", room, err)
+	}
+	return count, nil
+}
+
+// countBy 执行 "SELECT 列, COUNT(*) ... GROUP BY 列" 形式的查询，返回各分组的数量
+func (s *SQLiteMessageStore) countBy(query string) (map[string]int, error) {
+	rows, err := s.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := make(map[string]int)
+	for rows.Next() {
+		var key string
+		var count int
+		if err := rows.Scan(&key, &count); err != nil {
+			return nil, fmt.Errorf("扫描统计行失败: %w", err)
+		}
+		counts[key] = count
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("行迭代错误: %w", err)
+	}
+	return counts, nil
+}
+
+// Stats 使用聚合查询统计消息总数、各类型和各房间的数量以及最早/最新消息的时间
+func (s *SQLiteMessageStore) Stats() (Stats, error) {
+	var stats Stats
+
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM messages`).Scan(&stats.Total)
+	if err != nil {
+		return Stats{}, fmt.Errorf("统计消息数量失败: %w", err)
+	}
+	// RFC3339Nano 会省略小数部分末尾的 0，时间戳字符串不是定宽的，MIN/MAX 按字符串比较会排错顺序，
+	// 因此按自增 ID 取第一条和最后一条消息的时间戳
+	if stats.Oldest, err = s.edgeTimestamp(`SELECT timestamp FROM messages ORDER BY id ASC LIMIT 1`); err != nil {
+		return Stats{}, fmt.Errorf("查询最早消息时间失败: %w", err)
+	}
+	if stats.Newest, err = s.edgeTimestamp(`SELECT timestamp FROM messages ORDER BY id DESC LIMIT 1`); err != nil {
+		return Stats{}, fmt.Errorf("查询最新消息时间失败: %w", err)
+	}
+
+	if stats.ByType, err = s.countBy(`SELECT type, COUNT(*) FROM messages GROUP BY type`); err != nil {
+		return Stats{}, fmt.Errorf("按类型统计消息失败: %w", err)
+	}
+	if stats.ByRoom, err = s.countBy(`SELECT room, COUNT(*) FROM messages GROUP BY room`); err != nil {
+		return Stats{}, fmt.Errorf("按房间统计消息失败: %w", err)
+	}
+	return stats, nil
+}
+
+// edgeTimestamp 执行返回单个时间戳的查询，没有消息时返回 nil
+func (s *SQLiteMessageStore) edgeTimestamp(query string) (*time.Time, error) {
+	var ts sql.NullString
+	err := s.db.QueryRow(query).Scan(&ts)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return parseNullTimestamp(ts), nil
+}
+
+// parseNullTimestamp 解析可能为 NULL 的时间戳列，NULL 或无法解析时返回 nil
+func parseNullTimestamp(ns sql.NullString) *time.Time {
+	if !ns.Valid {
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, ns.String)
+	if err != nil {
+		log.Printf("警告: 解析时间戳 '%s' 失败: %v", ns.String, err)
+		return nil
+	}
+	t = t.UTC()
+	return &t
+}
+
+// UpdateLastSeen 记录用户的最后在线时间，已有记录时覆盖
+func (s *SQLiteMessageStore) UpdateLastSeen(username string, t time.Time) error {
+	upsertSQL := `INSERT INTO users(username, last_seen) VALUES(?, ?)
+		ON CONFLICT(username) DO UPDATE SET last_seen = excluded.last_seen`
+	err := s.withWriteRetry("更新最后在线时间", func() error {
+		_, err := s.db.Exec(upsertSQL, username, t.UTC().Format(time.RFC3339Nano))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("更新用户 %s 最后在线时间失败: %w", username, err)
+	}
+	return nil
+}
+
+// GetLastSeen 获取用户的最后在线时间，无记录时返回 ErrUserNotFound
+func (s *SQLiteMessageStore) GetLastSeen(username string) (time.Time, error) {
+	var lastSeenStr string
+	err := s.withRetry("查询最后在线时间", func() error {
+		return s.db.QueryRow(`SELECT last_seen FROM users WHERE username = ?`, username).Scan(&lastSeenStr)
+	})
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, ErrUserNotFound
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("查询用户 %s 最后在线时间失败: %w", username, err)
+	}
+	lastSeen, err := time.Parse(time.RFC3339Nano, lastSeenStr)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("解析最后在线时间 '%s' 失败: %w", lastSeenStr, err)
+	}
+	return lastSeen.UTC(), nil
+}
+
+// Ping 检查数据库连接是否可用。最近一次数据库操作在重试之后仍然失败时，
+// 即使连接本身正常（例如磁盘已满时读取仍然可以成功）也返回错误，直到下一次操作成功。
+func (s *SQLiteMessageStore) Ping() error {
+	if err := s.db.Ping(); err != nil {
+		return fmt.Errorf("数据库不可用: %w", err)
+	}
+	return s.health.err()
+}
+
 // Close 关闭数据库连接
 func (s *SQLiteMessageStore) Close() error {
 	return s.db.Close()
@@ -0,0 +1,541 @@
+package store
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"chatroom/models"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// testEpoch 是测试消息的基准时间，固定的时间让断言不依赖运行时刻。
+var testEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// newTestStore 在临时目录中创建并初始化一个存储。
+func newTestStore(t *testing.T, cfg Config) *SQLiteMessageStore {
+	t.Helper()
+	s, err := NewSQLiteMessageStoreWithConfig(filepath.Join(t.TempDir(), "chat.db"), cfg)
+	if err != nil {
+		t.Fatalf("创建存储失败: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	if err := s.Init(); err != nil {
+		t.Fatalf("初始化存储失败: %v", err)
+	}
+	return s
+}
+
+// save 保存一条消息并返回分配的 ID。
+func save(t *testing.T, s *SQLiteMessageStore, msg models.Message) int64 {
+	t.Helper()
+	if msg.Type == "" {
+		msg.Type = models.TypeChat
+	}
+	if msg.Timestamp.IsZero() {
+		msg.Timestamp = testEpoch
+	}
+	id, err := s.SaveMessage(msg)
+	if err != nil {
+		t.Fatalf("保存消息失败: %v", err)
+	}
+	return id
+}
+
+// saveChat 在 room 中保存一条 alice 的聊天消息，时间为 testEpoch 之后 minute 分钟。
+func saveChat(t *testing.T, s *SQLiteMessageStore, room, content string, minute int) int64 {
+	t.Helper()
+	return save(t, s, models.Message{
+		Username:  "alice",
+		Room:      room,
+		Content:   content,
+		Timestamp: testEpoch.Add(time.Duration(minute) * time.Minute),
+	})
+}
+
+// contents 提取消息内容，便于比较。
+func contents(msgs []models.Message) []string {
+	out := make([]string, len(msgs))
+	for i, msg := range msgs {
+		out[i] = msg.Content
+	}
+	return out
+}
+
+func TestCountMessages(t *testing.T) {
+	s := newTestStore(t, Config{})
+	if n, err := s.CountMessages("empty"); err != nil || n != 0 {
+		t.Fatalf("空房间的消息数 = %d, %v，期望 0", n, err)
+	}
+
+	saveChat(t, s, "general", "a", 0)
+	saveChat(t, s, "general", "b", 1)
+	saveChat(t, s, "other", "c", 2)
+
+	for room, want := range map[string]int{"general": 2, "other": 1, "empty": 0, "": 2} {
+		n, err := s.CountMessages(room)
+		if err != nil {
+			t.Fatalf("统计房间 %q 失败: %v", room, err)
+		}
+		if n != want {
+			t.Errorf("房间 %q 的消息数 = %d，期望 %d", room, n, want)
+		}
+	}
+}
+
+func TestEmptyRoomMeansConfiguredDefault(t *testing.T) {
+	s := newTestStore(t, Config{DefaultRoom: "lobby"})
+	save(t, s, models.Message{Username: "alice", Content: "a"})
+	saveChat(t, s, "lobby", "b", 1)
+	saveChat(t, s, models.DefaultRoom, "c", 2)
+
+	for room, want := range map[string]int{"": 2, "lobby": 2, models.DefaultRoom: 1} {
+		if n, err := s.CountMessages(room); err != nil || n != want {
+			t.Errorf("房间 %q 的消息数 = %d (%v)，期望 %d", room, n, err, want)
+		}
+	}
+	msgs, err := s.GetMessages("", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := contents(msgs); !slices.Equal(got, []string{"a", "b"}) {
+		t.Fatalf("空房间名取到的消息 = %v，期望 lobby 中的 [a b]", got)
+	}
+}
+
+func TestStatsEmptyStore(t *testing.T) {
+	s := newTestStore(t, Config{})
+	stats, err := s.Stats()
+	if err != nil {
+		t.Fatalf("Stats 失败: %v", err)
+	}
+	if stats.Total != 0 || len(stats.ByType) != 0 || len(stats.ByRoom) != 0 {
+		t.Errorf("空存储的统计应全为零，实际 %+v", stats)
+	}
+	if stats.Oldest != nil || stats.Newest != nil {
+		t.Errorf("空存储没有最早和最新时间，实际 oldest=%v newest=%v", stats.Oldest, stats.Newest)
+	}
+}
+
+func TestStatsPopulatedStore(t *testing.T) {
+	s := newTestStore(t, Config{})
+	// 整秒的时间戳格式化为 "...00Z"，带小数的为 "...00.5Z"，按字符串比较时前者反而更大
+	save(t, s, models.Message{Username: "alice", Room: "general", Content: "a", Timestamp: testEpoch})
+	save(t, s, models.Message{Type: models.TypeJoin, Username: "bob", Room: "dev", Timestamp: testEpoch.Add(250 * time.Millisecond)})
+	save(t, s, models.Message{Username: "bob", Room: "dev", Content: "b", Timestamp: testEpoch.Add(500 * time.Millisecond)})
+
+	stats, err := s.Stats()
+	if err != nil {
+		t.Fatalf("Stats 失败: %v", err)
+	}
+	if stats.Total != 3 {
+		t.Errorf("Total = %d，期望 3", stats.Total)
+	}
+	if want := map[string]int{"chat": 2, "join": 1}; !reflect.DeepEqual(stats.ByType, want) {
+		t.Errorf("ByType = %v，期望 %v", stats.ByType, want)
+	}
+	if want := map[string]int{"general": 1, "dev": 2}; !reflect.DeepEqual(stats.ByRoom, want) {
+		t.Errorf("ByRoom = %v，期望 %v", stats.ByRoom, want)
+	}
+	if stats.Oldest == nil || !stats.Oldest.Equal(testEpoch) {
+		t.Errorf("Oldest = %v，期望 %v", stats.Oldest, testEpoch)
+	}
+	if want := testEpoch.Add(500 * time.Millisecond); stats.Newest == nil || !stats.Newest.Equal(want) {
+		t.Errorf("Newest = %v，期望 %v", stats.Newest, want)
+	}
+}
+
+func TestPersistTypesRejectEphemeralTypes(t *testing.T) {
+	_, err := NewSQLiteMessageStoreWithConfig(filepath.Join(t.TempDir(), "chat.db"), Config{
+		PersistTypes: []models.MessageType{models.TypeChat, models.TypePresence},
+	})
+	if err == nil {
+		t.Fatal("持久化类型包含瞬时类型 presence 时应返回错误")
+	}
+}
+
+func TestSaveMessageHonoursPersistTypesAndEphemeral(t *testing.T) {
+	s := newTestStore(t, Config{PersistTypes: []models.MessageType{models.TypeChat, models.TypeAnnouncement}})
+
+	tests := []struct {
+		name  string
+		msg   models.Message
+		saved bool
+	}{
+		{"持久化的类型", models.Message{Type: models.TypeChat, Content: "kept"}, true},
+		{"不在持久化集合中的类型", models.Message{Type: models.TypeJoin, Content: "join"}, false},
+		{"显式瞬时的聊天消息", models.Message{Type: models.TypeChat, Content: "secret", Ephemeral: true}, false},
+		{"显式瞬时的公告", models.Message{Type: models.TypeAnnouncement, Content: "notice", Ephemeral: true}, false},
+		{"持久化的公告", models.Message{Type: models.TypeAnnouncement, Content: "notice"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before, _ := s.CountMessages("")
+			id := save(t, s, tt.msg)
+			after, _ := s.CountMessages("")
+			if saved := id != 0 && after == before+1; saved != tt.saved {
+				t.Fatalf("保存结果 = %v (id=%d, 条数 %d -> %d)，期望 %v", saved, id, before, after, tt.saved)
+			}
+		})
+	}
+}
+
+func TestOldestMessageID(t *testing.T) {
+	s := newTestStore(t, Config{})
+	if id, err := s.OldestMessageID("general"); err != nil || id != 0 {
+		t.Fatalf("空房间最早的消息 ID = %d, %v，期望 0", id, err)
+	}
+
+	other := saveChat(t, s, "other", "x", 0)
+	deleted := saveChat(t, s, "general", "a", 1)
+	oldest := saveChat(t, s, "general", "b", 2)
+	saveChat(t, s, "general", "c", 3)
+	if err := s.DeleteMessage(deleted); err != nil {
+		t.Fatal(err)
+	}
+
+	// 删除最早的消息后，下一条成为开头；空房间名表示默认房间
+	for room, want := range map[string]int64{"general": oldest, "": oldest, "other": other, "empty": 0} {
+		if id, err := s.OldestMessageID(room); err != nil || id != want {
+			t.Errorf("房间 %q 最早的消息 ID = %d, %v，期望 %d", room, id, err, want)
+		}
+	}
+}
+
+func TestSaveMessageSkipsUnpersistedTypeWithoutDB(t *testing.T) {
+	s := newTestStore(t, Config{}) // 默认集合不包含公告
+	if s.ShouldPersist(models.TypeAnnouncement) {
+		t.Fatal("默认不应持久化公告")
+	}
+	s.Close() // 之后任何数据库访问都会失败
+
+	id, err := s.SaveMessage(models.Message{Type: models.TypeAnnouncement, Content: "notice", Timestamp: testEpoch})
+	if err != nil || id != 0 {
+		t.Fatalf("不持久化的类型应直接返回 (0, nil)，实际 (%d, %v)", id, err)
+	}
+	if _, err := s.SaveMessage(models.Message{Type: models.TypeChat, Content: "hi", Timestamp: testEpoch}); err == nil {
+		t.Fatal("数据库已关闭，持久化的类型应保存失败")
+	}
+}
+
+func TestGetMessageByID(t *testing.T) {
+	s := newTestStore(t, Config{})
+	id := saveChat(t, s, "general", "hello", 0)
+
+	msg, err := s.GetMessageByID(id)
+	if err != nil {
+		t.Fatalf("获取存在的消息失败: %v", err)
+	}
+	if msg.ID != id || msg.Content != "hello" || msg.Username != "alice" || msg.Room != "general" {
+		t.Fatalf("取回的消息 = %+v", msg)
+	}
+
+	if _, err := s.GetMessageByID(id + 100); !errors.Is(err, ErrMessageNotFound) {
+		t.Fatalf("获取不存在的消息应返回 ErrMessageNotFound，实际 %v", err)
+	}
+}
+
+func TestDeleteMessage(t *testing.T) {
+	s := newTestStore(t, Config{})
+	id := saveChat(t, s, "general", "hello", 0)
+	other := saveChat(t, s, "general", "keep", 1)
+
+	if err := s.DeleteMessage(id); err != nil {
+		t.Fatalf("删除存在的消息失败: %v", err)
+	}
+	if _, err := s.GetMessageByID(id); !errors.Is(err, ErrMessageNotFound) {
+		t.Fatalf("删除后仍能取到消息: %v", err)
+	}
+	if _, err := s.GetMessageByID(other); err != nil {
+		t.Fatalf("删除一条消息不应影响其他消息: %v", err)
+	}
+
+	if err := s.DeleteMessage(id); !errors.Is(err, ErrMessageNotFound) {
+		t.Fatalf("再次删除应返回 ErrMessageNotFound，实际 %v", err)
+	}
+}
+
+func TestGetMessagesIsolatesRooms(t *testing.T) {
+	s := newTestStore(t, Config{})
+	saveChat(t, s, "a", "a1", 0)
+	saveChat(t, s, "b", "b1", 1)
+	saveChat(t, s, "a", "a2", 2)
+	saveChat(t, s, models.DefaultRoom, "g1", 3)
+
+	tests := []struct {
+		room string
+		want []string
+	}{
+		{"a", []string{"a1", "a2"}},
+		{"b", []string{"b1"}},
+		{"c", []string{}},
+		{"", []string{"g1"}}, // 空房间名表示默认房间
+	}
+	for _, tt := range tests {
+		msgs, err := s.GetMessages(tt.room, 10)
+		if err != nil {
+			t.Fatalf("读取房间 %q 失败: %v", tt.room, err)
+		}
+		if got := contents(msgs); !slices.Equal(got, tt.want) {
+			t.Errorf("房间 %q 的消息 = %v，期望 %v", tt.room, got, tt.want)
+		}
+	}
+}
+
+func TestReplyToRoundTrip(t *testing.T) {
+	s := newTestStore(t, Config{})
+	parent := saveChat(t, s, "general", "question", 0)
+	reply := save(t, s, models.Message{Username: "bob", Room: "general", Content: "answer", ReplyTo: parent, Timestamp: testEpoch.Add(time.Minute)})
+
+	msgs, err := s.GetMessages("general", 10)
+	if err != nil {
+		t.Fatalf("获取消息失败: %v", err)
+	}
+	if len(msgs) != 2 || msgs[0].ReplyTo != 0 || msgs[1].ID != reply || msgs[1].ReplyTo != parent {
+		t.Fatalf("取回的消息 = %+v，期望 answer 回复 question (ID %d)", msgs, parent)
+	}
+	got, err := s.GetMessageByID(reply)
+	if err != nil || got.ReplyTo != parent {
+		t.Fatalf("按 ID 取回的回复 = %+v (%v)，期望 ReplyTo=%d", got, err, parent)
+	}
+}
+
+func TestPragmasTakeEffect(t *testing.T) {
+	s := newTestStore(t, Config{JournalMode: "WAL", Synchronous: "NORMAL", BusyTimeout: 2 * time.Second})
+
+	pragma := func(name string) string {
+		var value string
+		if err := s.db.QueryRow("PRAGMA " + name).Scan(&value); err != nil {
+			t.Fatalf("读取 %s 失败: %v", name, err)
+		}
+		return value
+	}
+	for _, tt := range []struct{ name, want string }{
+		{"journal_mode", "wal"},
+		{"synchronous", "1"}, // NORMAL
+		{"busy_timeout", "2000"},
+	} {
+		if got := pragma(tt.name); got != tt.want {
+			t.Errorf("PRAGMA %s = %s，期望 %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestFullPayloadRoundTrip(t *testing.T) {
+	s := newTestStore(t, Config{})
+	lastSeen := testEpoch.Add(-time.Hour)
+	want := models.Message{
+		Type:      models.TypeJoin,
+		Username:  "alice",
+		Room:      "general",
+		Content:   "alice 加入了聊天室",
+		Timestamp: testEpoch,
+		Users:     []string{"alice", "bob"},
+		Statuses:  map[string]string{"bob": "开会中"},
+		LastSeen:  &lastSeen,
+		TextKey:   "join",
+		Meta:      map[string]interface{}{"client": "web", "beta": true},
+	}
+	want.ID = save(t, s, want)
+
+	msgs, err := s.GetMessages("general", 10)
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("获取消息 = %+v (%v)", msgs, err)
+	}
+	if !reflect.DeepEqual(msgs[0], want) {
+		t.Fatalf("取回的消息 = %+v\n期望 %+v", msgs[0], want)
+	}
+}
+
+func TestRowWithoutPayloadIsReadFromColumns(t *testing.T) {
+	s := newTestStore(t, Config{})
+	// 早期版本写入的行没有 payload
+	_, err := s.db.Exec(`INSERT INTO messages(type, username, content, timestamp, room) VALUES('chat', 'bob', 'old', ?, 'general')`, testEpoch.Format(time.RFC3339Nano))
+	if err != nil {
+		t.Fatalf("插入旧格式的行失败: %v", err)
+	}
+	msgs, err := s.GetMessages("general", 10)
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("获取消息 = %+v (%v)", msgs, err)
+	}
+	if got := msgs[0]; got.Type != models.TypeChat || got.Username != "bob" || got.Content != "old" || !got.Timestamp.Equal(testEpoch) {
+		t.Fatalf("取回的消息 = %+v", got)
+	}
+}
+
+func TestPinnedMessages(t *testing.T) {
+	s := newTestStore(t, Config{})
+	first := saveChat(t, s, "general", "first", 0)
+	second := saveChat(t, s, "general", "second", 1)
+	other := saveChat(t, s, "other", "elsewhere", 2)
+	for _, id := range []int64{second, first, other} {
+		if err := s.SetPinned(id, true); err != nil {
+			t.Fatalf("置顶消息 %d 失败: %v", id, err)
+		}
+	}
+
+	pinned, err := s.GetPinnedMessages("general")
+	if err != nil || !slices.Equal(contents(pinned), []string{"first", "second"}) {
+		t.Fatalf("general 的置顶消息 = %v (%v)，期望按 ID 升序且不含其他房间", contents(pinned), err)
+	}
+
+	if err := s.SetPinned(first, false); err != nil {
+		t.Fatalf("取消置顶失败: %v", err)
+	}
+	pinned, _ = s.GetPinnedMessages("general")
+	if !slices.Equal(contents(pinned), []string{"second"}) {
+		t.Fatalf("取消置顶后 = %v，期望 [second]", contents(pinned))
+	}
+
+	if err := s.SetPinned(other+100, true); !errors.Is(err, ErrMessageNotFound) {
+		t.Fatalf("置顶不存在的消息应返回 ErrMessageNotFound，实际 %v", err)
+	}
+}
+
+func TestGetMessagesByUser(t *testing.T) {
+	s := newTestStore(t, Config{})
+	save(t, s, models.Message{Type: models.TypeJoin, Username: "alice", Room: "general", Content: "join"})
+	saveChat(t, s, "general", "one", 1)
+	save(t, s, models.Message{Username: "bob", Room: "general", Content: "bob's", Timestamp: testEpoch.Add(2 * time.Minute)})
+	saveChat(t, s, "dev", "two", 3)
+	save(t, s, models.Message{Username: "Alice", Room: "random", Content: "three", Timestamp: testEpoch.Add(4 * time.Minute)})
+
+	msgs, err := s.GetMessagesByUser("ALICE", 10)
+	if err != nil || !slices.Equal(contents(msgs), []string{"one", "two", "three"}) {
+		t.Fatalf("alice 的消息 = %v (%v)，期望所有房间中按时间顺序的聊天消息", contents(msgs), err)
+	}
+	if msgs, err := s.GetMessagesByUser("alice", 2); err != nil || !slices.Equal(contents(msgs), []string{"two", "three"}) {
+		t.Fatalf("limit=2 时 = %v (%v)，期望最近的 2 条", contents(msgs), err)
+	}
+	if msgs, err := s.GetMessagesByUser("carol", 10); err != nil || len(msgs) != 0 {
+		t.Fatalf("没有发过消息的用户 = %v (%v)", contents(msgs), err)
+	}
+}
+
+func TestGetUserRooms(t *testing.T) {
+	s := newTestStore(t, Config{})
+	saveChat(t, s, "general", "g1", 0)
+	saveChat(t, s, "dev", "d1", 1)
+	save(t, s, models.Message{Username: "Alice ", Room: "random", Content: "r1", Timestamp: testEpoch.Add(2 * time.Minute)})
+	saveChat(t, s, "general", "g2", 3)
+	save(t, s, models.Message{Username: "bob", Room: "bobs", Content: "b1", Timestamp: testEpoch.Add(4 * time.Minute)})
+
+	rooms, err := s.GetUserRooms("ALICE", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, room := range rooms {
+		got = append(got, room.Room+":"+strconv.Itoa(room.Count))
+	}
+	if want := []string{"general:2", "random:1", "dev:1"}; !slices.Equal(got, want) {
+		t.Fatalf("alice 的房间 = %v，期望按最近活跃排序的 %v", got, want)
+	}
+	if last := rooms[0].LastActive; last == nil || !last.Equal(testEpoch.Add(3*time.Minute)) {
+		t.Fatalf("general 的最近活跃时间 = %v，期望最新一条消息的时间", last)
+	}
+
+	if rooms, err := s.GetUserRooms("alice", 2); err != nil || len(rooms) != 2 || rooms[1].Room != "random" {
+		t.Fatalf("limit=2 时 = %+v (%v)，期望最近的 2 个房间", rooms, err)
+	}
+	if rooms, err := s.GetUserRooms("carol", 10); err != nil || len(rooms) != 0 {
+		t.Fatalf("没有发过消息的用户 = %+v (%v)", rooms, err)
+	}
+}
+
+func TestDeleteMessagesByUser(t *testing.T) {
+	s := newTestStore(t, Config{})
+	save(t, s, models.Message{Type: models.TypeJoin, Username: "alice", Room: "general", Content: "join"})
+	saveChat(t, s, "general", "one", 1)
+	save(t, s, models.Message{Username: "bob", Room: "general", Content: "bob's", Timestamp: testEpoch.Add(2 * time.Minute)})
+	saveChat(t, s, "dev", "two", 3)
+	save(t, s, models.Message{Username: " Alice", Room: "random", Content: "three", Timestamp: testEpoch.Add(4 * time.Minute)})
+	roomContents := func(room string) []string {
+		t.Helper()
+		msgs, err := s.GetMessages(room, 10)
+		if err != nil {
+			t.Fatalf("读取 %s 的消息失败: %v", room, err)
+		}
+		return contents(msgs)
+	}
+
+	// 指定房间时只删除该房间中的，包括加入记录
+	if deleted, err := s.DeleteMessagesByUser("ALICE", "general"); err != nil || deleted != 2 {
+		t.Fatalf("删除 general 中的消息 = %d (%v)，期望 2 条", deleted, err)
+	}
+	if got := roomContents("general"); !slices.Equal(got, []string{"bob's"}) {
+		t.Fatalf("general 剩下 %v，应只剩其他用户的消息", got)
+	}
+	if got := roomContents("dev"); !slices.Equal(got, []string{"two"}) {
+		t.Fatalf("dev 剩下 %v，其他房间不受影响", got)
+	}
+
+	// 房间为空时删除所有房间中的，用户名按规范化形式比较
+	if deleted, err := s.DeleteMessagesByUser("alice", ""); err != nil || deleted != 2 {
+		t.Fatalf("删除所有房间中的消息 = %d (%v)，期望 2 条", deleted, err)
+	}
+	if msgs, err := s.GetMessagesByUser("alice", 10); err != nil || len(msgs) != 0 {
+		t.Fatalf("删除后 alice 还有 %v (%v)", contents(msgs), err)
+	}
+	if deleted, err := s.DeleteMessagesByUser("carol", ""); err != nil || deleted != 0 {
+		t.Fatalf("删除没有消息的用户 = %d (%v)，期望 0", deleted, err)
+	}
+}
+
+func TestGetMessagesOfTypes(t *testing.T) {
+	s := newTestStore(t, Config{})
+	save(t, s, models.Message{Type: models.TypeJoin, Username: "alice", Room: "general", Content: "join"})
+	saveChat(t, s, "general", "hello", 1)
+	save(t, s, models.Message{Type: models.TypeLeave, Username: "alice", Room: "general", Content: "leave", Timestamp: testEpoch.Add(2 * time.Minute)})
+
+	tests := []struct {
+		name  string
+		types []models.MessageType
+		want  []string
+	}{
+		{"不过滤", nil, []string{"join", "hello", "leave"}},
+		{"单个类型", []models.MessageType{models.TypeChat}, []string{"hello"}},
+		{"多个类型", []models.MessageType{models.TypeJoin, models.TypeLeave}, []string{"join", "leave"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msgs, err := s.GetMessagesOfTypes("general", tt.types, 10)
+			if err != nil || !slices.Equal(contents(msgs), tt.want) {
+				t.Fatalf("按类型 %v 获取 = %v (%v)，期望 %v", tt.types, contents(msgs), err, tt.want)
+			}
+		})
+	}
+}
+
+func TestTimestampsAreStoredInUTC(t *testing.T) {
+	s := newTestStore(t, Config{})
+	local := time.Date(2024, 6, 1, 20, 30, 0, 123456789, time.FixedZone("CST", 8*3600))
+	id := save(t, s, models.Message{Username: "alice", Room: "general", Content: "hi", Timestamp: local})
+
+	var raw string
+	if err := s.db.QueryRow(`SELECT timestamp FROM messages WHERE id = ?`, id).Scan(&raw); err != nil {
+		t.Fatalf("读取时间戳失败: %v", err)
+	}
+	if want := "2024-06-01T12:30:00.123456789Z"; raw != want {
+		t.Fatalf("保存的时间戳 = %q，期望 UTC 的 %q", raw, want)
+	}
+
+	msgs, err := s.GetMessages("general", 1)
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("获取消息 = %+v (%v)", msgs, err)
+	}
+	if got := msgs[0].Timestamp; got.Location() != time.UTC || !got.Equal(local) {
+		t.Fatalf("取回的时间戳 = %v，期望与 %v 相同的 UTC 时间", got, local)
+	}
+}
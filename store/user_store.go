@@ -0,0 +1,15 @@
+package store
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrUserNotFound 表示存储中没有该用户的记录（例如从未离开过聊天室）。
+var ErrUserNotFound = errors.New("用户不存在")
+
+// UserStore 定义了用户相关信息的存储接口
+type UserStore interface {
+	UpdateLastSeen(username string, t time.Time) error // 记录用户最后在线时间
+	GetLastSeen(username string) (time.Time, error)    // 获取用户最后在线时间，无记录时返回 ErrUserNotFound
+}
@@ -0,0 +1,35 @@
+package store
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLastSeenRoundTrip(t *testing.T) {
+	s := newTestStore(t, Config{})
+	if _, err := s.GetLastSeen("alice"); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("没有记录时应返回 ErrUserNotFound，实际 %v", err)
+	}
+
+	first := time.Date(2024, 3, 1, 12, 30, 0, 123456789, time.FixedZone("UTC+8", 8*3600))
+	if err := s.UpdateLastSeen("alice", first); err != nil {
+		t.Fatalf("记录最后在线时间失败: %v", err)
+	}
+	got, err := s.GetLastSeen("alice")
+	if err != nil {
+		t.Fatalf("读取最后在线时间失败: %v", err)
+	}
+	if !got.Equal(first) || got.Location() != time.UTC {
+		t.Fatalf("最后在线时间 = %v，期望 UTC 的 %v", got, first.UTC())
+	}
+
+	// 再次记录覆盖旧值
+	second := first.Add(time.Hour)
+	if err := s.UpdateLastSeen("alice", second); err != nil {
+		t.Fatalf("更新最后在线时间失败: %v", err)
+	}
+	if got, _ := s.GetLastSeen("alice"); !got.Equal(second) {
+		t.Fatalf("更新后的最后在线时间 = %v，期望 %v", got, second)
+	}
+}